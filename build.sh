@@ -1,3 +1,4 @@
 #!/bin/bash
 
 go build -o ./bin
+go build -o ./bin ./polykubectl
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/ekoops/polykube-cni-plugin/utils/polycube"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/rest"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultListenAddress   = ":9900"
+	defaultResyncPeriod    = 5 * time.Minute
+	defaultConfSyncPeriod  = 30 * time.Second
+	defaultReconcilePeriod = 30 * time.Second
+	shutdownTimeout        = 5 * time.Second
+)
+
+// AgentConf contains the options controlling the agent lifecycle
+type AgentConf struct {
+	listenAddress       string
+	resyncPeriod        time.Duration
+	confSyncPeriod      time.Duration
+	reconcilePeriod     time.Duration
+	removeCNIConfOnExit bool
+}
+
+// RegisterAgentFlags registers on the provided flag set the flags needed to fill the returned AgentConf
+func RegisterAgentFlags(fs *flag.FlagSet) *AgentConf {
+	conf := &AgentConf{}
+	fs.StringVar(&conf.listenAddress, "listen-address", defaultListenAddress,
+		"address on which the agent HTTP endpoints are exposed")
+	fs.DurationVar(&conf.resyncPeriod, "resync-period", defaultResyncPeriod, "informers resync period")
+	fs.DurationVar(&conf.confSyncPeriod, "conf-sync-period", defaultConfSyncPeriod,
+		"period after which the CNI configuration files are checked and, if needed, rewritten")
+	fs.DurationVar(&conf.reconcilePeriod, "reconcile-period", defaultReconcilePeriod,
+		"period after which the node topology is compared with the desired one and, if needed, repaired")
+	fs.BoolVar(&conf.removeCNIConfOnExit, "remove-cni-conf-on-exit", false,
+		"remove the CNI configuration file on shutdown, so that no pods are scheduled on the node while the agent is down")
+	return conf
+}
+
+// Agent configures the node networking and keeps it aligned with the cluster state until it is stopped
+type Agent struct {
+	conf       *EnvConf
+	agentConf  *AgentConf
+	kubeConfig *rest.Config
+	cubes      *polycube.Cubes
+	metrics    *Metrics
+	nodeInfo   *NodeInfo
+	// ready is set to 1 once the CNI configuration file is written
+	ready int32
+}
+
+// NewAgent creates an agent for the provided configuration, configuring the polycube cubes through the provided
+// managers and exposing the provided metrics
+func NewAgent(conf *EnvConf, agentConf *AgentConf, kubeConfig *rest.Config, cubes *polycube.Cubes, m *Metrics) *Agent {
+	return &Agent{
+		conf:       conf,
+		agentConf:  agentConf,
+		kubeConfig: kubeConfig,
+		cubes:      cubes,
+		metrics:    m,
+	}
+}
+
+// Ready returns true if the node is ready to host pods
+func (a *Agent) Ready() bool {
+	return atomic.LoadInt32(&a.ready) == 1
+}
+
+// Setup performs the initial node setup: it creates the overlay interface and the polycube cubes, recovering the pod
+// attachments, and, finally, it writes the CNI plugin configuration files
+func (a *Agent) Setup() error {
+	nodeInfo, err := BuildNodeInfo(a.conf)
+	if err != nil {
+		return err
+	}
+	a.nodeInfo = nodeInfo
+
+	if err := a.conf.overlay.Setup(nodeInfo); err != nil {
+		return err
+	}
+	if a.conf.egress.Masquerade {
+		if err := CreateEgressIface(nodeInfo); err != nil {
+			return err
+		}
+	}
+	if a.conf.egress.Gateway != nil {
+		if err := CreateEgressGatewayIface(a.conf.egress.Gateway, nodeInfo); err != nil {
+			return err
+		}
+	}
+	// the egress gateway announces the egress addresses as the services external ones
+	if a.conf.l2Announce || a.conf.egress.Gateway != nil {
+		if err := CreateAnnounceIface(); err != nil {
+			return err
+		}
+	}
+	if err := CreateCubes(a.cubes, nodeInfo, a.conf); err != nil {
+		return err
+	}
+	podGwMAC, err := GetNodePodDefaultGatewayMAC(a.cubes.Routers, a.conf)
+	if err != nil {
+		return err
+	}
+	nodeInfo.podGwInfo.MAC = podGwMAC
+
+	// the pods created before a restart of polycubed lost their lbrps. The ones without state are left to the
+	// reconciler, since the plugin could be still attaching them
+	if err := recoverAttachments(a.cubes, a.conf, make(map[string]bool), func(string, string) {}); err != nil {
+		log.WithField("detail", err).Error("failed to recover pod attachments")
+	}
+
+	if err := WritePluginKubeconfig(a.conf.CNIKubeconfigPath, a.conf.CNITokenPath, a.kubeConfig); err != nil {
+		return err
+	}
+	if err := CreateCNIConfFile(a.conf, nodeInfo); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&a.ready, 1)
+	log.Info("node setup completed")
+	return nil
+}
+
+// syncConfFiles rewrites the CNI configuration file and the plugin kubeconfig if they were changed or removed. The
+// plugin token is rewritten too when the projected service account token is rotated
+func (a *Agent) syncConfFiles() {
+	l := log.WithField("path", a.conf.CNIConfFilePath)
+	desired, err := RenderCNIConf(a.conf, a.nodeInfo)
+	if err != nil {
+		return
+	}
+	current, err := ioutil.ReadFile(a.conf.CNIConfFilePath)
+	if err != nil || !bytes.Equal(current, desired) {
+		l.Warning("cni config file changed or missing, rewriting it")
+		_ = CreateCNIConfFile(a.conf, a.nodeInfo)
+	}
+	_ = WritePluginKubeconfig(a.conf.CNIKubeconfigPath, a.conf.CNITokenPath, a.kubeConfig)
+}
+
+// Run starts the controllers and the HTTP endpoints, blocking until the provided context is done
+func (a *Agent) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	factory := informers.NewSharedInformerFactory(clientset, a.agentConf.resyncPeriod)
+	nodeCtrl := newNodeController(a.conf, a.nodeInfo, a.cubes.Routers, factory)
+	// the announcer is shared by the services and the egress gateway policies, so that they can't announce the same
+	// address
+	var announcer, serviceAnnouncer *l2Announcer
+	if a.conf.l2Announce || a.conf.egress.Gateway != nil {
+		announcer = newL2Announcer(a.nodeInfo.extIface)
+	}
+	if a.conf.l2Announce {
+		serviceAnnouncer = announcer
+	}
+	recorder, stopRecorder := newEventRecorder(a.conf.nodeName)
+	defer stopRecorder()
+	serviceCtrl := newServiceController(a.conf, a.nodeInfo, a.cubes, factory, serviceAnnouncer, recorder)
+	// the pods informer is restricted to the node pods
+	podFactory := informers.NewSharedInformerFactoryWithOptions(clientset, a.agentConf.resyncPeriod,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", a.conf.nodeName).String()
+		}),
+	)
+	podCtrl := newPodController(a.conf, a.nodeInfo, a.cubes, podFactory, nodeCtrl.withPeers, recorder,
+		serviceCtrl.resyncPodLbrp)
+	// the ConfigMaps informer is restricted to the egress gateway policies ConfigMap
+	var egressGwCtrl *egressGatewayController
+	if gw := a.conf.egress.Gateway; gw != nil {
+		cmFactory := informers.NewSharedInformerFactoryWithOptions(clientset, a.agentConf.resyncPeriod,
+			informers.WithNamespace(gw.ConfigMapNamespace),
+			informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+				options.FieldSelector = fields.OneTermEqualSelector("metadata.name", gw.ConfigMapName).String()
+			}),
+		)
+		egressGwCtrl = newEgressGatewayController(a.conf, a.nodeInfo, a.cubes, announcer, factory, cmFactory)
+		cmFactory.Start(ctx.Done())
+	}
+	factory.Start(ctx.Done())
+	podFactory.Start(ctx.Done())
+
+	rec := newReconciler(a.conf, a.nodeInfo, a.cubes, a.metrics, nodeCtrl, serviceCtrl, podCtrl, egressGwCtrl, recorder)
+
+	server := &http.Server{
+		Addr:    a.agentConf.listenAddress,
+		Handler: a.newServeMux(),
+	}
+
+	receiver := NewReportReceiver(a.conf.metricsConf, a.metrics)
+
+	errCh := make(chan error, 7)
+	var wg sync.WaitGroup
+	wg.Add(6)
+	if egressGwCtrl != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errCh <- egressGwCtrl.run(ctx)
+		}()
+	}
+	go func() {
+		defer wg.Done()
+		errCh <- nodeCtrl.run(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		errCh <- serviceCtrl.run(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		errCh <- podCtrl.run(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		wait.UntilWithContext(ctx, func(context.Context) { a.syncConfFiles() }, a.agentConf.confSyncPeriod)
+	}()
+	go func() {
+		defer wg.Done()
+		// the first reconciliation is delayed, so that the controllers can configure the peer nodes first: otherwise
+		// their routes would be considered stale
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(a.agentConf.reconcilePeriod):
+		}
+		wait.UntilWithContext(ctx, rec.run, a.agentConf.reconcilePeriod)
+	}()
+	go func() {
+		defer wg.Done()
+		if err := receiver.Run(ctx, a.agentConf.confSyncPeriod); err != nil {
+			errCh <- fmt.Errorf("failed to receive plugin reports: %v", err)
+		}
+	}()
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errCh <- fmt.Errorf("failed to serve agent HTTP endpoints: %v", err)
+		}
+	}()
+	log.WithField("address", a.agentConf.listenAddress).Info("agent started")
+
+	// waiting for a stop request or for the first failure
+	var runErr error
+	select {
+	case <-ctx.Done():
+	case runErr = <-errCh:
+	}
+
+	log.Info("agent stopping")
+	atomic.StoreInt32(&a.ready, 0)
+	cancel()
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+	_ = server.Shutdown(shutdownCtx)
+	wg.Wait()
+	a.cleanup()
+	return runErr
+}
+
+// cleanup removes, if requested, the CNI configuration file so that the kubelet stops considering the node network
+// ready while the agent is down
+func (a *Agent) cleanup() {
+	if !a.agentConf.removeCNIConfOnExit {
+		return
+	}
+	l := log.WithField("path", a.conf.CNIConfFilePath)
+	if err := os.Remove(a.conf.CNIConfFilePath); err != nil && !os.IsNotExist(err) {
+		l.WithField("detail", err).Error("failed to remove cni config file")
+		return
+	}
+	l.Info("cni config file removed")
+}
+
+// newServeMux returns the handler of the agent HTTP endpoints
+func (a *Agent) newServeMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		a.Healthz().write(w)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		a.Readyz().write(w)
+	})
+	mux.Handle("/metrics", a.metrics.Handler())
+	return mux
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/ekoops/polykube-cni-plugin/utils/affinity"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"net"
+	"sort"
+	"sync"
+	"syscall"
+)
+
+// On bare-metal clusters, the external addresses of the services (their externalIPs and LoadBalancer ingress IPs)
+// must be announced on the node network. Each address is announced by a single node, elected among the candidate
+// ones through a rendezvous hashing of the address: the elected node assigns the address to a dummy interface, so
+// that the node answers the ARP requests for it, and sends a gratuitous ARP to update the neighbours caches. The
+// traffic for the address is then received by the k8sdispatcher on the external interface and load-balanced by the
+// lbrp external entries
+const (
+	announceIfaceName = "pkext0"
+	// garpCount is the number of gratuitous ARP sent when an address is acquired
+	garpCount = 3
+)
+
+// l2Announcer announces the services external addresses elected on the current node and the egress addresses of the
+// egress gateway policies having the current node as gateway. A single instance is shared by the service and the
+// egress gateway controllers, so that an address is announced for a single owner
+type l2Announcer struct {
+	extIface *Iface
+	mu       sync.Mutex
+	// announced contains the owner (a service or an egress gateway policy) announcing each address, indexed by address
+	announced map[string]string
+}
+
+func newL2Announcer(extIface *Iface) *l2Announcer {
+	return &l2Announcer{
+		extIface:  extIface,
+		announced: make(map[string]string),
+	}
+}
+
+// CreateAnnounceIface creates the dummy interface holding the announced addresses
+func CreateAnnounceIface() error {
+	l := log.WithField("name", announceIfaceName)
+	dummy := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: announceIfaceName}}
+	if err := netlink.LinkAdd(dummy); err != nil && !errors.Is(err, syscall.EEXIST) {
+		l.WithField("detail", err).Error("failed to create announce interface")
+		return fmt.Errorf("failed to create %q interface - %v", announceIfaceName, err)
+	}
+	link, err := netlink.LinkByName(announceIfaceName)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve %q interface - %v", announceIfaceName, err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		l.WithField("detail", err).Error("failed to set announce interface up")
+		return fmt.Errorf("failed to set %q interface up - %v", announceIfaceName, err)
+	}
+	l.Info("announce interface created")
+	return nil
+}
+
+// ElectAnnouncer returns the node announcing the provided address among the provided candidates
+func ElectAnnouncer(ip string, candidates []string) (string, bool) {
+	sorted := append([]string(nil), candidates...)
+	sort.Strings(sorted)
+	return affinity.Rendezvous(ip, sorted)
+}
+
+// sync makes the current node announce exactly the provided addresses for the provided owner. An address already
+// announced for another owner is skipped
+func (a *l2Announcer) sync(key string, ips []string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	link, err := netlink.LinkByName(announceIfaceName)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve %q interface - %v", announceIfaceName, err)
+	}
+	l := log.WithFields(log.Fields{
+		"owner": key,
+		"iface": announceIfaceName,
+	})
+
+	desired := make(map[string]bool)
+	for _, ip := range ips {
+		desired[ip] = true
+	}
+	for ip, owner := range a.announced {
+		if owner != key || desired[ip] {
+			continue
+		}
+		addr := &netlink.Addr{IPNet: &net.IPNet{IP: net.ParseIP(ip).To4(), Mask: net.CIDRMask(32, 32)}}
+		if err := netlink.AddrDel(link, addr); err != nil && !errors.Is(err, syscall.EADDRNOTAVAIL) {
+			l.WithFields(log.Fields{
+				"address": ip,
+				"detail":  err,
+			}).Error("failed to withdraw external address")
+			return fmt.Errorf("failed to remove %s from %q interface - %v", ip, announceIfaceName, err)
+		}
+		delete(a.announced, ip)
+		l.WithField("address", ip).Info("external address withdrawn")
+	}
+	for _, ip := range ips {
+		if owner, ok := a.announced[ip]; ok {
+			if owner != key {
+				l.WithFields(log.Fields{
+					"address": ip,
+					"owner":   owner,
+				}).Warning("external address already announced for another owner")
+			}
+			continue
+		}
+		addr := &netlink.Addr{IPNet: &net.IPNet{IP: net.ParseIP(ip).To4(), Mask: net.CIDRMask(32, 32)}}
+		if err := netlink.AddrReplace(link, addr); err != nil {
+			l.WithFields(log.Fields{
+				"address": ip,
+				"detail":  err,
+			}).Error("failed to announce external address")
+			return fmt.Errorf("failed to add %s to %q interface - %v", ip, announceIfaceName, err)
+		}
+		a.announced[ip] = key
+		if err := sendGARP(a.extIface, addr.IP); err != nil {
+			// the neighbours learn the address at their next ARP request
+			l.WithFields(log.Fields{
+				"address": ip,
+				"detail":  err,
+			}).Warning("failed to send gratuitous arp")
+		}
+		l.WithField("address", ip).Info("external address announced")
+	}
+	return nil
+}
+
+// htons converts the provided value to network byte order
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// sendGARP broadcasts on the provided interface garpCount gratuitous ARP requests for the provided address
+func sendGARP(iface *Iface, ip net.IP) error {
+	attrs := iface.Link.Attrs()
+	mac := attrs.HardwareAddr
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(syscall.ETH_P_ARP)))
+	if err != nil {
+		return fmt.Errorf("failed to open packet socket - %v", err)
+	}
+	defer syscall.Close(fd)
+
+	broadcast := net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	frame := make([]byte, 42)
+	// ethernet header
+	copy(frame[0:6], broadcast)
+	copy(frame[6:12], mac)
+	binary.BigEndian.PutUint16(frame[12:14], syscall.ETH_P_ARP)
+	// arp request having the announced address as both sender and target address
+	binary.BigEndian.PutUint16(frame[14:16], 1)
+	binary.BigEndian.PutUint16(frame[16:18], syscall.ETH_P_IP)
+	frame[18], frame[19] = 6, 4
+	binary.BigEndian.PutUint16(frame[20:22], 1)
+	copy(frame[22:28], mac)
+	copy(frame[28:32], ip.To4())
+	copy(frame[38:42], ip.To4())
+
+	sa := &syscall.SockaddrLinklayer{
+		Protocol: htons(syscall.ETH_P_ARP),
+		Ifindex:  attrs.Index,
+		Halen:    6,
+	}
+	copy(sa.Addr[:], broadcast)
+	for i := 0; i < garpCount; i++ {
+		if err := syscall.Sendto(fd, frame, 0, sa); err != nil {
+			return fmt.Errorf("failed to send gratuitous arp - %v", err)
+		}
+	}
+	return nil
+}
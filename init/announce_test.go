@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/vishvananda/netlink"
+	"os"
+	"testing"
+)
+
+// TestL2AnnouncerOwners verifies that an address shared by a service and an egress gateway policy is announced for
+// the first owner only, and that it is withdrawn only by its owner
+func TestL2AnnouncerOwners(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating network namespaces and dummy interfaces requires root privileges")
+	}
+	netns, err := testutils.NewNS()
+	if err != nil {
+		t.Fatalf("failed to create netns: %v", err)
+	}
+	defer func() {
+		netns.Close()
+		_ = testutils.UnmountNS(netns)
+	}()
+	if err := netns.Do(func(ns.NetNS) error {
+		return CreateAnnounceIface()
+	}); err != nil {
+		t.Skipf("dummy interfaces are not supported: %v", err)
+	}
+
+	nodeInfo := newTestNodeInfo()
+	announcer := newL2Announcer(nodeInfo.extIface)
+	serviceKey, policyKey := "default/web", egressGwAnnounceKey("web")
+	const ip = "192.168.1.100"
+	err = netns.Do(func(ns.NetNS) error {
+		if err := announcer.sync(serviceKey, []string{ip}); err != nil {
+			return err
+		}
+		// the policy can neither take nor withdraw the address of the service
+		if err := announcer.sync(policyKey, []string{ip}); err != nil {
+			return err
+		}
+		if owner := announcer.announced[ip]; owner != serviceKey {
+			return errors.New("address owner changed to " + owner)
+		}
+		if err := announcer.sync(policyKey, nil); err != nil {
+			return err
+		}
+		link, err := netlink.LinkByName(announceIfaceName)
+		if err != nil {
+			return err
+		}
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+		if err != nil {
+			return err
+		}
+		if len(addrs) != 1 || addrs[0].IP.String() != ip {
+			return errors.New("address withdrawn by another owner")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
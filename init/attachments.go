@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ekoops/polykube-cni-plugin/utils/attachment"
+	"github.com/ekoops/polykube-cni-plugin/utils/polycube"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"regexp"
+	"strings"
+)
+
+// attachmentNameRegexp matches the host interfaces names generated by attachment.Name
+var attachmentNameRegexp = regexp.MustCompile(`^[A-Za-z0-9.-]+_[0-9a-f]+$`)
+
+// podAttachments returns the pod attachments of the node, indexed by name: the persisted ones and the ones found
+// scanning the host veths, in order to cover the pods created before their state was persisted. The states of the
+// attachments whose host interface doesn't exist anymore are removed.
+// The plugin creates the host veth before the lbrp and persists the state only after connecting it, so a veth without
+// state could belong to an attachment still being created: it is returned only if it was already found without state
+// by the previous scan, whose veths are kept in unpersisted (updated in place)
+func podAttachments(conf *EnvConf, unpersisted map[string]bool) (map[string]*attachment.Attachment, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list host interfaces: %v", err)
+	}
+	veths := make(map[string]bool)
+	for _, link := range links {
+		name := link.Attrs().Name
+		if link.Type() == "veth" && attachmentNameRegexp.MatchString(name) {
+			veths[name] = true
+		}
+	}
+
+	persisted, err := attachment.List(conf.stateDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list attachments state: %v", err)
+	}
+	atts := make(map[string]*attachment.Attachment)
+	for _, a := range persisted {
+		if !veths[a.Name] {
+			l := log.WithField("attachment", a.Name)
+			if err := attachment.Remove(conf.stateDir, a.Name); err != nil {
+				l.WithField("detail", err).Warning("failed to remove stale attachment state")
+				continue
+			}
+			l.Info("stale attachment state removed")
+			continue
+		}
+		atts[a.Name] = a
+	}
+	for name := range unpersisted {
+		if _, ok := atts[name]; ok || !veths[name] {
+			delete(unpersisted, name)
+		}
+	}
+	for name := range veths {
+		if _, ok := atts[name]; ok {
+			continue
+		}
+		if !unpersisted[name] {
+			log.WithField("attachment", name).Debug("host veth without attachment state, waiting for the next scan")
+			unpersisted[name] = true
+			continue
+		}
+		atts[name] = &attachment.Attachment{Name: name, Bridge: conf.bridgeName}
+	}
+	return atts, nil
+}
+
+// recoverAttachments rebuilds the per-pod lbrps and bridge ports of the node pod attachments that are missing, as
+// it happens when polycubed is restarted, so that the running pods regain connectivity. The lbrps of the pods steered
+// towards an egress gateway are not connected to the bridge, so they are left to the egress gateway controller. The
+// attachments without state are recovered only if found by two scans sharing unpersisted (see podAttachments). The
+// provided function is called for each recovered attachment
+func recoverAttachments(
+	cubes *polycube.Cubes, conf *EnvConf, unpersisted map[string]bool, recovered func(name, message string),
+) error {
+	atts, err := podAttachments(conf, unpersisted)
+	if err != nil {
+		return err
+	}
+	if len(atts) == 0 {
+		return nil
+	}
+
+	lbs, err := cubes.Lbrps.ListLbrps()
+	if err != nil && !polycube.IsNotFound(err) {
+		return fmt.Errorf("failed to list lbrps - %v", err)
+	}
+	existingLbs := make(map[string]bool, len(lbs))
+	for _, lb := range lbs {
+		existingLbs[lb.Name] = true
+	}
+	brPorts := make(map[string]map[string]bool)
+
+	podLBs := attachment.NewPodLBManager(cubes.Lbrps, cubes.Bridges)
+	var errs []string
+	for name, a := range atts {
+		brName := a.Bridge
+		if brName == "" {
+			brName = conf.bridgeName
+		}
+		ports, ok := brPorts[brName]
+		if !ok {
+			br, err := cubes.Bridges.ReadBridge(brName)
+			if err != nil {
+				return fmt.Errorf("failed to retrieve %q bridge - %v", brName, err)
+			}
+			ports = make(map[string]bool, len(br.Ports))
+			for _, p := range br.Ports {
+				ports[p.Name] = true
+			}
+			brPorts[brName] = ports
+		}
+
+		lbName := attachment.LbrpName(name)
+		brPortName := attachment.BridgePortName(lbName)
+		l := log.WithFields(log.Fields{
+			"attachment": name,
+			"lbrp":       lbName,
+			"bridge":     brName,
+		})
+		if existingLbs[lbName] && ports[brPortName] {
+			continue
+		}
+		// the lbrp of a pod steered towards an egress gateway is connected to the pod steering interface
+		if existingLbs[lbName] && isSteered(name) {
+			continue
+		}
+		if !existingLbs[lbName] {
+			// a bridge port left without its lbrp can't be connected to the new one, so it is recreated
+			if ports[brPortName] {
+				if err := cubes.Bridges.DeleteBridgePort(brName, brPortName); err != nil && !polycube.IsNotFound(err) {
+					l.WithField("detail", err).Error("failed to delete dangling bridge port")
+					errs = append(errs, fmt.Sprintf("failed to delete %q bridge %q port - %v", brName, brPortName, err))
+					continue
+				}
+			}
+			if err := podLBs.Create(lbName, name); err != nil {
+				l.WithField("detail", err).Error("failed to recreate lbrp")
+				errs = append(errs, fmt.Sprintf("failed to recreate %q lbrp - %v", lbName, err))
+				continue
+			}
+		}
+		if _, _, err := podLBs.ConnectToBridge(lbName, brName); err != nil {
+			l.WithField("detail", err).Error("failed to reconnect lbrp to bridge")
+			errs = append(errs, fmt.Sprintf("failed to connect %q lbrp to %q bridge - %v", lbName, brName, err))
+			continue
+		}
+		l.Info("pod attachment recovered")
+		recovered(name, fmt.Sprintf("%q lbrp and %q bridge port rebuilt", lbName, brPortName))
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/ekoops/polykube-cni-plugin/utils/attachment"
+	"github.com/vishvananda/netlink"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// errVethUnsupported is returned when the kernel can't create veth pairs
+var errVethUnsupported = errors.New("veth pairs are not supported by the kernel")
+
+// TestPodAttachmentsUnpersisted verifies that a host veth without attachment state is returned only if it is found
+// without state by two scans, while a persisted one is always returned and a stale state is removed
+func TestPodAttachmentsUnpersisted(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating network namespaces and veth pairs requires root privileges")
+	}
+	netns, err := testutils.NewNS()
+	if err != nil {
+		t.Fatalf("failed to create netns: %v", err)
+	}
+	defer func() {
+		netns.Close()
+		_ = testutils.UnmountNS(netns)
+	}()
+	if err := netns.Do(func(ns.NetNS) error {
+		veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "vethprobe"}, PeerName: "vethprobep"}
+		if err := netlink.LinkAdd(veth); err != nil {
+			return errVethUnsupported
+		}
+		return netlink.LinkDel(veth)
+	}); err != nil {
+		t.Skip(err)
+	}
+
+	stateDir, err := ioutil.TempDir("", "polykube-attachments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(stateDir)
+	conf := newTestConf()
+	conf.stateDir = stateDir
+
+	persisted := attachment.Name("eth0", "0123456789abcdef")
+	pending := attachment.Name("eth0", "fedcba9876543210")
+	stale := attachment.Name("eth0", "00112233445566")
+	for _, a := range []*attachment.Attachment{{Name: persisted, Bridge: "br1"}, {Name: stale, Bridge: "br0"}} {
+		if err := attachment.Save(stateDir, a); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = netns.Do(func(ns.NetNS) error {
+		for i, name := range []string{persisted, pending} {
+			veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: name}, PeerName: fmt.Sprintf("peer%d", i)}
+			if err := netlink.LinkAdd(veth); err != nil {
+				return err
+			}
+		}
+		unpersisted := make(map[string]bool)
+
+		// the first scan finds the veth without state, which could be still being attached by the plugin
+		atts, err := podAttachments(conf, unpersisted)
+		if err != nil {
+			return err
+		}
+		if len(atts) != 1 || atts[persisted] == nil || atts[persisted].Bridge != "br1" {
+			return fmt.Errorf("first scan - required: only %q, found: %v", persisted, atts)
+		}
+		if !unpersisted[pending] {
+			return fmt.Errorf("first scan didn't record the %q veth without state", pending)
+		}
+		if states, err := attachment.List(stateDir); err != nil || len(states) != 1 {
+			return fmt.Errorf("stale attachment state not removed: %v, %v", states, err)
+		}
+
+		// the second scan still finds it without state, so it is recovered on the default bridge
+		atts, err = podAttachments(conf, unpersisted)
+		if err != nil {
+			return err
+		}
+		if len(atts) != 2 || atts[pending] == nil || atts[pending].Bridge != conf.bridgeName {
+			return fmt.Errorf("second scan - required: %q and %q, found: %v", persisted, pending, atts)
+		}
+
+		// once persisted, the veth is not tracked anymore
+		if err := attachment.Save(stateDir, &attachment.Attachment{Name: pending, Bridge: "br0"}); err != nil {
+			return err
+		}
+		if _, err := podAttachments(conf, unpersisted); err != nil {
+			return err
+		}
+		if len(unpersisted) != 0 {
+			return fmt.Errorf("persisted veths still tracked: %v", unpersisted)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
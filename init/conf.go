@@ -1,12 +1,19 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/ekoops/polykube-cni-plugin/utils"
+	"github.com/ekoops/polykube-cni-plugin/utils/attachment"
+	"github.com/ekoops/polykube-cni-plugin/utils/metrics"
+	"github.com/ekoops/polykube-cni-plugin/utils/polycube"
 	log "github.com/sirupsen/logrus"
 	"net"
 	"os"
 	"strconv"
+	"strings"
 )
 
 const (
@@ -22,6 +29,10 @@ const (
 		"ip": "%s",
 		"mac": "%s"
 	},
+	"log": %s,
+	"polycubeURL": "%s",
+	"metrics": %s,
+	"stateDir": "%s",
 	"ipam": {
 		"type": "host-local",
 		"ranges": [
@@ -34,7 +45,7 @@ const (
 				}
 			]
 		],
-		"dataDir": "/var/lib/cni/networks/mynet",
+		"dataDir": "%s",
 		"resolvConf": "/etc/resolv.conf"
 	}
 }
@@ -53,6 +64,37 @@ func getEnv(envVar string, defaultVal string) string {
 	return env
 }
 
+// getLogConf builds a log configuration from the environment variables having the provided prefix
+func getLogConf(prefix string, defaultFile string) (*utils.LogConf, error) {
+	conf := &utils.LogConf{
+		File:   os.Getenv(prefix + "_LOG_FILE"),
+		Level:  getEnv(prefix+"_LOG_LEVEL", "info"),
+		Format: getEnv(prefix+"_LOG_FORMAT", "text"),
+	}
+	if conf.File == "" {
+		conf.File = defaultFile
+	}
+
+	maxSize, err := strconv.Atoi(getEnv(prefix+"_LOG_MAX_SIZE", strconv.Itoa(utils.DefaultLogMaxSize)))
+	if err != nil || maxSize < 0 {
+		return nil, fmt.Errorf("failed to parse env variable: %s_LOG_MAX_SIZE must be a non negative integer", prefix)
+	}
+	conf.MaxSize = utils.IntPtr(maxSize)
+
+	maxBackups, err := strconv.Atoi(getEnv(prefix+"_LOG_MAX_BACKUPS", strconv.Itoa(utils.DefaultLogMaxBackups)))
+	if err != nil || maxBackups < 0 {
+		return nil, fmt.Errorf("failed to parse env variable: %s_LOG_MAX_BACKUPS must be a non negative integer", prefix)
+	}
+	conf.MaxBackups = utils.IntPtr(maxBackups)
+	return conf, nil
+}
+
+// GetLogConf returns the log configuration of this program. If no log file is provided, log records are written on
+// stderr
+func GetLogConf() (*utils.LogConf, error) {
+	return getLogConf("POLYKUBE", "")
+}
+
 // GetEnvConf create a conf object taking values from environment variables and in some cases, if the environment
 // variable is not defined, defaulting them
 func GetEnvConf() (*EnvConf, error) {
@@ -60,19 +102,31 @@ func GetEnvConf() (*EnvConf, error) {
 	conf := &EnvConf{}
 	conf.nodeName = os.Getenv("NODE_K8S_NAME")
 	if conf.nodeName == "" {
-		log.Fatal("K8S_NODE_NAME env variable not found")
-		panic("K8S_NODE_NAME env variable not found")
+		// the hostname is not used as fallback since it could differ from the node name (e.g. in a DaemonSet)
+		log.Error("NODE_K8S_NAME env variable not found")
+		return nil, errors.New("NODE_K8S_NAME env variable not found")
 	}
 
+	// polycubeURL
+	conf.polycubeURL = getEnv("POLYCUBE_URL", polycube.DefaultURL)
+
 	// vxlanIfName
-	conf.vxlanIfName =  getEnv("NODE_VXLAN_IFACE_NAME", "vxlan0")
+	conf.vxlanIfName = getEnv("NODE_VXLAN_IFACE_NAME", "vxlan0")
+
+	// overlay
+	overlay, err := getOverlay(conf)
+	if err != nil {
+		log.WithField("detail", err).Error("failed to parse env variable")
+		return nil, err
+	}
+	conf.overlay = overlay
 
 	// vtepCIDR
 	_, vtepCIDR, err := net.ParseCIDR(getEnv("NODE_VTEP_CIDR", "10.18.0.0/16"))
 	if err != nil {
 		log.WithField(
 			"detail", "NODE_VTEP_CIDR must be in the format w.x.y.z/n",
-		).Fatal("failed to parse env variable")
+		).Error("failed to parse env variable")
 		return nil, fmt.Errorf("failed to parse env variable: NODE_VTEP_CIDR must be in the format w.x.y.z/n")
 	}
 	conf.vtepCIDR = vtepCIDR
@@ -80,24 +134,82 @@ func GetEnvConf() (*EnvConf, error) {
 	// CNIConfFilePath
 	conf.CNIConfFilePath = getEnv("CNI_CONF_FILE_PATH", "/etc/cni/net.d/00-polykube.json")
 
+	// CNIKubeconfigPath
+	conf.CNIKubeconfigPath = getEnv("CNI_KUBECONFIG_PATH", "/etc/cni/net.d/polykube-kubeconfig")
+
+	// CNITokenPath
+	conf.CNITokenPath = getEnv("CNI_TOKEN_PATH", "/etc/cni/net.d/polykube-token")
+
+	// stateDir
+	conf.stateDir = getEnv("POLYKUBE_STATE_DIR", attachment.DefaultStateDir)
+
+	// ipamDataDir
+	conf.ipamDataDir = getEnv("CNI_IPAM_DATA_DIR", "/var/lib/cni/networks/mynet")
+
 	// vClusterCIDR
 	_, vClusterCIDR, err := net.ParseCIDR(getEnv("POLYCUBE_VPODS_RANGE", "10.10.0.0/16"))
 	if err != nil {
 		log.WithField(
 			"detail", "POLYCUBE_VPODS_RANGE must be in the format w.x.y.z/n",
-		).Fatal("failed to parse env variable")
+		).Error("failed to parse env variable")
 		return nil, fmt.Errorf("failed to parse env variable: POLYCUBE_VPODS_RANGE must be in the format w.x.y.z/n")
 	}
 	conf.vClusterCIDR = vClusterCIDR
 
-	// MTU
-	MTU, err := strconv.Atoi(getEnv("POLYCUBE_MTU", "1450"))
+	// serviceCIDR
+	_, serviceCIDR, err := net.ParseCIDR(getEnv("POLYKUBE_SERVICE_CIDR", "11.11.11.0/24"))
 	if err != nil {
-		log.WithField("detail", "POLYCUBE_MTU must be a positive integer").Fatal("failed to parse env variable")
-		return nil, fmt.Errorf("failed to parse env variable: POLYCUBE_MTU must be a positive integer")
+		log.WithField(
+			"detail", "POLYKUBE_SERVICE_CIDR must be in the format w.x.y.z/n",
+		).Error("failed to parse env variable")
+		return nil, fmt.Errorf("failed to parse env variable: POLYKUBE_SERVICE_CIDR must be in the format w.x.y.z/n")
+	}
+	conf.serviceCIDR = serviceCIDR
+
+	// edgeServices (namespace/name of the services replicated into the per-pod lbrps)
+	conf.edgeServices = make(map[string]bool)
+	if rawServices := getEnv("POLYKUBE_POD_EDGE_SERVICES", ""); rawServices != "" {
+		for _, key := range strings.Split(rawServices, ",") {
+			key = strings.TrimSpace(key)
+			if parts := strings.Split(key, "/"); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				log.WithField(
+					"detail", "POLYKUBE_POD_EDGE_SERVICES must be a comma separated list of namespace/name",
+				).Error("failed to parse env variable")
+				return nil, fmt.Errorf(
+					"failed to parse env variable: POLYKUBE_POD_EDGE_SERVICES must be a comma separated list of namespace/name",
+				)
+			}
+			conf.edgeServices[key] = true
+		}
 	}
-	conf.MTU = MTU
 
+	// l2Announce (announcement of the services external addresses through gratuitous ARP)
+	if conf.l2Announce, err = strconv.ParseBool(getEnv("POLYKUBE_L2_ANNOUNCE", "false")); err != nil {
+		log.WithField("detail", "POLYKUBE_L2_ANNOUNCE must be a boolean").Error("failed to parse env variable")
+		return nil, fmt.Errorf("failed to parse env variable: POLYKUBE_L2_ANNOUNCE must be a boolean")
+	}
+
+	// nodePortRange
+	if conf.nodePortRange, err = ParseNodePortRange(getEnv("POLYKUBE_NODEPORT_RANGE", "30000-32767")); err != nil {
+		log.WithField("detail", "POLYKUBE_NODEPORT_RANGE must be in the format min-max").Error("failed to parse env variable")
+		return nil, fmt.Errorf("failed to parse env variable: POLYKUBE_NODEPORT_RANGE must be in the format min-max")
+	}
+
+	// egress
+	if conf.egress, err = getEgressConf(conf); err != nil {
+		log.WithField("detail", err).Error("failed to parse env variable")
+		return nil, err
+	}
+
+	// MTU ("auto" means that it is derived from the external interface MTU)
+	if rawMTU := getEnv("POLYCUBE_MTU", "auto"); rawMTU != "auto" {
+		MTU, err := strconv.Atoi(rawMTU)
+		if err != nil || MTU <= 0 {
+			log.WithField("detail", "POLYCUBE_MTU must be a positive integer or auto").Error("failed to parse env variable")
+			return nil, fmt.Errorf("failed to parse env variable: POLYCUBE_MTU must be a positive integer or auto")
+		}
+		conf.MTU = MTU
+	}
 
 	// bridgeName
 	conf.bridgeName = getEnv("POLYCUBE_BRIDGE_NAME", "br0")
@@ -110,42 +222,72 @@ func GetEnvConf() (*EnvConf, error) {
 
 	// k8sDispName
 	conf.k8sDispName = getEnv("POLYCUBE_K8SDISP_NAME", "k0")
+
+	// cniLogConf
+	cniLogConf, err := getLogConf("CNI", "/var/log/polykube/polykube-cni-plugin.log")
+	if err != nil {
+		log.WithField("detail", err).Error("failed to parse env variable")
+		return nil, err
+	}
+	conf.cniLogConf = cniLogConf
+
+	// metricsConf
+	conf.metricsConf = &metrics.PushConf{
+		Socket: getEnv("POLYKUBE_METRICS_SOCKET", metrics.DefaultSocketPath),
+		Spool:  getEnv("POLYKUBE_METRICS_SPOOL", metrics.DefaultSpoolPath),
+	}
 	return conf, nil
 }
 
-// CreateCNIConfFile creates the configuration file for the CNI plugin
-func CreateCNIConfFile(conf *EnvConf, nodeInfo *NodeInfo) error {
-	fName := conf.CNIConfFilePath
-	f, err := os.Create(fName)
+// RenderCNIConf returns the content of the configuration file for the CNI plugin
+func RenderCNIConf(conf *EnvConf, nodeInfo *NodeInfo) ([]byte, error) {
+	cniLogConf, err := json.Marshal(conf.cniLogConf)
 	if err != nil {
-		log.WithFields(log.Fields{
-			"path":   fName,
-			"detail": err,
-		}).Fatal("failed to create cni config file")
-		return fmt.Errorf("failed to create cni config file in %q: %v", fName, err)
+		log.WithField("detail", err).Error("failed to encode cni log configuration")
+		return nil, fmt.Errorf("failed to encode cni log configuration: %v", err)
+	}
+	metricsConf, err := json.Marshal(conf.metricsConf)
+	if err != nil {
+		log.WithField("detail", err).Error("failed to encode cni metrics configuration")
+		return nil, fmt.Errorf("failed to encode cni metrics configuration: %v", err)
 	}
-	defer f.Close()
 
 	podCIDR := nodeInfo.podCIDR
 	podGwIP := nodeInfo.podGwInfo.IPNet.IP
 	podGwMAC := nodeInfo.podGwInfo.MAC
 
-	if _, err := fmt.Fprintf(f,
+	return []byte(fmt.Sprintf(
 		confFormat,
-		conf.MTU,
+		nodeInfo.MTU,
 		conf.vClusterCIDR,
 		conf.bridgeName,
 		podGwIP.String(),
 		podGwMAC.String(),
+		cniLogConf,
+		conf.polycubeURL,
+		metricsConf,
+		conf.stateDir,
 		podCIDR.String(),
 		ip.NextIP(podCIDR.IP).String(), // .1
 		ip.PrevIP(podGwIP).String(),    // .253
 		podGwIP.String(),
-	); err != nil {
+		conf.ipamDataDir,
+	)), nil
+}
+
+// CreateCNIConfFile creates the configuration file for the CNI plugin
+func CreateCNIConfFile(conf *EnvConf, nodeInfo *NodeInfo) error {
+	fName := conf.CNIConfFilePath
+	content, err := RenderCNIConf(conf, nodeInfo)
+	if err != nil {
+		return err
+	}
+	// the file is written atomically since the kubelet could read it at any time
+	if err := utils.WriteFileAtomic(fName, content, 0644); err != nil {
 		log.WithFields(log.Fields{
 			"path":   fName,
 			"detail": err,
-		}).Fatal("failed to write cni config file")
+		}).Error("failed to write cni config file")
 		return fmt.Errorf("failed to write cni config file in %q: %v", fName, err)
 	}
 	return nil
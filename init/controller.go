@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"time"
+)
+
+const (
+	// maxSyncRetries is the number of times a key is requeued before being dropped
+	maxSyncRetries = 10
+)
+
+// controller processes the keys of the objects notified by one or more informers, serializing the calls to the
+// provided sync function. A key whose sync fails is requeued with an exponential backoff
+type controller struct {
+	name   string
+	queue  workqueue.RateLimitingInterface
+	synced []cache.InformerSynced
+	sync   func(key string) error
+}
+
+func newController(name string, sync func(key string) error) *controller {
+	return &controller{
+		name:  name,
+		queue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), name),
+		sync:  sync,
+	}
+}
+
+// watch makes the controller enqueue the keys of the objects notified by the provided informer. If keyFunc is nil,
+// the namespace/name key of the notified object is used
+func (c *controller) watch(informer cache.SharedIndexInformer, keyFunc func(obj interface{}) (string, error)) {
+	if keyFunc == nil {
+		keyFunc = cache.DeletionHandlingMetaNamespaceKeyFunc
+	}
+	enqueue := func(obj interface{}) {
+		key, err := keyFunc(obj)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"controller": c.name,
+				"detail":     err,
+			}).Error("failed to compute object key")
+			return
+		}
+		c.queue.Add(key)
+	}
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    enqueue,
+		UpdateFunc: func(_, obj interface{}) { enqueue(obj) },
+		DeleteFunc: enqueue,
+	})
+	c.synced = append(c.synced, informer.HasSynced)
+}
+
+// run waits for the informers caches to be synced and then processes the queued keys until ctx is done
+func (c *controller) run(ctx context.Context) error {
+	defer c.queue.ShutDown()
+	l := log.WithField("controller", c.name)
+
+	if !cache.WaitForCacheSync(ctx.Done(), c.synced...) {
+		return fmt.Errorf("failed to sync %q controller caches", c.name)
+	}
+	l.Info("controller started")
+	go wait.UntilWithContext(ctx, func(context.Context) {
+		for c.processNextKey() {
+		}
+	}, time.Second)
+	<-ctx.Done()
+	l.Info("controller stopped")
+	return nil
+}
+
+func (c *controller) processNextKey() bool {
+	item, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(item)
+
+	key := item.(string)
+	l := log.WithFields(log.Fields{
+		"controller": c.name,
+		"key":        key,
+	})
+	if err := c.sync(key); err != nil {
+		if c.queue.NumRequeues(key) < maxSyncRetries {
+			l.WithField("detail", err).Warning("failed to sync key, requeuing")
+			c.queue.AddRateLimited(key)
+			return true
+		}
+		l.WithField("detail", err).Error("failed to sync key, dropping")
+	}
+	c.queue.Forget(key)
+	return true
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ekoops/polykube-cni-plugin/utils"
+	"github.com/ekoops/polykube-cni-plugin/utils/polycube"
+	router "github.com/ekoops/polykube-cni-plugin/utils/router"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// When the egress masquerade is enabled, a nat cube is attached to the k8sdispatcher port connected to the node
+// external interface and translates the source address of the pods traffic leaving the node into the node address.
+// Since the nat cube is crossed after the k8sdispatcher, the replies of the NodePort services, already translated by
+// the k8sdispatcher, are not affected.
+// The traffic towards the destinations that must not be masqueraded (the cluster nodes and the configured CIDRs) is
+// routed by the router towards the node through a veth pair, bypassing the k8sdispatcher and the nat cube, and then
+// forwarded by the node itself. The traffic towards the VClusterCIDR, the service CIDR and the peer nodes pods never
+// leaves the node through the k8sdispatcher, so it is never masqueraded
+const (
+	egressHostIfaceName   = "pkhost0"
+	egressRouterIfaceName = "pkhost0r"
+	egressRouterPort      = "to_host0"
+	// egressSnatRuleID is the id of the nat cube rule masquerading the pods traffic
+	egressSnatRuleID = 1
+	ipForwardPath    = "/proc/sys/net/ipv4/ip_forward"
+)
+
+// EgressConf describes how the pods traffic leaving the cluster is handled
+type EgressConf struct {
+	// Masquerade enables the translation of the pods addresses into the node address
+	Masquerade bool
+	// NatName is the name of the nat cube performing the masquerade
+	NatName string
+	// NonMasqueradeCIDRs contains the destinations, in addition to the cluster ones, that are reached without
+	// masquerading the pods addresses
+	NonMasqueradeCIDRs []*net.IPNet
+	// Gateway is the egress gateway configuration, or nil if the egress gateway is not enabled
+	Gateway *EgressGatewayConf
+}
+
+// getEgressConf returns the egress configuration taken from the POLYKUBE_EGRESS_MASQUERADE,
+// POLYKUBE_NON_MASQUERADE_CIDRS, POLYCUBE_NAT_NAME and POLYKUBE_EGRESS_GATEWAY_* environment variables
+func getEgressConf(conf *EnvConf) (*EgressConf, error) {
+	egressConf := &EgressConf{}
+	var err error
+	if egressConf.Masquerade, err = strconv.ParseBool(getEnv("POLYKUBE_EGRESS_MASQUERADE", "false")); err != nil {
+		return nil, fmt.Errorf("failed to parse env variable: POLYKUBE_EGRESS_MASQUERADE must be a boolean")
+	}
+	egressConf.NatName = getEnv("POLYCUBE_NAT_NAME", "nat0")
+	if rawCIDRs := getEnv("POLYKUBE_NON_MASQUERADE_CIDRS", ""); rawCIDRs != "" {
+		for _, rawCIDR := range strings.Split(rawCIDRs, ",") {
+			_, cidr, err := net.ParseCIDR(strings.TrimSpace(rawCIDR))
+			if err != nil || cidr.IP.To4() == nil {
+				return nil, fmt.Errorf(
+					"failed to parse env variable: POLYKUBE_NON_MASQUERADE_CIDRS must be a comma separated list of w.x.y.z/n",
+				)
+			}
+			egressConf.NonMasqueradeCIDRs = append(egressConf.NonMasqueradeCIDRs, cidr)
+		}
+	}
+	// with direct routing the peer nodes pods are reached through the k8sdispatcher, so their traffic would be
+	// masqueraded
+	if egressConf.Masquerade && conf.overlay.Name() == overlayDirect {
+		return nil, fmt.Errorf("egress masquerade is not supported by the %s overlay", overlayDirect)
+	}
+	if egressConf.Gateway, err = getEgressGatewayConf(); err != nil {
+		return nil, err
+	}
+	// the gateway node translates the steered traffic through the nat cube
+	if egressConf.Gateway != nil && !egressConf.Masquerade {
+		return nil, fmt.Errorf("egress gateway requires POLYKUBE_EGRESS_MASQUERADE to be enabled")
+	}
+	return egressConf, nil
+}
+
+// CreateEgressIface creates the veth pair connecting the router to the node and configures the node for forwarding
+// the pods traffic received from it
+func CreateEgressIface(nodeInfo *NodeInfo) error {
+	l := log.WithField("name", egressHostIfaceName)
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:         egressHostIfaceName,
+			MTU:          nodeInfo.extIface.Link.Attrs().MTU,
+			HardwareAddr: ipToMAC(egressHostIPNet.IP),
+		},
+		PeerName: egressRouterIfaceName,
+	}
+	if err := netlink.LinkAdd(veth); err != nil && !errors.Is(err, syscall.EEXIST) {
+		l.WithField("detail", err).Error("failed to create egress interface")
+		return fmt.Errorf("failed to create %q interface - %v", egressHostIfaceName, err)
+	}
+	for _, name := range []string{egressHostIfaceName, egressRouterIfaceName} {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve %q interface - %v", name, err)
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			l.WithField("detail", err).Error("failed to set egress interface up")
+			return fmt.Errorf("failed to set %q interface up - %v", name, err)
+		}
+		if name != egressHostIfaceName {
+			continue
+		}
+		if err := netlink.AddrReplace(link, &netlink.Addr{IPNet: egressHostIPNet}); err != nil {
+			l.WithField("detail", err).Error("failed to set egress interface address")
+			return fmt.Errorf("failed to set %q interface address - %v", name, err)
+		}
+		// the pods are reached through the router, so that the node doesn't drop their traffic as martian
+		route := &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       nodeInfo.podCIDR,
+			Gw:        egressRouterIPNet.IP,
+		}
+		if err := netlink.RouteReplace(route); err != nil {
+			l.WithField("detail", err).Error("failed to set pods route")
+			return fmt.Errorf("failed to set route to %s via %q interface - %v", nodeInfo.podCIDR, name, err)
+		}
+	}
+	if err := ioutil.WriteFile(ipForwardPath, []byte("1"), 0644); err != nil {
+		l.WithField("detail", err).Error("failed to enable ip forwarding")
+		return fmt.Errorf("failed to enable ip forwarding - %v", err)
+	}
+	l.Info("egress interface created")
+	return nil
+}
+
+// checkEgressIface verifies that the veth pair connecting the router to the node is configured as required
+func checkEgressIface(nodeInfo *NodeInfo) error {
+	var link netlink.Link
+	for _, name := range []string{egressRouterIfaceName, egressHostIfaceName} {
+		var err error
+		if link, err = netlink.LinkByName(name); err != nil {
+			return fmt.Errorf("failed to retrieve %q interface: %v", name, err)
+		}
+		if link.Attrs().Flags&net.FlagUp == 0 {
+			return fmt.Errorf("%q interface is down", name)
+		}
+	}
+	// link is now the host side of the veth pair
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve %q interface addresses: %v", egressHostIfaceName, err)
+	}
+	found := false
+	for _, addr := range addrs {
+		if addr.IPNet.String() == egressHostIPNet.String() {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("address %s is not assigned to %q interface", egressHostIPNet, egressHostIfaceName)
+	}
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Dst: nodeInfo.podCIDR},
+		netlink.RT_FILTER_DST)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve routes to %s: %v", nodeInfo.podCIDR, err)
+	}
+	for _, route := range routes {
+		if route.LinkIndex == link.Attrs().Index && route.Gw.Equal(egressRouterIPNet.IP) {
+			return nil
+		}
+	}
+	return fmt.Errorf("route to %s via %q interface is missing", nodeInfo.podCIDR, egressHostIfaceName)
+}
+
+// egressSnatRule returns the nat cube rule masquerading the node pods traffic
+func egressSnatRule(nodeInfo *NodeInfo) polycube.SnatRule {
+	return polycube.SnatRule{
+		Id:          egressSnatRuleID,
+		InternalNet: nodeInfo.podCIDR.String(),
+		ExternalIp:  nodeInfo.extIface.IPNet.IP.String(),
+	}
+}
+
+// CreateEgressNat creates the nat cube masquerading the pods traffic and attaches it to the k8sdispatcher port
+// connected to the node external interface
+func CreateEgressNat(nats polycube.NatManager, conf *EnvConf, nodeInfo *NodeInfo) error {
+	name := conf.egress.NatName
+	parent := utils.CreatePeer(conf.k8sDispName, "to_int")
+	l := log.WithFields(log.Fields{
+		"name":   name,
+		"parent": parent,
+	})
+	if err := nats.CreateNat(polycube.Nat{Name: name, Loglevel: "TRACE"}); err != nil && !polycube.IsConflict(err) {
+		l.WithField("detail", err).Error("failed to create nat")
+		return fmt.Errorf("failed to create %q nat - %v", name, err)
+	}
+	n, err := nats.ReadNat(name)
+	if err != nil {
+		l.WithField("detail", err).Error("failed to retrieve nat")
+		return fmt.Errorf("failed to retrieve %q nat - %v", name, err)
+	}
+	if n.Parent != parent {
+		if err := nats.AttachNat(name, parent); err != nil {
+			l.WithField("detail", err).Error("failed to attach nat")
+			return fmt.Errorf("failed to attach %q nat to %q - %v", name, parent, err)
+		}
+	}
+	rule := egressSnatRule(nodeInfo)
+	if err := nats.ReplaceSnatRule(name, rule); err != nil {
+		l.WithFields(log.Fields{
+			"rule":   fmt.Sprintf("%+v", rule),
+			"detail": err,
+		}).Error("failed to set nat masquerade rule")
+		return fmt.Errorf("failed to set %q nat masquerade rule - %v", name, err)
+	}
+	l.Info("nat created")
+	return nil
+}
+
+// checkEgressNat verifies that the nat cube is attached to the k8sdispatcher and that it masquerades the pods traffic
+func checkEgressNat(nats polycube.NatManager, conf *EnvConf, nodeInfo *NodeInfo) error {
+	name := conf.egress.NatName
+	n, err := nats.ReadNat(name)
+	if err != nil {
+		if polycube.IsNotFound(err) {
+			return fmt.Errorf("nat %q doesn't exist", name)
+		}
+		return fmt.Errorf("failed to retrieve nat %q - %v", name, err)
+	}
+	if parent := utils.CreatePeer(conf.k8sDispName, "to_int"); n.Parent != parent {
+		return fmt.Errorf("nat %q parent - required: %q, found: %q", name, parent, n.Parent)
+	}
+	rules, err := nats.ListSnatRules(name)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve nat %q rules - %v", name, err)
+	}
+	expected := egressSnatRule(nodeInfo)
+	for _, rule := range rules {
+		if rule == expected {
+			return nil
+		}
+	}
+	return fmt.Errorf("nat %q masquerade rule for %s is missing", name, expected.InternalNet)
+}
+
+// egressRouterPorts returns the router port connected to the veth pair and the static arp entry of the node side
+func egressRouterPorts() (router.Ports, router.ArpTable) {
+	port := router.Ports{
+		Name: egressRouterPort,
+		Ip:   egressRouterIPNet.String(),
+		Mac:  ipToMAC(egressRouterIPNet.IP).String(),
+	}
+	entry := router.ArpTable{
+		Address:    egressHostIPNet.IP.String(),
+		Mac:        ipToMAC(egressHostIPNet.IP).String(),
+		Interface_: egressRouterPort,
+	}
+	return port, entry
+}
+
+// egressRoutes returns the router routes towards the destinations that must not be masqueraded: the current node, the
+// peer nodes and the configured non-masquerade CIDRs
+func egressRoutes(conf *EnvConf, nodeInfo *NodeInfo, peers map[string]*PeerNode) []router.Route {
+	networks := []string{nodeInfo.extIface.IPNet.IP.String() + "/32"}
+	for _, peer := range peers {
+		networks = append(networks, peer.IP.String()+"/32")
+	}
+	for _, cidr := range conf.egress.NonMasqueradeCIDRs {
+		networks = append(networks, cidr.String())
+	}
+	routes := make([]router.Route, 0, len(networks))
+	for _, network := range networks {
+		routes = append(routes, router.Route{
+			Network:    network,
+			Nexthop:    egressHostIPNet.IP.String(),
+			Interface_: egressRouterPort,
+		})
+	}
+	return routes
+}
+
+// SyncEgressRoutes aligns the router routes through the veth pair with the desired ones, calling the provided function
+// for each change
+func SyncEgressRoutes(
+	routers polycube.RouterManager, conf *EnvConf, nodeInfo *NodeInfo, peers map[string]*PeerNode,
+	changed func(message string),
+) error {
+	rName := conf.routerName
+	r, err := routers.ReadRouter(rName)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve %q router - %v", rName, err)
+	}
+	expected := make(map[string]bool)
+	for _, route := range egressRoutes(conf, nodeInfo, peers) {
+		expected[route.Network] = true
+		if hasRoute(r, route) {
+			continue
+		}
+		if err := routers.CreateRoute(rName, route); err != nil && !polycube.IsConflict(err) {
+			return fmt.Errorf("failed to create %q router route to %s - %v", rName, route.Network, err)
+		}
+		changed(fmt.Sprintf("non-masquerade route to %s created", route.Network))
+	}
+	for _, route := range r.Route {
+		if route.Interface_ != egressRouterPort || expected[route.Network] {
+			continue
+		}
+		if err := routers.DeleteRoute(rName, route.Network, route.Nexthop); err != nil && !polycube.IsNotFound(err) {
+			return fmt.Errorf("failed to delete %q router route to %s - %v", rName, route.Network, err)
+		}
+		changed(fmt.Sprintf("stale non-masquerade route to %s removed", route.Network))
+	}
+	return nil
+}
@@ -0,0 +1,1068 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ekoops/polykube-cni-plugin/utils/attachment"
+	"github.com/ekoops/polykube-cni-plugin/utils/polycube"
+	router "github.com/ekoops/polykube-cni-plugin/utils/router"
+	simplebridge "github.com/ekoops/polykube-cni-plugin/utils/simplebridge"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"io/ioutil"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"net"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// The egress gateway makes the external traffic of the selected pods leave the cluster from a designated node, which
+// translates their addresses into a fixed egress address. The router only routes by destination, so the pods traffic
+// can't be selected by the router of the pods node: instead, the agent detaches the per-pod lbrp of each selected pod
+// from the bridge and connects it to a dedicated veth pair, whose host side is routed by the node through a routing
+// rule matching it as input interface. The pod netns is never modified, so the pod can't bypass the steering.
+// The rule makes the node look up a routing table dedicated to the gateway node, which routes:
+//   - the traffic towards the node pods through a node-wide veth pair connected to the bridge;
+//   - the traffic that is not masqueraded (the VClusterCIDR, the service CIDR, the cluster nodes and the configured
+//     CIDRs) to the router, through the same veth pair;
+//   - any other traffic to a node-wide vxlan interface, which encapsulates it towards the gateway node.
+//
+// On the gateway node, the encapsulated traffic is received by the same node-wide vxlan interface, which is connected
+// to the router: from there, it follows the path of the gateway node pods traffic, and the nat cube translates it
+// through a dedicated rule for each pod address. The vxlan interface has no remote endpoint, so the gateway node
+// address is set in its forwarding database, and the router port connected to it has a MAC address derived from the
+// node address, so that the pods nodes can address it without resolving it.
+// The replies are routed by the gateway node towards the pods node through the overlay, as any traffic directed to a
+// peer node pod. There, the router reaches the pod through the node-wide veth pair, whose host side answers the arp
+// requests for the steered pods addresses, and the node forwards them to the pod through its veth pair.
+// The gateway node announces the egress addresses on the node network through the announcer of the services external
+// addresses, so an address used by both is announced only for the first owner. The rules are keyed by the pod
+// address, so the traffic of the pods having a virtual address is not translated
+const (
+	egressGwIfaceName  = "pkegw0"
+	egressGwRouterPort = "to_egw0"
+	// egressGwBridgeIfaceName and egressGwBridgePeerName are the sides of the veth pair connecting the node to the
+	// bridge port egressGwBridgePort
+	egressGwBridgeIfaceName = "pkegwb0"
+	egressGwBridgePeerName  = "pkegwb0b"
+	egressGwBridgePort      = "to_egw0"
+	// egressGwRuleBase is the lowest id of the nat cube rules translating the gateway pods traffic
+	egressGwRuleBase int32 = 100
+	// egressGwRulePriority is the priority of the node routing rules matching the steered pods traffic
+	egressGwRulePriority = 100
+	// egressGwRouteProtocol marks the routes created by the agent for the steered pods, so that the stale ones can be
+	// recognized
+	egressGwRouteProtocol netlink.RouteProtocol = 176
+	// egressGwSyncKey is the key processed by the egress gateway controller, since any change can affect every policy.
+	// egressGwFullSyncKey is processed in the same way, but the steering of every pod is configured again
+	egressGwSyncKey     = "egress-gateway"
+	egressGwFullSyncKey = egressGwSyncKey + "/full"
+	proxyArpPathFormat  = "/proc/sys/net/ipv4/conf/%s/proxy_arp"
+	// proxyDelayPathFormat is the path of the delay of the proxied arp replies, which are sent at once
+	proxyDelayPathFormat = "/proc/sys/net/ipv4/neigh/%s/proxy_delay"
+)
+
+// EgressGatewayConf describes where the egress gateway policies are read and how the steered traffic is encapsulated
+type EgressGatewayConf struct {
+	// ConfigMapNamespace and ConfigMapName identify the ConfigMap containing the policies
+	ConfigMapNamespace string
+	ConfigMapName      string
+	VNI                int
+	Port               int
+}
+
+// getEgressGatewayConf returns the egress gateway configuration taken from the POLYKUBE_EGRESS_GATEWAY_* environment
+// variables, or nil if the egress gateway is not enabled
+func getEgressGatewayConf() (*EgressGatewayConf, error) {
+	rawKey := getEnv("POLYKUBE_EGRESS_GATEWAY_CONFIGMAP", "")
+	if rawKey == "" {
+		return nil, nil
+	}
+	parts := strings.Split(strings.TrimSpace(rawKey), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("failed to parse env variable: POLYKUBE_EGRESS_GATEWAY_CONFIGMAP must be in the format namespace/name")
+	}
+	conf := &EgressGatewayConf{ConfigMapNamespace: parts[0], ConfigMapName: parts[1]}
+	var err error
+	if conf.VNI, err = parseIntEnv("POLYKUBE_EGRESS_GATEWAY_VNI", "43", 1, maxVNI); err != nil {
+		return nil, err
+	}
+	if conf.Port, err = parseIntEnv("POLYKUBE_EGRESS_GATEWAY_PORT", "4790", 1, 65535); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// EgressGatewayPolicy makes the external traffic of the selected pods leave the cluster from the gateway node with the
+// egress address. A nil selector selects everything, but at least one of them must be provided
+type EgressGatewayPolicy struct {
+	Name              string                `json:"-"`
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	PodSelector       *metav1.LabelSelector `json:"podSelector,omitempty"`
+	GatewayNode       string                `json:"gatewayNode"`
+	EgressIP          string                `json:"egressIP"`
+	namespaces        labels.Selector
+	pods              labels.Selector
+}
+
+// parseEgressGatewayPolicy parses the policy contained in the provided ConfigMap entry
+func parseEgressGatewayPolicy(name, raw string) (*EgressGatewayPolicy, error) {
+	p := &EgressGatewayPolicy{Name: name}
+	if err := json.Unmarshal([]byte(raw), p); err != nil {
+		return nil, fmt.Errorf("invalid policy %q: %v", name, err)
+	}
+	if p.NamespaceSelector == nil && p.PodSelector == nil {
+		return nil, fmt.Errorf("invalid policy %q: at least one of namespaceSelector and podSelector is required", name)
+	}
+	if p.GatewayNode == "" {
+		return nil, fmt.Errorf("invalid policy %q: gatewayNode is required", name)
+	}
+	if ip := net.ParseIP(p.EgressIP); ip == nil || ip.To4() == nil {
+		return nil, fmt.Errorf("invalid policy %q: egressIP %q must be an IPv4 address", name, p.EgressIP)
+	}
+	var err error
+	p.namespaces, p.pods = labels.Everything(), labels.Everything()
+	if p.NamespaceSelector != nil {
+		if p.namespaces, err = metav1.LabelSelectorAsSelector(p.NamespaceSelector); err != nil {
+			return nil, fmt.Errorf("invalid policy %q namespaceSelector: %v", name, err)
+		}
+	}
+	if p.PodSelector != nil {
+		if p.pods, err = metav1.LabelSelectorAsSelector(p.PodSelector); err != nil {
+			return nil, fmt.Errorf("invalid policy %q podSelector: %v", name, err)
+		}
+	}
+	return p, nil
+}
+
+// ParseEgressGatewayPolicies returns the valid policies contained in the provided ConfigMap, one for each entry, sorted
+// by name. The invalid ones are logged and skipped
+func ParseEgressGatewayPolicies(cm *v1.ConfigMap) []*EgressGatewayPolicy {
+	var policies []*EgressGatewayPolicy
+	for name, raw := range cm.Data {
+		p, err := parseEgressGatewayPolicy(name, raw)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"configmap": cm.Namespace + "/" + cm.Name,
+				"detail":    err,
+			}).Error("failed to parse egress gateway policy")
+			continue
+		}
+		policies = append(policies, p)
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].Name < policies[j].Name })
+	return policies
+}
+
+// matches returns true if the provided pod, belonging to the provided namespace, is selected by the policy
+func (p *EgressGatewayPolicy) matches(pod *v1.Pod, namespace *v1.Namespace) bool {
+	return p.namespaces.Matches(labels.Set(namespace.Labels)) && p.pods.Matches(labels.Set(pod.Labels))
+}
+
+// CreateEgressGatewayIface creates the node-wide vxlan interface through which the node pods traffic is steered
+// towards the gateway nodes and the traffic steered by the peer nodes pods is received, and the veth pair connecting
+// the node to the bridge
+func CreateEgressGatewayIface(conf *EgressGatewayConf, nodeInfo *NodeInfo) error {
+	l := log.WithField("name", egressGwIfaceName)
+	extIface := nodeInfo.extIface
+	vxlan := &netlink.Vxlan{
+		LinkAttrs:    netlink.LinkAttrs{Name: egressGwIfaceName, MTU: extIface.Link.Attrs().MTU - vxlanOverhead},
+		VxlanId:      conf.VNI,
+		VtepDevIndex: extIface.Link.Attrs().Index,
+		SrcAddr:      extIface.IPNet.IP,
+		Port:         conf.Port,
+	}
+	if err := netlink.LinkAdd(vxlan); err != nil && !errors.Is(err, syscall.EEXIST) {
+		l.WithField("detail", err).Error("failed to create egress gateway interface")
+		return fmt.Errorf("failed to create %q interface - %v", egressGwIfaceName, err)
+	}
+	link, err := netlink.LinkByName(egressGwIfaceName)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve %q interface - %v", egressGwIfaceName, err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		l.WithField("detail", err).Error("failed to set egress gateway interface up")
+		return fmt.Errorf("failed to set %q interface up - %v", egressGwIfaceName, err)
+	}
+	l.Info("egress gateway interface created")
+	return createEgressGatewayBridgeIface(nodeInfo)
+}
+
+// createEgressGatewayBridgeIface creates the veth pair connecting the node to the bridge. The host side has no
+// address: it answers the arp requests for the steered pods addresses, which are routed through their own veth pairs
+func createEgressGatewayBridgeIface(nodeInfo *NodeInfo) error {
+	l := log.WithField("name", egressGwBridgeIfaceName)
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{Name: egressGwBridgeIfaceName, MTU: nodeInfo.MTU},
+		PeerName:  egressGwBridgePeerName,
+	}
+	if err := netlink.LinkAdd(veth); err != nil && !errors.Is(err, syscall.EEXIST) {
+		l.WithField("detail", err).Error("failed to create egress gateway bridge veth interface")
+		return fmt.Errorf("failed to create %q interface - %v", egressGwBridgeIfaceName, err)
+	}
+	for _, name := range []string{egressGwBridgeIfaceName, egressGwBridgePeerName} {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve %q interface - %v", name, err)
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			l.WithField("detail", err).Error("failed to set egress gateway bridge veth interface up")
+			return fmt.Errorf("failed to set %q interface up - %v", name, err)
+		}
+	}
+	// the replies directed to the steered pods come from any address, so they must pass the loose reverse path filter
+	if err := ioutil.WriteFile(fmt.Sprintf(rpFilterPathFormat, egressGwBridgeIfaceName), []byte("2"), 0644); err != nil {
+		l.WithField("detail", err).Error("failed to set loose reverse path filter")
+		return fmt.Errorf("failed to set %q interface loose reverse path filter - %v", egressGwBridgeIfaceName, err)
+	}
+	if err := setProxyArp(egressGwBridgeIfaceName); err != nil {
+		l.WithField("detail", err).Error("failed to enable proxy arp")
+		return err
+	}
+	l.Info("egress gateway bridge veth interface created")
+	return nil
+}
+
+// setProxyArp makes the provided interface answer at once the arp requests for the addresses routed through another
+// interface
+func setProxyArp(name string) error {
+	if err := ioutil.WriteFile(fmt.Sprintf(proxyArpPathFormat, name), []byte("1"), 0644); err != nil {
+		return fmt.Errorf("failed to enable %q interface proxy arp - %v", name, err)
+	}
+	if err := ioutil.WriteFile(fmt.Sprintf(proxyDelayPathFormat, name), []byte("0"), 0644); err != nil {
+		return fmt.Errorf("failed to set %q interface proxy arp delay - %v", name, err)
+	}
+	return nil
+}
+
+// checkEgressGatewayIface verifies that the node-wide vxlan interface exists, is up and uses the configured parameters
+func checkEgressGatewayIface(conf *EgressGatewayConf) error {
+	link, err := netlink.LinkByName(egressGwIfaceName)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve %q interface: %v", egressGwIfaceName, err)
+	}
+	vxlan, ok := link.(*netlink.Vxlan)
+	if !ok {
+		return fmt.Errorf("%q interface is not a vxlan interface", egressGwIfaceName)
+	}
+	if vxlan.VxlanId != conf.VNI || vxlan.Port != conf.Port {
+		return fmt.Errorf("%q interface VNI/port - required: %d/%d, found: %d/%d",
+			egressGwIfaceName, conf.VNI, conf.Port, vxlan.VxlanId, vxlan.Port)
+	}
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		return fmt.Errorf("%q interface is down", egressGwIfaceName)
+	}
+	return nil
+}
+
+// checkEgressGatewayBridgeIface verifies that the veth pair connecting the node to the bridge exists and is up
+func checkEgressGatewayBridgeIface() error {
+	for _, name := range []string{egressGwBridgePeerName, egressGwBridgeIfaceName} {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve %q interface: %v", name, err)
+		}
+		if link.Attrs().Flags&net.FlagUp == 0 {
+			return fmt.Errorf("%q interface is down", name)
+		}
+	}
+	return nil
+}
+
+// egressGatewayRouterPort returns the router port connected to the node-wide vxlan interface. Its MAC address is
+// derived from the provided node address, since the peer nodes send the steered traffic to it without resolving it
+func egressGatewayRouterPort(nodeIP net.IP) router.Ports {
+	return router.Ports{
+		Name: egressGwRouterPort,
+		Ip:   egressGwHopIPNet.String(),
+		Mac:  ipToMAC(nodeIP).String(),
+	}
+}
+
+// ConnectEgressGatewayBridge connects the provided bridge to the node through the veth pair, creating the bridge port
+// if it doesn't exist
+func ConnectEgressGatewayBridge(bridges polycube.BridgeManager, brName string) error {
+	l := log.WithFields(log.Fields{
+		"name": brName,
+		"port": egressGwBridgePort,
+		"peer": egressGwBridgePeerName,
+	})
+	port := simplebridge.Ports{
+		Name: egressGwBridgePort,
+		Peer: egressGwBridgePeerName,
+	}
+	if err := bridges.CreateBridgePort(brName, port); err != nil {
+		if !polycube.IsConflict(err) {
+			l.WithField("detail", err).Error("failed to create bridge port")
+			return fmt.Errorf("failed to create %q port on %q bridge - %v", egressGwBridgePort, brName, err)
+		}
+		if err := bridges.UpdateBridgePort(brName, egressGwBridgePort, simplebridge.Ports{Peer: port.Peer}); err != nil {
+			l.WithField("detail", err).Error("failed to set bridge port peer")
+			return fmt.Errorf("failed to set %q port peer on %q bridge to %q - %v",
+				egressGwBridgePort, brName, port.Peer, err,
+			)
+		}
+	}
+	l.Info("bridge port peer set")
+	return nil
+}
+
+// egressGwTable returns the node routing table steering the pods traffic towards the provided gateway node
+func egressGwTable(gatewayIP net.IP) int {
+	return int(binary.BigEndian.Uint32(gatewayIP.To4()))
+}
+
+// egressGwRule returns the node routing rule making the traffic received from the provided interface look up the
+// provided table
+func egressGwRule(iface string, table int) *netlink.Rule {
+	rule := netlink.NewRule()
+	rule.Family = netlink.FAMILY_V4
+	rule.Priority = egressGwRulePriority
+	rule.IifName = iface
+	rule.Table = table
+	return rule
+}
+
+// egressGwRules returns the node routing rules matching the steered pods traffic
+func egressGwRules() ([]netlink.Rule, error) {
+	rules, err := netlink.RuleListFiltered(netlink.FAMILY_V4, &netlink.Rule{Priority: egressGwRulePriority},
+		netlink.RT_FILTER_PRIORITY)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list routing rules: %v", err)
+	}
+	return rules, nil
+}
+
+// syncSteeringTable aligns the routes of the table steering the pods traffic towards the provided gateway node:
+// the node pods are reached through the bridge, the provided direct destinations through the router and any other
+// destination through the gateway node
+func syncSteeringTable(gatewayIP net.IP, nodeInfo *NodeInfo, direct []*net.IPNet) error {
+	brLink, err := netlink.LinkByName(egressGwBridgeIfaceName)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve %q interface: %v", egressGwBridgeIfaceName, err)
+	}
+	vxLink, err := netlink.LinkByName(egressGwIfaceName)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve %q interface: %v", egressGwIfaceName, err)
+	}
+	podGw := nodeInfo.podGwInfo
+	gatewayMAC := ipToMAC(gatewayIP)
+	// neither the router nor the gateway node router port are resolved: the latter doesn't answer arp requests
+	// coming from the vxlan interface
+	neighs := []*netlink.Neigh{
+		{
+			LinkIndex:    brLink.Attrs().Index,
+			State:        netlink.NUD_PERMANENT,
+			IP:           podGw.IPNet.IP,
+			HardwareAddr: podGw.MAC,
+		},
+		{
+			LinkIndex:    vxLink.Attrs().Index,
+			State:        netlink.NUD_PERMANENT,
+			IP:           gatewayIP,
+			HardwareAddr: gatewayMAC,
+		},
+		{
+			LinkIndex:    vxLink.Attrs().Index,
+			Family:       syscall.AF_BRIDGE,
+			Flags:        netlink.NTF_SELF,
+			State:        netlink.NUD_PERMANENT,
+			IP:           gatewayIP,
+			HardwareAddr: gatewayMAC,
+		},
+	}
+	for _, neigh := range neighs {
+		if err := netlink.NeighSet(neigh); err != nil {
+			return fmt.Errorf("failed to set neighbor entry for %s on %d interface: %v", neigh.IP, neigh.LinkIndex, err)
+		}
+	}
+
+	table := egressGwTable(gatewayIP)
+	routes := []*netlink.Route{
+		{
+			LinkIndex: brLink.Attrs().Index,
+			Dst:       nodeInfo.podCIDR,
+			Scope:     netlink.SCOPE_LINK,
+			Table:     table,
+			Protocol:  egressGwRouteProtocol,
+		},
+	}
+	for _, cidr := range direct {
+		routes = append(routes, &netlink.Route{
+			LinkIndex: brLink.Attrs().Index,
+			Dst:       cidr,
+			Gw:        podGw.IPNet.IP,
+			Flags:     int(netlink.FLAG_ONLINK),
+			Table:     table,
+			Protocol:  egressGwRouteProtocol,
+		})
+	}
+	routes = append(routes, &netlink.Route{
+		LinkIndex: vxLink.Attrs().Index,
+		Dst:       &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)},
+		Gw:        gatewayIP,
+		Flags:     int(netlink.FLAG_ONLINK),
+		Table:     table,
+		Protocol:  egressGwRouteProtocol,
+	})
+	desired := make(map[string]bool, len(routes))
+	for _, route := range routes {
+		desired[route.Dst.String()] = true
+		if err := netlink.RouteReplace(route); err != nil {
+			return fmt.Errorf("failed to set route to %s in table %d: %v", route.Dst, table, err)
+		}
+	}
+	present, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: table},
+		netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return fmt.Errorf("failed to list table %d routes: %v", table, err)
+	}
+	for _, route := range present {
+		if route.Dst == nil || desired[route.Dst.String()] {
+			continue
+		}
+		route := route
+		if err := netlink.RouteDel(&route); err != nil && !errors.Is(err, syscall.ESRCH) {
+			return fmt.Errorf("failed to delete route to %s from table %d: %v", route.Dst, table, err)
+		}
+	}
+	return nil
+}
+
+// steerPod creates the veth pair of the provided attachment and routes the traffic received from it through the table
+// of the provided gateway node. The host side has the pod gateway addresses, so that the pod neighbor entries stay
+// valid, and answers the pod arp requests. The per-pod lbrp must be connected to the veth pair by the caller
+func steerPod(att *attachment.Attachment, gatewayIP net.IP, nodeInfo *NodeInfo) error {
+	podIP := net.ParseIP(att.IP).To4()
+	if podIP == nil {
+		return fmt.Errorf("invalid attachment address %q", att.IP)
+	}
+	host, lb := attachment.SteeringIfaceNames(att.Name)
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:         host,
+			MTU:          nodeInfo.MTU,
+			HardwareAddr: nodeInfo.podGwInfo.MAC,
+		},
+		PeerName: lb,
+	}
+	if err := netlink.LinkAdd(veth); err != nil && !errors.Is(err, syscall.EEXIST) {
+		return fmt.Errorf("failed to create %q interface: %v", host, err)
+	}
+	var link netlink.Link
+	for _, name := range []string{lb, host} {
+		var err error
+		if link, err = netlink.LinkByName(name); err != nil {
+			return fmt.Errorf("failed to retrieve %q interface: %v", name, err)
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			return fmt.Errorf("failed to set %q interface up: %v", name, err)
+		}
+	}
+	// link is now the host side of the veth pair
+	if err := setProxyArp(host); err != nil {
+		return err
+	}
+	route := &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       &net.IPNet{IP: podIP, Mask: net.CIDRMask(32, 32)},
+		Scope:     netlink.SCOPE_LINK,
+		Protocol:  egressGwRouteProtocol,
+	}
+	if err := netlink.RouteReplace(route); err != nil {
+		return fmt.Errorf("failed to set route to %s: %v", route.Dst, err)
+	}
+
+	table := egressGwTable(gatewayIP)
+	rules, err := egressGwRules()
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, rule := range rules {
+		if rule.IifName != host {
+			continue
+		}
+		if rule.Table == table {
+			found = true
+			continue
+		}
+		// the pod was steered towards another gateway node
+		if err := netlink.RuleDel(egressGwRule(host, rule.Table)); err != nil && !errors.Is(err, syscall.ENOENT) {
+			return fmt.Errorf("failed to delete routing rule of %q interface: %v", host, err)
+		}
+	}
+	if !found {
+		if err := netlink.RuleAdd(egressGwRule(host, table)); err != nil && !errors.Is(err, syscall.EEXIST) {
+			return fmt.Errorf("failed to add routing rule of %q interface: %v", host, err)
+		}
+	}
+	return nil
+}
+
+// unsteerPod removes the routing rules and the veth pair of the provided attachment, if any. The per-pod lbrp must be
+// connected again to the bridge by the caller
+func unsteerPod(att *attachment.Attachment) error {
+	host, _ := attachment.SteeringIfaceNames(att.Name)
+	rules, err := egressGwRules()
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if rule.IifName != host {
+			continue
+		}
+		if err := netlink.RuleDel(egressGwRule(host, rule.Table)); err != nil && !errors.Is(err, syscall.ENOENT) {
+			return fmt.Errorf("failed to delete routing rule of %q interface: %v", host, err)
+		}
+	}
+	// the route towards the pod is removed with the veth pair
+	link, err := netlink.LinkByName(host)
+	if _, notFound := err.(netlink.LinkNotFoundError); notFound {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to retrieve %q interface: %v", host, err)
+	}
+	if err := netlink.LinkDel(link); err != nil {
+		return fmt.Errorf("failed to delete %q interface: %v", host, err)
+	}
+	return nil
+}
+
+// isSteered returns true if the traffic of the provided attachment is steered towards an egress gateway, so its
+// per-pod lbrp is not connected to the bridge
+func isSteered(att string) bool {
+	host, _ := attachment.SteeringIfaceNames(att)
+	_, err := netlink.LinkByName(host)
+	return err == nil
+}
+
+// sweepSteering removes the veth pairs, the routing rules and the routes not belonging to the provided steered
+// attachments and gateway nodes, as the ones of the deleted pods
+func sweepSteering(steered map[string]bool, gateways map[string]net.IP) error {
+	hosts := make(map[string]bool, len(steered))
+	for name := range steered {
+		host, _ := attachment.SteeringIfaceNames(name)
+		hosts[host] = true
+	}
+	tables := make(map[int]bool, len(gateways))
+	for _, gatewayIP := range gateways {
+		tables[egressGwTable(gatewayIP)] = true
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return fmt.Errorf("failed to list host interfaces: %v", err)
+	}
+	for _, link := range links {
+		name := link.Attrs().Name
+		if link.Type() != "veth" || !strings.HasPrefix(name, attachment.SteeringIfacePrefix) || hosts[name] ||
+			strings.HasSuffix(name, "l") {
+			continue
+		}
+		if err := netlink.LinkDel(link); err != nil {
+			return fmt.Errorf("failed to delete stale %q interface: %v", name, err)
+		}
+		log.WithField("interface", name).Info("stale egress gateway steering interface deleted")
+	}
+	rules, err := egressGwRules()
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if hosts[rule.IifName] && tables[rule.Table] {
+			continue
+		}
+		if err := netlink.RuleDel(egressGwRule(rule.IifName, rule.Table)); err != nil && !errors.Is(err, syscall.ENOENT) {
+			return fmt.Errorf("failed to delete stale routing rule of %q interface: %v", rule.IifName, err)
+		}
+	}
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4,
+		&netlink.Route{Table: syscall.RT_TABLE_UNSPEC, Protocol: egressGwRouteProtocol},
+		netlink.RT_FILTER_TABLE|netlink.RT_FILTER_PROTOCOL,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to list routes: %v", err)
+	}
+	for _, route := range routes {
+		if route.Table == syscall.RT_TABLE_MAIN || tables[route.Table] {
+			continue
+		}
+		route := route
+		if err := netlink.RouteDel(&route); err != nil && !errors.Is(err, syscall.ESRCH) {
+			return fmt.Errorf("failed to delete stale route to %s from table %d: %v", route.Dst, route.Table, err)
+		}
+	}
+
+	// the entries towards the gateway nodes that are no more used
+	vxLink, err := netlink.LinkByName(egressGwIfaceName)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve %q interface: %v", egressGwIfaceName, err)
+	}
+	used := make(map[string]bool, len(gateways))
+	for _, gatewayIP := range gateways {
+		used[gatewayIP.String()] = true
+	}
+	for _, family := range []int{netlink.FAMILY_V4, syscall.AF_BRIDGE} {
+		neighs, err := netlink.NeighList(vxLink.Attrs().Index, family)
+		if err != nil {
+			return fmt.Errorf("failed to list %q interface neighbor entries: %v", egressGwIfaceName, err)
+		}
+		for _, neigh := range neighs {
+			if neigh.IP == nil || neigh.State != netlink.NUD_PERMANENT || used[neigh.IP.String()] {
+				continue
+			}
+			neigh := neigh
+			if err := netlink.NeighDel(&neigh); err != nil && !errors.Is(err, syscall.ENOENT) {
+				return fmt.Errorf("failed to delete stale neighbor entry for %s: %v", neigh.IP, err)
+			}
+		}
+	}
+	return nil
+}
+
+// SyncEgressGatewayRules aligns the nat cube rules translating the gateway pods traffic with the provided ones,
+// expressed as egress address indexed by pod network. The rules keep their id while their translation doesn't change
+func SyncEgressGatewayRules(nats polycube.NatManager, conf *EnvConf, desired map[string]string) error {
+	name := conf.egress.NatName
+	rules, err := nats.ListSnatRules(name)
+	if err != nil && !polycube.IsNotFound(err) {
+		return fmt.Errorf("failed to list %q nat rules - %v", name, err)
+	}
+	used := make(map[int32]bool)
+	present := make(map[string]bool)
+	for _, rule := range rules {
+		used[rule.Id] = true
+		if rule.Id < egressGwRuleBase {
+			continue
+		}
+		if desired[rule.InternalNet] == rule.ExternalIp && !present[rule.InternalNet] {
+			present[rule.InternalNet] = true
+			continue
+		}
+		l := log.WithFields(log.Fields{
+			"name": name,
+			"rule": fmt.Sprintf("%+v", rule),
+		})
+		if err := nats.DeleteSnatRule(name, rule.Id); err != nil && !polycube.IsNotFound(err) {
+			l.WithField("detail", err).Error("failed to delete stale egress gateway rule")
+			return fmt.Errorf("failed to delete %q nat rule %d - %v", name, rule.Id, err)
+		}
+		delete(used, rule.Id)
+		l.Info("stale egress gateway rule deleted")
+	}
+
+	networks := make([]string, 0, len(desired))
+	for network := range desired {
+		networks = append(networks, network)
+	}
+	sort.Strings(networks)
+	id := egressGwRuleBase
+	for _, network := range networks {
+		if present[network] {
+			continue
+		}
+		for used[id] {
+			id++
+		}
+		rule := polycube.SnatRule{Id: id, InternalNet: network, ExternalIp: desired[network]}
+		l := log.WithFields(log.Fields{
+			"name": name,
+			"rule": fmt.Sprintf("%+v", rule),
+		})
+		if err := nats.ReplaceSnatRule(name, rule); err != nil {
+			l.WithField("detail", err).Error("failed to set egress gateway rule")
+			return fmt.Errorf("failed to set %q nat rule %d - %v", name, id, err)
+		}
+		used[id] = true
+		l.Info("egress gateway rule set")
+	}
+	return nil
+}
+
+// egressGatewayController steers the traffic of the node pods selected by the egress gateway policies towards their
+// gateway nodes and, for the policies having the current node as gateway, translates the traffic of the selected pods
+// and announces the egress addresses
+type egressGatewayController struct {
+	*controller
+	conf       *EnvConf
+	nodeInfo   *NodeInfo
+	nats       polycube.NatManager
+	routers    polycube.RouterManager
+	bridges    polycube.BridgeManager
+	podLBs     attachment.PodLBManager
+	announcer  *l2Announcer
+	cmLister   corelisters.ConfigMapLister
+	podLister  corelisters.PodLister
+	nsLister   corelisters.NamespaceLister
+	nodeLister corelisters.NodeLister
+	// steered contains the gateway node address of the steered node pods, indexed by attachment name
+	steered map[string]string
+	// announced contains the names of the policies whose egress address is announced by the current node
+	announced map[string]bool
+}
+
+// newEgressGatewayController returns a controller for the policies contained in the ConfigMap notified by cmFactory,
+// which must be restricted to the configured ConfigMap, and for the cluster pods, namespaces and nodes notified by
+// factory. The egress addresses are announced through the provided announcer, shared with the service controller
+func newEgressGatewayController(
+	conf *EnvConf, nodeInfo *NodeInfo, cubes *polycube.Cubes, announcer *l2Announcer,
+	factory, cmFactory informers.SharedInformerFactory,
+) *egressGatewayController {
+	cmInformer := cmFactory.Core().V1().ConfigMaps()
+	podInformer := factory.Core().V1().Pods()
+	nsInformer := factory.Core().V1().Namespaces()
+	nodeInformer := factory.Core().V1().Nodes()
+	c := &egressGatewayController{
+		conf:       conf,
+		nodeInfo:   nodeInfo,
+		nats:       cubes.Nats,
+		routers:    cubes.Routers,
+		bridges:    cubes.Bridges,
+		podLBs:     attachment.NewPodLBManager(cubes.Lbrps, cubes.Bridges),
+		announcer:  announcer,
+		cmLister:   cmInformer.Lister(),
+		podLister:  podInformer.Lister(),
+		nsLister:   nsInformer.Lister(),
+		nodeLister: nodeInformer.Lister(),
+		steered:    make(map[string]string),
+		announced:  make(map[string]bool),
+	}
+	c.controller = newController("egress-gateway", c.sync)
+	keyFunc := func(interface{}) (string, error) { return egressGwSyncKey, nil }
+	c.watch(cmInformer.Informer(), keyFunc)
+	c.watch(podInformer.Informer(), keyFunc)
+	c.watch(nsInformer.Informer(), keyFunc)
+	c.watch(nodeInformer.Informer(), keyFunc)
+	return c
+}
+
+// resync enqueues the policies, so that the nat cube rules and the steering of every pod are configured again
+func (c *egressGatewayController) resync() {
+	c.queue.Add(egressGwFullSyncKey)
+}
+
+// policies returns the policies contained in the configured ConfigMap
+func (c *egressGatewayController) policies() ([]*EgressGatewayPolicy, error) {
+	gw := c.conf.egress.Gateway
+	cm, err := c.cmLister.ConfigMaps(gw.ConfigMapNamespace).Get(gw.ConfigMapName)
+	if k8serrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseEgressGatewayPolicies(cm), nil
+}
+
+// policyFor returns the first policy, by name, selecting the provided pod, or nil if no policy selects it
+func (c *egressGatewayController) policyFor(pod *v1.Pod, policies []*EgressGatewayPolicy) (*EgressGatewayPolicy, error) {
+	if pod.Spec.HostNetwork || len(policies) == 0 {
+		return nil, nil
+	}
+	namespace, err := c.nsLister.Get(pod.Namespace)
+	if k8serrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range policies {
+		if p.matches(pod, namespace) {
+			return p, nil
+		}
+	}
+	return nil, nil
+}
+
+func (c *egressGatewayController) sync(key string) error {
+	if key == egressGwFullSyncKey {
+		c.steered = make(map[string]string)
+	}
+	policies, err := c.policies()
+	if err != nil {
+		return err
+	}
+	nodes, err := c.nodeLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	// the traffic towards the destinations that are not masqueraded is never steered
+	direct := []*net.IPNet{c.conf.vClusterCIDR, c.conf.serviceCIDR}
+	direct = append(direct, c.conf.egress.NonMasqueradeCIDRs...)
+	nodeIPs := make(map[string]net.IP)
+	for _, node := range nodes {
+		for _, addr := range node.Status.Addresses {
+			if ip := net.ParseIP(addr.Address).To4(); addr.Type == v1.NodeInternalIP && ip != nil {
+				nodeIPs[node.Name] = ip
+				direct = append(direct, &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)})
+				break
+			}
+		}
+	}
+
+	pods, err := c.podLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	rules := make(map[string]string)
+	// gateways contains the gateway node address of the selected node pods, indexed by namespace/name
+	gateways := make(map[string]net.IP)
+	for _, pod := range pods {
+		p, err := c.policyFor(pod, policies)
+		if err != nil {
+			return err
+		}
+		if p == nil {
+			continue
+		}
+		if p.GatewayNode == c.conf.nodeName {
+			if ip := net.ParseIP(pod.Status.PodIP).To4(); ip != nil {
+				rules[ip.String()+"/32"] = p.EgressIP
+			}
+			continue
+		}
+		if pod.Spec.NodeName != c.conf.nodeName {
+			continue
+		}
+		gatewayIP, ok := nodeIPs[p.GatewayNode]
+		if !ok {
+			log.WithFields(log.Fields{
+				"policy": p.Name,
+				"node":   p.GatewayNode,
+			}).Warning("egress gateway node not found or without internal address")
+			continue
+		}
+		gateways[pod.Namespace+"/"+pod.Name] = gatewayIP
+	}
+
+	var errs []string
+	if err := SyncEgressGatewayRules(c.nats, c.conf, rules); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := c.syncAnnouncements(policies); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := c.syncPods(gateways, direct); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// egressGwAnnounceKey returns the announcer owner of the egress address of the provided policy. It can't be a
+// service key, since it doesn't contain a namespace
+func egressGwAnnounceKey(policy string) string {
+	return egressGwSyncKey + ":" + policy
+}
+
+// syncAnnouncements makes the current node announce the egress addresses of the policies having it as gateway
+func (c *egressGatewayController) syncAnnouncements(policies []*EgressGatewayPolicy) error {
+	desired := make(map[string]bool)
+	for _, p := range policies {
+		if p.GatewayNode != c.conf.nodeName {
+			continue
+		}
+		desired[p.Name] = true
+		if err := c.announcer.sync(egressGwAnnounceKey(p.Name), []string{p.EgressIP}); err != nil {
+			return err
+		}
+		c.announced[p.Name] = true
+	}
+	for name := range c.announced {
+		if desired[name] {
+			continue
+		}
+		if err := c.announcer.sync(egressGwAnnounceKey(name), nil); err != nil {
+			return err
+		}
+		delete(c.announced, name)
+	}
+	return nil
+}
+
+// syncPods steers the traffic of the provided node pods, indexed by namespace/name, towards their gateway nodes and
+// restores the default path of the other ones
+func (c *egressGatewayController) syncPods(gateways map[string]net.IP, direct []*net.IPNet) error {
+	atts, err := attachment.List(c.conf.stateDir)
+	if err != nil {
+		return fmt.Errorf("failed to list attachments state: %v", err)
+	}
+	var errs []string
+	// the tables are shared by the pods steered towards the same gateway node
+	tables := make(map[string]net.IP)
+	failed := make(map[string]bool)
+	for _, gatewayIP := range gateways {
+		if _, ok := tables[gatewayIP.String()]; ok {
+			continue
+		}
+		tables[gatewayIP.String()] = gatewayIP
+		if err := syncSteeringTable(gatewayIP, c.nodeInfo, direct); err != nil {
+			log.WithFields(log.Fields{
+				"gateway": gatewayIP,
+				"detail":  err,
+			}).Error("failed to set egress gateway routing table")
+			errs = append(errs, fmt.Sprintf("failed to set %s gateway routing table: %v", gatewayIP, err))
+			failed[gatewayIP.String()] = true
+		}
+	}
+
+	found := make(map[string]bool)
+	steered := make(map[string]bool)
+	podIPs := make(map[string]bool)
+	for _, att := range atts {
+		if att.PodName == "" || att.IP == "" {
+			continue
+		}
+		found[att.Name] = true
+		key := att.PodNamespace + "/" + att.PodName
+		l := log.WithFields(log.Fields{
+			"pod":        key,
+			"attachment": att.Name,
+		})
+		gatewayIP, selected := gateways[key]
+		if !selected {
+			// the pod could have been steered before an agent restart
+			if !isSteered(att.Name) {
+				delete(c.steered, att.Name)
+				continue
+			}
+			if err := c.restore(att); err != nil {
+				l.WithField("detail", err).Error("failed to restore pod egress traffic")
+				errs = append(errs, fmt.Sprintf("failed to restore %q pod egress traffic: %v", key, err))
+				steered[att.Name] = true
+				continue
+			}
+			delete(c.steered, att.Name)
+			l.Info("pod egress traffic restored")
+			continue
+		}
+		steered[att.Name] = true
+		podIPs[att.IP] = true
+		// the pods towards a gateway node whose table was not set are left as they are until the next sync
+		if c.steered[att.Name] == gatewayIP.String() || failed[gatewayIP.String()] {
+			continue
+		}
+		l = l.WithField("gateway", gatewayIP)
+		if err := c.steer(att, gatewayIP); err != nil {
+			l.WithField("detail", err).Error("failed to steer pod egress traffic")
+			errs = append(errs, fmt.Sprintf("failed to steer %q pod egress traffic: %v", key, err))
+			continue
+		}
+		c.steered[att.Name] = gatewayIP.String()
+		l.Info("pod egress traffic steered to gateway")
+	}
+	for name := range c.steered {
+		if !found[name] {
+			delete(c.steered, name)
+		}
+	}
+	if err := sweepSteering(steered, tables); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := c.sweepArpEntries(podIPs); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// podArpEntry returns the router static arp entry resolving the provided steered pod address into the node side of
+// the veth pair connecting the node to the bridge
+func podArpEntry(podIP string) (router.ArpTable, error) {
+	link, err := netlink.LinkByName(egressGwBridgeIfaceName)
+	if err != nil {
+		return router.ArpTable{}, fmt.Errorf("failed to retrieve %q interface: %v", egressGwBridgeIfaceName, err)
+	}
+	return router.ArpTable{
+		Address:    podIP,
+		Mac:        link.Attrs().HardwareAddr.String(),
+		Interface_: "to_br0",
+	}, nil
+}
+
+// steer steers the traffic of the provided attachment towards the provided gateway node: the per-pod lbrp is moved
+// from the bridge to the veth pair of the pod, and the router reaches the pod through the node
+func (c *egressGatewayController) steer(att *attachment.Attachment, gatewayIP net.IP) error {
+	if err := steerPod(att, gatewayIP, c.nodeInfo); err != nil {
+		return err
+	}
+	lbName := attachment.LbrpName(att.Name)
+	_, lb := attachment.SteeringIfaceNames(att.Name)
+	if err := c.podLBs.ConnectToIface(lbName, lb, c.bridgeOf(att)); err != nil {
+		return fmt.Errorf("failed to connect %q lbrp to %q interface - %v", lbName, lb, err)
+	}
+	// the router could still resolve the pod address into the pod interface, which is no more connected to the bridge
+	entry, err := podArpEntry(att.IP)
+	if err != nil {
+		return err
+	}
+	if err := c.routers.ReplaceArpEntry(c.conf.routerName, entry); err != nil {
+		return fmt.Errorf("failed to set %q router arp entry for %q - %v", c.conf.routerName, entry.Address, err)
+	}
+	return nil
+}
+
+// restore connects again the per-pod lbrp of the provided attachment to the bridge and removes its steering
+func (c *egressGatewayController) restore(att *attachment.Attachment) error {
+	rName := c.conf.routerName
+	if err := c.routers.DeleteArpEntry(rName, att.IP); err != nil && !polycube.IsNotFound(err) {
+		return fmt.Errorf("failed to delete %q router arp entry for %q - %v", rName, att.IP, err)
+	}
+	lbName := attachment.LbrpName(att.Name)
+	brName := c.bridgeOf(att)
+	brPortName := attachment.BridgePortName(lbName)
+	// a bridge port could have been left by a failed restore
+	if err := c.bridges.DeleteBridgePort(brName, brPortName); err != nil && !polycube.IsNotFound(err) {
+		return fmt.Errorf("failed to delete %q bridge %q port - %v", brName, brPortName, err)
+	}
+	if _, _, err := c.podLBs.ConnectToBridge(lbName, brName); err != nil {
+		return fmt.Errorf("failed to connect %q lbrp to %q bridge - %v", lbName, brName, err)
+	}
+	return unsteerPod(att)
+}
+
+// bridgeOf returns the bridge the per-pod lbrp of the provided attachment is connected to when it is not steered
+func (c *egressGatewayController) bridgeOf(att *attachment.Attachment) string {
+	if att.Bridge != "" {
+		return att.Bridge
+	}
+	return c.conf.bridgeName
+}
+
+// sweepArpEntries deletes the router static arp entries resolving the addresses of the pods that are no more steered
+// into the node
+func (c *egressGatewayController) sweepArpEntries(podIPs map[string]bool) error {
+	rName := c.conf.routerName
+	r, err := c.routers.ReadRouter(rName)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve %q router - %v", rName, err)
+	}
+	nodeEntry, err := podArpEntry("")
+	if err != nil {
+		return err
+	}
+	for _, entry := range r.ArpTable {
+		if entry.Interface_ != nodeEntry.Interface_ || !strings.EqualFold(entry.Mac, nodeEntry.Mac) ||
+			podIPs[entry.Address] {
+			continue
+		}
+		if err := c.routers.DeleteArpEntry(rName, entry.Address); err != nil && !polycube.IsNotFound(err) {
+			return fmt.Errorf("failed to delete %q router arp entry for %q - %v", rName, entry.Address, err)
+		}
+	}
+	return nil
+}
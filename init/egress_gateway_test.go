@@ -0,0 +1,366 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/ekoops/polykube-cni-plugin/test/fakepolycubed"
+	"github.com/ekoops/polykube-cni-plugin/utils/attachment"
+	"github.com/ekoops/polykube-cni-plugin/utils/polycube"
+	"github.com/vishvananda/netlink"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestParseEgressGatewayPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		raw   string
+		valid bool
+	}{
+		{
+			name:  "namespace selector",
+			raw:   `{"namespaceSelector": {"matchLabels": {"env": "prod"}}, "gatewayNode": "node2", "egressIP": "192.168.1.100"}`,
+			valid: true,
+		},
+		{
+			name:  "empty pod selector",
+			raw:   `{"podSelector": {}, "gatewayNode": "node2", "egressIP": "192.168.1.100"}`,
+			valid: true,
+		},
+		{
+			name: "invalid json",
+			raw:  `{"podSelector": {}`,
+		},
+		{
+			name: "no selectors",
+			raw:  `{"gatewayNode": "node2", "egressIP": "192.168.1.100"}`,
+		},
+		{
+			name: "no gateway node",
+			raw:  `{"podSelector": {}, "egressIP": "192.168.1.100"}`,
+		},
+		{
+			name: "invalid egress address",
+			raw:  `{"podSelector": {}, "gatewayNode": "node2", "egressIP": "192.168.1"}`,
+		},
+		{
+			name: "IPv6 egress address",
+			raw:  `{"podSelector": {}, "gatewayNode": "node2", "egressIP": "fd00::100"}`,
+		},
+		{
+			name: "invalid selector operator",
+			raw: `{"podSelector": {"matchExpressions": [{"key": "app", "operator": "Near", "values": ["web"]}]},
+				"gatewayNode": "node2", "egressIP": "192.168.1.100"}`,
+		},
+	} {
+		p, err := parseEgressGatewayPolicy("policy", tc.raw)
+		if tc.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%s: expected an error, found policy %+v", tc.name, p)
+		}
+	}
+}
+
+func TestParseEgressGatewayPolicies(t *testing.T) {
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "egress"},
+		Data: map[string]string{
+			"web":     `{"podSelector": {"matchLabels": {"app": "web"}}, "gatewayNode": "node2", "egressIP": "192.168.1.100"}`,
+			"invalid": `{"gatewayNode": "node2", "egressIP": "192.168.1.101"}`,
+			"db":      `{"podSelector": {"matchLabels": {"app": "db"}}, "gatewayNode": "node3", "egressIP": "192.168.1.102"}`,
+		},
+	}
+	policies := ParseEgressGatewayPolicies(cm)
+	if len(policies) != 2 || policies[0].Name != "db" || policies[1].Name != "web" {
+		names := make([]string, 0, len(policies))
+		for _, p := range policies {
+			names = append(names, p.Name)
+		}
+		t.Fatalf("expected the valid policies sorted by name [db web], found: %v", names)
+	}
+}
+
+// snatRules returns the nat cube rules, indexed by id
+func snatRules(t *testing.T, nats polycube.NatManager, name string) map[int32]polycube.SnatRule {
+	rules, err := nats.ListSnatRules(name)
+	if err != nil {
+		t.Fatalf("failed to list nat rules: %v", err)
+	}
+	byID := make(map[int32]polycube.SnatRule, len(rules))
+	for _, rule := range rules {
+		byID[rule.Id] = rule
+	}
+	return byID
+}
+
+func TestSyncEgressGatewayRules(t *testing.T) {
+	srv := fakepolycubed.NewServer()
+	ts, url := srv.Start()
+	defer ts.Close()
+	cubes := polycube.NewCubes(url)
+	conf := newTestConf()
+	nodeInfo := newTestNodeInfo()
+	natName := conf.egress.NatName
+	if err := cubes.Nats.CreateNat(polycube.Nat{Name: natName}); err != nil {
+		t.Fatalf("failed to create nat: %v", err)
+	}
+	masquerade := egressSnatRule(nodeInfo)
+	if err := cubes.Nats.ReplaceSnatRule(natName, masquerade); err != nil {
+		t.Fatalf("failed to set masquerade rule: %v", err)
+	}
+
+	for _, step := range []struct {
+		name    string
+		desired map[string]string
+		// rules contains the expected gateway rules translation, indexed by id
+		rules map[int32]string
+	}{
+		{
+			name:    "first sync",
+			desired: map[string]string{"10.10.1.5/32": "192.168.1.100", "10.10.1.6/32": "192.168.1.100"},
+			rules:   map[int32]string{100: "10.10.1.5/32>192.168.1.100", 101: "10.10.1.6/32>192.168.1.100"},
+		},
+		{
+			name: "new pod sorted before the existing ones",
+			desired: map[string]string{
+				"10.10.1.4/32": "192.168.1.101", "10.10.1.5/32": "192.168.1.100", "10.10.1.6/32": "192.168.1.100",
+			},
+			rules: map[int32]string{
+				100: "10.10.1.5/32>192.168.1.100", 101: "10.10.1.6/32>192.168.1.100", 102: "10.10.1.4/32>192.168.1.101",
+			},
+		},
+		{
+			name:    "stale pod removed",
+			desired: map[string]string{"10.10.1.4/32": "192.168.1.101", "10.10.1.6/32": "192.168.1.100"},
+			rules:   map[int32]string{101: "10.10.1.6/32>192.168.1.100", 102: "10.10.1.4/32>192.168.1.101"},
+		},
+		{
+			name:    "egress address changed",
+			desired: map[string]string{"10.10.1.4/32": "192.168.1.101", "10.10.1.6/32": "192.168.1.102"},
+			rules:   map[int32]string{100: "10.10.1.6/32>192.168.1.102", 102: "10.10.1.4/32>192.168.1.101"},
+		},
+		{
+			name:  "no policies",
+			rules: map[int32]string{},
+		},
+	} {
+		if err := SyncEgressGatewayRules(cubes.Nats, conf, step.desired); err != nil {
+			t.Fatalf("%s: SyncEgressGatewayRules failed: %v", step.name, err)
+		}
+		rules := snatRules(t, cubes.Nats, natName)
+		// the rules below the gateway ones are never touched
+		if rule, ok := rules[masquerade.Id]; !ok || rule != masquerade {
+			t.Errorf("%s: masquerade rule changed: %+v", step.name, rule)
+		}
+		delete(rules, masquerade.Id)
+		if len(rules) != len(step.rules) {
+			t.Errorf("%s: expected %d gateway rules, found: %+v", step.name, len(step.rules), rules)
+		}
+		for id, translation := range step.rules {
+			rule, ok := rules[id]
+			if !ok || rule.InternalNet+">"+rule.ExternalIp != translation {
+				t.Errorf("%s: rule %d - required: %s, found: %+v", step.name, id, translation, rule)
+			}
+		}
+	}
+}
+
+func TestEgressGatewayPolicyFor(t *testing.T) {
+	namespaces := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, ns := range []*v1.Namespace{
+		{ObjectMeta: metav1.ObjectMeta{Name: "prod", Labels: map[string]string{"env": "prod"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "dev", Labels: map[string]string{"env": "dev"}}},
+	} {
+		if err := namespaces.Add(ns); err != nil {
+			t.Fatalf("failed to add namespace: %v", err)
+		}
+	}
+	c := &egressGatewayController{nsLister: corelisters.NewNamespaceLister(namespaces)}
+	var policies []*EgressGatewayPolicy
+	for _, entry := range []struct{ name, raw string }{
+		{"a-prod", `{"namespaceSelector": {"matchLabels": {"env": "prod"}}, "gatewayNode": "node2", "egressIP": "192.168.1.100"}`},
+		{"b-web", `{"podSelector": {"matchLabels": {"app": "web"}}, "gatewayNode": "node3", "egressIP": "192.168.1.101"}`},
+	} {
+		p, err := parseEgressGatewayPolicy(entry.name, entry.raw)
+		if err != nil {
+			t.Fatalf("failed to parse policy: %v", err)
+		}
+		policies = append(policies, p)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		pod    *v1.Pod
+		policy string
+	}{
+		{
+			name:   "pod selected by both policies",
+			pod:    &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: "web", Labels: map[string]string{"app": "web"}}},
+			policy: "a-prod",
+		},
+		{
+			name:   "pod selected by the pod selector",
+			pod:    &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "dev", Name: "web", Labels: map[string]string{"app": "web"}}},
+			policy: "b-web",
+		},
+		{
+			name: "pod not selected",
+			pod:  &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "dev", Name: "db", Labels: map[string]string{"app": "db"}}},
+		},
+		{
+			name: "host network pod",
+			pod: &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: "agent"},
+				Spec:       v1.PodSpec{HostNetwork: true},
+			},
+		},
+		{
+			name: "pod of an unknown namespace",
+			pod:  &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "web", Labels: map[string]string{"app": "web"}}},
+		},
+	} {
+		p, err := c.policyFor(tc.pod, policies)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		name := ""
+		if p != nil {
+			name = p.Name
+		}
+		if name != tc.policy {
+			t.Errorf("%s: policy - required: %q, found: %q", tc.name, tc.policy, name)
+		}
+	}
+}
+
+// errSteeringUnsupported is returned when the kernel can't create the interfaces used by the egress gateway
+var errSteeringUnsupported = errors.New("dummy, veth or vxlan interfaces are not supported by the kernel")
+
+// steeringRuleTables returns the tables looked up by the routing rules of the provided interface
+func steeringRuleTables(iface string) ([]int, error) {
+	rules, err := egressGwRules()
+	if err != nil {
+		return nil, err
+	}
+	var tables []int
+	for _, rule := range rules {
+		if rule.IifName == iface {
+			tables = append(tables, rule.Table)
+		}
+	}
+	return tables, nil
+}
+
+// TestEgressGatewaySteering verifies the node side of the steering of a pod: its routing rule follows the gateway
+// node changes, the tables no more used are removed and the pod is restored without leftovers
+func TestEgressGatewaySteering(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating network namespaces and interfaces requires root privileges")
+	}
+	netns, err := testutils.NewNS()
+	if err != nil {
+		t.Fatalf("failed to create netns: %v", err)
+	}
+	defer func() {
+		netns.Close()
+		_ = testutils.UnmountNS(netns)
+	}()
+	nodeInfo := newTestNodeInfo()
+	nodeInfo.MTU = 1450
+	conf := newTestConf()
+	if err := netns.Do(func(ns.NetNS) error {
+		ext := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "eth0"}}
+		if err := netlink.LinkAdd(ext); err != nil {
+			return errSteeringUnsupported
+		}
+		if err := netlink.AddrAdd(ext, &netlink.Addr{IPNet: nodeInfo.extIface.IPNet}); err != nil {
+			return err
+		}
+		if err := netlink.LinkSetUp(ext); err != nil {
+			return err
+		}
+		link, err := netlink.LinkByName("eth0")
+		if err != nil {
+			return err
+		}
+		nodeInfo.extIface.Link = link
+		if err := CreateEgressGatewayIface(&EgressGatewayConf{VNI: 43, Port: 4790}, nodeInfo); err != nil {
+			return errSteeringUnsupported
+		}
+		return nil
+	}); err != nil {
+		t.Skip(err)
+	}
+
+	att := &attachment.Attachment{Name: "eth0_0123456789", IP: "10.10.1.5"}
+	host, _ := attachment.SteeringIfaceNames(att.Name)
+	gw1, gw2 := net.IPv4(192, 168, 1, 11).To4(), net.IPv4(192, 168, 1, 12).To4()
+	direct := []*net.IPNet{conf.vClusterCIDR, conf.serviceCIDR}
+	err = netns.Do(func(ns.NetNS) error {
+		if err := checkEgressGatewayBridgeIface(); err != nil {
+			return err
+		}
+		for _, gw := range []net.IP{gw1, gw2} {
+			if err := syncSteeringTable(gw, nodeInfo, direct); err != nil {
+				return fmt.Errorf("syncSteeringTable failed: %v", err)
+			}
+		}
+		// the steering is configured again by each full sync, so it must succeed on existing interfaces
+		for i := 0; i < 2; i++ {
+			if err := steerPod(att, gw1, nodeInfo); err != nil {
+				return fmt.Errorf("steerPod (run %d) failed: %v", i+1, err)
+			}
+		}
+		if !isSteered(att.Name) {
+			return errors.New("pod not steered after steerPod")
+		}
+		if err := steerPod(att, gw2, nodeInfo); err != nil {
+			return fmt.Errorf("steerPod towards the new gateway failed: %v", err)
+		}
+		tables, err := steeringRuleTables(host)
+		if err != nil {
+			return err
+		}
+		if len(tables) != 1 || tables[0] != egressGwTable(gw2) {
+			return fmt.Errorf("routing rules tables - required: [%d], found: %v", egressGwTable(gw2), tables)
+		}
+
+		if err := sweepSteering(map[string]bool{att.Name: true}, map[string]net.IP{gw2.String(): gw2}); err != nil {
+			return fmt.Errorf("sweepSteering failed: %v", err)
+		}
+		for table, count := range map[int]int{egressGwTable(gw1): 0, egressGwTable(gw2): len(direct) + 2} {
+			routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: table},
+				netlink.RT_FILTER_TABLE)
+			if err != nil {
+				return err
+			}
+			if len(routes) != count {
+				return fmt.Errorf("table %d routes - required: %d, found: %d", table, count, len(routes))
+			}
+		}
+
+		if err := unsteerPod(att); err != nil {
+			return fmt.Errorf("unsteerPod failed: %v", err)
+		}
+		if isSteered(att.Name) {
+			return errors.New("pod still steered after unsteerPod")
+		}
+		if tables, err = steeringRuleTables(host); err != nil || len(tables) != 0 {
+			return fmt.Errorf("routing rules left after unsteerPod: %v (%v)", tables, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
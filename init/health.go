@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ekoops/polykube-cni-plugin/utils"
+	"github.com/ekoops/polykube-cni-plugin/utils/polycube"
+	"github.com/vishvananda/netlink"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	healthStatusOK     = "ok"
+	healthStatusFailed = "failed"
+)
+
+// HealthCheck describes the outcome of a single health or readiness check
+type HealthCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// HealthReport is the body of the agent /healthz and /readyz responses
+type HealthReport struct {
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+// add records the outcome of a check: a nil error means that the check succeeded
+func (r *HealthReport) add(name string, err error) {
+	check := HealthCheck{Name: name, OK: err == nil}
+	if err != nil {
+		check.Detail = err.Error()
+	}
+	r.Checks = append(r.Checks, check)
+}
+
+// Failed returns true if at least one check failed
+func (r *HealthReport) Failed() bool {
+	for _, check := range r.Checks {
+		if !check.OK {
+			return true
+		}
+	}
+	return false
+}
+
+// write writes the report as JSON, using 503 as status code if at least one check failed
+func (r *HealthReport) write(w http.ResponseWriter) {
+	code := http.StatusOK
+	r.Status = healthStatusOK
+	if r.Failed() {
+		code = http.StatusServiceUnavailable
+		r.Status = healthStatusFailed
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(r)
+}
+
+// cubePort describes a cube port, independently of the cube kind
+type cubePort struct {
+	name   string
+	status string
+	peer   string
+}
+
+// expectedPort describes a port of the node cubes and the peer it must be connected to
+type expectedPort struct {
+	kind string
+	cube string
+	port string
+	peer string
+}
+
+// nodeCubesPorts returns the ports of the node cubes with their expected peers, as configured by ConnectCubes
+func nodeCubesPorts(conf *EnvConf, extIfaceName string) []expectedPort {
+	brName := conf.bridgeName
+	rName := conf.routerName
+	lbName := conf.lbrpName
+	kName := conf.k8sDispName
+	ports := []expectedPort{
+		{kind: "simplebridge", cube: brName, port: "to_r0", peer: utils.CreatePeer(rName, "to_br0")},
+		{kind: "router", cube: rName, port: "to_br0", peer: utils.CreatePeer(brName, "to_r0")},
+		{kind: "router", cube: rName, port: "to_lbrp0", peer: utils.CreatePeer(lbName, "to_r0")},
+		{kind: "lbrp", cube: lbName, port: "to_r0", peer: utils.CreatePeer(rName, "to_lbrp0")},
+		{kind: "lbrp", cube: lbName, port: "to_k0", peer: utils.CreatePeer(kName, "to_lbrp0")},
+		{kind: "k8sdispatcher", cube: kName, port: "to_lbrp0", peer: utils.CreatePeer(lbName, "to_k0")},
+		{kind: "k8sdispatcher", cube: kName, port: "to_int", peer: extIfaceName},
+	}
+	overlayPorts, _ := conf.overlay.RouterPorts()
+	for _, port := range overlayPorts {
+		ports = append(ports, expectedPort{kind: "router", cube: rName, port: port.Name, peer: port.Peer})
+	}
+	if conf.egress.Masquerade {
+		ports = append(ports, expectedPort{kind: "router", cube: rName, port: egressRouterPort, peer: egressRouterIfaceName})
+	}
+	if conf.egress.Gateway != nil {
+		ports = append(ports,
+			expectedPort{kind: "router", cube: rName, port: egressGwRouterPort, peer: egressGwIfaceName},
+			expectedPort{kind: "simplebridge", cube: brName, port: egressGwBridgePort, peer: egressGwBridgePeerName},
+		)
+	}
+	return ports
+}
+
+// readCubePorts retrieves the ports of the cube of the provided kind
+func readCubePorts(cubes *polycube.Cubes, kind, name string) ([]cubePort, error) {
+	var ports []cubePort
+	switch kind {
+	case "simplebridge":
+		br, err := cubes.Bridges.ReadBridge(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range br.Ports {
+			ports = append(ports, cubePort{name: p.Name, status: p.Status, peer: p.Peer})
+		}
+	case "router":
+		r, err := cubes.Routers.ReadRouter(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range r.Ports {
+			ports = append(ports, cubePort{name: p.Name, status: p.Status, peer: p.Peer})
+		}
+	case "lbrp":
+		lb, err := cubes.Lbrps.ReadLbrp(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range lb.Ports {
+			ports = append(ports, cubePort{name: p.Name, status: p.Status, peer: p.Peer})
+		}
+	case "k8sdispatcher":
+		k, err := cubes.Dispatchers.ReadDispatcher(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range k.Ports {
+			ports = append(ports, cubePort{name: p.Name, status: p.Status, peer: p.Peer})
+		}
+	default:
+		return nil, fmt.Errorf("unknown cube kind %q", kind)
+	}
+	return ports, nil
+}
+
+// checkCube verifies that the cube exists, that all its ports are UP and that the expected ports are connected to
+// the expected peers
+func checkCube(cubes *polycube.Cubes, kind, name string, expected []expectedPort) error {
+	ports, err := readCubePorts(cubes, kind, name)
+	if err != nil {
+		if polycube.IsNotFound(err) {
+			return fmt.Errorf("%s %q doesn't exist", kind, name)
+		}
+		return fmt.Errorf("failed to retrieve %s %q - %v", kind, name, err)
+	}
+	byName := make(map[string]cubePort, len(ports))
+	var problems []string
+	for _, p := range ports {
+		byName[p.name] = p
+		if p.status != "UP" {
+			problems = append(problems, fmt.Sprintf("port %q is %s", p.name, p.status))
+		}
+	}
+	for _, e := range expected {
+		p, ok := byName[e.port]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("port %q is missing", e.port))
+			continue
+		}
+		if p.peer != e.peer {
+			problems = append(problems, fmt.Sprintf("port %q peer - required: %q, found: %q", e.port, e.peer, p.peer))
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// checkVxlanIface verifies that the vxlan interface is configured as required, that it is up and that the VTEP
+// address is assigned to it
+func checkVxlanIface(name string, vxlanConf *VxlanConf, nodeInfo *NodeInfo) error {
+	vtepIPNet := nodeInfo.nodeVtepIPNet
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve %q interface: %v", name, err)
+	}
+	if mismatch := vxlanMismatch(link, newVxlanLink(name, vxlanConf, nodeInfo.MTU, nodeInfo.extIface)); mismatch != "" {
+		return fmt.Errorf("%q interface misconfigured: wrong %s", name, mismatch)
+	}
+	if mtu := link.Attrs().MTU; mtu != nodeInfo.MTU {
+		return fmt.Errorf("%q interface MTU - required: %d, found: %d", name, nodeInfo.MTU, mtu)
+	}
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		return fmt.Errorf("%q interface is down", name)
+	}
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve %q interface addresses: %v", name, err)
+	}
+	for _, addr := range addrs {
+		if addr.IPNet.String() == vtepIPNet.String() {
+			return nil
+		}
+	}
+	return fmt.Errorf("VTEP address %s is not assigned to %q interface", vtepIPNet, name)
+}
+
+// checkCNIConfFile verifies that the CNI configuration file content matches the desired one
+func checkCNIConfFile(conf *EnvConf, nodeInfo *NodeInfo) error {
+	desired, err := RenderCNIConf(conf, nodeInfo)
+	if err != nil {
+		return fmt.Errorf("failed to render desired cni config: %v", err)
+	}
+	current, err := ioutil.ReadFile(conf.CNIConfFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to read %q: %v", conf.CNIConfFilePath, err)
+	}
+	if !bytes.Equal(current, desired) {
+		return fmt.Errorf("%q content differs from the desired one", conf.CNIConfFilePath)
+	}
+	return nil
+}
+
+// Healthz returns the agent liveness report: the agent is alive as long as it is able to serve the request
+func (a *Agent) Healthz() *HealthReport {
+	report := &HealthReport{}
+	report.add("agent", nil)
+	return report
+}
+
+// Readyz returns the agent readiness report: the node is ready if the setup is completed, polycubed responds, the
+// node cubes, the overlay and, if enabled, the egress masquerade and gateway are correctly configured and the CNI configuration
+// file is up to date
+func (a *Agent) Readyz() *HealthReport {
+	report := &HealthReport{}
+	if !a.Ready() {
+		report.add("setup", errors.New("node setup not completed or agent stopping"))
+		return report
+	}
+	report.add("setup", nil)
+
+	// a 404 means that no bridge exists, but polycubed responded anyway
+	_, polycubeErr := a.cubes.Bridges.ListBridges()
+	if polycube.IsNotFound(polycubeErr) {
+		polycubeErr = nil
+	}
+	if polycubeErr != nil {
+		polycubeErr = fmt.Errorf("polycubed doesn't respond - %v", polycubeErr)
+	}
+	report.add("polycubed", polycubeErr)
+
+	ports := nodeCubesPorts(a.conf, a.nodeInfo.extIface.Link.Attrs().Name)
+	for _, c := range []struct{ kind, name string }{
+		{"simplebridge", a.conf.bridgeName},
+		{"router", a.conf.routerName},
+		{"lbrp", a.conf.lbrpName},
+		{"k8sdispatcher", a.conf.k8sDispName},
+	} {
+		var expected []expectedPort
+		for _, p := range ports {
+			if p.cube == c.name {
+				expected = append(expected, p)
+			}
+		}
+		name := fmt.Sprintf("%s/%s", c.kind, c.name)
+		if polycubeErr != nil {
+			// the cube is not read, since each request would be retried, delaying the response
+			report.add(name, errors.New("not checked: polycubed doesn't respond"))
+			continue
+		}
+		report.add(name, checkCube(a.cubes, c.kind, c.name, expected))
+	}
+
+	report.add("overlay/"+a.conf.overlay.Name(), a.conf.overlay.Check(a.nodeInfo))
+	if a.conf.egress.Masquerade {
+		egressErr := checkEgressIface(a.nodeInfo)
+		if egressErr == nil && polycubeErr == nil {
+			egressErr = checkEgressNat(a.cubes.Nats, a.conf, a.nodeInfo)
+		}
+		report.add("egress", egressErr)
+	}
+	if a.conf.egress.Gateway != nil {
+		gwErr := checkEgressGatewayIface(a.conf.egress.Gateway)
+		if gwErr == nil {
+			gwErr = checkEgressGatewayBridgeIface()
+		}
+		report.add("egress-gateway", gwErr)
+	}
+	report.add("cniconf", checkCNIConfFile(a.conf, a.nodeInfo))
+	return report
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ekoops/polykube-cni-plugin/utils/polycube"
+	router "github.com/ekoops/polykube-cni-plugin/utils/router"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"net"
+	"syscall"
+)
+
+const (
+	// ipipOverhead is the number of bytes added by the IP-in-IP encapsulation: the outer IPv4 header (20)
+	ipipOverhead = 20
+	// ipipRouterPort is the name of the router port connected to the IP-in-IP interface through the veth pair
+	ipipRouterPort      = "to_ipip0"
+	ipipHostIfaceName   = "pkipip0"
+	ipipRouterIfaceName = "pkipip0r"
+)
+
+// ipipVeth is the veth pair connecting the router to the node
+var ipipVeth = &overlayVeth{
+	kind:        overlayIPIP,
+	hostName:    ipipHostIfaceName,
+	routerName:  ipipRouterIfaceName,
+	port:        ipipRouterPort,
+	hostIPNet:   ipipHostIPNet,
+	routerIPNet: ipipRouterIPNet,
+}
+
+// ipipOverlay implements the IP-in-IP backend: a single node IP-in-IP interface without a remote endpoint
+// encapsulates the packets towards the address of the next hop of the route through which they are sent, so the node
+// has a route towards each peer node pods whose next hop is the peer node IP.
+// As the WireGuard one, an IP-in-IP interface has no link layer header, so the router is connected to the node through
+// a veth pair and the node forwards the packets between the veth pair and the IP-in-IP interface
+type ipipOverlay struct {
+	name string
+}
+
+// getIPIPOverlay returns the IP-in-IP backend configured through the NODE_IPIP_* environment variables
+func getIPIPOverlay() *ipipOverlay {
+	return &ipipOverlay{name: getEnv("NODE_IPIP_IFACE_NAME", "ipip0")}
+}
+
+func (o *ipipOverlay) Name() string {
+	return overlayIPIP
+}
+
+func (o *ipipOverlay) Overhead() int {
+	return ipipOverhead
+}
+
+// RouterPorts returns the router port connected to the veth pair and the static arp entry of the node side, since the
+// IP-in-IP interface is reached through the veth pair
+func (o *ipipOverlay) RouterPorts() ([]router.Ports, []router.ArpTable) {
+	return ipipVeth.routerPorts()
+}
+
+// Uninstall removes the IP-in-IP interface and the veth pair connecting it to the router
+func (o *ipipOverlay) Uninstall(report *UninstallReport) {
+	uninstallLink(o.name, report)
+	uninstallLink(ipipHostIfaceName, report)
+}
+
+// newLink returns the IP-in-IP interface of the node: it has no remote endpoint, so that it can reach every peer node
+func (o *ipipOverlay) newLink(nodeInfo *NodeInfo) *netlink.Iptun {
+	return &netlink.Iptun{
+		LinkAttrs: netlink.LinkAttrs{Name: o.name, MTU: nodeInfo.MTU},
+		Local:     nodeInfo.extIface.IPNet.IP,
+	}
+}
+
+// Setup creates the IP-in-IP interface and the veth pair connecting the router to the node
+func (o *ipipOverlay) Setup(nodeInfo *NodeInfo) error {
+	l := log.WithField("interface", o.name)
+
+	// creating the IP-in-IP interface (it could be already present if the program was restarted)
+	link_ := o.newLink(nodeInfo)
+	if err := netlink.LinkAdd(link_); err != nil && !errors.Is(err, syscall.EEXIST) {
+		l.WithField("detail", err).Error("failed to create the cluster node IP-in-IP interface")
+		return fmt.Errorf("failed to create the cluster node %q IP-in-IP interface: %v", o.name, err)
+	}
+	link, err := netlink.LinkByName(o.name)
+	if err != nil {
+		l.WithField("detail", err).Error("failed to retrieve the cluster node IP-in-IP interface")
+		return fmt.Errorf("failed to retrieve the cluster node %q IP-in-IP interface: %v", o.name, err)
+	}
+	// the local address can't be changed, so an interface bound to another address is recreated
+	if iptun, ok := link.(*netlink.Iptun); !ok || !iptun.Local.Equal(link_.Local) {
+		l.WithField("type", link.Type()).Warning("cluster node IP-in-IP interface misconfigured, recreating it")
+		if err := netlink.LinkDel(link); err != nil {
+			return fmt.Errorf("failed to delete the misconfigured cluster node %q IP-in-IP interface: %v", o.name, err)
+		}
+		if err := netlink.LinkAdd(link_); err != nil {
+			return fmt.Errorf("failed to create the cluster node %q IP-in-IP interface: %v", o.name, err)
+		}
+		if link, err = netlink.LinkByName(o.name); err != nil {
+			return fmt.Errorf("failed to retrieve the cluster node %q IP-in-IP interface: %v", o.name, err)
+		}
+	}
+	if link.Attrs().MTU != nodeInfo.MTU {
+		if err := netlink.LinkSetMTU(link, nodeInfo.MTU); err != nil {
+			l.WithField("detail", err).Error("failed to set the cluster node IP-in-IP interface MTU")
+			return fmt.Errorf("failed to set the cluster node %q IP-in-IP interface MTU to %d: %v", o.name, nodeInfo.MTU, err)
+		}
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		l.WithField("detail", err).Error("failed to set the cluster node IP-in-IP interface up")
+		return fmt.Errorf("failed to set the cluster node %q IP-in-IP interface up: %v", o.name, err)
+	}
+	l.Info("cluster node IP-in-IP interface configured")
+
+	return ipipVeth.create(nodeInfo)
+}
+
+// Check verifies that the IP-in-IP interface is up and bound to the node address, and that the veth pair connecting
+// the router is configured
+func (o *ipipOverlay) Check(nodeInfo *NodeInfo) error {
+	link, err := netlink.LinkByName(o.name)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve %q interface: %v", o.name, err)
+	}
+	iptun, ok := link.(*netlink.Iptun)
+	if !ok {
+		return fmt.Errorf("%q interface misconfigured: wrong type - required: %s, found: %s",
+			o.name, overlayIPIP, link.Type())
+	}
+	if local := nodeInfo.extIface.IPNet.IP; !iptun.Local.Equal(local) {
+		return fmt.Errorf("%q interface local address - required: %s, found: %s", o.name, local, iptun.Local)
+	}
+	if mtu := link.Attrs().MTU; mtu != nodeInfo.MTU {
+		return fmt.Errorf("%q interface MTU - required: %d, found: %d", o.name, nodeInfo.MTU, mtu)
+	}
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		return fmt.Errorf("%q interface is down", o.name)
+	}
+	return ipipVeth.check(nodeInfo)
+}
+
+// peerKernelRoutes returns the node routes towards the provided peer node pods and pods virtual addresses through the
+// IP-in-IP interface. The peer node IP is their next hop, so it is the destination of the encapsulated packets
+func (o *ipipOverlay) peerKernelRoutes(peer *PeerNode) ([]*netlink.Route, error) {
+	link, err := netlink.LinkByName(o.name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve the cluster node %q IP-in-IP interface: %v", o.name, err)
+	}
+	dsts := []*net.IPNet{peer.podCIDR}
+	for _, vIP := range peer.virtualIPs {
+		dsts = append(dsts, &net.IPNet{IP: vIP, Mask: net.CIDRMask(32, 32)})
+	}
+	routes := make([]*netlink.Route, 0, len(dsts))
+	for _, dst := range dsts {
+		routes = append(routes, &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       dst,
+			Gw:        peer.IP,
+			Flags:     int(netlink.FLAG_ONLINK),
+		})
+	}
+	return routes, nil
+}
+
+func (o *ipipOverlay) AddPeer(routers polycube.RouterManager, rName string, _ *NodeInfo, peer *PeerNode) error {
+	l := log.WithFields(log.Fields{
+		"interface": o.name,
+		"nodeIP":    peer.IP,
+	})
+	routes, err := o.peerKernelRoutes(peer)
+	if err != nil {
+		l.WithField("detail", err).Error("failed to retrieve the cluster node IP-in-IP interface")
+		return err
+	}
+	for _, route := range routes {
+		if err := netlink.RouteReplace(route); err != nil {
+			l.WithField("detail", err).Error("failed to set the route towards the new node pods")
+			return fmt.Errorf("failed to set route to %s via %q interface - %v", route.Dst, o.name, err)
+		}
+	}
+	if err := ipipVeth.setArpEntries(routers, rName); err != nil {
+		return err
+	}
+	l.Info("IP-in-IP routes towards the new node configured")
+	return nil
+}
+
+func (o *ipipOverlay) DelPeer(_ polycube.RouterManager, _ string, peer *PeerNode) error {
+	l := log.WithFields(log.Fields{
+		"interface": o.name,
+		"nodeIP":    peer.IP,
+	})
+	// without the interface, the routes were already removed with it
+	routes, err := o.peerKernelRoutes(peer)
+	if err != nil {
+		return nil
+	}
+	for _, route := range routes {
+		if err := netlink.RouteDel(route); err != nil && !errors.Is(err, syscall.ESRCH) {
+			l.WithField("detail", err).Error("failed to delete the route towards the removed node pods")
+			return fmt.Errorf("failed to delete route to %s via %q interface - %v", route.Dst, o.name, err)
+		}
+	}
+	l.Info("IP-in-IP routes towards the removed node deleted")
+	return nil
+}
+
+func (o *ipipOverlay) CheckPeer(r *router.Router, peer *PeerNode) error {
+	routes, err := o.peerKernelRoutes(peer)
+	if err != nil {
+		return err
+	}
+	link, err := netlink.LinkByName(o.name)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve %q interface: %v", o.name, err)
+	}
+	for _, route := range routes {
+		if !hasKernelRoute(link, route.Dst, peer.IP) {
+			return fmt.Errorf("route to %s via %q interface is missing", route.Dst, o.name)
+		}
+	}
+	_, entries := o.RouterPorts()
+	return checkArpEntries(r, entries)
+}
+
+func (o *ipipOverlay) PeerRoute(peer *PeerNode) router.Route {
+	return ipipVeth.peerRoute(peer)
+}
+
+func (o *ipipOverlay) IsPeerRoute(route router.Route) bool {
+	return route.Interface_ == ipipRouterPort
+}
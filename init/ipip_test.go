@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/ekoops/polykube-cni-plugin/test/fakepolycubed"
+	"github.com/ekoops/polykube-cni-plugin/utils/polycube"
+	"github.com/vishvananda/netlink"
+	"net"
+	"os"
+	"testing"
+)
+
+// errIPIPUnsupported is returned when the kernel can't create IP-in-IP interfaces
+var errIPIPUnsupported = errors.New("IP-in-IP interfaces are not supported by the kernel")
+
+// TestIPIPOverlay verifies the IP-in-IP overlay: the node setup, which must succeed again after a restart, and the
+// addition and removal of a peer node having a pod virtual address
+func TestIPIPOverlay(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating network namespaces and IP-in-IP interfaces requires root privileges")
+	}
+	netns, err := testutils.NewNS()
+	if err != nil {
+		t.Fatalf("failed to create netns: %v", err)
+	}
+	defer func() {
+		netns.Close()
+		_ = testutils.UnmountNS(netns)
+	}()
+	nodeInfo := newTestNodeInfo()
+	if err := netns.Do(func(ns.NetNS) error {
+		link := &netlink.Iptun{LinkAttrs: netlink.LinkAttrs{Name: "ipipprobe"}, Local: nodeInfo.extIface.IPNet.IP}
+		if err := netlink.LinkAdd(link); err != nil {
+			return errIPIPUnsupported
+		}
+		return netlink.LinkDel(link)
+	}); err != nil {
+		t.Skip(err)
+	}
+
+	srv := fakepolycubed.NewServer()
+	ts, url := srv.Start()
+	defer ts.Close()
+	cubes := polycube.NewCubes(url)
+	overlay := &ipipOverlay{name: "ipip0"}
+	conf := newTestConf()
+	conf.overlay = overlay
+	nodeInfo.MTU = 1480
+	_, podCIDR, _ := net.ParseCIDR("10.10.2.0/24")
+	peer := &PeerNode{
+		name:       "worker2",
+		IP:         net.IPv4(192, 168, 1, 11).To4(),
+		podCIDR:    podCIDR,
+		virtualIPs: []net.IP{net.IPv4(172, 16, 0, 5).To4()},
+	}
+
+	err = netns.Do(func(ns.NetNS) error {
+		ext := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "eth0"}}
+		if err := netlink.LinkAdd(ext); err != nil {
+			return err
+		}
+		if err := netlink.AddrAdd(ext, &netlink.Addr{IPNet: nodeInfo.extIface.IPNet}); err != nil {
+			return err
+		}
+		if err := netlink.LinkSetUp(ext); err != nil {
+			return err
+		}
+
+		if err := overlay.Check(nodeInfo); err == nil {
+			return errors.New("check succeeded without the IP-in-IP interface")
+		}
+		// the setup is performed again after a restart, so it must succeed on existing interfaces
+		for i := 0; i < 2; i++ {
+			if err := overlay.Setup(nodeInfo); err != nil {
+				return fmt.Errorf("setup (run %d) failed: %v", i+1, err)
+			}
+		}
+		if err := overlay.Check(nodeInfo); err != nil {
+			return fmt.Errorf("check failed after Setup: %v", err)
+		}
+		if err := CreateCubes(cubes, nodeInfo, conf); err != nil {
+			return fmt.Errorf("CreateCubes failed: %v", err)
+		}
+
+		if err := AddNode(overlay, cubes.Routers, conf.routerName, nodeInfo, peer); err != nil {
+			return fmt.Errorf("AddNode failed: %v", err)
+		}
+		r, err := cubes.Routers.ReadRouter(conf.routerName)
+		if err != nil {
+			return err
+		}
+		if err := overlay.CheckPeer(r, peer); err != nil {
+			return fmt.Errorf("CheckPeer failed: %v", err)
+		}
+		for _, route := range peerRoutes(overlay, peer) {
+			if !hasRoute(r, route) {
+				return fmt.Errorf("router route %+v is missing", route)
+			}
+		}
+
+		if err := DelNode(overlay, cubes.Routers, conf.routerName, peer); err != nil {
+			return fmt.Errorf("DelNode failed: %v", err)
+		}
+		link, err := netlink.LinkByName(overlay.name)
+		if err != nil {
+			return err
+		}
+		if hasKernelRoute(link, peer.podCIDR, peer.IP) {
+			return fmt.Errorf("route to %s still present after DelNode", peer.podCIDR)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
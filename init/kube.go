@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/ekoops/polykube-cni-plugin/utils"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"os"
+)
+
+const (
+	defaultKubeAPIQPS    = 5
+	defaultKubeAPIBurst  = 10
+	defaultKubeUserAgent = "polykube-init"
+	pluginKubeconfigMode = 0600
+)
+
+// KubeConf describes how the Kubernetes API server has to be reached
+type KubeConf struct {
+	kubeconfig string
+	qps        float64
+	burst      int
+	userAgent  string
+}
+
+// RegisterKubeFlags registers on the provided flag set the flags needed to fill the returned KubeConf. The
+// kubeconfig path defaults to the content of the KUBECONFIG env variable
+func RegisterKubeFlags(fs *flag.FlagSet) *KubeConf {
+	conf := &KubeConf{}
+	fs.StringVar(&conf.kubeconfig, "kubeconfig", os.Getenv("KUBECONFIG"),
+		"path to a kubeconfig file; if empty, the in-cluster configuration is used")
+	fs.Float64Var(&conf.qps, "kube-api-qps", defaultKubeAPIQPS, "QPS to use while talking with the API server")
+	fs.IntVar(&conf.burst, "kube-api-burst", defaultKubeAPIBurst, "burst to use while talking with the API server")
+	fs.StringVar(&conf.userAgent, "user-agent", defaultKubeUserAgent, "user agent used while talking with the API server")
+	return conf
+}
+
+// BuildKubeConfig returns the configuration for reaching the API server. If a kubeconfig path is provided it is used,
+// otherwise the in-cluster configuration is built from the pod service account
+func BuildKubeConfig(conf *KubeConf) (*rest.Config, error) {
+	l := log.WithField("kubeconfig", conf.kubeconfig)
+	var config *rest.Config
+	var err error
+	if conf.kubeconfig != "" {
+		config, err = clientcmd.BuildConfigFromFlags("", conf.kubeconfig)
+	} else {
+		config, err = rest.InClusterConfig()
+		if err == rest.ErrNotInCluster {
+			err = fmt.Errorf("%v: a kubeconfig must be provided through the KUBECONFIG env variable or the --kubeconfig flag", err)
+		}
+	}
+	if err != nil {
+		l.WithField("detail", err).Error("failed to build client config")
+		return nil, fmt.Errorf("failed to build client config: %v", err)
+	}
+	config.QPS = float32(conf.qps)
+	config.Burst = conf.burst
+	config.UserAgent = conf.userAgent
+	l.WithField("host", config.Host).Info("client config built")
+	return config, nil
+}
+
+// NewClientset creates a clientset for the provided configuration
+func NewClientset(config *rest.Config) (*kubernetes.Clientset, error) {
+	cs, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		log.WithField("detail", err).Error("failed to create clientset")
+		return nil, fmt.Errorf("failed to create clientset: %v", err)
+	}
+	return cs, nil
+}
+
+// readFileOrData returns data if it is not empty, otherwise it returns the content of the provided file (if any)
+func readFileOrData(data []byte, file string) ([]byte, error) {
+	if len(data) > 0 || file == "" {
+		return data, nil
+	}
+	return ioutil.ReadFile(file)
+}
+
+// readFileOrToken returns the content of the provided token file if any, otherwise it returns the static token. The
+// file is preferred since it is the projected service account token, which is periodically rotated by the kubelet
+func readFileOrToken(token string, file string) ([]byte, error) {
+	if file == "" {
+		return []byte(token), nil
+	}
+	return ioutil.ReadFile(file)
+}
+
+// writeFileIfChanged atomically writes content at the provided path, unless the file already has that content. It
+// returns whether the file was written
+func writeFileIfChanged(path string, content []byte, perm os.FileMode) (bool, error) {
+	if current, err := ioutil.ReadFile(path); err == nil && bytes.Equal(current, content) {
+		return false, nil
+	}
+	// writing atomically, so that the plugin never reads a partially written file
+	return true, utils.WriteFileAtomic(path, content, perm)
+}
+
+// WritePluginKubeconfig writes at the provided path a kubeconfig that can be used by the CNI plugin to reach the API
+// server with the same identity of this program. Since the plugin runs in the host filesystem, certificates are
+// embedded instead of being referenced through their (container) path. The token instead is mirrored in the file at
+// tokenPath, which is referenced by the kubeconfig: since it is rewritten whenever the projected token is rotated,
+// the plugin always reads a valid token
+func WritePluginKubeconfig(path string, tokenPath string, config *rest.Config) error {
+	l := log.WithFields(log.Fields{
+		"path":      path,
+		"tokenPath": tokenPath,
+	})
+
+	ca, err := readFileOrData(config.CAData, config.CAFile)
+	if err != nil {
+		l.WithField("detail", err).Error("failed to read API server CA")
+		return fmt.Errorf("failed to read API server CA: %v", err)
+	}
+	token, err := readFileOrToken(config.BearerToken, config.BearerTokenFile)
+	if err != nil {
+		l.WithField("detail", err).Error("failed to read API server token")
+		return fmt.Errorf("failed to read API server token: %v", err)
+	}
+	cert, err := readFileOrData(config.CertData, config.CertFile)
+	if err != nil {
+		l.WithField("detail", err).Error("failed to read client certificate")
+		return fmt.Errorf("failed to read client certificate: %v", err)
+	}
+	key, err := readFileOrData(config.KeyData, config.KeyFile)
+	if err != nil {
+		l.WithField("detail", err).Error("failed to read client key")
+		return fmt.Errorf("failed to read client key: %v", err)
+	}
+
+	// the token is written before the kubeconfig referencing it
+	tokenFile := ""
+	if len(token) > 0 {
+		written, err := writeFileIfChanged(tokenPath, token, pluginKubeconfigMode)
+		if err != nil {
+			l.WithField("detail", err).Error("failed to write plugin token")
+			return fmt.Errorf("failed to write plugin token in %q: %v", tokenPath, err)
+		}
+		if written {
+			l.Info("plugin token written")
+		}
+		tokenFile = tokenPath
+	}
+
+	kubeconfig := clientcmdapi.NewConfig()
+	kubeconfig.Clusters["polykube"] = &clientcmdapi.Cluster{
+		Server:                   config.Host,
+		CertificateAuthorityData: ca,
+		InsecureSkipTLSVerify:    config.Insecure,
+	}
+	kubeconfig.AuthInfos["polykube"] = &clientcmdapi.AuthInfo{
+		TokenFile:             tokenFile,
+		ClientCertificateData: cert,
+		ClientKeyData:         key,
+	}
+	kubeconfig.Contexts["polykube"] = &clientcmdapi.Context{
+		Cluster:  "polykube",
+		AuthInfo: "polykube",
+	}
+	kubeconfig.CurrentContext = "polykube"
+
+	content, err := clientcmd.Write(*kubeconfig)
+	if err != nil {
+		l.WithField("detail", err).Error("failed to encode plugin kubeconfig")
+		return fmt.Errorf("failed to encode plugin kubeconfig: %v", err)
+	}
+	written, err := writeFileIfChanged(path, content, pluginKubeconfigMode)
+	if err != nil {
+		l.WithField("detail", err).Error("failed to write plugin kubeconfig")
+		return fmt.Errorf("failed to write plugin kubeconfig in %q: %v", path, err)
+	}
+	if written {
+		l.Info("plugin kubeconfig written")
+	}
+	return nil
+}
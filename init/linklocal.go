@@ -0,0 +1,29 @@
+package main
+
+import "net"
+
+// The router is connected to the node through interfaces addressed in the IPv4 link-local range, which is never
+// assigned to the pods nor to the nodes. Each connection has its own /30 block, so that the router ports never
+// overlap, whichever combination of features is enabled: any new connection must take a new block from here
+var (
+	// egressHostIPNet is the address of the host side of the egress veth pair
+	egressHostIPNet = linkLocalIPNet(42, 1)
+	// egressRouterIPNet is the address of the router port connected to the egress veth pair
+	egressRouterIPNet = linkLocalIPNet(42, 2)
+	// wireguardHostIPNet is the address of the host side of the WireGuard veth pair
+	wireguardHostIPNet = linkLocalIPNet(43, 1)
+	// wireguardRouterIPNet is the address of the router port connected to the WireGuard veth pair
+	wireguardRouterIPNet = linkLocalIPNet(43, 2)
+	// egressGwHopIPNet is the address of the router port connected to the node-wide egress gateway vxlan interface.
+	// The pods netns route their steered traffic through it
+	egressGwHopIPNet = linkLocalIPNet(44, 1)
+	// ipipHostIPNet is the address of the host side of the IP-in-IP veth pair
+	ipipHostIPNet = linkLocalIPNet(45, 1)
+	// ipipRouterIPNet is the address of the router port connected to the IP-in-IP veth pair
+	ipipRouterIPNet = linkLocalIPNet(45, 2)
+)
+
+// linkLocalIPNet returns the address 169.254.block.host in a /30 network
+func linkLocalIPNet(block, host byte) *net.IPNet {
+	return &net.IPNet{IP: net.IPv4(169, 254, block, host).To4(), Mask: net.CIDRMask(30, 32)}
+}
@@ -2,130 +2,109 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"flag"
+	"github.com/ekoops/polykube-cni-plugin/utils"
+	"github.com/ekoops/polykube-cni-plugin/utils/metrics"
+	"github.com/ekoops/polykube-cni-plugin/utils/polycube"
 	log "github.com/sirupsen/logrus"
-	"io/ioutil"
-	v1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/tools/clientcmd"
-	"net"
 	"os"
+	"os/signal"
 	"runtime"
-	"strings"
-)
-
-const (
-	//kubeconfig = "/var/lib/pcn_k8s/kubeconfig.conf"
-	kubeconfig = "/home/ubuntu/.kube/config"
+	"syscall"
 )
 
 var (
-	clientset        *kubernetes.Clientset
+	clientset kubernetes.Interface
 )
 
 func init() {
-	log.SetLevel(log.DebugLevel)
-	// TODO change log file position
-	file, err := os.OpenFile("polykube.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	logConf, err := GetLogConf()
 	if err == nil {
-		log.SetOutput(file)
-	} else {
-		// TODO what I have to do in this case? Discard?
-		fmt.Println("NO LOG")
-		log.SetOutput(ioutil.Discard)
+		err = utils.SetupLogger(logConf)
+	}
+	if err != nil {
+		// the standard logger keeps writing on stderr, so the failure is still visible through the container logs
+		log.WithField("detail", err).Error("failed to configure the logger")
 	}
 
 	// this ensures that main runs only on main thread (thread group leader).
 	// since namespace ops (unshare, setns) are done for a single thread, we
 	// must ensure that the goroutine does not jump from OS thread to thread
 	runtime.LockOSThread()
+}
 
-	// use the current context in kubeconfig
-	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
-	if err != nil {
-		log.WithField("detail", err).Fatal("failed to build config")
-		panic(fmt.Sprintf("failed to build config: %v", err))
+func main() {
+	if len(os.Args) > 1 && (os.Args[1] == "uninstall" || os.Args[1] == "reset") {
+		os.Exit(uninstall(os.Args[2:]))
 	}
 
-	//// creates the in-cluster config
-	//config, err := rest.InClusterConfig()
-	//checkError("create k8s client", err)
-
-	// creates the clientset
-	clientset, err = kubernetes.NewForConfig(config)
-	if err != nil {
-		log.WithField("detail", err).Fatal("failed to create clientset")
-		panic(fmt.Sprintf("failed to create clientset: %v", err))
+	kubeConf := RegisterKubeFlags(flag.CommandLine)
+	agentConf := RegisterAgentFlags(flag.CommandLine)
+	flag.Parse()
 
+	if err := run(kubeConf, agentConf); err != nil {
+		log.WithField("detail", err).Error("polykube agent failed")
+		os.Exit(1)
 	}
 }
 
-func addOtherNodes(conf *EnvConf) error {
-	nodes, err := clientset.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{})
-	if err != nil {
-		log.WithFields(log.Fields{
-			"detail": err,
-		}).Fatal("failed to retrieve cluster nodes info")
-		return fmt.Errorf("failed to retrieve cluster nodes info: %v", err)
-	}
-	for _, node := range nodes.Items {
-		if strings.HasPrefix(node.Name, "worker") && node.Name != conf.nodeName {
-			var nodeIP net.IP
-			for _, addr := range node.Status.Addresses {
-				if addr.Type == v1.NodeInternalIP {
-					nodeIP = net.ParseIP(addr.Address)
-					break
-				}
-			}
-			_, nodePodCIDR, err := net.ParseCIDR(node.Spec.PodCIDR)
-			if err != nil {
-				log.WithFields(log.Fields{
-					"detail": err,
-				}).Fatal("failed to parse cluster node podCIDR")
-				return fmt.Errorf("failed to retrieve %q cluster node podCIDR: %v", node.Name, err)
-			}
-			nodeVtepIPNet, err := CalcNodeVtepIPNet(&node, conf.vtepCIDR)
-			if err != nil {
-				return fmt.Errorf("failed to add %q cluster node podCIDR: %v", node.Name, err)
-			}
-			if err := AddNode(conf.vxlanIfName, nodeIP, nodePodCIDR, nodeVtepIPNet.IP); err != nil {
-				return fmt.Errorf("failed to add %q cluster node podCIDR: %v", node.Name, err)
-			}
-		}
-	}
-	return nil
-}
+// uninstall removes polykube from the node, printing a report of the removed resources. It returns the program exit
+// code
+func uninstall(args []string) int {
+	fs := flag.NewFlagSet("uninstall", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only list the resources that would be removed")
+	_ = fs.Parse(args)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-func main() {
 	conf, err := GetEnvConf()
 	if err != nil {
-		panic(err)
+		log.WithField("detail", err).Error("polykube uninstall failed")
+		return 1
 	}
-	nodeInfo, err := BuildNodeInfo(conf)
-	if err != nil {
-		panic(err)
+	cubes := polycube.NewCubesWithConf(&polycube.Conf{
+		BasePath: conf.polycubeURL,
+		Retry:    polycube.DefaultRetryConf,
+		Context:  ctx,
+	})
+	report := Uninstall(cubes, conf, *dryRun)
+	report.Print(os.Stdout)
+	if report.Failed() {
+		return 1
 	}
+	return 0
+}
+
+// run performs the node setup and then runs the agent until a termination signal is received
+func run(kubeConf *KubeConf, agentConf *AgentConf) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	_, err = CreateNodeVxlanIface(conf.vxlanIfName, nodeInfo.extIface, nodeInfo.nodeVtepIPNet)
+	config, err := BuildKubeConfig(kubeConf)
 	if err != nil {
-		panic(err)
+		return err
 	}
-
-	if err := CreateCubes(nodeInfo, conf); err != nil {
-		panic(err)
+	if clientset, err = NewClientset(config); err != nil {
+		return err
 	}
-
-	podGwMAC, err := GetNodePodDefaultGatewayMAC(conf)
+	conf, err := GetEnvConf()
 	if err != nil {
-		panic(err)
+		return err
 	}
-	nodeInfo.podGwInfo.MAC = podGwMAC
 
-	if err := CreateCNIConfFile(conf, nodeInfo); err != nil {
-		panic(err)
+	m := NewMetrics()
+	cubes := polycube.NewCubesWithConf(&polycube.Conf{
+		BasePath:   conf.polycubeURL,
+		Retry:      polycube.DefaultRetryConf,
+		HTTPClient: metrics.NewInstrumentedClient(m),
+		// the pending calls are interrupted as soon as the agent is requested to stop
+		Context: ctx,
+	})
+	agent := NewAgent(conf, agentConf, config, cubes, m)
+	if err := agent.Setup(); err != nil {
+		return err
 	}
-	if err := addOtherNodes(conf); err != nil {
-		panic(err)
-	}
-}
\ No newline at end of file
+	return agent.Run(ctx)
+}
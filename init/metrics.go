@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/ekoops/polykube-cni-plugin/utils/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	metricsNamespace = "polykube"
+	// reportReadTimeout bounds the time spent reading a report pushed by the plugin
+	reportReadTimeout = time.Second
+)
+
+// Metrics contains the collectors of the metrics exposed by the agent
+type Metrics struct {
+	registry          *prometheus.Registry
+	operations        *prometheus.CounterVec
+	operationDuration *prometheus.HistogramVec
+	stepDuration      *prometheus.HistogramVec
+	requests          *prometheus.CounterVec
+	requestDuration   *prometheus.HistogramVec
+	reconciliations   *prometheus.CounterVec
+	repairs           *prometheus.CounterVec
+}
+
+// NewMetrics creates the agent metrics, registering them on a dedicated registry
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "cni",
+			Name:      "operations_total",
+			Help:      "Number of CNI operations performed by the plugin, by operation and outcome.",
+		}, []string{"op", "outcome"}),
+		operationDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "cni",
+			Name:      "operation_duration_seconds",
+			Help:      "Duration of the CNI operations performed by the plugin.",
+			Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+		}, []string{"op", "outcome"}),
+		stepDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "cni",
+			Name:      "step_duration_seconds",
+			Help:      "Duration of the steps (ipam, veth, lbrp, bridge, ...) of the CNI operations performed by the plugin.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+		}, []string{"op", "step", "outcome"}),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "polycube",
+			Name:      "requests_total",
+			Help:      "Number of polycube API requests, by component, service, method, endpoint and status code.",
+		}, []string{"component", "service", "method", "endpoint", "code"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "polycube",
+			Name:      "request_duration_seconds",
+			Help:      "Duration of the polycube API requests, by component, service, method and endpoint.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+		}, []string{"component", "service", "method", "endpoint"}),
+		reconciliations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "reconciler",
+			Name:      "runs_total",
+			Help:      "Number of node topology reconciliations, by outcome.",
+		}, []string{"outcome"}),
+		repairs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "reconciler",
+			Name:      "repairs_total",
+			Help:      "Number of node topology drifts repaired by the reconciler, by kind of repaired resource.",
+		}, []string{"resource"}),
+	}
+	m.registry.MustRegister(
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		prometheus.NewGoCollector(),
+		m.operations,
+		m.operationDuration,
+		m.stepDuration,
+		m.requests,
+		m.requestDuration,
+		m.reconciliations,
+		m.repairs,
+	)
+	return m
+}
+
+// Handler returns the handler of the /metrics endpoint
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func (m *Metrics) observeRequest(component string, r metrics.Request) {
+	m.requests.WithLabelValues(component, r.Service, r.Method, r.Endpoint, r.Code).Inc()
+	m.requestDuration.WithLabelValues(component, r.Service, r.Method, r.Endpoint).Observe(r.Duration)
+}
+
+// ObserveRequest implements the metrics.RequestObserver interface for the requests performed by the agent
+func (m *Metrics) ObserveRequest(r metrics.Request) {
+	m.observeRequest("agent", r)
+}
+
+// ObserveReport records the content of a report pushed by the plugin
+func (m *Metrics) ObserveReport(r *metrics.Report) {
+	m.operations.WithLabelValues(r.Op, r.Outcome).Inc()
+	m.operationDuration.WithLabelValues(r.Op, r.Outcome).Observe(r.Duration)
+	for _, step := range r.Steps {
+		m.stepDuration.WithLabelValues(r.Op, step.Name, step.Outcome).Observe(step.Duration)
+	}
+	for _, req := range r.Requests {
+		m.observeRequest("plugin", req)
+	}
+}
+
+// ObserveReconciliation records the outcome of a node topology reconciliation
+func (m *Metrics) ObserveReconciliation(err error) {
+	outcome := metrics.OutcomeSuccess
+	if err != nil {
+		outcome = metrics.OutcomeFailure
+	}
+	m.reconciliations.WithLabelValues(outcome).Inc()
+}
+
+// ObserveRepair records the repair of a node topology resource
+func (m *Metrics) ObserveRepair(resource string) {
+	m.repairs.WithLabelValues(resource).Inc()
+}
+
+// ReportReceiver collects the reports pushed by the plugin, both through the unix socket and through the spool file
+type ReportReceiver struct {
+	conf    *metrics.PushConf
+	metrics *Metrics
+}
+
+// NewReportReceiver returns a receiver recording the received reports into the provided metrics
+func NewReportReceiver(conf *metrics.PushConf, m *Metrics) *ReportReceiver {
+	return &ReportReceiver{conf: conf, metrics: m}
+}
+
+// Run listens for reports on the unix socket, periodically draining the spool file, until the provided context is
+// done
+func (r *ReportReceiver) Run(ctx context.Context, spoolPeriod time.Duration) error {
+	l := log.WithField("socket", r.conf.Socket)
+	if err := os.MkdirAll(filepath.Dir(r.conf.Socket), 0755); err != nil {
+		l.WithField("detail", err).Error("failed to create metrics socket directory")
+		return err
+	}
+	// a socket file left by a previous run would make listening fail
+	if err := os.Remove(r.conf.Socket); err != nil && !errors.Is(err, os.ErrNotExist) {
+		l.WithField("detail", err).Error("failed to remove stale metrics socket")
+		return err
+	}
+	listener, err := net.Listen("unix", r.conf.Socket)
+	if err != nil {
+		l.WithField("detail", err).Error("failed to listen on metrics socket")
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	go func() {
+		ticker := time.NewTicker(spoolPeriod)
+		defer ticker.Stop()
+		for {
+			r.drainSpool()
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			l.WithField("detail", err).Error("failed to accept metrics socket connection")
+			return err
+		}
+		go r.handle(conn)
+	}
+}
+
+func (r *ReportReceiver) handle(conn net.Conn) {
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(reportReadTimeout))
+	report := &metrics.Report{}
+	if err := json.NewDecoder(conn).Decode(report); err != nil {
+		log.WithField("detail", err).Warning("failed to decode pushed report")
+		return
+	}
+	r.metrics.ObserveReport(report)
+}
+
+// drainSpool records the reports contained in the spool file and removes them. The file is renamed before reading
+// it, so that the reports appended in the meanwhile are not lost
+func (r *ReportReceiver) drainSpool() {
+	if r.conf.Spool == "" {
+		return
+	}
+	l := log.WithField("spool", r.conf.Spool)
+	draining := r.conf.Spool + ".draining"
+	if err := os.Rename(r.conf.Spool, draining); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			l.WithField("detail", err).Warning("failed to rename metrics spool file")
+		}
+		return
+	}
+	defer os.Remove(draining)
+
+	f, err := os.Open(draining)
+	if err != nil {
+		l.WithField("detail", err).Warning("failed to open metrics spool file")
+		return
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	count := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			report := &metrics.Report{}
+			if decodeErr := json.Unmarshal(line, report); decodeErr == nil {
+				r.metrics.ObserveReport(report)
+				count++
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			l.WithField("detail", err).Warning("failed to read metrics spool file")
+			break
+		}
+	}
+	l.WithField("reports", count).Info("metrics spool file drained")
+}
@@ -5,15 +5,15 @@ import (
 	"errors"
 	"fmt"
 	"github.com/containernetworking/plugins/pkg/ip"
-	router "github.com/ekoops/polykube-cni-plugin/utils/router"
+	"github.com/ekoops/polykube-cni-plugin/utils/polycube"
 	log "github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"net"
-	"net/url"
 	"strconv"
 	"strings"
+	"syscall"
 )
 
 
@@ -22,7 +22,7 @@ func GetNode(name string) (*v1.Node, error) {
 	l := log.WithField("node", name)
 	node, err := clientset.CoreV1().Nodes().Get(context.TODO(), name, metav1.GetOptions{})
 	if err != nil {
-		l.WithField("detail", err).Fatal("failed to retrieve cluster node info")
+		l.WithField("detail", err).Error("failed to retrieve cluster node info")
 		return nil, fmt.Errorf("failed to retrieve the %q cluster node info: %v", name, err)
 	}
 	l.Info("cluster node info retrieved")
@@ -34,7 +34,7 @@ func ParseNodePodCIDR(node *v1.Node) (*net.IPNet, error) {
 	l := log.WithField("node", node.Name)
 	_, podCIDR, err := net.ParseCIDR(node.Spec.PodCIDR)
 	if err != nil {
-		l.WithField("detail", err).Fatal("failed to parse cluster node Pod CIDR")
+		l.WithField("detail", err).Error("failed to parse cluster node Pod CIDR")
 		return nil, fmt.Errorf("failed to parse %q cluster node Pod CIDR: %v", node.Name, err)
 	}
 	// making sure that the pods CIDR is IPv4
@@ -42,7 +42,7 @@ func ParseNodePodCIDR(node *v1.Node) (*net.IPNet, error) {
 	if podCIDR.IP == nil {
 		l.WithField(
 			"detail", "unsupported IPv6 Pod CIDR",
-		).Fatal("failed to parse cluster node Pod CIDR")
+		).Error("failed to parse cluster node Pod CIDR")
 		return nil, fmt.Errorf("failed to parse %q cluster node Pod CIDR: unsupported IPv6 Pod CIDR", node.Name)
 	}
 	l.WithField("podCIDR", podCIDR).Info("parsed cluster node Pod CIDR")
@@ -76,8 +76,8 @@ func CalcNodePodDefaultGateway(podCIDR *net.IPNet) (*GwInfo, error) {
 }
 
 // GetNodePodDefaultGatewayMAC returns the pods default gateway MAC obtained by querying the polycube infrastructure
-func GetNodePodDefaultGatewayMAC(conf *EnvConf) (net.HardwareAddr, error) {
-	r, err := GetRouter(conf.routerName)
+func GetNodePodDefaultGatewayMAC(routers polycube.RouterManager, conf *EnvConf) (net.HardwareAddr, error) {
+	r, err := GetRouter(routers, conf.routerName)
 	if err != nil {
 		return nil, err
 	}
@@ -90,7 +90,7 @@ func GetNodePodDefaultGatewayMAC(conf *EnvConf) (net.HardwareAddr, error) {
 		if port.Name == "to_br0" {
 			routerMAC, err = net.ParseMAC(port.Mac)
 			if err != nil {
-				l.WithField("detail", err).Fatal("failed to parse cluster node pod default gateway mac")
+				l.WithField("detail", err).Error("failed to parse cluster node pod default gateway mac")
 				return nil, fmt.Errorf("failed to parse %q cluster node pod %q default gateway mac: %v", conf.nodeName, conf.routerName, err)
 			}
 			l.WithField("MAC", routerMAC).Info("cluster node pod default gateway mac retrieved")
@@ -100,7 +100,7 @@ func GetNodePodDefaultGatewayMAC(conf *EnvConf) (net.HardwareAddr, error) {
 	l.WithFields(log.Fields{
 		"port":   "to_br0",
 		"detail": "port not found",
-	}).Fatal("failed to retrieve cluster node pod default gateway mac")
+	}).Error("failed to retrieve cluster node pod default gateway mac")
 	return nil, fmt.Errorf(
 		"failed to retrieve %q cluster node pod %q default gateway mac: %q port not found",
 		conf.nodeName, conf.routerName, "to_br0",
@@ -119,14 +119,14 @@ func GetNodeExtIface(node *v1.Node) (*Iface, error) {
 		}
 	}
 	if extIfaceIP == nil {
-		l.Fatal("failed to parse cluster node external interface IP")
+		l.Error("failed to parse cluster node external interface IP")
 		return nil, fmt.Errorf("failed to parse %q cluster node external interface IP", node.Name)
 	}
 
 	// retrieving the interfaces list
 	links, err := netlink.LinkList()
 	if err != nil {
-		l.Fatal("failed to retrieve cluster node interfaces list")
+		l.Error("failed to retrieve cluster node interfaces list")
 		return nil, fmt.Errorf("failed to retrieve %q cluster node interfaces list: %v", node.Name, err)
 	}
 
@@ -136,7 +136,7 @@ func GetNodeExtIface(node *v1.Node) (*Iface, error) {
 		linkLog := l.WithField("interface", linkName)
 		addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
 		if err != nil {
-			linkLog.Fatal("failed to retrieve addresses list for node interface")
+			linkLog.Error("failed to retrieve addresses list for node interface")
 			return nil, fmt.Errorf(
 				"failed to retrieve addresses list for %q cluster node %q interface: %v", node.Name, linkName, err,
 			)
@@ -156,7 +156,7 @@ func GetNodeExtIface(node *v1.Node) (*Iface, error) {
 			}
 		}
 	}
-	l.Fatal("failed to retrieve cluster node external interface info")
+	l.Error("failed to retrieve cluster node external interface info")
 	return nil, fmt.Errorf("failed to retrieve %q cluster node external interface info", node.Name)
 }
 
@@ -169,7 +169,7 @@ func CalcNodeVtepIPNet(node *v1.Node, vtepCIDR *net.IPNet) (*net.IPNet, error) {
 	// TODO this is a temporary solution
 	n, err := strconv.Atoi(strings.TrimPrefix(node.Name, "worker"))
 	if err != nil {
-		l.WithField("detail", err).Fatal("failed to extract cluster node number for Vtep IP evaluation")
+		l.WithField("detail", err).Error("failed to extract cluster node number for Vtep IP evaluation")
 		return nil, fmt.Errorf("failed to extract %q cluster node number for Vtep IP evaluation: %v", node.Name, err)
 	}
 	nodeVtepIP := vtepCIDR.IP
@@ -184,35 +184,57 @@ func CalcNodeVtepIPNet(node *v1.Node, vtepCIDR *net.IPNet) (*net.IPNet, error) {
 	return nodeVtepIPNet, nil
 }
 
-// CreateNodeVxlanIface creates a vxlan interface on the node associating it with the node external interface
-func CreateNodeVxlanIface(name string, extIface *Iface, vtepIPNet *net.IPNet) (*Iface, error) {
+// CreateNodeVxlanIface creates a vxlan interface on the node associating it with the node external interface. An
+// existing interface whose parameters differ from the configured ones is recreated
+func CreateNodeVxlanIface(name string, vxlanConf *VxlanConf, mtu int, extIface *Iface, vtepIPNet *net.IPNet) (*Iface, error) {
 	l := log.WithField("interface", name)
-	extIfaceIndex := extIface.Link.Attrs().Index
 	// defining the vxlan interface properties
-	link_ := &netlink.Vxlan{
-		LinkAttrs:    netlink.LinkAttrs{Name: name},
-		VxlanId:      42,            // TODO mocked
-		VtepDevIndex: extIfaceIndex, // TODO this is the index of the associated link?
-		Port:         4789,
-	}
+	link_ := newVxlanLink(name, vxlanConf, mtu, extIface)
 
-	// creating the vxlan interface
-	if err := netlink.LinkAdd(link_); err != nil {
-		l.WithField("detail", err).Fatal("failed to create the cluster node vxlan interface")
+	// creating the vxlan interface (it could be already present if the program was restarted)
+	if err := netlink.LinkAdd(link_); err != nil && !errors.Is(err, syscall.EEXIST) {
+		l.WithField("detail", err).Error("failed to create the cluster node vxlan interface")
 		return nil, fmt.Errorf("failed to create the cluster node %q vxlan interface: %v", name, err)
 	}
 
 	// retrieving the vxlan interface
-	// TODO is it really necessary?
 	link, err := netlink.LinkByName(name)
 	if err != nil {
-		l.WithField("detail", err).Fatal("failed to retrieve the cluster node vxlan interface")
+		l.WithField("detail", err).Error("failed to retrieve the cluster node vxlan interface")
 		return nil, fmt.Errorf("failed to retrieve the cluster node %q vxlan interface: %v", name, err)
 	}
 
+	// recreating the vxlan interface if it was created with different parameters
+	if mismatch := vxlanMismatch(link, link_); mismatch != "" {
+		l.WithField("mismatch", mismatch).Warning("cluster node vxlan interface misconfigured, recreating it")
+		if err := netlink.LinkDel(link); err != nil {
+			l.WithField("detail", err).Error("failed to delete the misconfigured cluster node vxlan interface")
+			return nil, fmt.Errorf("failed to delete the misconfigured cluster node %q vxlan interface: %v", name, err)
+		}
+		if err := netlink.LinkAdd(link_); err != nil {
+			l.WithField("detail", err).Error("failed to create the cluster node vxlan interface")
+			return nil, fmt.Errorf("failed to create the cluster node %q vxlan interface: %v", name, err)
+		}
+		if link, err = netlink.LinkByName(name); err != nil {
+			l.WithField("detail", err).Error("failed to retrieve the cluster node vxlan interface")
+			return nil, fmt.Errorf("failed to retrieve the cluster node %q vxlan interface: %v", name, err)
+		}
+	}
+
+	// aligning the vxlan interface MTU
+	if link.Attrs().MTU != mtu {
+		if err := netlink.LinkSetMTU(link, mtu); err != nil {
+			l.WithFields(log.Fields{
+				"MTU":    mtu,
+				"detail": err,
+			}).Error("failed to set the cluster node vxlan interface MTU")
+			return nil, fmt.Errorf("failed to set the cluster node %q vxlan interface MTU to %d: %v", name, mtu, err)
+		}
+	}
+
 	// setting up the vxlan interface
 	if err := netlink.LinkSetUp(link); err != nil {
-		l.WithField("detail", err).Fatal("failed to set the cluster node vxlan interface up")
+		l.WithField("detail", err).Error("failed to set the cluster node vxlan interface up")
 		return nil, fmt.Errorf("failed to set the cluster node %q vxlan interface up: %v", name, err)
 	}
 
@@ -222,8 +244,8 @@ func CreateNodeVxlanIface(name string, extIface *Iface, vtepIPNet *net.IPNet) (*
 		Label: "",
 	}
 	l = l.WithField("address", fmt.Sprintf("%+v", vtepIPNet))
-	if err = netlink.AddrAdd(link, addr); err != nil {
-		l.WithField("detail", err).Fatal("failed to add IPv4 address to the cluster node vxlan interface")
+	if err = netlink.AddrAdd(link, addr); err != nil && !errors.Is(err, syscall.EEXIST) {
+		l.WithField("detail", err).Error("failed to add IPv4 address to the cluster node vxlan interface")
 		return nil, fmt.Errorf("failed to add IPv4 address to the cluster node %q vxlan interface: %v", name, err)
 	}
 	vxlanIface := &Iface{
@@ -246,13 +268,13 @@ func GetNodeDefaultGateway(extIface *Iface) (*GwInfo, error) {
 	if err != nil {
 		l.WithField(
 			"detail", err,
-		).Fatal("failed to retrieve the cluster node default route through cluster node external interface")
+		).Error("failed to retrieve the cluster node default route through cluster node external interface")
 		return nil, fmt.Errorf("failed to retrieve the cluster node default route: %v", err)
 	}
 	if len(routes) != 1 {
 		l.WithField(
 			"routes", fmt.Sprintf("%+v", routes),
-		).Fatal("failed to determine a cluster node single default route")
+		).Error("failed to determine a cluster node single default route")
 		return nil, fmt.Errorf("failed to determine a single node default route - found routes: %+v", routes)
 	}
 	route := routes[0]
@@ -264,7 +286,7 @@ func GetNodeDefaultGateway(extIface *Iface) (*GwInfo, error) {
 		l.WithFields(log.Fields{
 			"routeLinkIndex":    routeLI,
 			"extIfaceLinkIndex": extIfaceLI,
-		}).Fatal("the route link index doesn't match the external interface link index")
+		}).Error("the route link index doesn't match the external interface link index")
 		return nil, fmt.Errorf(
 			"the route link index doesn't match the %q external interface link index - routeLinkIndex: %d, extIfaceLinkIndex: %d",
 			extIfaceName,
@@ -282,7 +304,7 @@ func GetNodeDefaultGateway(extIface *Iface) (*GwInfo, error) {
 	// > retrieving the neighbor list of the external interface
 	neighs, err := netlink.NeighList(extIfaceLI, netlink.FAMILY_V4)
 	if err != nil {
-		l.WithField("detail", err).Fatal("failed to retrieve the external interface neighbor list")
+		l.WithField("detail", err).Error("failed to retrieve the external interface neighbor list")
 		return nil, errors.New("failed to determine default gateway mac address")
 	}
 	// searching for a neighbor whose IP address is the default gateway one
@@ -298,72 +320,12 @@ func GetNodeDefaultGateway(extIface *Iface) (*GwInfo, error) {
 			return gwInfo, nil
 		}
 	}
-	l.Fatal("failed to retrieve the cluster node default gateway through cluster node external interface")
+	l.Error("failed to retrieve the cluster node default gateway through cluster node external interface")
 	return nil, fmt.Errorf(
 		"failed to retrieve the cluster node default gateway through cluster node %q external interface", extIfaceName,
 	)
 }
 
-// AddNode updates the polycube cubes configuration in order to make the provided node pods reachable
-// from the current node
-func AddNode(vxlanIfName string, nodeIP net.IP, nodePodCIDR *net.IPNet, nodeVtepIP net.IP) error {
-	l := log.WithField("name", vxlanIfName)
-	// retrieving vxlan interface
-	link, err := netlink.LinkByName(vxlanIfName)
-	if err != nil {
-		l.WithField("detail", err).Fatal("failed to retrieve the cluster node vxlan interface")
-		return fmt.Errorf("failed to retrieve the cluster node %q vxlan interface: %v", vxlanIfName, err)
-	}
-
-	// appending to bridge fdb a rule for the new node
-	neigh := &netlink.Neigh{
-		LinkIndex:    link.Attrs().Index, // vxlan index
-		State:        netlink.NUD_PERMANENT,
-		IP:           nodeIP,
-		HardwareAddr: net.HardwareAddr{0, 0, 0, 0, 0, 0},
-	}
-	l = l.WithFields(log.Fields{
-		"entry":  fmt.Sprintf("%+v", *neigh),
-		"nodeIP": nodeIP,
-	})
-	if err := netlink.NeighAppend(neigh); err != nil {
-		l.WithField(
-			"detail", err,
-		).Fatal("failed to configure the node fdb for allowing communication with the new node IP through the vxlan interface")
-		return fmt.Errorf(
-			"failed to configure the node fdb for allowing communication with the new node %q IP through the %q vxlan interface: %v",
-			nodeIP, vxlanIfName, err,
-		)
-	}
-	l.Info("node fdb configured in order to allow communication with the new node through vxlan interface")
-
-	// adding route to router in order to make node pod CIDR reachable throw vxlan interface
-	route := router.Route{
-		Network:    nodePodCIDR.String(),
-		Nexthop:    nodeVtepIP.String(),
-		Interface_: "to_vxlan0",
-	}
-	l = log.WithFields(log.Fields{
-		"router": "r0",
-		"route":  fmt.Sprintf("%+v", route),
-		"nodeIP": nodeIP,
-	})
-
-	if resp, err := routerAPI.CreateRouterRouteByID(context.TODO(), "r0", url.QueryEscape(route.Network), route.Nexthop, route); err != nil {
-		l.WithFields(log.Fields{
-			"error":    err,
-			"response": fmt.Sprintf("%+v", resp),
-		}).Fatal("failed to set router route for allowing communication with the new node IP through the vxlan interface")
-		return fmt.Errorf(
-			"failed to set %q router route for allowing communication with the new node %q IP through the %q vxlan"+
-				"interface - error: %v, response: %+v",
-			"r0", nodeIP, vxlanIfName, err, resp,
-		)
-	}
-	l.Info("router route configured in order to allow communication with the new node through 6vxlan interface")
-	return nil
-}
-
 // BuildNodeInfo returns an object describing the cluster node on which it is executed. The provided name must match
 // the cluster node name on which the program is executed
 func BuildNodeInfo(conf *EnvConf) (*NodeInfo, error) {
@@ -375,6 +337,15 @@ func BuildNodeInfo(conf *EnvConf) (*NodeInfo, error) {
 	if err != nil {
 		return nil, err
 	}
+	// the plugin refuses the pod addresses outside the VClusterCIDR
+	vOnes, _ := conf.vClusterCIDR.Mask.Size()
+	if ones, _ := podCIDR.Mask.Size(); !conf.vClusterCIDR.Contains(podCIDR.IP) || ones < vOnes {
+		log.WithFields(log.Fields{
+			"podCIDR":      podCIDR,
+			"vClusterCIDR": conf.vClusterCIDR,
+		}).Error("cluster node podCIDR is outside the VClusterCIDR")
+		return nil, fmt.Errorf("cluster node podCIDR %s is outside the VClusterCIDR %s", podCIDR, conf.vClusterCIDR)
+	}
 	podGwInfo, err := CalcNodePodDefaultGateway(podCIDR)
 	if err != nil {
 		return nil, err
@@ -395,6 +366,11 @@ func BuildNodeInfo(conf *EnvConf) (*NodeInfo, error) {
 		return nil, err
 	}
 
+	mtu, err := CalcPodMTU(conf, extIface)
+	if err != nil {
+		return nil, err
+	}
+
 	return &NodeInfo{
 		name:          conf.nodeName,
 		kNode:         node,
@@ -403,5 +379,6 @@ func BuildNodeInfo(conf *EnvConf) (*NodeInfo, error) {
 		extIface:      extIface,
 		nodeVtepIPNet: nodeVtepIPNet,
 		nodeGwInfo:    nodeGwInfo,
+		MTU:           mtu,
 	}, nil
 }
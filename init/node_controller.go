@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"github.com/ekoops/polykube-cni-plugin/utils/polycube"
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"net"
+	"strings"
+	"sync"
+)
+
+// PeerNode describes how the pods of another cluster node can be reached from the current node
+type PeerNode struct {
+	name    string
+	IP      net.IP
+	podCIDR *net.IPNet
+	vtepIP  net.IP
+	// publicKey is the node WireGuard public key, if published
+	publicKey string
+	// virtualIPs contains the virtual addresses of the node pods, as published by the node
+	virtualIPs []net.IP
+}
+
+func (p *PeerNode) equal(o *PeerNode) bool {
+	if len(p.virtualIPs) != len(o.virtualIPs) {
+		return false
+	}
+	for i := range p.virtualIPs {
+		if !p.virtualIPs[i].Equal(o.virtualIPs[i]) {
+			return false
+		}
+	}
+	return p.IP.Equal(o.IP) && p.podCIDR.String() == o.podCIDR.String() && p.vtepIP.Equal(o.vtepIP) &&
+		p.publicKey == o.publicKey
+}
+
+// isPeerNode returns true if the provided node pods have to be reachable from the current node
+// TODO this relies on the same naming convention used for calculating the Vtep IP (temporary solution)
+func isPeerNode(node *v1.Node, conf *EnvConf) bool {
+	return strings.HasPrefix(node.Name, "worker") && node.Name != conf.nodeName
+}
+
+// BuildPeerNode returns the info needed to reach the pods of the provided node. It returns a nil PeerNode if the node
+// has not been assigned a pod CIDR yet
+func BuildPeerNode(node *v1.Node, conf *EnvConf) (*PeerNode, error) {
+	l := log.WithField("node", node.Name)
+	if node.Spec.PodCIDR == "" {
+		l.Info("cluster node has no podCIDR yet")
+		return nil, nil
+	}
+	var nodeIP net.IP
+	for _, addr := range node.Status.Addresses {
+		if addr.Type == v1.NodeInternalIP {
+			nodeIP = net.ParseIP(addr.Address)
+			break
+		}
+	}
+	if nodeIP == nil {
+		l.Error("failed to retrieve cluster node internal IP")
+		return nil, fmt.Errorf("failed to retrieve %q cluster node internal IP", node.Name)
+	}
+	_, nodePodCIDR, err := net.ParseCIDR(node.Spec.PodCIDR)
+	if err != nil {
+		l.WithField("detail", err).Error("failed to parse cluster node podCIDR")
+		return nil, fmt.Errorf("failed to retrieve %q cluster node podCIDR: %v", node.Name, err)
+	}
+	nodeVtepIPNet, err := CalcNodeVtepIPNet(node, conf.vtepCIDR)
+	if err != nil {
+		return nil, err
+	}
+	return &PeerNode{
+		name:       node.Name,
+		IP:         nodeIP,
+		podCIDR:    nodePodCIDR,
+		vtepIP:     nodeVtepIPNet.IP,
+		publicKey:  node.Annotations[wireguardPublicKeyAnnotation],
+		virtualIPs: parseNodeVirtualIPs(node.Annotations[nodeVirtualIPsAnnotation]),
+	}, nil
+}
+
+// parseNodeVirtualIPs returns the virtual addresses listed in the provided nodeVirtualIPsAnnotation value. The invalid
+// entries are ignored
+func parseNodeVirtualIPs(raw string) []net.IP {
+	var vIPs []net.IP
+	for _, rawIP := range strings.Split(raw, ",") {
+		if vIP := net.ParseIP(strings.TrimSpace(rawIP)).To4(); vIP != nil {
+			vIPs = append(vIPs, vIP)
+		}
+	}
+	return vIPs
+}
+
+// nodeController keeps the node overlay and the router routes (including the non-masquerade ones) aligned with the
+// set of cluster nodes
+type nodeController struct {
+	*controller
+	conf     *EnvConf
+	nodeInfo *NodeInfo
+	routers  polycube.RouterManager
+	lister   corelisters.NodeLister
+	// mu serializes the changes to the peer nodes configuration performed by the controller and by the reconciler
+	mu sync.Mutex
+	// peers contains the currently configured peer nodes, indexed by name
+	peers map[string]*PeerNode
+}
+
+func newNodeController(
+	conf *EnvConf, nodeInfo *NodeInfo, routers polycube.RouterManager, factory informers.SharedInformerFactory,
+) *nodeController {
+	nodeInformer := factory.Core().V1().Nodes()
+	c := &nodeController{
+		conf:     conf,
+		nodeInfo: nodeInfo,
+		routers:  routers,
+		lister:   nodeInformer.Lister(),
+		peers:    make(map[string]*PeerNode),
+	}
+	c.controller = newController("nodes", c.syncNode)
+	c.watch(nodeInformer.Informer(), nil)
+	return c
+}
+
+// withPeers calls the provided function with the currently configured peer nodes, preventing the controller from
+// changing them in the meanwhile
+func (c *nodeController) withPeers(fn func(peers map[string]*PeerNode)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fn(c.peers)
+}
+
+func (c *nodeController) syncNode(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	old := c.peers[name]
+	var peer *PeerNode
+	node, err := c.lister.Get(name)
+	switch {
+	case errors.IsNotFound(err):
+	case err != nil:
+		return err
+	case isPeerNode(node, c.conf):
+		if peer, err = BuildPeerNode(node, c.conf); err != nil {
+			return err
+		}
+	}
+
+	if old != nil && peer != nil && old.equal(peer) {
+		return nil
+	}
+	if old != nil {
+		if err := DelNode(c.conf.overlay, c.routers, c.conf.routerName, old); err != nil {
+			return fmt.Errorf("failed to remove %q cluster node: %v", name, err)
+		}
+		delete(c.peers, name)
+	}
+	if peer != nil {
+		if err := AddNode(c.conf.overlay, c.routers, c.conf.routerName, c.nodeInfo, peer); err != nil {
+			return fmt.Errorf("failed to add %q cluster node podCIDR: %v", name, err)
+		}
+		c.peers[name] = peer
+	}
+	// the peer nodes are not masqueraded
+	if c.conf.egress.Masquerade {
+		if err := SyncEgressRoutes(c.routers, c.conf, c.nodeInfo, c.peers, func(message string) {
+			log.WithField("node", name).Info(message)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
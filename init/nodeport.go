@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	k8sdispatcher "github.com/ekoops/polykube-cni-plugin/utils/k8sdispatcher"
+	"github.com/ekoops/polykube-cni-plugin/utils/polycube"
+	log "github.com/sirupsen/logrus"
+	"io"
+	v1 "k8s.io/api/core/v1"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// reasonNodePortConflict is the reason of the events emitted for the NodePorts that can't be configured
+	reasonNodePortConflict = "NodePortConflict"
+
+	// tcpListenState is the state of the listening TCP sockets in /proc/net/tcp
+	tcpListenState = "0A"
+	// udpUnconnState is the state of the bound, not connected, UDP sockets in /proc/net/udp
+	udpUnconnState = "07"
+)
+
+// NodePortRange is the range of the ports usable by the NodePort services
+type NodePortRange struct {
+	Min int32
+	Max int32
+}
+
+// ParseNodePortRange parses a range in the format min-max
+func ParseNodePortRange(s string) (NodePortRange, error) {
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) != 2 {
+		return NodePortRange{}, fmt.Errorf("invalid range %q: it must be in the format min-max", s)
+	}
+	min, err1 := strconv.ParseUint(parts[0], 10, 16)
+	max, err2 := strconv.ParseUint(parts[1], 10, 16)
+	if err1 != nil || err2 != nil || min == 0 || min > max {
+		return NodePortRange{}, fmt.Errorf("invalid range %q: it must be in the format min-max", s)
+	}
+	return NodePortRange{Min: int32(min), Max: int32(max)}, nil
+}
+
+func (r NodePortRange) String() string {
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
+
+// Contains returns true if the provided port belongs to the range
+func (r NodePortRange) Contains(port int32) bool {
+	return port >= r.Min && port <= r.Max
+}
+
+// nodePortKey identifies a k8sdispatcher NodePort rule
+type nodePortKey struct {
+	port  int32
+	proto string
+}
+
+// HostListeners returns the TCP and UDP ports on which a node process is listening, as reported by /proc/net
+func HostListeners() (map[nodePortKey]bool, error) {
+	listeners := make(map[nodePortKey]bool)
+	for _, f := range []struct{ path, proto, state string }{
+		{"/proc/net/tcp", string(v1.ProtocolTCP), tcpListenState},
+		{"/proc/net/tcp6", string(v1.ProtocolTCP), tcpListenState},
+		{"/proc/net/udp", string(v1.ProtocolUDP), udpUnconnState},
+		{"/proc/net/udp6", string(v1.ProtocolUDP), udpUnconnState},
+	} {
+		file, err := os.Open(f.path)
+		if os.IsNotExist(err) {
+			// IPv6 could be disabled
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %q - %v", f.path, err)
+		}
+		err = scanListeners(file, f.proto, f.state, listeners)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %q - %v", f.path, err)
+		}
+	}
+	return listeners, nil
+}
+
+// scanListeners adds to listeners the ports of the sockets in the provided state found in the provided /proc/net
+// sockets table
+func scanListeners(r io.Reader, proto, state string, listeners map[nodePortKey]bool) error {
+	scanner := bufio.NewScanner(r)
+	// skipping the header
+	scanner.Scan()
+	for scanner.Scan() {
+		// the fields are: sl local_address rem_address st ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[3] != state {
+			continue
+		}
+		i := strings.LastIndex(fields[1], ":")
+		if i < 0 {
+			continue
+		}
+		port, err := strconv.ParseUint(fields[1][i+1:], 16, 16)
+		if err != nil {
+			continue
+		}
+		listeners[nodePortKey{port: int32(port), proto: proto}] = true
+	}
+	return scanner.Err()
+}
+
+// nodePortServiceType returns the k8sdispatcher service type implementing the external traffic policy of the provided
+// service
+func nodePortServiceType(svc *v1.Service) string {
+	if svc.Spec.ExternalTrafficPolicy == v1.ServiceExternalTrafficPolicyTypeLocal {
+		return "LOCAL"
+	}
+	return "CLUSTER"
+}
+
+// SyncNodeportRange sets the configured NodePort range on the k8sdispatcher, if it differs. It returns true if the
+// range was updated
+func SyncNodeportRange(dispatchers polycube.DispatcherManager, conf *EnvConf) (bool, error) {
+	name := conf.k8sDispName
+	k, err := dispatchers.ReadDispatcher(name)
+	if err != nil {
+		return false, fmt.Errorf("failed to retrieve %q k8sdispatcher - %v", name, err)
+	}
+	desired := conf.nodePortRange.String()
+	if k.NodeportRange == desired {
+		return false, nil
+	}
+	l := log.WithFields(log.Fields{
+		"name":    name,
+		"current": k.NodeportRange,
+		"desired": desired,
+	})
+	if err := dispatchers.UpdateNodeportRange(name, desired); err != nil {
+		l.WithField("detail", err).Error("failed to update k8sdispatcher nodeport range")
+		return false, fmt.Errorf("failed to update %q k8sdispatcher nodeport range - %v", name, err)
+	}
+	l.Info("k8sdispatcher nodeport range updated")
+	return true, nil
+}
+
+// CleanupNodeportRules removes the k8sdispatcher NodePort rules not belonging to any of the provided services, as the
+// ones left over by the services deleted while the agent was not running
+func CleanupNodeportRules(dispatchers polycube.DispatcherManager, conf *EnvConf, services []*v1.Service) error {
+	name := conf.k8sDispName
+	rules, err := dispatchers.ListNodeportRules(name)
+	if err != nil && !polycube.IsNotFound(err) {
+		return fmt.Errorf("failed to list %q k8sdispatcher nodeport rules - %v", name, err)
+	}
+	used := make(map[nodePortKey]bool)
+	for _, svc := range services {
+		for _, port := range svc.Spec.Ports {
+			if port.NodePort != 0 {
+				used[nodePortKey{port: port.NodePort, proto: strings.ToUpper(string(port.Protocol))}] = true
+			}
+		}
+	}
+	for _, rule := range rules {
+		k := nodePortKey{port: rule.NodeportPort, proto: strings.ToUpper(rule.Proto)}
+		if used[k] {
+			continue
+		}
+		l := log.WithFields(log.Fields{
+			"name": name,
+			"rule": fmt.Sprintf("%+v", rule),
+		})
+		if err := dispatchers.DeleteNodeportRule(name, rule.NodeportPort, rule.Proto); err != nil &&
+			!polycube.IsNotFound(err) {
+			l.WithField("detail", err).Error("failed to delete stale nodeport rule")
+			return fmt.Errorf("failed to delete %q k8sdispatcher nodeport rule %d/%s - %v",
+				name, rule.NodeportPort, rule.Proto, err)
+		}
+		l.Info("stale nodeport rule deleted")
+	}
+	return nil
+}
+
+// nodePortRule returns the k8sdispatcher rule dispatching the traffic received on the provided NodePort
+func nodePortRule(svc *v1.Service, port v1.ServicePort) k8sdispatcher.NodeportRule {
+	return k8sdispatcher.NodeportRule{
+		NodeportPort: port.NodePort,
+		Proto:        strings.ToUpper(string(port.Protocol)),
+		ServiceType:  nodePortServiceType(svc),
+	}
+}
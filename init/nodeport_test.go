@@ -0,0 +1,166 @@
+package main
+
+import (
+	"github.com/ekoops/polykube-cni-plugin/test/fakepolycubed"
+	k8sdispatcher "github.com/ekoops/polykube-cni-plugin/utils/k8sdispatcher"
+	"github.com/ekoops/polykube-cni-plugin/utils/polycube"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseNodePortRange(t *testing.T) {
+	for _, tc := range []struct {
+		s       string
+		r       NodePortRange
+		invalid bool
+	}{
+		{s: "30000-32767", r: NodePortRange{Min: 30000, Max: 32767}},
+		{s: " 8080-8080\n", r: NodePortRange{Min: 8080, Max: 8080}},
+		{s: "1-65535", r: NodePortRange{Min: 1, Max: 65535}},
+		{s: "30000", invalid: true},
+		{s: "30000-32767-40000", invalid: true},
+		{s: "32767-30000", invalid: true},
+		{s: "0-100", invalid: true},
+		{s: "30000-65536", invalid: true},
+		{s: "-1-100", invalid: true},
+		{s: "a-b", invalid: true},
+	} {
+		r, err := ParseNodePortRange(tc.s)
+		if tc.invalid {
+			if err == nil {
+				t.Errorf("%q: parsing succeeded with %v", tc.s, r)
+			}
+			continue
+		}
+		if err != nil || r != tc.r {
+			t.Errorf("%q - required: %v, found: %v, error: %v", tc.s, tc.r, r, err)
+		}
+		if r.String() != strings.TrimSpace(tc.s) {
+			t.Errorf("%q: range formatted as %q", tc.s, r.String())
+		}
+	}
+}
+
+// procNetTCP is a /proc/net/tcp sample: sshd and a NodePort listener on all the addresses, a loopback listener and
+// established and time-wait connections, whose local ports must be ignored
+const procNetTCP = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:0016 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 21234 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 21840 1 0000000000000000 100 0 0 10 0
+   2: 00000000:7594 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 30411 1 0000000000000000 100 0 0 10 0
+   3: 0A01A8C0:0016 6401A8C0:D431 01 00000000:00000000 02:000A3F5C 00000000     0        0 31877 4 0000000000000000 20 4 29 10 -1
+   4: 0A01A8C0:9C40 0B01A8C0:1A0B 06 00000000:00000000 03:00000F1B 00000000     0        0 0 3 0000000000000000
+`
+
+func TestScanListeners(t *testing.T) {
+	listeners := make(map[nodePortKey]bool)
+	if err := scanListeners(strings.NewReader(procNetTCP), string(v1.ProtocolTCP), tcpListenState, listeners); err != nil {
+		t.Fatalf("scanListeners failed: %v", err)
+	}
+	expected := map[nodePortKey]bool{
+		{port: 22, proto: "TCP"}:    true,
+		{port: 8080, proto: "TCP"}:  true,
+		{port: 30100, proto: "TCP"}: true,
+	}
+	if len(listeners) != len(expected) {
+		t.Fatalf("wrong listeners - required: %v, found: %v", expected, listeners)
+	}
+	for k := range expected {
+		if !listeners[k] {
+			t.Errorf("missing listener %+v", k)
+		}
+	}
+
+	// the TCP listeners are not bound UDP sockets
+	udp := make(map[nodePortKey]bool)
+	if err := scanListeners(strings.NewReader(procNetTCP), string(v1.ProtocolUDP), udpUnconnState, udp); err != nil {
+		t.Fatalf("scanListeners failed: %v", err)
+	}
+	if len(udp) != 0 {
+		t.Fatalf("unexpected UDP listeners: %v", udp)
+	}
+}
+
+// TestHostListeners verifies that a listener opened by the test is reported
+func TestHostListeners(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("failed to open a TCP listener: %v", err)
+	}
+	defer ln.Close()
+	port := int32(ln.Addr().(*net.TCPAddr).Port)
+
+	listeners, err := HostListeners()
+	if err != nil {
+		t.Fatalf("HostListeners failed: %v", err)
+	}
+	if !listeners[nodePortKey{port: port, proto: "TCP"}] {
+		t.Fatalf("TCP listener on port %d not reported", port)
+	}
+}
+
+func TestCleanupNodeportRules(t *testing.T) {
+	srv := fakepolycubed.NewServer()
+	ts, url := srv.Start()
+	defer ts.Close()
+	cubes := polycube.NewCubes(url)
+	conf := newTestConf()
+	name := conf.k8sDispName
+
+	// without the k8sdispatcher rules, there is nothing to remove
+	if err := cubes.Dispatchers.CreateDispatcher(k8sdispatcher.K8sdispatcher{Name: name}); err != nil {
+		t.Fatalf("failed to create k8sdispatcher: %v", err)
+	}
+	if err := CleanupNodeportRules(cubes.Dispatchers, conf, nil); err != nil {
+		t.Fatalf("CleanupNodeportRules failed without rules: %v", err)
+	}
+
+	for _, rule := range []k8sdispatcher.NodeportRule{
+		{NodeportPort: 30080, Proto: "TCP", ServiceType: "CLUSTER"},
+		{NodeportPort: 30080, Proto: "UDP", ServiceType: "CLUSTER"},
+		{NodeportPort: 30053, Proto: "UDP", ServiceType: "LOCAL"},
+		{NodeportPort: 30443, Proto: "TCP", ServiceType: "CLUSTER"},
+	} {
+		if err := cubes.Dispatchers.ReplaceNodeportRule(name, rule); err != nil {
+			t.Fatalf("failed to create nodeport rule: %v", err)
+		}
+	}
+	services := []*v1.Service{
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+			Spec: v1.ServiceSpec{Ports: []v1.ServicePort{
+				{Name: "http", Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP},
+				// a port without NodePort doesn't keep any rule
+				{Name: "metrics", Port: 9090, Protocol: v1.ProtocolTCP},
+			}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "dns"},
+			Spec: v1.ServiceSpec{Ports: []v1.ServicePort{
+				{Name: "dns", Port: 53, NodePort: 30053, Protocol: v1.ProtocolUDP},
+			}},
+		},
+	}
+	if err := CleanupNodeportRules(cubes.Dispatchers, conf, services); err != nil {
+		t.Fatalf("CleanupNodeportRules failed: %v", err)
+	}
+
+	rules, err := cubes.Dispatchers.ListNodeportRules(name)
+	if err != nil {
+		t.Fatalf("failed to list nodeport rules: %v", err)
+	}
+	expected := map[nodePortKey]bool{
+		{port: 30080, proto: "TCP"}: true,
+		{port: 30053, proto: "UDP"}: true,
+	}
+	if len(rules) != len(expected) {
+		t.Fatalf("wrong nodeport rules - required: %v, found: %+v", expected, rules)
+	}
+	for _, rule := range rules {
+		if !expected[nodePortKey{port: rule.NodeportPort, proto: rule.Proto}] {
+			t.Errorf("unexpected nodeport rule %+v", rule)
+		}
+	}
+}
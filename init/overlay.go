@@ -0,0 +1,439 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ekoops/polykube-cni-plugin/utils/polycube"
+	router "github.com/ekoops/polykube-cni-plugin/utils/router"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"net"
+	"strings"
+	"syscall"
+)
+
+const (
+	overlayVxlan  = "vxlan"
+	overlayGeneve = "geneve"
+	overlayIPIP   = "ipip"
+	overlayDirect = "direct"
+
+	// geneveOverhead is the number of bytes added by the geneve encapsulation over IPv4 without options: outer
+	// ethernet (14), IPv4 (20), UDP (8) and geneve (8) headers
+	geneveOverhead = 50
+
+	// genevePrefix is the prefix of the per-peer geneve interfaces names
+	genevePrefix = "gnv"
+)
+
+// Overlay is a backend connecting the node pods with the pods of the peer nodes. The router reaches each peer node pod
+// CIDR through the route returned by PeerRoute, while the backend provides what is needed for the route to work (the
+// node interfaces, the router ports and their arp entries)
+type Overlay interface {
+	// Name returns the backend name
+	Name() string
+	// Overhead returns the number of bytes added by the encapsulation to each packet
+	Overhead() int
+	// RouterPorts returns the router ports connected to the node-wide overlay interfaces, with their peers, and the
+	// static arp entries they require. A backend without node-wide interfaces returns no ports
+	RouterPorts() ([]router.Ports, []router.ArpTable)
+	// Setup creates or repairs the node-wide overlay resources
+	Setup(nodeInfo *NodeInfo) error
+	// Check verifies the node-wide overlay resources
+	Check(nodeInfo *NodeInfo) error
+	// Uninstall removes the node-wide overlay resources, recording the outcome in the provided report
+	Uninstall(report *UninstallReport)
+	// AddPeer configures the resources needed to reach the provided peer node
+	AddPeer(routers polycube.RouterManager, rName string, nodeInfo *NodeInfo, peer *PeerNode) error
+	// DelPeer removes the resources configured by AddPeer
+	DelPeer(routers polycube.RouterManager, rName string, peer *PeerNode) error
+	// CheckPeer verifies the resources configured by AddPeer, given the current router configuration
+	CheckPeer(r *router.Router, peer *PeerNode) error
+	// PeerRoute returns the router route towards the provided peer node pods
+	PeerRoute(peer *PeerNode) router.Route
+	// IsPeerRoute returns true if the provided router route could have been returned by PeerRoute
+	IsPeerRoute(route router.Route) bool
+}
+
+// getOverlay returns the overlay backend selected by the POLYKUBE_OVERLAY environment variable
+func getOverlay(conf *EnvConf) (Overlay, error) {
+	switch backend := getEnv("POLYKUBE_OVERLAY", overlayVxlan); backend {
+	case overlayVxlan:
+		vxlanConf, err := getVxlanConf()
+		if err != nil {
+			return nil, err
+		}
+		return &vxlanOverlay{name: conf.vxlanIfName, conf: vxlanConf}, nil
+	case overlayGeneve:
+		o := &tunnelOverlay{kind: overlayGeneve, prefix: genevePrefix, overhead: geneveOverhead}
+		var err error
+		if o.vni, err = parseIntEnv("NODE_GENEVE_VNI", "42", 1, maxVNI); err != nil {
+			return nil, err
+		}
+		if o.port, err = parseIntEnv("NODE_GENEVE_PORT", "6081", 1, 65535); err != nil {
+			return nil, err
+		}
+		if o.ttl, err = parseIntEnv("NODE_GENEVE_TTL", "0", 0, 255); err != nil {
+			return nil, err
+		}
+		return o, nil
+	case overlayIPIP:
+		return getIPIPOverlay(), nil
+	case overlayWireguard:
+		return getWireguardOverlay()
+	case overlayDirect:
+		return &directOverlay{}, nil
+	default:
+		return nil, fmt.Errorf(
+			"failed to parse env variable: POLYKUBE_OVERLAY must be one of %s", strings.Join(
+				[]string{overlayVxlan, overlayGeneve, overlayIPIP, overlayWireguard, overlayDirect}, ", ",
+			),
+		)
+	}
+}
+
+// AddNode makes the provided peer node pods reachable from the current node through the overlay
+func AddNode(overlay Overlay, routers polycube.RouterManager, rName string, nodeInfo *NodeInfo, peer *PeerNode) error {
+	if err := overlay.AddPeer(routers, rName, nodeInfo, peer); err != nil {
+		return err
+	}
+
+	// adding routes to router in order to make node pod CIDR and pods virtual addresses reachable through the overlay
+	for _, route := range peerRoutes(overlay, peer) {
+		l := log.WithFields(log.Fields{
+			"router":  rName,
+			"overlay": overlay.Name(),
+			"route":   fmt.Sprintf("%+v", route),
+			"nodeIP":  peer.IP,
+		})
+		if err := routers.CreateRoute(rName, route); err != nil && !polycube.IsConflict(err) {
+			l.WithField("detail", err).Error("failed to set router route towards the new node pods")
+			return fmt.Errorf(
+				"failed to set %q router route towards the new node %q pods through the %s overlay - %v",
+				rName, peer.IP, overlay.Name(), err,
+			)
+		}
+		l.Info("router route configured in order to allow communication with the new node pods")
+	}
+	return nil
+}
+
+// DelNode reverts the configuration performed by AddNode for the provided peer node
+func DelNode(overlay Overlay, routers polycube.RouterManager, rName string, peer *PeerNode) error {
+	// removing router routes towards the node pod CIDR and pods virtual addresses
+	for _, route := range peerRoutes(overlay, peer) {
+		l := log.WithFields(log.Fields{
+			"router":  rName,
+			"network": route.Network,
+			"nexthop": route.Nexthop,
+			"nodeIP":  peer.IP,
+		})
+		if err := routers.DeleteRoute(rName, route.Network, route.Nexthop); err != nil && !polycube.IsNotFound(err) {
+			l.WithField("detail", err).Error("failed to delete router route towards the removed node")
+			return fmt.Errorf("failed to delete %q router route towards the removed node %q - %v", rName, peer.IP, err)
+		}
+		l.Info("router route towards the removed node deleted")
+	}
+	return overlay.DelPeer(routers, rName, peer)
+}
+
+// peerRoutes returns the router routes towards the provided peer node: the one towards its pods and the ones towards
+// its pods virtual addresses, which are reached in the same way
+func peerRoutes(overlay Overlay, peer *PeerNode) []router.Route {
+	route := overlay.PeerRoute(peer)
+	routes := []router.Route{route}
+	for _, vIP := range peer.virtualIPs {
+		vIPRoute := route
+		vIPRoute.Network = vIP.String() + "/32"
+		routes = append(routes, vIPRoute)
+	}
+	return routes
+}
+
+// hasRoute returns true if the router contains the provided route
+func hasRoute(r *router.Router, route router.Route) bool {
+	for _, rt := range r.Route {
+		if rt.Network == route.Network && rt.Nexthop == route.Nexthop && rt.Interface_ == route.Interface_ {
+			return true
+		}
+	}
+	return false
+}
+
+// checkArpEntries verifies that the router contains the provided static arp entries
+func checkArpEntries(r *router.Router, entries []router.ArpTable) error {
+	for _, expected := range entries {
+		found := false
+		for _, entry := range r.ArpTable {
+			if entry.Address == expected.Address && strings.EqualFold(entry.Mac, expected.Mac) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("arp entry %s -> %s is missing", expected.Address, expected.Mac)
+		}
+	}
+	return nil
+}
+
+// ipToMAC returns the locally administered MAC address derived from the provided IPv4 address
+func ipToMAC(ip net.IP) net.HardwareAddr {
+	ip4 := ip.To4()
+	return net.HardwareAddr{0x0a, 0x58, ip4[0], ip4[1], ip4[2], ip4[3]}
+}
+
+// tunnelOverlay implements the geneve backend. Since a geneve interface has a single remote endpoint, a
+// point-to-point interface is created for each peer node and connected to a dedicated router port. The router port
+// MAC address and the peer VTEP arp entry are derived from the VTEP addresses, so that each node knows in advance the
+// destination MAC of the frames sent towards a peer
+type tunnelOverlay struct {
+	kind     string
+	prefix   string
+	overhead int
+	vni      int
+	port     int
+	ttl      int
+}
+
+func (o *tunnelOverlay) Name() string {
+	return o.kind
+}
+
+func (o *tunnelOverlay) Overhead() int {
+	return o.overhead
+}
+
+func (o *tunnelOverlay) RouterPorts() ([]router.Ports, []router.ArpTable) {
+	return nil, nil
+}
+
+func (o *tunnelOverlay) Setup(*NodeInfo) error {
+	return nil
+}
+
+func (o *tunnelOverlay) Check(*NodeInfo) error {
+	return nil
+}
+
+// Uninstall removes the per-peer interfaces, which are the only resources created on the node
+func (o *tunnelOverlay) Uninstall(report *UninstallReport) {
+	uninstallTunnelIfaces(o.kind, o.prefix, report)
+}
+
+// ifaceName returns the name of the tunnel interface towards the provided peer node
+func (o *tunnelOverlay) ifaceName(peer *PeerNode) string {
+	ip4 := peer.IP.To4()
+	return fmt.Sprintf("%s%02x%02x%02x%02x", o.prefix, ip4[0], ip4[1], ip4[2], ip4[3])
+}
+
+func (o *tunnelOverlay) portName(peer *PeerNode) string {
+	return "to_" + o.ifaceName(peer)
+}
+
+func (o *tunnelOverlay) newLink(nodeInfo *NodeInfo, peer *PeerNode) netlink.Link {
+	return &netlink.Geneve{
+		LinkAttrs: netlink.LinkAttrs{Name: o.ifaceName(peer), MTU: nodeInfo.MTU},
+		ID:        uint32(o.vni),
+		Remote:    peer.IP,
+		Dport:     uint16(o.port),
+		Ttl:       uint8(o.ttl),
+	}
+}
+
+func (o *tunnelOverlay) AddPeer(routers polycube.RouterManager, rName string, nodeInfo *NodeInfo, peer *PeerNode) error {
+	name := o.ifaceName(peer)
+	l := log.WithFields(log.Fields{
+		"interface": name,
+		"nodeIP":    peer.IP,
+	})
+
+	// creating the tunnel interface (it could be already present if the program was restarted)
+	if err := netlink.LinkAdd(o.newLink(nodeInfo, peer)); err != nil && !errors.Is(err, syscall.EEXIST) {
+		l.WithField("detail", err).Errorf("failed to create the %s interface towards the new node", o.kind)
+		return fmt.Errorf("failed to create the %q %s interface towards the new node %q: %v", name, o.kind, peer.IP, err)
+	}
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		l.WithField("detail", err).Errorf("failed to retrieve the %s interface towards the new node", o.kind)
+		return fmt.Errorf("failed to retrieve the %q %s interface: %v", name, o.kind, err)
+	}
+	if link.Attrs().MTU != nodeInfo.MTU {
+		if err := netlink.LinkSetMTU(link, nodeInfo.MTU); err != nil {
+			l.WithField("detail", err).Errorf("failed to set the %s interface MTU", o.kind)
+			return fmt.Errorf("failed to set the %q %s interface MTU to %d: %v", name, o.kind, nodeInfo.MTU, err)
+		}
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		l.WithField("detail", err).Errorf("failed to set the %s interface up", o.kind)
+		return fmt.Errorf("failed to set the %q %s interface up: %v", name, o.kind, err)
+	}
+
+	// connecting the interface to a dedicated router port
+	port := router.Ports{
+		Name: o.portName(peer),
+		Mac:  ipToMAC(nodeInfo.nodeVtepIPNet.IP).String(),
+		Peer: name,
+	}
+	l = l.WithFields(log.Fields{
+		"router": rName,
+		"port":   fmt.Sprintf("%+v", port),
+	})
+	if err := routers.CreateRouterPort(rName, port); err != nil && !polycube.IsConflict(err) {
+		l.WithField("detail", err).Error("failed to create router port towards the new node")
+		return fmt.Errorf("failed to create %q router %q port - %v", rName, port.Name, err)
+	}
+	// the port could exist with a stale peer if the interface was recreated
+	if err := routers.SetRouterPortPeer(rName, port.Name, name); err != nil {
+		l.WithField("detail", err).Error("failed to set router port peer")
+		return fmt.Errorf("failed to set %q port peer on %q router to %q - %v", port.Name, rName, name, err)
+	}
+
+	// the peer VTEP can't be resolved through arp on a point-to-point interface
+	entry := router.ArpTable{
+		Address:    peer.vtepIP.String(),
+		Mac:        ipToMAC(peer.vtepIP).String(),
+		Interface_: port.Name,
+	}
+	if err := routers.ReplaceArpEntry(rName, entry); err != nil {
+		l.WithField("detail", err).Error("failed to set router arp entry for the new node VTEP")
+		return fmt.Errorf("failed to set %q router arp entry for %q - %v", rName, entry.Address, err)
+	}
+	l.Infof("%s interface towards the new node configured", o.kind)
+	return nil
+}
+
+func (o *tunnelOverlay) DelPeer(routers polycube.RouterManager, rName string, peer *PeerNode) error {
+	name := o.ifaceName(peer)
+	portName := o.portName(peer)
+	l := log.WithFields(log.Fields{
+		"interface": name,
+		"router":    rName,
+		"port":      portName,
+		"nodeIP":    peer.IP,
+	})
+	if err := routers.DeleteArpEntry(rName, peer.vtepIP.String()); err != nil && !polycube.IsNotFound(err) {
+		l.WithField("detail", err).Error("failed to delete router arp entry for the removed node VTEP")
+		return fmt.Errorf("failed to delete %q router arp entry for %q - %v", rName, peer.vtepIP, err)
+	}
+	if err := routers.DeleteRouterPort(rName, portName); err != nil && !polycube.IsNotFound(err) {
+		l.WithField("detail", err).Error("failed to delete router port towards the removed node")
+		return fmt.Errorf("failed to delete %q router %q port - %v", rName, portName, err)
+	}
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		if _, notFound := err.(netlink.LinkNotFoundError); notFound {
+			return nil
+		}
+		l.WithField("detail", err).Errorf("failed to retrieve the %s interface towards the removed node", o.kind)
+		return fmt.Errorf("failed to retrieve the %q %s interface: %v", name, o.kind, err)
+	}
+	if err := netlink.LinkDel(link); err != nil {
+		l.WithField("detail", err).Errorf("failed to delete the %s interface towards the removed node", o.kind)
+		return fmt.Errorf("failed to delete the %q %s interface: %v", name, o.kind, err)
+	}
+	l.Infof("%s interface towards the removed node deleted", o.kind)
+	return nil
+}
+
+func (o *tunnelOverlay) CheckPeer(r *router.Router, peer *PeerNode) error {
+	name := o.ifaceName(peer)
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve %q interface: %v", name, err)
+	}
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		return fmt.Errorf("%q interface is down", name)
+	}
+	portName := o.portName(peer)
+	hasPort := false
+	for _, p := range r.Ports {
+		if p.Name == portName && p.Peer == name {
+			hasPort = true
+			break
+		}
+	}
+	if !hasPort {
+		return fmt.Errorf("%q router port is missing or not connected to %q", portName, name)
+	}
+	mac := ipToMAC(peer.vtepIP).String()
+	for _, entry := range r.ArpTable {
+		if entry.Address == peer.vtepIP.String() && strings.EqualFold(entry.Mac, mac) {
+			return nil
+		}
+	}
+	return fmt.Errorf("arp entry %s -> %s is missing", peer.vtepIP, mac)
+}
+
+func (o *tunnelOverlay) PeerRoute(peer *PeerNode) router.Route {
+	return router.Route{
+		Network:    peer.podCIDR.String(),
+		Nexthop:    peer.vtepIP.String(),
+		Interface_: o.portName(peer),
+	}
+}
+
+func (o *tunnelOverlay) IsPeerRoute(route router.Route) bool {
+	return strings.HasPrefix(route.Interface_, "to_"+o.prefix)
+}
+
+// directOverlay implements the no-encapsulation backend for L2-adjacent nodes: the peer node pods are reached
+// through the external interface, using the peer node IP as next hop
+type directOverlay struct{}
+
+func (o *directOverlay) Name() string {
+	return overlayDirect
+}
+
+func (o *directOverlay) Overhead() int {
+	return 0
+}
+
+func (o *directOverlay) RouterPorts() ([]router.Ports, []router.ArpTable) {
+	return nil, nil
+}
+
+func (o *directOverlay) Setup(*NodeInfo) error {
+	return nil
+}
+
+func (o *directOverlay) Check(*NodeInfo) error {
+	return nil
+}
+
+func (o *directOverlay) Uninstall(*UninstallReport) {}
+
+func (o *directOverlay) AddPeer(_ polycube.RouterManager, _ string, nodeInfo *NodeInfo, peer *PeerNode) error {
+	if extIPNet := nodeInfo.extIface.IPNet; !extIPNet.Contains(peer.IP) {
+		log.WithFields(log.Fields{
+			"nodeIP": peer.IP,
+			"subnet": extIPNet.String(),
+		}).Error("cluster node is not L2-adjacent")
+		return fmt.Errorf(
+			"%q cluster node IP %s is outside the external interface %s subnet: direct routing requires L2-adjacent nodes",
+			peer.name, peer.IP, extIPNet,
+		)
+	}
+	return nil
+}
+
+func (o *directOverlay) DelPeer(polycube.RouterManager, string, *PeerNode) error {
+	return nil
+}
+
+func (o *directOverlay) CheckPeer(*router.Router, *PeerNode) error {
+	return nil
+}
+
+func (o *directOverlay) PeerRoute(peer *PeerNode) router.Route {
+	return router.Route{
+		Network:    peer.podCIDR.String(),
+		Nexthop:    peer.IP.String(),
+		Interface_: "to_lbrp0",
+	}
+}
+
+// IsPeerRoute excludes the default route, which shares the port with the peer nodes routes
+func (o *directOverlay) IsPeerRoute(route router.Route) bool {
+	return route.Interface_ == "to_lbrp0" && route.Network != "0.0.0.0/0"
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ekoops/polykube-cni-plugin/utils/polycube"
+	router "github.com/ekoops/polykube-cni-plugin/utils/router"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"io/ioutil"
+	"net"
+	"syscall"
+)
+
+const (
+	// overlayPodsRouteMetric is the metric of the node route towards the pods through an overlay veth pair: it differs
+	// from the egress one, so that both routes can coexist
+	overlayPodsRouteMetric = 100
+	rpFilterPathFormat     = "/proc/sys/net/ipv4/conf/%s/rp_filter"
+)
+
+// overlayVeth is the veth pair connecting the router to the node for the backends whose node interface has no link
+// layer header: the router datapath only parses ethernet frames, so it can't be attached to those interfaces, and the
+// node forwards the packets between the veth pair and the overlay interface through its routes
+type overlayVeth struct {
+	// kind is the backend name, used in the logs
+	kind       string
+	hostName   string
+	routerName string
+	// port is the name of the router port connected to the router side of the veth pair
+	port        string
+	hostIPNet   *net.IPNet
+	routerIPNet *net.IPNet
+}
+
+// routerPorts returns the router port connected to the veth pair and the static arp entry of the node side: the node
+// side can't be resolved through arp, since its address is the same on each node
+func (v *overlayVeth) routerPorts() ([]router.Ports, []router.ArpTable) {
+	port := router.Ports{
+		Name: v.port,
+		Ip:   v.routerIPNet.String(),
+		Mac:  ipToMAC(v.routerIPNet.IP).String(),
+		Peer: v.routerName,
+	}
+	entry := router.ArpTable{
+		Address:    v.hostIPNet.IP.String(),
+		Mac:        ipToMAC(v.hostIPNet.IP).String(),
+		Interface_: v.port,
+	}
+	return []router.Ports{port}, []router.ArpTable{entry}
+}
+
+// peerRoute returns the router route towards the provided peer node pods, which are reached through the node
+func (v *overlayVeth) peerRoute(peer *PeerNode) router.Route {
+	return router.Route{
+		Network:    peer.podCIDR.String(),
+		Nexthop:    v.hostIPNet.IP.String(),
+		Interface_: v.port,
+	}
+}
+
+// setArpEntries sets the router static arp entries required by the veth pair. They are shared by all the peer nodes,
+// so they are never removed
+func (v *overlayVeth) setArpEntries(routers polycube.RouterManager, rName string) error {
+	_, entries := v.routerPorts()
+	for _, entry := range entries {
+		if err := routers.ReplaceArpEntry(rName, entry); err != nil {
+			log.WithFields(log.Fields{
+				"router": rName,
+				"entry":  fmt.Sprintf("%+v", entry),
+				"detail": err,
+			}).Errorf("failed to set router arp entry for the %s veth interface", v.kind)
+			return fmt.Errorf("failed to set %q router arp entry for %q - %v", rName, entry.Address, err)
+		}
+	}
+	return nil
+}
+
+// create creates the veth pair and configures the node for forwarding the pods traffic between it and the overlay
+// interface
+func (v *overlayVeth) create(nodeInfo *NodeInfo) error {
+	l := log.WithField("name", v.hostName)
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:         v.hostName,
+			MTU:          nodeInfo.MTU,
+			HardwareAddr: ipToMAC(v.hostIPNet.IP),
+		},
+		PeerName: v.routerName,
+	}
+	if err := netlink.LinkAdd(veth); err != nil && !errors.Is(err, syscall.EEXIST) {
+		l.WithField("detail", err).Errorf("failed to create %s veth interface", v.kind)
+		return fmt.Errorf("failed to create %q interface - %v", v.hostName, err)
+	}
+	for _, name := range []string{v.hostName, v.routerName} {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve %q interface - %v", name, err)
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			l.WithField("detail", err).Errorf("failed to set %s veth interface up", v.kind)
+			return fmt.Errorf("failed to set %q interface up - %v", name, err)
+		}
+		if name != v.hostName {
+			continue
+		}
+		if err := netlink.AddrReplace(link, &netlink.Addr{IPNet: v.hostIPNet}); err != nil {
+			l.WithField("detail", err).Errorf("failed to set %s veth interface address", v.kind)
+			return fmt.Errorf("failed to set %q interface address - %v", name, err)
+		}
+		// the pods traffic received from the peer nodes is sent to the router through the veth pair
+		route := &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       nodeInfo.podCIDR,
+			Gw:        v.routerIPNet.IP,
+			Priority:  overlayPodsRouteMetric,
+		}
+		if err := netlink.RouteReplace(route); err != nil {
+			l.WithField("detail", err).Error("failed to set pods route")
+			return fmt.Errorf("failed to set route to %s via %q interface - %v", nodeInfo.podCIDR, name, err)
+		}
+	}
+	// the best node route towards the pods could be the egress one, so the pods traffic received from the router must
+	// pass the loose reverse path filter
+	rpFilterPath := fmt.Sprintf(rpFilterPathFormat, v.hostName)
+	if err := ioutil.WriteFile(rpFilterPath, []byte("2"), 0644); err != nil {
+		l.WithField("detail", err).Error("failed to set loose reverse path filter")
+		return fmt.Errorf("failed to set %q interface loose reverse path filter - %v", v.hostName, err)
+	}
+	if err := ioutil.WriteFile(ipForwardPath, []byte("1"), 0644); err != nil {
+		l.WithField("detail", err).Error("failed to enable ip forwarding")
+		return fmt.Errorf("failed to enable ip forwarding - %v", err)
+	}
+	l.Infof("%s veth interface created", v.kind)
+	return nil
+}
+
+// check verifies that the veth pair is configured as required
+func (v *overlayVeth) check(nodeInfo *NodeInfo) error {
+	var link netlink.Link
+	for _, name := range []string{v.routerName, v.hostName} {
+		var err error
+		if link, err = netlink.LinkByName(name); err != nil {
+			return fmt.Errorf("failed to retrieve %q interface: %v", name, err)
+		}
+		if link.Attrs().Flags&net.FlagUp == 0 {
+			return fmt.Errorf("%q interface is down", name)
+		}
+	}
+	// link is now the host side of the veth pair
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve %q interface addresses: %v", v.hostName, err)
+	}
+	found := false
+	for _, addr := range addrs {
+		if addr.IPNet.String() == v.hostIPNet.String() {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("address %s is not assigned to %q interface", v.hostIPNet, v.hostName)
+	}
+	if !hasKernelRoute(link, nodeInfo.podCIDR, v.routerIPNet.IP) {
+		return fmt.Errorf("route to %s via %q interface is missing", nodeInfo.podCIDR, v.hostName)
+	}
+	return nil
+}
+
+// hasKernelRoute returns true if the node has a route towards the provided destination through the provided
+// interface and gateway (nil for a directly connected destination)
+func hasKernelRoute(link netlink.Link, dst *net.IPNet, gw net.IP) bool {
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Dst: dst}, netlink.RT_FILTER_DST)
+	if err != nil {
+		return false
+	}
+	for _, route := range routes {
+		if route.LinkIndex == link.Attrs().Index && route.Gw.Equal(gw) {
+			return true
+		}
+	}
+	return false
+}
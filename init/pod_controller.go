@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ekoops/polykube-cni-plugin/utils/attachment"
+	lbrp "github.com/ekoops/polykube-cni-plugin/utils/lbrp"
+	"github.com/ekoops/polykube-cni-plugin/utils/polycube"
+	router "github.com/ekoops/polykube-cni-plugin/utils/router"
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"net"
+	"sort"
+	"strings"
+)
+
+const (
+	// virtualIPAnnotation is the pod annotation declaring the pod virtual address. The pod lbrp rewrites the pod
+	// address into the virtual one in the traffic sent by the pod and translates the traffic directed to the virtual
+	// address
+	virtualIPAnnotation = "polykube.io/virtual-ip"
+	// nodeVirtualIPsAnnotation is the node annotation through which each node publishes the comma separated virtual
+	// addresses of its pods, so that the other nodes route them towards it
+	nodeVirtualIPsAnnotation = "polykube.io/virtual-ips"
+	// reasonVirtualIPRejected is the reason of the events emitted for the virtual addresses that can't be configured
+	reasonVirtualIPRejected = "VirtualIPRejected"
+)
+
+// podVirtualIP describes the virtual address configuration of a pod lbrp
+type podVirtualIP struct {
+	lbName   string
+	vIP      net.IP
+	podIP    net.IP
+	services []lbrpServiceKey
+}
+
+// route returns the router route delivering the traffic directed to the virtual address to the pod lbrp, which
+// translates it
+func (v *podVirtualIP) route() router.Route {
+	return router.Route{
+		Network:    v.vIP.String() + "/32",
+		Nexthop:    v.podIP.String(),
+		Interface_: "to_br0",
+	}
+}
+
+// podController keeps the per-pod lbrps of the node pods aligned with their virtual address annotation. It also
+// notifies the creation of new per-pod lbrps, so that the edge services and the ones with session affinity can be
+// replicated into them
+type podController struct {
+	*controller
+	conf     *EnvConf
+	nodeInfo *NodeInfo
+	lbrps    polycube.LbrpManager
+	routers  polycube.RouterManager
+	podLBs   attachment.PodLBManager
+	lister   corelisters.PodLister
+	recorder record.EventRecorder
+	// withPeers calls the provided function with the currently configured peer nodes
+	withPeers func(fn func(peers map[string]*PeerNode))
+	// virtualIPs contains the virtual address configuration of the pods having one, indexed by namespace/name
+	virtualIPs map[string]*podVirtualIP
+	// published is the last nodeVirtualIPsAnnotation value published on the node
+	published string
+	// lbNames contains the per-pod lbrp name of the pods already notified, indexed by namespace/name
+	lbNames map[string]string
+	// onAttached is called with the name of each new per-pod lbrp found
+	onAttached func(lbName string)
+}
+
+// newPodController returns a controller for the pods notified by the provided factory, which must be restricted to
+// the pods of the current node. The virtual addresses are checked against the peer nodes provided by withPeers. The
+// onAttached callback is called when a new per-pod lbrp is found
+func newPodController(conf *EnvConf, nodeInfo *NodeInfo, cubes *polycube.Cubes, factory informers.SharedInformerFactory,
+	withPeers func(fn func(peers map[string]*PeerNode)), recorder record.EventRecorder, onAttached func(lbName string),
+) *podController {
+	podInformer := factory.Core().V1().Pods()
+	c := &podController{
+		conf:       conf,
+		nodeInfo:   nodeInfo,
+		lbrps:      cubes.Lbrps,
+		routers:    cubes.Routers,
+		podLBs:     attachment.NewPodLBManager(cubes.Lbrps, cubes.Bridges),
+		lister:     podInformer.Lister(),
+		recorder:   recorder,
+		withPeers:  withPeers,
+		virtualIPs: make(map[string]*podVirtualIP),
+		lbNames:    make(map[string]string),
+		onAttached: onAttached,
+	}
+	if nodeInfo.kNode != nil {
+		c.published = nodeInfo.kNode.Annotations[nodeVirtualIPsAnnotation]
+	}
+	c.controller = newController("pods", c.syncPod)
+	c.watch(podInformer.Informer(), nil)
+	return c
+}
+
+// ParseVirtualIP returns the virtual address declared by the provided pod annotation, or nil if it is not declared.
+// The virtual address must be an IPv4 address belonging to the VClusterCIDR
+func ParseVirtualIP(pod *v1.Pod, vClusterCIDR *net.IPNet) (net.IP, error) {
+	raw, ok := pod.Annotations[virtualIPAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	vIP := net.ParseIP(strings.TrimSpace(raw))
+	if vIP == nil || vIP.To4() == nil {
+		return nil, fmt.Errorf("invalid %s annotation %q: it must be an IPv4 address", virtualIPAnnotation, raw)
+	}
+	if !vClusterCIDR.Contains(vIP) {
+		return nil, fmt.Errorf("invalid %s annotation %q: it must belong to %s", virtualIPAnnotation, raw, vClusterCIDR)
+	}
+	return vIP.To4(), nil
+}
+
+// BuildVirtualIPServices returns the lbrp service entries translating the traffic directed to the pod virtual address
+// into traffic directed to the pod address: one for each port declared by the pod containers, and one for ICMP
+func BuildVirtualIPServices(pod *v1.Pod, podIP, vIP net.IP) []lbrp.Service {
+	newService := func(port int32, proto string) lbrp.Service {
+		return lbrp.Service{
+			Name:  fmt.Sprintf("%s/%s:%d/%s", pod.Namespace, pod.Name, port, proto),
+			Vip:   vIP.String(),
+			Vport: port,
+			Proto: proto,
+			Backend: []lbrp.ServiceBackend{{
+				Name:   podIP.String(),
+				Ip:     podIP.String(),
+				Port:   port,
+				Weight: 1,
+			}},
+		}
+	}
+	services := []lbrp.Service{newService(0, "ICMP")}
+	seen := make(map[lbrpServiceKey]bool)
+	for _, container := range pod.Spec.Containers {
+		for _, port := range container.Ports {
+			proto := strings.ToUpper(string(port.Protocol))
+			if proto == "" {
+				proto = string(v1.ProtocolTCP)
+			}
+			// the lbrp doesn't support SCTP
+			if proto != string(v1.ProtocolTCP) && proto != string(v1.ProtocolUDP) {
+				continue
+			}
+			k := lbrpServiceKey{vip: vIP.String(), vport: port.ContainerPort, proto: proto}
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			services = append(services, newService(port.ContainerPort, proto))
+		}
+	}
+	return services
+}
+
+// checkVirtualIP verifies that the provided virtual address of the pod with the provided key doesn't conflict with the
+// pods addresses, which belong to the nodes podCIDRs, and with the virtual addresses of the other pods
+func (c *podController) checkVirtualIP(key string, vIP net.IP) error {
+	if c.nodeInfo.podCIDR.Contains(vIP) {
+		return fmt.Errorf("%s belongs to the current node podCIDR %s", vIP, c.nodeInfo.podCIDR)
+	}
+	for k, other := range c.virtualIPs {
+		if k != key && other.vIP.Equal(vIP) {
+			return fmt.Errorf("%s is already the virtual address of the %q pod", vIP, k)
+		}
+	}
+	var err error
+	c.withPeers(func(peers map[string]*PeerNode) {
+		for name, peer := range peers {
+			if peer.podCIDR.Contains(vIP) {
+				err = fmt.Errorf("%s belongs to the %q node podCIDR %s", vIP, name, peer.podCIDR)
+				return
+			}
+			for _, peerVIP := range peer.virtualIPs {
+				if peerVIP.Equal(vIP) {
+					err = fmt.Errorf("%s is already the virtual address of a %q node pod", vIP, name)
+					return
+				}
+			}
+		}
+	})
+	return err
+}
+
+// reject records the rejection of the pod virtual address annotation
+func (c *podController) reject(pod *v1.Pod, err error) {
+	log.WithFields(log.Fields{
+		"pod":    pod.Namespace + "/" + pod.Name,
+		"detail": err,
+	}).Error("pod virtual ip rejected")
+	c.recorder.Eventf(pod, v1.EventTypeWarning, reasonVirtualIPRejected, "%s annotation rejected: %v",
+		virtualIPAnnotation, err)
+}
+
+// deleteRoute removes the router route towards the provided virtual address
+func (c *podController) deleteRoute(vIP *podVirtualIP) error {
+	route := vIP.route()
+	rName := c.conf.routerName
+	if err := c.routers.DeleteRoute(rName, route.Network, route.Nexthop); err != nil && !polycube.IsNotFound(err) {
+		return fmt.Errorf("failed to delete %q router route to %s - %v", rName, route.Network, err)
+	}
+	return nil
+}
+
+// publish sets the nodeVirtualIPsAnnotation of the current node to the current pods virtual addresses, if they
+// changed since the last publication. The annotation is removed if no pod has a virtual address
+func (c *podController) publish() error {
+	vIPs := make([]string, 0, len(c.virtualIPs))
+	for _, vIP := range c.virtualIPs {
+		vIPs = append(vIPs, vIP.vIP.String())
+	}
+	sort.Strings(vIPs)
+	value := strings.Join(vIPs, ",")
+	if value == c.published {
+		return nil
+	}
+	var annotation interface{}
+	if value != "" {
+		annotation = value
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{nodeVirtualIPsAnnotation: annotation},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode node annotation patch: %v", err)
+	}
+	nodeName := c.nodeInfo.name
+	l := log.WithFields(log.Fields{
+		"node":       nodeName,
+		"virtualIPs": value,
+	})
+	if _, err := clientset.CoreV1().Nodes().Patch(
+		context.TODO(), nodeName, types.MergePatchType, patch, metav1.PatchOptions{},
+	); err != nil {
+		l.WithField("detail", err).Error("failed to publish the cluster node pods virtual ips")
+		return fmt.Errorf("failed to publish the %q cluster node pods virtual ips: %v", nodeName, err)
+	}
+	c.published = value
+	l.Info("cluster node pods virtual ips published")
+	return nil
+}
+
+// findAttachment returns the attachment of the provided pod, or nil if it doesn't exist
+func (c *podController) findAttachment(namespace, name string) (*attachment.Attachment, error) {
+	atts, err := attachment.List(c.conf.stateDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list attachments state: %v", err)
+	}
+	for _, a := range atts {
+		if a.PodNamespace == namespace && a.PodName == name {
+			return a, nil
+		}
+	}
+	return nil, nil
+}
+
+// clear removes the virtual address configuration from the pod lbrp and the router route towards it, unless keep is
+// provided: in this case, only the lbrp services not contained in keep are removed. A missing lbrp is not an error,
+// since the pod could have been deleted in the meanwhile
+func (c *podController) clear(vIP *podVirtualIP, keep map[lbrpServiceKey]bool) error {
+	for _, k := range vIP.services {
+		if keep[k] {
+			continue
+		}
+		if err := c.lbrps.DeleteLbrpService(vIP.lbName, k.vip, k.vport, k.proto); err != nil && !polycube.IsNotFound(err) {
+			return fmt.Errorf("failed to delete %q lbrp service %+v - %v", vIP.lbName, k, err)
+		}
+	}
+	if keep != nil {
+		return nil
+	}
+	if err := c.podLBs.ClearVirtualIP(vIP.lbName); err != nil && !polycube.IsNotFound(err) {
+		return fmt.Errorf("failed to clear %q lbrp virtual ip - %v", vIP.lbName, err)
+	}
+	return c.deleteRoute(vIP)
+}
+
+// notifyAttached calls the onAttached callback if the provided per-pod lbrp was not already notified for the pod
+func (c *podController) notifyAttached(key, lbName string) {
+	if c.lbNames[key] == lbName {
+		return
+	}
+	c.lbNames[key] = lbName
+	if c.onAttached != nil {
+		c.onAttached(lbName)
+	}
+}
+
+func (c *podController) syncPod(key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+	l := log.WithField("pod", key)
+	old := c.virtualIPs[key]
+
+	var vIP, podIP net.IP
+	var att *attachment.Attachment
+	pod, err := c.lister.Pods(namespace).Get(name)
+	switch {
+	case errors.IsNotFound(err):
+	case err != nil:
+		return err
+	case pod.Spec.HostNetwork:
+	default:
+		// an invalid or conflicting annotation is not retried until it changes
+		if vIP, err = ParseVirtualIP(pod, c.conf.vClusterCIDR); err != nil {
+			c.reject(pod, err)
+			vIP = nil
+		} else if vIP != nil {
+			if err := c.checkVirtualIP(key, vIP); err != nil {
+				c.reject(pod, err)
+				vIP = nil
+			}
+		}
+		if att, err = c.findAttachment(namespace, name); err != nil {
+			return err
+		}
+		if att != nil {
+			c.notifyAttached(key, attachment.LbrpName(att.Name))
+		}
+		if vIP == nil {
+			break
+		}
+		if att == nil || net.ParseIP(att.IP) == nil {
+			// the pod could be still in creation
+			return fmt.Errorf("%q pod attachment not found", key)
+		}
+		podIP = net.ParseIP(att.IP)
+	}
+	if pod == nil || att == nil {
+		delete(c.lbNames, key)
+	}
+
+	if vIP == nil {
+		if old != nil {
+			if err := c.clear(old, nil); err != nil {
+				return err
+			}
+			delete(c.virtualIPs, key)
+			l.Info("pod virtual ip removed")
+		}
+		return c.publish()
+	}
+
+	lbName := attachment.LbrpName(att.Name)
+	if old != nil && old.lbName != lbName {
+		// the pod sandbox was recreated: the old lbrp is removed by the plugin, while the route could be stale
+		if !old.podIP.Equal(podIP) {
+			if err := c.deleteRoute(old); err != nil {
+				return err
+			}
+		}
+		old = nil
+	}
+	l = l.WithFields(log.Fields{
+		"lbrp":      lbName,
+		"virtualIP": vIP,
+		"podIP":     podIP,
+	})
+	if err := c.podLBs.SetVirtualIP(lbName, podIP, vIP); err != nil {
+		l.WithField("detail", err).Error("failed to set pod virtual ip")
+		return fmt.Errorf("failed to set %q lbrp virtual ip - %v", lbName, err)
+	}
+	current := &podVirtualIP{lbName: lbName, vIP: vIP, podIP: podIP}
+	route := current.route()
+	if err := c.routers.CreateRoute(c.conf.routerName, route); err != nil && !polycube.IsConflict(err) {
+		l.WithField("detail", err).Error("failed to set router route towards pod virtual ip")
+		return fmt.Errorf("failed to set %q router route to %s - %v", c.conf.routerName, route.Network, err)
+	}
+	desiredKeys := make(map[lbrpServiceKey]bool)
+	for _, service := range BuildVirtualIPServices(pod, podIP, vIP) {
+		k := lbrpServiceKey{vip: service.Vip, vport: service.Vport, proto: service.Proto}
+		if err := c.lbrps.ReplaceLbrpService(lbName, service); err != nil {
+			l.WithFields(log.Fields{
+				"entry":  fmt.Sprintf("%+v", service),
+				"detail": err,
+			}).Error("failed to configure lbrp service")
+			return fmt.Errorf("failed to configure %q lbrp service %+v - %v", lbName, k, err)
+		}
+		current.services = append(current.services, k)
+		desiredKeys[k] = true
+	}
+	if old != nil {
+		if err := c.clear(old, desiredKeys); err != nil {
+			return err
+		}
+		if !old.vIP.Equal(vIP) || !old.podIP.Equal(podIP) {
+			if err := c.deleteRoute(old); err != nil {
+				return err
+			}
+		}
+	}
+	c.virtualIPs[key] = current
+	l.WithField("entries", len(current.services)).Info("pod virtual ip synced")
+	return c.publish()
+}
+
+// resync enqueues all the node pods, so that their virtual addresses are configured again. It is used when the
+// per-pod lbrps are recreated
+func (c *podController) resync() error {
+	pods, err := c.lister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	for _, pod := range pods {
+		key, err := cache.MetaNamespaceKeyFunc(pod)
+		if err != nil {
+			return err
+		}
+		c.queue.Add(key)
+	}
+	return nil
+}
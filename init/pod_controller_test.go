@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"github.com/ekoops/polykube-cni-plugin/test/fakepolycubed"
+	"github.com/ekoops/polykube-cni-plugin/utils/attachment"
+	lbrp "github.com/ekoops/polykube-cni-plugin/utils/lbrp"
+	"github.com/ekoops/polykube-cni-plugin/utils/polycube"
+	router "github.com/ekoops/polykube-cni-plugin/utils/router"
+	"github.com/ekoops/polykube-cni-plugin/utils/wireguard"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"net"
+	"strings"
+	"testing"
+)
+
+// newTestPod returns a pod of the node1 node declaring the provided virtual address
+func newTestPod(name, vIP string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        name,
+			Annotations: map[string]string{virtualIPAnnotation: vIP},
+		},
+		Spec: v1.PodSpec{NodeName: "node1"},
+	}
+}
+
+// testPodEnv contains the pod controller under test and its dependencies
+type testPodEnv struct {
+	c        *podController
+	cubes    *polycube.Cubes
+	pods     cache.Indexer
+	recorder *record.FakeRecorder
+	peers    map[string]*PeerNode
+}
+
+func newTestPodEnv(t *testing.T) *testPodEnv {
+	srv := fakepolycubed.NewServer()
+	ts, url := srv.Start()
+	t.Cleanup(ts.Close)
+	cubes := polycube.NewCubes(url)
+	conf := newTestConf()
+	conf.stateDir = t.TempDir()
+	nodeInfo := newTestNodeInfo()
+	if err := CreateCubes(cubes, nodeInfo, conf); err != nil {
+		t.Fatalf("CreateCubes failed: %v", err)
+	}
+	clientset = fake.NewSimpleClientset(&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}})
+
+	e := &testPodEnv{
+		cubes:    cubes,
+		pods:     cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}),
+		recorder: record.NewFakeRecorder(10),
+		peers:    make(map[string]*PeerNode),
+	}
+	e.c = &podController{
+		conf:     conf,
+		nodeInfo: nodeInfo,
+		lbrps:    cubes.Lbrps,
+		routers:  cubes.Routers,
+		podLBs:   attachment.NewPodLBManager(cubes.Lbrps, cubes.Bridges),
+		lister:   corelisters.NewPodLister(e.pods),
+		recorder: e.recorder,
+		withPeers: func(fn func(peers map[string]*PeerNode)) {
+			fn(e.peers)
+		},
+		virtualIPs: make(map[string]*podVirtualIP),
+		lbNames:    make(map[string]string),
+	}
+	return e
+}
+
+// addPod adds the provided pod with its attachment and per-pod lbrp, and syncs it
+func (e *testPodEnv) addPod(t *testing.T, pod *v1.Pod, containerID, podIP string) error {
+	t.Helper()
+	att := &attachment.Attachment{
+		Name:         attachment.Name("eth0", containerID),
+		ContainerID:  containerID,
+		IfName:       "eth0",
+		PodNamespace: pod.Namespace,
+		PodName:      pod.Name,
+		IP:           podIP,
+	}
+	if err := attachment.Save(e.c.conf.stateDir, att); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.cubes.Lbrps.CreateLbrp(lbrp.Lbrp{Name: attachment.LbrpName(att.Name)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.pods.Add(pod); err != nil {
+		t.Fatal(err)
+	}
+	return e.c.syncPod(pod.Namespace + "/" + pod.Name)
+}
+
+// routerRoutes returns the current routes of the node router
+func (e *testPodEnv) routerRoutes(t *testing.T) []router.Route {
+	t.Helper()
+	r, err := e.cubes.Routers.ReadRouter(e.c.conf.routerName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r.Route
+}
+
+// publishedVirtualIPs returns the virtual addresses published on the node
+func publishedVirtualIPs(t *testing.T) string {
+	t.Helper()
+	node, err := clientset.CoreV1().Nodes().Get(context.TODO(), "node1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return node.Annotations[nodeVirtualIPsAnnotation]
+}
+
+// expectRejection verifies that a rejection event containing the provided text was emitted
+func (e *testPodEnv) expectRejection(t *testing.T, text string) {
+	t.Helper()
+	select {
+	case event := <-e.recorder.Events:
+		if !strings.Contains(event, reasonVirtualIPRejected) || !strings.Contains(event, text) {
+			t.Fatalf("unexpected event: %s", event)
+		}
+	default:
+		t.Fatalf("no rejection event emitted (expected %q)", text)
+	}
+}
+
+func TestPodVirtualIP(t *testing.T) {
+	e := newTestPodEnv(t)
+
+	if err := e.addPod(t, newTestPod("a", "10.10.200.5"), "aaaaaaaaaaaa", "10.10.1.5"); err != nil {
+		t.Fatalf("failed to sync pod: %v", err)
+	}
+	route := router.Route{Network: "10.10.200.5/32", Nexthop: "10.10.1.5", Interface_: "to_br0"}
+	if !hasRoute(&router.Router{Route: e.routerRoutes(t)}, route) {
+		t.Fatalf("router route %+v is missing", route)
+	}
+	if vIPs := publishedVirtualIPs(t); vIPs != "10.10.200.5" {
+		t.Fatalf("published virtual ips - required: 10.10.200.5, found: %q", vIPs)
+	}
+
+	// conflicting annotations are rejected
+	if err := e.addPod(t, newTestPod("b", "10.10.200.5"), "bbbbbbbbbbbb", "10.10.1.6"); err != nil {
+		t.Fatalf("failed to sync pod: %v", err)
+	}
+	e.expectRejection(t, `virtual address of the "default/a" pod`)
+	if err := e.addPod(t, newTestPod("c", "10.10.1.7"), "cccccccccccc", "10.10.1.8"); err != nil {
+		t.Fatalf("failed to sync pod: %v", err)
+	}
+	e.expectRejection(t, "current node podCIDR")
+	_, peerPodCIDR, _ := net.ParseCIDR("10.10.2.0/24")
+	e.peers["worker2"] = &PeerNode{
+		name:       "worker2",
+		podCIDR:    peerPodCIDR,
+		virtualIPs: []net.IP{net.ParseIP("10.10.200.9").To4()},
+	}
+	if err := e.addPod(t, newTestPod("d", "10.10.200.9"), "dddddddddddd", "10.10.1.9"); err != nil {
+		t.Fatalf("failed to sync pod: %v", err)
+	}
+	e.expectRejection(t, `"worker2" node pod`)
+	if err := e.addPod(t, newTestPod("f", "10.10.2.10"), "ffffffffffff", "10.10.1.10"); err != nil {
+		t.Fatalf("failed to sync pod: %v", err)
+	}
+	e.expectRejection(t, `"worker2" node podCIDR`)
+	if len(e.c.virtualIPs) != 1 {
+		t.Fatalf("rejected virtual ips configured: %+v", e.c.virtualIPs)
+	}
+
+	// removing the annotation removes the route and the published address
+	pod := newTestPod("a", "")
+	delete(pod.Annotations, virtualIPAnnotation)
+	if err := e.pods.Update(pod); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.c.syncPod("default/a"); err != nil {
+		t.Fatalf("failed to sync pod: %v", err)
+	}
+	if hasRoute(&router.Router{Route: e.routerRoutes(t)}, route) {
+		t.Fatalf("router route %+v not removed", route)
+	}
+	if vIPs := publishedVirtualIPs(t); vIPs != "" {
+		t.Fatalf("published virtual ips not removed: %q", vIPs)
+	}
+}
+
+// TestPeerVirtualIPRoutes verifies that the virtual addresses published by a peer node are routed as its pods
+func TestPeerVirtualIPRoutes(t *testing.T) {
+	srv := fakepolycubed.NewServer()
+	ts, url := srv.Start()
+	defer ts.Close()
+	cubes := polycube.NewCubes(url)
+	conf := newTestConf()
+	conf.overlay = &directOverlay{}
+	conf.egress = &EgressConf{NatName: "nat0"}
+	nodeInfo := newTestNodeInfo()
+	if err := CreateCubes(cubes, nodeInfo, conf); err != nil {
+		t.Fatalf("CreateCubes failed: %v", err)
+	}
+	node := newTestPeer(wireguard.Key{})
+	node.Annotations[nodeVirtualIPsAnnotation] = "10.10.200.9,10.10.200.10"
+	_, conf.vtepCIDR, _ = net.ParseCIDR("10.18.0.0/16")
+	peer, err := BuildPeerNode(node, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := AddNode(conf.overlay, cubes.Routers, conf.routerName, nodeInfo, peer); err != nil {
+		t.Fatalf("AddNode failed: %v", err)
+	}
+	r, err := cubes.Routers.ReadRouter(conf.routerName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, network := range []string{"10.10.2.0/24", "10.10.200.9/32", "10.10.200.10/32"} {
+		route := router.Route{Network: network, Nexthop: "192.168.1.11", Interface_: "to_lbrp0"}
+		if !hasRoute(r, route) {
+			t.Errorf("router route %+v is missing", route)
+		}
+	}
+	if err := DelNode(conf.overlay, cubes.Routers, conf.routerName, peer); err != nil {
+		t.Fatalf("DelNode failed: %v", err)
+	}
+	if r, err = cubes.Routers.ReadRouter(conf.routerName); err != nil {
+		t.Fatal(err)
+	}
+	for _, route := range r.Route {
+		if route.Nexthop == "192.168.1.11" {
+			t.Errorf("router route %+v not removed", route)
+		}
+	}
+}
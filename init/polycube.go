@@ -1,52 +1,20 @@
 package main
 
 import (
-	"context"
 	"fmt"
 	"github.com/ekoops/polykube-cni-plugin/utils"
 	k8sdispatcher "github.com/ekoops/polykube-cni-plugin/utils/k8sdispatcher"
 	lbrp "github.com/ekoops/polykube-cni-plugin/utils/lbrp"
+	"github.com/ekoops/polykube-cni-plugin/utils/polycube"
 	router "github.com/ekoops/polykube-cni-plugin/utils/router"
 	simplebridge "github.com/ekoops/polykube-cni-plugin/utils/simplebridge"
 	log "github.com/sirupsen/logrus"
 	"net"
 )
 
-const (
-	basePath = "http://127.0.0.1:9000/polycube/v1"
-)
-
-var (
-	simplebridgeAPI  *simplebridge.SimplebridgeApiService
-	lbrpAPI          *lbrp.LbrpApiService
-	routerAPI        *router.RouterApiService
-	k8sdispatcherAPI *k8sdispatcher.K8sdispatcherApiService
-)
-
-func init() {
-	// init simplebrige API
-	cfgSimplebridge := simplebridge.Configuration{BasePath: basePath}
-	srSimplebridge := simplebridge.NewAPIClient(&cfgSimplebridge)
-	simplebridgeAPI = srSimplebridge.SimplebridgeApi
-
-	// init router API
-	cfgRouter := router.Configuration{BasePath: basePath}
-	srRouter := router.NewAPIClient(&cfgRouter)
-	routerAPI = srRouter.RouterApi
-
-	// init lbrp API
-	cfgLbrp := lbrp.Configuration{BasePath: basePath}
-	srLbrp := lbrp.NewAPIClient(&cfgLbrp)
-	lbrpAPI = srLbrp.LbrpApi
-
-	// init k8sdispatcher API
-	cfgK8sdispatcher := k8sdispatcher.Configuration{BasePath: basePath}
-	srK8sdispatcher := k8sdispatcher.NewAPIClient(&cfgK8sdispatcher)
-	k8sdispatcherAPI = srK8sdispatcher.K8sdispatcherApi
-}
-
-// CreateBridge creates a polycube simplebridge cube
-func CreateBridge(name string) error {
+// CreateBridge creates a polycube simplebridge cube. As the other cube creation functions, it doesn't fail if the
+// cube already exists, so that the node setup can be performed again after a restart
+func CreateBridge(bridges polycube.BridgeManager, name string) error {
 	l := log.WithField("name", name)
 	// defining bridge port that will be connected to the router
 	brToRPort := simplebridge.Ports{
@@ -61,36 +29,35 @@ func CreateBridge(name string) error {
 
 	l = l.WithField("bridge", fmt.Sprintf("%+v", br))
 	// creating bridge
-	if resp, err := simplebridgeAPI.CreateSimplebridgeByID(context.TODO(), name, br); err != nil {
-		l.WithFields(log.Fields{
-			"error":    err,
-			"response": fmt.Sprintf("%+v", resp),
-		}).Fatal("failed to create bridge")
-		return fmt.Errorf("failed to create %q bridge - error: %s, response: %+v", name, err, resp)
+	if err := bridges.CreateBridge(br); err != nil && !polycube.IsConflict(err) {
+		l.WithField("detail", err).Error("failed to create bridge")
+		return fmt.Errorf("failed to create %q bridge - %v", name, err)
 	}
 	l.Info("bridge created")
 	return nil
 }
 
 // GetRouter retrieve a polycube router cube given the name
-func GetRouter(name string) (*router.Router, error) {
+func GetRouter(routers polycube.RouterManager, name string) (*router.Router, error) {
 	l := log.WithField("name", name)
 
 	// retrieving router
-	r, resp, err := routerAPI.ReadRouterByID(context.TODO(), name)
+	r, err := routers.ReadRouter(name)
 	if err != nil {
-		l.WithFields(log.Fields{
-			"error":    err,
-			"response": fmt.Sprintf("%+v", resp),
-		}).Fatal("failed to retrieve router")
-		return nil, fmt.Errorf("failed to retrieve %q router - error: %s, response: %+v", name, err, resp)
+		l.WithField("detail", err).Error("failed to retrieve router")
+		return nil, fmt.Errorf("failed to retrieve %q router - %v", name, err)
 	}
 	l.Info("router retrieved")
-	return &r, nil
+	return r, nil
 }
 
-// CreateRouter creates a polycube router cube
-func CreateRouter(name string, extIface *Iface, podsGwInfo *GwInfo, nodeGwInfo *GwInfo) error {
+// CreateRouter creates a polycube router cube. The ports towards the overlay interfaces are the ones required by the
+// overlay, while the port towards the node is created only if the egress masquerade is enabled and the port towards
+// the egress gateway interface only if the egress gateway is enabled
+func CreateRouter(
+	routers polycube.RouterManager, name string, overlay Overlay, egress *EgressConf, extIface *Iface,
+	podsGwInfo *GwInfo, nodeGwInfo *GwInfo,
+) error {
 	l := log.WithField("name", name)
 
 	// defining the router port that will be connected to the bridge
@@ -99,17 +66,13 @@ func CreateRouter(name string, extIface *Iface, podsGwInfo *GwInfo, nodeGwInfo *
 		Ip:   podsGwInfo.IPNet.String(),
 		Mac:  podsGwInfo.MAC.String(),
 	}
-	// defining the router port that will be connected to the vxlan interface
-	rToVxlanPort := router.Ports{
-		Name: "to_vxlan0",
-	}
 	// defining the router port that will be connected to the lbrp
 	rToLbrpPort := router.Ports{
 		Name: "to_lbrp0",
 		Ip:   extIface.IPNet.String(),
 		Mac:  extIface.Link.Attrs().HardwareAddr.String(),
 	}
-	rPorts := []router.Ports{rToBrPort, rToVxlanPort, rToLbrpPort}
+	rPorts := []router.Ports{rToBrPort, rToLbrpPort}
 
 	// defining router default route and setting static arp table entry for the default gateway
 	routes := []router.Route{
@@ -126,6 +89,24 @@ func CreateRouter(name string, extIface *Iface, podsGwInfo *GwInfo, nodeGwInfo *
 			Interface_: "to_lbrp0",
 		},
 	}
+	// defining the router ports that will be connected to the overlay interfaces and their static arp table entries.
+	// The ports are connected to their peers by ConnectCubes
+	overlayPorts, overlayEntries := overlay.RouterPorts()
+	for _, port := range overlayPorts {
+		port.Peer = ""
+		rPorts = append(rPorts, port)
+	}
+	arptable = append(arptable, overlayEntries...)
+	// defining the router port that will be connected to the node and the static arp table entry for the node side
+	if egress.Masquerade {
+		rToHostPort, hostEntry := egressRouterPorts()
+		rPorts = append(rPorts, rToHostPort)
+		arptable = append(arptable, hostEntry)
+	}
+	// defining the router port that will be connected to the egress gateway interface
+	if egress.Gateway != nil {
+		rPorts = append(rPorts, egressGatewayRouterPort(extIface.IPNet.IP))
+	}
 	r := router.Router{
 		Name:     name,
 		Ports:    rPorts,
@@ -136,19 +117,58 @@ func CreateRouter(name string, extIface *Iface, podsGwInfo *GwInfo, nodeGwInfo *
 
 	l = l.WithField("router", fmt.Sprintf("%+v", r))
 	// creating router
-	if resp, err := routerAPI.CreateRouterByID(context.TODO(), name, r); err != nil {
-		l.WithFields(log.Fields{
-			"error":    err,
-			"response": fmt.Sprintf("%+v", resp),
-		}).Fatal("failed to create router")
-		return fmt.Errorf("failed to create %q router - error: %s, response: %+v", name, err, resp)
+	if err := routers.CreateRouter(r); err != nil {
+		if !polycube.IsConflict(err) {
+			l.WithField("detail", err).Error("failed to create router")
+			return fmt.Errorf("failed to create %q router - %v", name, err)
+		}
+		// the router was created by a previous run, possibly with a different set of enabled features
+		if err := completeRouter(routers, r); err != nil {
+			l.WithField("detail", err).Error("failed to complete the existing router")
+			return err
+		}
 	}
 	l.Info("router created")
 	return nil
 }
 
+// completeRouter creates the ports and the static arp table entries of the provided router definition that are
+// missing from the existing router with the same name
+func completeRouter(routers polycube.RouterManager, desired router.Router) error {
+	name := desired.Name
+	current, err := routers.ReadRouter(name)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve %q router - %v", name, err)
+	}
+	existing := make(map[string]bool, len(current.Ports))
+	for _, port := range current.Ports {
+		existing[port.Name] = true
+	}
+	for _, port := range desired.Ports {
+		if existing[port.Name] {
+			continue
+		}
+		if err := routers.CreateRouterPort(name, port); err != nil && !polycube.IsConflict(err) {
+			return fmt.Errorf("failed to create %q router %q port - %v", name, port.Name, err)
+		}
+		log.WithFields(log.Fields{
+			"name": name,
+			"port": fmt.Sprintf("%+v", port),
+		}).Info("missing router port created")
+	}
+	if err := checkArpEntries(current, desired.ArpTable); err == nil {
+		return nil
+	}
+	for _, entry := range desired.ArpTable {
+		if err := routers.ReplaceArpEntry(name, entry); err != nil {
+			return fmt.Errorf("failed to set %q router arp entry for %q - %v", name, entry.Address, err)
+		}
+	}
+	return nil
+}
+
 // CreateLbrp creates a polycube lbrp cube for managing incoming connection
-func CreateLbrp(name string) error {
+func CreateLbrp(lbrps polycube.LbrpManager, name string) error {
 	l := log.WithField("name", name)
 
 	// defining the lbrp port that will be connected to the router interface
@@ -171,19 +191,19 @@ func CreateLbrp(name string) error {
 
 	l = l.WithField("lbrp", fmt.Sprintf("%+v", lb))
 	// creating lbrp
-	if resp, err := lbrpAPI.CreateLbrpByID(context.TODO(), name, lb); err != nil {
-		l.WithFields(log.Fields{
-			"error":    err,
-			"response": fmt.Sprintf("%+v", resp),
-		}).Fatal("failed to create lbrp")
-		return fmt.Errorf("failed to create %q lbrp - error: %s, response: %+v", name, err, resp)
+	if err := lbrps.CreateLbrp(lb); err != nil && !polycube.IsConflict(err) {
+		l.WithField("detail", err).Error("failed to create lbrp")
+		return fmt.Errorf("failed to create %q lbrp - %v", name, err)
 	}
 	l.Info("lbrp created")
 	return nil
 }
 
 // CreateK8sDispatcher creates a polycube k8sdispatcher cube for managing incoming connection
-func CreateK8sDispatcher(name string, podCIDR *net.IPNet) error {
+func CreateK8sDispatcher(
+	dispatchers polycube.DispatcherManager, name string, podCIDR *net.IPNet, serviceCIDR *net.IPNet,
+	nodePortRange NodePortRange,
+) error {
 	l := log.WithField("name", name)
 
 	// defining the k8sdispatcher port that will be connected to the lbrp interface
@@ -204,36 +224,32 @@ func CreateK8sDispatcher(name string, podCIDR *net.IPNet) error {
 		Name:            name,
 		Loglevel:        "TRACE",
 		Ports:           kPorts,
-		ClusterIpSubnet: "11.11.11.0/24", // TODO mocked
+		ClusterIpSubnet: serviceCIDR.String(),
 		ClientSubnet:    podCIDR.String(),
-		InternalSrcIp:   "3.3.1.3",     // TODO mocked
-		NodeportRange:   "30000-32767", // TODO mocked
+		InternalSrcIp:   "3.3.1.3", // TODO mocked
+		NodeportRange:   nodePortRange.String(),
 	}
 
 	l = l.WithField("k8sdispatcher", fmt.Sprintf("%+v", k))
 	// creating k8sdispatcher
-	if resp, err := k8sdispatcherAPI.CreateK8sdispatcherByID(context.TODO(), name, k); err != nil {
-		l.WithFields(log.Fields{
-			"error":    err,
-			"response": fmt.Sprintf("%+v", resp),
-		}).Fatal("failed to create k8sdispatcher")
-		return fmt.Errorf("failed to create %q k8sdispatcher - error: %s, response: %+v", name, err, resp)
+	if err := dispatchers.CreateDispatcher(k); err != nil && !polycube.IsConflict(err) {
+		l.WithField("detail", err).Error("failed to create k8sdispatcher")
+		return fmt.Errorf("failed to create %q k8sdispatcher - %v", name, err)
 	}
 	// TODO trying to create in a single shot also the following port
-	if resp, err := k8sdispatcherAPI.CreateK8sdispatcherPortsByID(context.TODO(), name, "to_int", kToIntPort); err != nil {
+	if err := dispatchers.CreateDispatcherPort(name, kToIntPort); err != nil && !polycube.IsConflict(err) {
 		l.WithFields(log.Fields{
-			"port":     "to_int",
-			"error":    err,
-			"response": fmt.Sprintf("%+v", resp),
-		}).Fatal("failed to create k8sdispatcher port")
-		return fmt.Errorf("failed to create %q k8sdispatcher port - error: %s, response: %+v", name, err, resp)
+			"port":   "to_int",
+			"detail": err,
+		}).Error("failed to create k8sdispatcher port")
+		return fmt.Errorf("failed to create %q k8sdispatcher port - %v", name, err)
 	}
 	l.Info("k8sdispatcher created")
 	return nil
 }
 
 // ConnectCubes connect each port of the already deployed polycube infrastructure with the right peer
-func ConnectCubes(conf *EnvConf, extIface *Iface) error {
+func ConnectCubes(cubes *polycube.Cubes, conf *EnvConf, extIface *Iface) error {
 	brName := conf.bridgeName
 	rName := conf.routerName
 	lbName := conf.lbrpName
@@ -250,13 +266,10 @@ func ConnectCubes(conf *EnvConf, extIface *Iface) error {
 	brToRPort := simplebridge.Ports{
 		Peer: brToRPortPeer,
 	}
-	if resp, err := simplebridgeAPI.UpdateSimplebridgePortsByID(context.TODO(), brName, brToRPortName, brToRPort); err != nil {
-		l.WithFields(log.Fields{
-			"error":    err,
-			"response": fmt.Sprintf("%+v", resp),
-		}).Fatal("failed to set bridge port peer")
-		return fmt.Errorf("failed to set %q port peer on %q bridge to %q - error: %s, response: %+v",
-			brToRPortName, brName, brToRPortPeer, err, resp,
+	if err := cubes.Bridges.UpdateBridgePort(brName, brToRPortName, brToRPort); err != nil {
+		l.WithField("detail", err).Error("failed to set bridge port peer")
+		return fmt.Errorf("failed to set %q port peer on %q bridge to %q - %v",
+			brToRPortName, brName, brToRPortPeer, err,
 		)
 	}
 	l.Info("bridge port peer set")
@@ -273,37 +286,73 @@ func ConnectCubes(conf *EnvConf, extIface *Iface) error {
 	rToBrPort := router.Ports{
 		Peer: rToBrPortPeer,
 	}
-	if resp, err := routerAPI.UpdateRouterPortsByID(context.TODO(), rName, rToBrPortName, rToBrPort); err != nil {
-		l.WithFields(log.Fields{
-			"error":    err,
-			"response": fmt.Sprintf("%+v", resp),
-		}).Fatal("failed to set router port peer")
-		return fmt.Errorf("failed to set %q port peer on %q router to %q - error: %s, response: %+v",
-			rToBrPortName, rName, rToBrPortPeer, err, resp,
+	if err := cubes.Routers.UpdateRouterPort(rName, rToBrPortName, rToBrPort); err != nil {
+		l.WithField("detail", err).Error("failed to set router port peer")
+		return fmt.Errorf("failed to set %q port peer on %q router to %q - %v",
+			rToBrPortName, rName, rToBrPortPeer, err,
 		)
 	}
 	l.Info("router port peer set")
 
-	// updating router "to_vxlan0" port in order to set peer=vxlan0
-	rToVxlanPortName := "to_vxlan0"
-	rToVxlanPortPeer := "vxlan0"
-	l = l.WithFields(log.Fields{
-		"port": rToVxlanPortName,
-		"peer": rToVxlanPortPeer,
-	})
-	rToVxlanPort := router.Ports{
-		Peer: rToVxlanPortPeer,
-	}
-	if resp, err := routerAPI.UpdateRouterPortsByID(context.TODO(), rName, rToVxlanPortName, rToVxlanPort); err != nil {
-		l.WithFields(log.Fields{
-			"error":    err,
-			"response": fmt.Sprintf("%+v", resp),
-		}).Fatal("failed to set router port peer")
-		return fmt.Errorf("failed to set %q port peer on %q router to %q - error: %s, response: %+v",
-			rToVxlanPortName, rName, rToVxlanPortPeer, err, resp,
-		)
+	// updating router overlay ports (e.g.: "to_vxlan0") in order to set peer=overlay interface (e.g.: vxlan0)
+	overlayPorts, _ := conf.overlay.RouterPorts()
+	for _, port := range overlayPorts {
+		l = l.WithFields(log.Fields{
+			"port": port.Name,
+			"peer": port.Peer,
+		})
+		rToOverlayPort := router.Ports{
+			Peer: port.Peer,
+		}
+		if err := cubes.Routers.UpdateRouterPort(rName, port.Name, rToOverlayPort); err != nil {
+			l.WithField("detail", err).Error("failed to set router port peer")
+			return fmt.Errorf("failed to set %q port peer on %q router to %q - %v",
+				port.Name, rName, port.Peer, err,
+			)
+		}
+		l.Info("router port peer set")
+	}
+
+	// updating router "to_host0" port in order to set peer=pkhost0r
+	if conf.egress.Masquerade {
+		l = l.WithFields(log.Fields{
+			"port": egressRouterPort,
+			"peer": egressRouterIfaceName,
+		})
+		rToHostPort := router.Ports{
+			Peer: egressRouterIfaceName,
+		}
+		if err := cubes.Routers.UpdateRouterPort(rName, egressRouterPort, rToHostPort); err != nil {
+			l.WithField("detail", err).Error("failed to set router port peer")
+			return fmt.Errorf("failed to set %q port peer on %q router to %q - %v",
+				egressRouterPort, rName, egressRouterIfaceName, err,
+			)
+		}
+		l.Info("router port peer set")
+	}
+
+	// updating router "to_egw0" port in order to set peer=pkegw0
+	if conf.egress.Gateway != nil {
+		l = l.WithFields(log.Fields{
+			"port": egressGwRouterPort,
+			"peer": egressGwIfaceName,
+		})
+		rToEgwPort := router.Ports{
+			Peer: egressGwIfaceName,
+		}
+		if err := cubes.Routers.UpdateRouterPort(rName, egressGwRouterPort, rToEgwPort); err != nil {
+			l.WithField("detail", err).Error("failed to set router port peer")
+			return fmt.Errorf("failed to set %q port peer on %q router to %q - %v",
+				egressGwRouterPort, rName, egressGwIfaceName, err,
+			)
+		}
+		l.Info("router port peer set")
+
+		// creating bridge "to_egw0" port connected to the node
+		if err := ConnectEgressGatewayBridge(cubes.Bridges, brName); err != nil {
+			return err
+		}
 	}
-	l.Info("router port peer set")
 
 	// updating router "to_lbrp0" port in order to set peer=lbrp0:to_r0
 	rToLbPortName := "to_lbrp0"
@@ -315,13 +364,10 @@ func ConnectCubes(conf *EnvConf, extIface *Iface) error {
 	rToLbPort := router.Ports{
 		Peer: rToLbPortPeer,
 	}
-	if resp, err := routerAPI.UpdateRouterPortsByID(context.TODO(), rName, rToLbPortName, rToLbPort); err != nil {
-		l.WithFields(log.Fields{
-			"error":    err,
-			"response": fmt.Sprintf("%+v", resp),
-		}).Fatal("failed to set router port peer")
-		return fmt.Errorf("failed to set %q port peer on %q router to %q - error: %s, response: %+v",
-			rToLbPortName, rName, rToLbPortPeer, err, resp,
+	if err := cubes.Routers.UpdateRouterPort(rName, rToLbPortName, rToLbPort); err != nil {
+		l.WithField("detail", err).Error("failed to set router port peer")
+		return fmt.Errorf("failed to set %q port peer on %q router to %q - %v",
+			rToLbPortName, rName, rToLbPortPeer, err,
 		)
 	}
 	l.Info("router port peer set")
@@ -338,13 +384,10 @@ func ConnectCubes(conf *EnvConf, extIface *Iface) error {
 	lbToRPort := lbrp.Ports{
 		Peer: lbToRPortPeer,
 	}
-	if resp, err := lbrpAPI.UpdateLbrpPortsByID(context.TODO(), lbName, lbToRPortName, lbToRPort); err != nil {
-		l.WithFields(log.Fields{
-			"error":    err,
-			"response": fmt.Sprintf("%+v", resp),
-		}).Fatal("failed to set lbrp port peer")
-		return fmt.Errorf("failed to set %q port peer on %q lbrp to %q - error: %s, response: %+v",
-			lbToRPortName, lbName, lbToRPortPeer, err, resp,
+	if err := cubes.Lbrps.UpdateLbrpPort(lbName, lbToRPortName, lbToRPort); err != nil {
+		l.WithField("detail", err).Error("failed to set lbrp port peer")
+		return fmt.Errorf("failed to set %q port peer on %q lbrp to %q - %v",
+			lbToRPortName, lbName, lbToRPortPeer, err,
 		)
 	}
 	l.Info("lbrp port peer set")
@@ -359,13 +402,10 @@ func ConnectCubes(conf *EnvConf, extIface *Iface) error {
 	lbToKPort := lbrp.Ports{
 		Peer: lbToKPortPeer,
 	}
-	if resp, err := lbrpAPI.UpdateLbrpPortsByID(context.TODO(), lbName, lbToKPortName, lbToKPort); err != nil {
-		l.WithFields(log.Fields{
-			"error":    err,
-			"response": fmt.Sprintf("%+v", resp),
-		}).Fatal("failed to set lbrp port peer")
-		return fmt.Errorf("failed to set %q port peer on %q lbrp to %q - error: %s, response: %+v",
-			lbToKPortName, lbName, lbToKPortPeer, err, resp,
+	if err := cubes.Lbrps.UpdateLbrpPort(lbName, lbToKPortName, lbToKPort); err != nil {
+		l.WithField("detail", err).Error("failed to set lbrp port peer")
+		return fmt.Errorf("failed to set %q port peer on %q lbrp to %q - %v",
+			lbToKPortName, lbName, lbToKPortPeer, err,
 		)
 	}
 	l.Info("lbrp port peer set")
@@ -382,13 +422,10 @@ func ConnectCubes(conf *EnvConf, extIface *Iface) error {
 	kToLbPort := k8sdispatcher.Ports{
 		Peer: kToLbPortPeer,
 	}
-	if resp, err := k8sdispatcherAPI.UpdateK8sdispatcherPortsByID(context.TODO(), kName, kToLbPortName, kToLbPort); err != nil {
-		l.WithFields(log.Fields{
-			"error":    err,
-			"response": fmt.Sprintf("%+v", resp),
-		}).Fatal("failed to set k8sdispatcher port peer")
-		return fmt.Errorf("failed to set %q port peer on %q k8sdispatcher to %q - error: %s, response: %+v",
-			kToLbPortName, kName, kToLbPortPeer, err, resp,
+	if err := cubes.Dispatchers.UpdateDispatcherPort(kName, kToLbPortName, kToLbPort); err != nil {
+		l.WithField("detail", err).Error("failed to set k8sdispatcher port peer")
+		return fmt.Errorf("failed to set %q port peer on %q k8sdispatcher to %q - %v",
+			kToLbPortName, kName, kToLbPortPeer, err,
 		)
 	}
 	l.Info("k8sdispatcher port peer set")
@@ -403,13 +440,10 @@ func ConnectCubes(conf *EnvConf, extIface *Iface) error {
 	kToIntPort := k8sdispatcher.Ports{
 		Peer: kToIntPortPeer,
 	}
-	if resp, err := k8sdispatcherAPI.UpdateK8sdispatcherPortsByID(context.TODO(), kName, kToIntPortName, kToIntPort); err != nil {
-		l.WithFields(log.Fields{
-			"error":    err,
-			"response": fmt.Sprintf("%+v", resp),
-		}).Fatal("failed to set k8sdispatcher port peer")
-		return fmt.Errorf("failed to set %q port peer on %q k8sdispatcher to %q - error: %s, response: %+v",
-			kToIntPortName, kName, kToIntPortPeer, err, resp,
+	if err := cubes.Dispatchers.UpdateDispatcherPort(kName, kToIntPortName, kToIntPort); err != nil {
+		l.WithField("detail", err).Error("failed to set k8sdispatcher port peer")
+		return fmt.Errorf("failed to set %q port peer on %q k8sdispatcher to %q - %v",
+			kToIntPortName, kName, kToIntPortPeer, err,
 		)
 	}
 	l.Info("k8sdispatcher port peer set")
@@ -417,21 +451,33 @@ func ConnectCubes(conf *EnvConf, extIface *Iface) error {
 	return nil
 }
 
-func CreateCubes(nodeInfo *NodeInfo, conf *EnvConf) error {
-	if err := CreateBridge(conf.bridgeName); err != nil {
+// CreateCubes creates the node cubes and connects them
+func CreateCubes(cubes *polycube.Cubes, nodeInfo *NodeInfo, conf *EnvConf) error {
+	if err := CreateBridge(cubes.Bridges, conf.bridgeName); err != nil {
+		return err
+	}
+	if err := CreateRouter(cubes.Routers, conf.routerName, conf.overlay, conf.egress, nodeInfo.extIface, nodeInfo.podGwInfo, nodeInfo.nodeGwInfo); err != nil {
 		return err
 	}
-	if err := CreateRouter(conf.routerName, nodeInfo.extIface, nodeInfo.podGwInfo, nodeInfo.nodeGwInfo); err != nil {
+	if err := CreateLbrp(cubes.Lbrps, conf.lbrpName); err != nil {
 		return err
 	}
-	if err := CreateLbrp(conf.lbrpName); err != nil {
+	if err := CreateK8sDispatcher(
+		cubes.Dispatchers, conf.k8sDispName, nodeInfo.podCIDR, conf.serviceCIDR, conf.nodePortRange,
+	); err != nil {
 		return err
 	}
-	if err := CreateK8sDispatcher(conf.k8sDispName, nodeInfo.podCIDR); err != nil {
+	// the k8sdispatcher could already exist with a different range
+	if _, err := SyncNodeportRange(cubes.Dispatchers, conf); err != nil {
 		return err
 	}
-	if err := ConnectCubes(conf, nodeInfo.extIface); err != nil {
+	if err := ConnectCubes(cubes, conf, nodeInfo.extIface); err != nil {
 		return err
 	}
+	if conf.egress.Masquerade {
+		if err := CreateEgressNat(cubes.Nats, conf, nodeInfo); err != nil {
+			return err
+		}
+	}
 	return nil
 }
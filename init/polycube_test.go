@@ -0,0 +1,230 @@
+package main
+
+import (
+	"github.com/ekoops/polykube-cni-plugin/test/fakepolycubed"
+	"github.com/ekoops/polykube-cni-plugin/utils/polycube"
+	router "github.com/ekoops/polykube-cni-plugin/utils/router"
+	"github.com/vishvananda/netlink"
+	"net"
+	"testing"
+)
+
+// newTestConf returns the configuration of a node using the vxlan overlay and the egress masquerade
+func newTestConf() *EnvConf {
+	_, serviceCIDR, _ := net.ParseCIDR("11.11.11.0/24")
+	_, vClusterCIDR, _ := net.ParseCIDR("10.10.0.0/16")
+	return &EnvConf{
+		nodeName:      "node1",
+		overlay:       &vxlanOverlay{name: "vxlan0", conf: &VxlanConf{}},
+		vClusterCIDR:  vClusterCIDR,
+		serviceCIDR:   serviceCIDR,
+		nodePortRange: NodePortRange{Min: 30000, Max: 32767},
+		egress:        &EgressConf{Masquerade: true, NatName: "nat0"},
+		bridgeName:    "br0",
+		routerName:    "r0",
+		lbrpName:      "lbrp0",
+		k8sDispName:   "k0",
+	}
+}
+
+// newTestNodeInfo returns the information of a node whose external interface is eth0
+func newTestNodeInfo() *NodeInfo {
+	mustParseIPNet := func(s string) *net.IPNet {
+		ip, ipNet, _ := net.ParseCIDR(s)
+		ipNet.IP = ip
+		return ipNet
+	}
+	mustParseMAC := func(s string) net.HardwareAddr {
+		mac, _ := net.ParseMAC(s)
+		return mac
+	}
+	_, podCIDR, _ := net.ParseCIDR("10.10.1.0/24")
+	return &NodeInfo{
+		name:    "node1",
+		podCIDR: podCIDR,
+		podGwInfo: &GwInfo{
+			IPNet: mustParseIPNet("10.10.1.254/24"),
+			MAC:   mustParseMAC("aa:bb:cc:dd:ee:ff"),
+		},
+		extIface: &Iface{
+			IPNet: mustParseIPNet("192.168.1.10/24"),
+			Link: &netlink.Device{LinkAttrs: netlink.LinkAttrs{
+				Name:         "eth0",
+				HardwareAddr: mustParseMAC("02:00:00:00:00:01"),
+			}},
+		},
+		nodeGwInfo: &GwInfo{
+			IPNet: mustParseIPNet("192.168.1.1/24"),
+			MAC:   mustParseMAC("02:00:00:00:00:02"),
+		},
+		MTU: 1450,
+	}
+}
+
+func TestCreateCubes(t *testing.T) {
+	srv := fakepolycubed.NewServer()
+	ts, url := srv.Start()
+	defer ts.Close()
+	cubes := polycube.NewCubes(url)
+	conf := newTestConf()
+	nodeInfo := newTestNodeInfo()
+
+	// the node setup is performed again after a restart, so it must succeed on already existing cubes
+	for i := 0; i < 2; i++ {
+		if err := CreateCubes(cubes, nodeInfo, conf); err != nil {
+			t.Fatalf("CreateCubes (run %d) failed: %v", i+1, err)
+		}
+	}
+
+	r, err := cubes.Routers.ReadRouter(conf.routerName)
+	if err != nil {
+		t.Fatalf("failed to read router: %v", err)
+	}
+	peers := map[string]string{
+		"to_br0":         "br0:to_r0",
+		"to_lbrp0":       "lbrp0:to_r0",
+		"to_vxlan0":      "vxlan0",
+		egressRouterPort: egressRouterIfaceName,
+	}
+	for _, port := range r.Ports {
+		peer, ok := peers[port.Name]
+		if !ok {
+			t.Errorf("unexpected router port %q", port.Name)
+			continue
+		}
+		delete(peers, port.Name)
+		if port.Peer != peer {
+			t.Errorf("router port %q peer - required: %q, found: %q", port.Name, peer, port.Peer)
+		}
+		if port.Status != "UP" {
+			t.Errorf("router port %q status - required: UP, found: %s", port.Name, port.Status)
+		}
+	}
+	for name := range peers {
+		t.Errorf("missing router port %q", name)
+	}
+
+	k, err := cubes.Dispatchers.ReadDispatcher(conf.k8sDispName)
+	if err != nil {
+		t.Fatalf("failed to read k8sdispatcher: %v", err)
+	}
+	if k.NodeportRange != conf.nodePortRange.String() {
+		t.Errorf("k8sdispatcher nodeport range - required: %q, found: %q", conf.nodePortRange, k.NodeportRange)
+	}
+	for _, port := range k.Ports {
+		if port.Status != "UP" {
+			t.Errorf("k8sdispatcher port %q status - required: UP, found: %s", port.Name, port.Status)
+		}
+	}
+
+	if err := checkEgressNat(cubes.Nats, conf, nodeInfo); err != nil {
+		t.Errorf("egress nat misconfigured: %v", err)
+	}
+}
+
+// TestCreateCubesLinkLocalPorts verifies that the router ports connected to the node through link-local addresses
+// don't overlap when all of them are enabled, for each backend connected through a veth pair
+func TestCreateCubesLinkLocalPorts(t *testing.T) {
+	overlays := map[string]Overlay{
+		wireguardRouterPort: &wireguardOverlay{name: "wg0", port: 51820},
+		ipipRouterPort:      &ipipOverlay{name: "ipip0"},
+	}
+	for overlayPort, overlay := range overlays {
+		srv := fakepolycubed.NewServer()
+		ts, url := srv.Start()
+		cubes := polycube.NewCubes(url)
+		conf := newTestConf()
+		conf.overlay = overlay
+		conf.egress.Gateway = &EgressGatewayConf{ConfigMapNamespace: "kube-system", ConfigMapName: "egress", VNI: 43, Port: 4790}
+		nodeInfo := newTestNodeInfo()
+
+		err := CreateCubes(cubes, nodeInfo, conf)
+		var r *router.Router
+		if err == nil {
+			r, err = cubes.Routers.ReadRouter(conf.routerName)
+		}
+		ts.Close()
+		if err != nil {
+			t.Fatalf("%s overlay: failed to create cubes: %v", overlay.Name(), err)
+		}
+		// every router port must be in its own subnet, otherwise the router can't choose the port of a directly
+		// connected destination
+		subnets := make(map[string]*net.IPNet)
+		for _, port := range r.Ports {
+			ip, subnet, err := net.ParseCIDR(port.Ip)
+			if err != nil {
+				t.Fatalf("%s overlay: router port %q address %q - %v", overlay.Name(), port.Name, port.Ip, err)
+			}
+			for name, other := range subnets {
+				if other.Contains(ip) || subnet.Contains(other.IP) {
+					t.Errorf("%s overlay: router ports %q (%s) and %q (%s) overlap",
+						overlay.Name(), port.Name, subnet, name, other)
+				}
+			}
+			subnets[port.Name] = subnet
+		}
+		for _, name := range []string{overlayPort, egressRouterPort, egressGwRouterPort} {
+			if _, ok := subnets[name]; !ok {
+				t.Errorf("%s overlay: missing router port %q", overlay.Name(), name)
+			}
+		}
+	}
+}
+
+// TestCreateCubesNewFeatures verifies that the node setup succeeds on a router created by a previous run with fewer
+// features enabled, creating the missing ports and arp entries
+func TestCreateCubesNewFeatures(t *testing.T) {
+	srv := fakepolycubed.NewServer()
+	ts, url := srv.Start()
+	defer ts.Close()
+	cubes := polycube.NewCubes(url)
+	conf := newTestConf()
+	conf.egress.Masquerade = false
+	nodeInfo := newTestNodeInfo()
+	if err := CreateCubes(cubes, nodeInfo, conf); err != nil {
+		t.Fatalf("CreateCubes failed: %v", err)
+	}
+
+	conf.overlay = &wireguardOverlay{name: "wg0", port: 51820}
+	conf.egress.Masquerade = true
+	conf.egress.Gateway = &EgressGatewayConf{ConfigMapNamespace: "kube-system", ConfigMapName: "egress", VNI: 43, Port: 4790}
+	if err := CreateCubes(cubes, nodeInfo, conf); err != nil {
+		t.Fatalf("CreateCubes with the new features failed: %v", err)
+	}
+	r, err := cubes.Routers.ReadRouter(conf.routerName)
+	if err != nil {
+		t.Fatalf("failed to read router: %v", err)
+	}
+	peers := map[string]string{
+		wireguardRouterPort: wireguardRouterIfaceName,
+		egressRouterPort:    egressRouterIfaceName,
+		egressGwRouterPort:  egressGwIfaceName,
+	}
+	for _, port := range r.Ports {
+		if peer, ok := peers[port.Name]; ok {
+			delete(peers, port.Name)
+			if port.Peer != peer {
+				t.Errorf("router port %q peer - required: %q, found: %q", port.Name, peer, port.Peer)
+			}
+		}
+		// the peer nodes address the egress gateway port through the node address
+		if mac := ipToMAC(nodeInfo.extIface.IPNet.IP).String(); port.Name == egressGwRouterPort && port.Mac != mac {
+			t.Errorf("router port %q MAC - required: %s, found: %s", port.Name, mac, port.Mac)
+		}
+	}
+	for name := range peers {
+		t.Errorf("missing router port %q", name)
+	}
+	brPort, err := cubes.Bridges.ReadBridgePort(conf.bridgeName, egressGwBridgePort)
+	if err != nil {
+		t.Fatalf("failed to read bridge port %q: %v", egressGwBridgePort, err)
+	}
+	if brPort.Peer != egressGwBridgePeerName {
+		t.Errorf("bridge port %q peer - required: %q, found: %q", egressGwBridgePort, egressGwBridgePeerName, brPort.Peer)
+	}
+	_, entries := conf.overlay.RouterPorts()
+	_, hostEntry := egressRouterPorts()
+	if err := checkArpEntries(r, append(entries, hostEntry)); err != nil {
+		t.Errorf("router arp table: %v", err)
+	}
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ekoops/polykube-cni-plugin/utils"
+	"github.com/ekoops/polykube-cni-plugin/utils/attachment"
+	k8sdispatcher "github.com/ekoops/polykube-cni-plugin/utils/k8sdispatcher"
+	lbrp "github.com/ekoops/polykube-cni-plugin/utils/lbrp"
+	"github.com/ekoops/polykube-cni-plugin/utils/polycube"
+	router "github.com/ekoops/polykube-cni-plugin/utils/router"
+	simplebridge "github.com/ekoops/polykube-cni-plugin/utils/simplebridge"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"strings"
+)
+
+const (
+	// reasonTopologyRepaired is the reason of the events emitted for each repaired node topology drift
+	reasonTopologyRepaired = "TopologyRepaired"
+	// reasonTopologyRepairFailed is the reason of the events emitted when a drift can't be repaired
+	reasonTopologyRepairFailed = "TopologyRepairFailed"
+)
+
+// reconciler periodically compares the node topology with the desired one, repairing the differences. Each repair
+// is logged, counted in the agent metrics and notified through an event on the node
+type reconciler struct {
+	conf        *EnvConf
+	nodeInfo    *NodeInfo
+	cubes       *polycube.Cubes
+	metrics     *Metrics
+	nodeCtrl    *nodeController
+	serviceCtrl *serviceController
+	podCtrl     *podController
+	// egressGwCtrl is nil if the egress gateway is not enabled
+	egressGwCtrl *egressGatewayController
+	recorder     record.EventRecorder
+	// unpersisted contains the pod host veths found without attachment state by the previous reconciliation
+	unpersisted map[string]bool
+}
+
+func newReconciler(
+	conf *EnvConf, nodeInfo *NodeInfo, cubes *polycube.Cubes, m *Metrics,
+	nodeCtrl *nodeController, serviceCtrl *serviceController, podCtrl *podController,
+	egressGwCtrl *egressGatewayController, recorder record.EventRecorder,
+) *reconciler {
+	return &reconciler{
+		conf:         conf,
+		nodeInfo:     nodeInfo,
+		cubes:        cubes,
+		metrics:      m,
+		nodeCtrl:     nodeCtrl,
+		serviceCtrl:  serviceCtrl,
+		podCtrl:      podCtrl,
+		egressGwCtrl: egressGwCtrl,
+		recorder:     recorder,
+		unpersisted:  make(map[string]bool),
+	}
+}
+
+// newEventRecorder returns a recorder emitting the agent events through the API server. The returned function stops
+// the events delivery
+func newEventRecorder(nodeName string) (record.EventRecorder, func()) {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	recorder := broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: "polykube-agent", Host: nodeName})
+	return recorder, broadcaster.Shutdown
+}
+
+// repaired records the repair of a drift on the provided resource
+func (r *reconciler) repaired(resource, name, message string) {
+	log.WithFields(log.Fields{
+		"resource": resource,
+		"name":     name,
+	}).Warning(message)
+	r.metrics.ObserveRepair(resource)
+	r.recorder.Eventf(r.nodeInfo.kNode, v1.EventTypeWarning, reasonTopologyRepaired, "%s %s: %s", resource, name, message)
+}
+
+// failed records the failure of a repair on the provided resource
+func (r *reconciler) failed(resource, name string, err error) error {
+	log.WithFields(log.Fields{
+		"resource": resource,
+		"name":     name,
+		"detail":   err,
+	}).Error("failed to repair node topology drift")
+	r.recorder.Eventf(r.nodeInfo.kNode, v1.EventTypeWarning, reasonTopologyRepairFailed, "%s %s: %v", resource, name, err)
+	return fmt.Errorf("failed to repair %s %q: %v", resource, name, err)
+}
+
+// run reconciles the node topology. It is meant to be called periodically
+func (r *reconciler) run(_ context.Context) {
+	err := r.reconcile()
+	r.metrics.ObserveReconciliation(err)
+	if err != nil {
+		log.WithField("detail", err).Error("node topology reconciliation failed")
+	}
+}
+
+// reconcile repairs, in order, the node-wide overlay resources, the node cubes (recreating them if polycubed lost them), their
+// ports peers, the k8sdispatcher NodePort range, the pod attachments, the router default route and default gateway arp entry, the routes towards the
+// peer nodes and, finally, the egress masquerade and gateway resources
+func (r *reconciler) reconcile() error {
+	var errs []string
+	for _, step := range []func() error{
+		r.reconcileOverlay,
+		r.reconcileCubes,
+		r.reconcilePortsPeers,
+		r.reconcileNodeportRange,
+		r.reconcileAttachments,
+		r.reconcileDefaultRoute,
+		r.reconcilePeerNodes,
+		r.reconcileEgress,
+	} {
+		if err := step(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (r *reconciler) reconcileOverlay() error {
+	overlay := r.conf.overlay
+	name := overlay.Name()
+	err := overlay.Check(r.nodeInfo)
+	if err == nil {
+		return nil
+	}
+	if err := overlay.Setup(r.nodeInfo); err != nil {
+		return r.failed("overlay", name, err)
+	}
+	// if the interfaces were recreated, the router ports are still attached to the old ones: they are detached and
+	// attached again to the new ones
+	ports, _ := overlay.RouterPorts()
+	rName := r.conf.routerName
+	for _, port := range ports {
+		for _, peer := range []string{"", port.Peer} {
+			if err := r.cubes.Routers.SetRouterPortPeer(rName, port.Name, peer); err != nil {
+				return r.failed("overlay", name, fmt.Errorf("failed to attach %q router to %q - %v", rName, port.Peer, err))
+			}
+		}
+	}
+	r.repaired("overlay", name, fmt.Sprintf("overlay reconfigured (%v)", err))
+	return nil
+}
+
+// reconcileCubes recreates the node cubes if at least one of them is missing, as it happens when polycubed is
+// restarted. Since the lbrp services are lost with the lbrp, the cluster services are synced again
+func (r *reconciler) reconcileCubes() error {
+	var missing []string
+	for _, c := range []struct{ kind, name string }{
+		{"simplebridge", r.conf.bridgeName},
+		{"router", r.conf.routerName},
+		{"lbrp", r.conf.lbrpName},
+		{"k8sdispatcher", r.conf.k8sDispName},
+	} {
+		if _, err := readCubePorts(r.cubes, c.kind, c.name); err != nil {
+			if !polycube.IsNotFound(err) {
+				return fmt.Errorf("failed to retrieve %s %q - %v", c.kind, c.name, err)
+			}
+			missing = append(missing, c.kind+"/"+c.name)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	name := strings.Join(missing, ",")
+	if err := CreateCubes(r.cubes, r.nodeInfo, r.conf); err != nil {
+		return r.failed("cube", name, err)
+	}
+	// the peer nodes routes are restored by reconcilePeerNodes
+	if err := r.serviceCtrl.resync(); err != nil {
+		return r.failed("cube", name, fmt.Errorf("failed to resync services: %v", err))
+	}
+	r.repaired("cube", name, "missing cubes recreated")
+	return nil
+}
+
+// updatePortPeer sets the peer of the port of the cube of the provided kind
+func updatePortPeer(cubes *polycube.Cubes, p expectedPort) error {
+	switch p.kind {
+	case "simplebridge":
+		return cubes.Bridges.UpdateBridgePort(p.cube, p.port, simplebridge.Ports{Peer: p.peer})
+	case "router":
+		return cubes.Routers.UpdateRouterPort(p.cube, p.port, router.Ports{Peer: p.peer})
+	case "lbrp":
+		return cubes.Lbrps.UpdateLbrpPort(p.cube, p.port, lbrp.Ports{Peer: p.peer})
+	case "k8sdispatcher":
+		return cubes.Dispatchers.UpdateDispatcherPort(p.cube, p.port, k8sdispatcher.Ports{Peer: p.peer})
+	}
+	return fmt.Errorf("unknown cube kind %q", p.kind)
+}
+
+func (r *reconciler) reconcilePortsPeers() error {
+	expected := nodeCubesPorts(r.conf, r.nodeInfo.extIface.Link.Attrs().Name)
+	current := make(map[string][]cubePort)
+	var errs []string
+	for _, e := range expected {
+		ports, ok := current[e.cube]
+		if !ok {
+			var err error
+			if ports, err = readCubePorts(r.cubes, e.kind, e.cube); err != nil {
+				return fmt.Errorf("failed to retrieve %s %q - %v", e.kind, e.cube, err)
+			}
+			current[e.cube] = ports
+		}
+		peer := ""
+		for _, p := range ports {
+			if p.name == e.port {
+				peer = p.peer
+			}
+		}
+		if peer == e.peer {
+			continue
+		}
+		name := utils.CreatePeer(e.cube, e.port)
+		if err := updatePortPeer(r.cubes, e); err != nil {
+			errs = append(errs, r.failed("port", name, err).Error())
+			continue
+		}
+		r.repaired("port", name, fmt.Sprintf("peer changed from %q to %q", peer, e.peer))
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// reconcileNodeportRange restores the configured NodePort range on the k8sdispatcher
+func (r *reconciler) reconcileNodeportRange() error {
+	updated, err := SyncNodeportRange(r.cubes.Dispatchers, r.conf)
+	if err != nil {
+		return r.failed("k8sdispatcher", r.conf.k8sDispName, err)
+	}
+	if updated {
+		r.repaired("k8sdispatcher", r.conf.k8sDispName, "nodeport range restored")
+	}
+	return nil
+}
+
+// reconcileAttachments rebuilds the missing per-pod lbrps. Since the pods virtual addresses, the replicated services
+// and the egress gateway steering are lost with their lbrps, the node pods and the egress gateway policies are synced
+// again if at least one lbrp is rebuilt, while the replicated services are configured again in the rebuilt lbrps
+func (r *reconciler) reconcileAttachments() error {
+	var recovered []string
+	err := recoverAttachments(r.cubes, r.conf, r.unpersisted, func(name, message string) {
+		recovered = append(recovered, name)
+		r.repaired("attachment", name, message)
+	})
+	if len(recovered) > 0 {
+		if err := r.podCtrl.resync(); err != nil {
+			return r.failed("attachment", "pods", fmt.Errorf("failed to resync pods: %v", err))
+		}
+		for _, name := range recovered {
+			r.serviceCtrl.resyncPodLbrp(attachment.LbrpName(name))
+		}
+		// the rebuilt lbrps are connected to the bridge, even if their pods were steered towards an egress gateway
+		if r.egressGwCtrl != nil {
+			r.egressGwCtrl.resync()
+		}
+	}
+	return err
+}
+
+// reconcileDefaultRoute restores the router default route and the static arp entry of the node default gateway, as
+// configured by CreateRouter
+func (r *reconciler) reconcileDefaultRoute() error {
+	rName := r.conf.routerName
+	rt, err := r.cubes.Routers.ReadRouter(rName)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve router %q - %v", rName, err)
+	}
+	gwIP := r.nodeInfo.nodeGwInfo.IPNet.IP.String()
+	gwMAC := r.nodeInfo.nodeGwInfo.MAC.String()
+
+	found := false
+	for _, route := range rt.Route {
+		if route.Network != "0.0.0.0/0" {
+			continue
+		}
+		if route.Nexthop == gwIP {
+			found = true
+			continue
+		}
+		if err := r.cubes.Routers.DeleteRoute(rName, route.Network, route.Nexthop); err != nil && !polycube.IsNotFound(err) {
+			return r.failed("route", rName, err)
+		}
+		r.repaired("route", rName, fmt.Sprintf("unexpected default route via %s removed", route.Nexthop))
+	}
+	if !found {
+		route := router.Route{
+			Network:    "0.0.0.0/0",
+			Nexthop:    gwIP,
+			Interface_: "to_lbrp0",
+		}
+		if err := r.cubes.Routers.CreateRoute(rName, route); err != nil && !polycube.IsConflict(err) {
+			return r.failed("route", rName, err)
+		}
+		r.repaired("route", rName, fmt.Sprintf("default route via %s restored", gwIP))
+	}
+
+	for _, entry := range rt.ArpTable {
+		if entry.Address == gwIP && strings.EqualFold(entry.Mac, gwMAC) {
+			return nil
+		}
+	}
+	entry := router.ArpTable{
+		Address:    gwIP,
+		Mac:        gwMAC,
+		Interface_: "to_lbrp0",
+	}
+	if err := r.cubes.Routers.ReplaceArpEntry(rName, entry); err != nil {
+		return r.failed("arp", rName, err)
+	}
+	r.repaired("arp", rName, fmt.Sprintf("default gateway arp entry %s -> %s restored", gwIP, gwMAC))
+	return nil
+}
+
+// reconcilePeerNodes restores the router routes and the overlay resources needed to reach the peer nodes pods,
+// removing the routes towards nodes that are not peers anymore
+func (r *reconciler) reconcilePeerNodes() error {
+	var err error
+	r.nodeCtrl.withPeers(func(peers map[string]*PeerNode) {
+		err = r.reconcilePeerNodesLocked(peers)
+	})
+	return err
+}
+
+func (r *reconciler) reconcilePeerNodesLocked(peers map[string]*PeerNode) error {
+	overlay := r.conf.overlay
+	rName := r.conf.routerName
+	rt, err := r.cubes.Routers.ReadRouter(rName)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve router %q - %v", rName, err)
+	}
+
+	var errs []string
+	expected := make(map[string]bool)
+	for name, peer := range peers {
+		var drift error
+		for _, route := range peerRoutes(overlay, peer) {
+			expected[route.Network+" "+route.Nexthop] = true
+			if drift == nil && !hasRoute(rt, route) {
+				drift = fmt.Errorf("route to %s via %s is missing", route.Network, route.Nexthop)
+			}
+		}
+		if drift == nil {
+			drift = overlay.CheckPeer(rt, peer)
+		}
+		if drift == nil {
+			continue
+		}
+		if err := AddNode(overlay, r.cubes.Routers, rName, r.nodeInfo, peer); err != nil {
+			errs = append(errs, r.failed("node", name, err).Error())
+			continue
+		}
+		r.repaired("node", name, fmt.Sprintf("%s overlay towards %s restored (%v)", overlay.Name(), peer.IP, drift))
+	}
+
+	// the overlay routes are only the ones towards the peer nodes pods and pods virtual addresses
+	for _, route := range rt.Route {
+		if !overlay.IsPeerRoute(route) || expected[route.Network+" "+route.Nexthop] {
+			continue
+		}
+		if err := r.cubes.Routers.DeleteRoute(rName, route.Network, route.Nexthop); err != nil && !polycube.IsNotFound(err) {
+			errs = append(errs, r.failed("route", rName, err).Error())
+			continue
+		}
+		r.repaired("route", rName, fmt.Sprintf("stale route to %s via %s removed", route.Network, route.Nexthop))
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// reconcileEgress restores the veth pair connecting the router to the node, the nat cube and the non-masquerade
+// routes, if the egress masquerade is enabled, and the egress gateway interface, if the egress gateway is enabled
+func (r *reconciler) reconcileEgress() error {
+	if !r.conf.egress.Masquerade {
+		return nil
+	}
+	rName := r.conf.routerName
+	if err := checkEgressIface(r.nodeInfo); err != nil {
+		if err := CreateEgressIface(r.nodeInfo); err != nil {
+			return r.failed("interface", egressHostIfaceName, err)
+		}
+		// if the veth pair was recreated, the router port is still attached to the old one
+		for _, peer := range []string{"", egressRouterIfaceName} {
+			if err := r.cubes.Routers.SetRouterPortPeer(rName, egressRouterPort, peer); err != nil {
+				return r.failed("interface", egressHostIfaceName,
+					fmt.Errorf("failed to attach %q router to %q - %v", rName, egressRouterIfaceName, err),
+				)
+			}
+		}
+		r.repaired("interface", egressHostIfaceName, fmt.Sprintf("egress interface reconfigured (%v)", err))
+	}
+
+	natName := r.conf.egress.NatName
+	if err := checkEgressNat(r.cubes.Nats, r.conf, r.nodeInfo); err != nil {
+		if err := CreateEgressNat(r.cubes.Nats, r.conf, r.nodeInfo); err != nil {
+			return r.failed("nat", natName, err)
+		}
+		r.repaired("nat", natName, fmt.Sprintf("nat reconfigured (%v)", err))
+		// the egress gateway rules are lost with the nat cube
+		if r.egressGwCtrl != nil {
+			r.egressGwCtrl.resync()
+		}
+	}
+
+	if gw := r.conf.egress.Gateway; gw != nil {
+		if err := checkEgressGatewayIface(gw); err != nil {
+			// an interface with different parameters can't be updated
+			if link, linkErr := netlink.LinkByName(egressGwIfaceName); linkErr == nil {
+				if err := netlink.LinkDel(link); err != nil {
+					return r.failed("interface", egressGwIfaceName, err)
+				}
+			}
+			if err := CreateEgressGatewayIface(gw, r.nodeInfo); err != nil {
+				return r.failed("interface", egressGwIfaceName, err)
+			}
+			// if the interface was recreated, the router port is still attached to the old one
+			for _, peer := range []string{"", egressGwIfaceName} {
+				if err := r.cubes.Routers.SetRouterPortPeer(rName, egressGwRouterPort, peer); err != nil {
+					return r.failed("interface", egressGwIfaceName,
+						fmt.Errorf("failed to attach %q router to %q - %v", rName, egressGwIfaceName, err),
+					)
+				}
+			}
+			r.repaired("interface", egressGwIfaceName, fmt.Sprintf("egress gateway interface reconfigured (%v)", err))
+			// the steering routes through the old interface are lost with it
+			if r.egressGwCtrl != nil {
+				r.egressGwCtrl.resync()
+			}
+		}
+		if err := checkEgressGatewayBridgeIface(); err != nil {
+			if err := createEgressGatewayBridgeIface(r.nodeInfo); err != nil {
+				return r.failed("interface", egressGwBridgeIfaceName, err)
+			}
+			// if the veth pair was recreated, the bridge port is still attached to the old one
+			brName := r.conf.bridgeName
+			if err := r.cubes.Bridges.DeleteBridgePort(brName, egressGwBridgePort); err != nil &&
+				!polycube.IsNotFound(err) {
+				return r.failed("interface", egressGwBridgeIfaceName,
+					fmt.Errorf("failed to detach %q bridge from %q - %v", brName, egressGwBridgePeerName, err),
+				)
+			}
+			if err := ConnectEgressGatewayBridge(r.cubes.Bridges, brName); err != nil {
+				return r.failed("interface", egressGwBridgeIfaceName, err)
+			}
+			r.repaired("interface", egressGwBridgeIfaceName,
+				fmt.Sprintf("egress gateway bridge interface reconfigured (%v)", err),
+			)
+			if r.egressGwCtrl != nil {
+				r.egressGwCtrl.resync()
+			}
+		}
+	}
+
+	var err error
+	r.nodeCtrl.withPeers(func(peers map[string]*PeerNode) {
+		err = SyncEgressRoutes(r.cubes.Routers, r.conf, r.nodeInfo, peers, func(message string) {
+			r.repaired("route", rName, message)
+		})
+	})
+	if err != nil {
+		return r.failed("route", rName, err)
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	lbrp "github.com/ekoops/polykube-cni-plugin/utils/lbrp"
+	v1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1"
+)
+
+const (
+	// the weights of the service backends, depending on their locality with respect to the current node
+	localBackendWeight  = 4
+	zoneBackendWeight   = 2
+	remoteBackendWeight = 1
+)
+
+// nodeTopology describes the locality of the current node
+type nodeTopology struct {
+	name   string
+	labels map[string]string
+}
+
+// serviceEndpoint is a service endpoint, as described by an EndpointSlice, for a specific service port
+type serviceEndpoint struct {
+	ip       string
+	port     int32
+	topology map[string]string
+	// zoneHints contains the zones whose nodes should use the endpoint, as hinted by the EndpointSlice controller. It
+	// is nil if the endpoint has no hints
+	zoneHints map[string]bool
+	ready     bool
+	// serving is true if the endpoint is terminating but still able to serve the traffic
+	serving bool
+}
+
+// matches returns true if the endpoint has the same value of the current node for the provided topology key
+func (n *nodeTopology) matches(ep *serviceEndpoint, key string) bool {
+	value, ok := n.labels[key]
+	if key == v1.LabelHostname && !ok {
+		value, ok = n.name, true
+	}
+	return ok && ep.topology[key] == value
+}
+
+// local returns true if the endpoint is on the current node
+func (n *nodeTopology) local(ep *serviceEndpoint) bool {
+	return ep.topology[v1.LabelHostname] == n.name || n.matches(ep, v1.LabelHostname)
+}
+
+// weight returns the lbrp weight of the provided endpoint, favouring the node-local endpoints and then the ones in the
+// same zone of the current node
+func (n *nodeTopology) weight(ep *serviceEndpoint) int32 {
+	switch {
+	case n.local(ep):
+		return localBackendWeight
+	case n.matches(ep, v1.LabelTopologyZone):
+		return zoneBackendWeight
+	default:
+		return remoteBackendWeight
+	}
+}
+
+// serviceBackend is a service backend selected for the current node
+type serviceBackend struct {
+	lbrp.ServiceBackend
+	// Local is true if the backend is on the current node
+	Local bool
+}
+
+// lbrpBackends returns the lbrp entries of the provided backends
+func lbrpBackends(backends []serviceBackend) []lbrp.ServiceBackend {
+	var entries []lbrp.ServiceBackend
+	for _, backend := range backends {
+		entries = append(entries, backend.ServiceBackend)
+	}
+	return entries
+}
+
+// collectEndpoints returns the IPv4 endpoints described by the provided EndpointSlices for the provided service port.
+// The endpoints that are neither ready nor serving are discarded
+func collectEndpoints(slices []*discovery.EndpointSlice, port v1.ServicePort, node *nodeTopology) []serviceEndpoint {
+	var eps []serviceEndpoint
+	seen := make(map[string]bool)
+	for _, slice := range slices {
+		if slice.AddressType != discovery.AddressTypeIPv4 {
+			continue
+		}
+		for _, epPort := range slice.Ports {
+			if epPort.Port == nil || epPort.Name == nil || *epPort.Name != port.Name ||
+				epPort.Protocol == nil || *epPort.Protocol != port.Protocol {
+				continue
+			}
+			for _, endpoint := range slice.Endpoints {
+				ep := serviceEndpoint{
+					port:     *epPort.Port,
+					topology: make(map[string]string),
+					// a nil ready condition must be interpreted as ready
+					ready:   endpoint.Conditions.Ready == nil || *endpoint.Conditions.Ready,
+					serving: endpoint.Conditions.Serving != nil && *endpoint.Conditions.Serving,
+				}
+				if endpoint.Conditions.Terminating != nil && *endpoint.Conditions.Terminating {
+					ep.ready = false
+				}
+				if !ep.ready && !ep.serving {
+					continue
+				}
+				if endpoint.Zone != nil {
+					ep.topology[v1.LabelTopologyZone] = *endpoint.Zone
+				}
+				if endpoint.NodeName != nil {
+					ep.topology[v1.LabelHostname] = *endpoint.NodeName
+				}
+				if endpoint.Hints != nil && len(endpoint.Hints.ForZones) > 0 {
+					ep.zoneHints = make(map[string]bool, len(endpoint.Hints.ForZones))
+					for _, zone := range endpoint.Hints.ForZones {
+						ep.zoneHints[zone.Name] = true
+					}
+				}
+				for _, addr := range endpoint.Addresses {
+					if seen[addr] {
+						continue
+					}
+					seen[addr] = true
+					ep.ip = addr
+					eps = append(eps, ep)
+				}
+			}
+		}
+	}
+	return eps
+}
+
+// filterEndpoints returns the endpoints satisfying the provided predicate
+func filterEndpoints(eps []serviceEndpoint, keep func(ep *serviceEndpoint) bool) []serviceEndpoint {
+	var filtered []serviceEndpoint
+	for i := range eps {
+		if keep(&eps[i]) {
+			filtered = append(filtered, eps[i])
+		}
+	}
+	return filtered
+}
+
+// activeEndpoints returns the ready endpoints or, if none of them is ready, the terminating endpoints still serving
+// the traffic. In this way, the terminating endpoints stop receiving new connections as soon as possible, but they
+// are still used while a replacement is not ready
+func activeEndpoints(eps []serviceEndpoint) []serviceEndpoint {
+	ready := filterEndpoints(eps, func(ep *serviceEndpoint) bool { return ep.ready })
+	if len(ready) > 0 {
+		return ready
+	}
+	return eps
+}
+
+// hintedEndpoints returns the endpoints whose zone hints include the zone of the current node. As kube-proxy does,
+// the hints are ignored if the node has no zone, if any endpoint has no hints or if no endpoint is hinted for the
+// node zone, so that the traffic is never dropped because of them
+func hintedEndpoints(eps []serviceEndpoint, node *nodeTopology) []serviceEndpoint {
+	zone, ok := node.labels[v1.LabelTopologyZone]
+	if !ok {
+		return eps
+	}
+	var hinted []serviceEndpoint
+	for _, ep := range eps {
+		if ep.zoneHints == nil {
+			return eps
+		}
+		if ep.zoneHints[zone] {
+			hinted = append(hinted, ep)
+		}
+	}
+	if len(hinted) == 0 {
+		return eps
+	}
+	return hinted
+}
+
+// SelectBackends returns the lbrp backends of the provided service port, weighted by their locality. The internal
+// traffic of a service with the Local internal traffic policy and the external traffic of a service with the Local
+// external traffic policy are served only by the node-local endpoints. Otherwise, the endpoints hinted for the zone of
+// the current node are preferred
+func SelectBackends(svc *v1.Service, eps []serviceEndpoint, node *nodeTopology, external bool) []serviceBackend {
+	local := false
+	if external && svc.Spec.ExternalTrafficPolicy == v1.ServiceExternalTrafficPolicyTypeLocal {
+		local = true
+	} else if !external && svc.Spec.InternalTrafficPolicy != nil &&
+		*svc.Spec.InternalTrafficPolicy == v1.ServiceInternalTrafficPolicyLocal {
+		local = true
+	}
+	if local {
+		eps = filterEndpoints(eps, node.local)
+	}
+	eps = activeEndpoints(eps)
+	if !local {
+		eps = hintedEndpoints(eps, node)
+	}
+	var backends []serviceBackend
+	for _, ep := range eps {
+		backends = append(backends, serviceBackend{
+			ServiceBackend: lbrp.ServiceBackend{
+				Name:   ep.ip,
+				Ip:     ep.ip,
+				Port:   ep.port,
+				Weight: node.weight(&ep),
+			},
+			Local: node.local(&ep),
+		})
+	}
+	return backends
+}
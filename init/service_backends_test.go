@@ -0,0 +1,150 @@
+package main
+
+import (
+	v1 "k8s.io/api/core/v1"
+	"testing"
+)
+
+func TestSelectBackends(t *testing.T) {
+	node := &nodeTopology{
+		name:   "node1",
+		labels: map[string]string{v1.LabelTopologyZone: "zone-a"},
+	}
+	eps := []serviceEndpoint{
+		{ip: "10.10.1.5", port: 80, ready: true, topology: map[string]string{v1.LabelHostname: "node1"}},
+		{ip: "10.10.2.5", port: 80, ready: true,
+			topology: map[string]string{v1.LabelHostname: "node2", v1.LabelTopologyZone: "zone-a"}},
+		{ip: "10.10.3.5", port: 80, ready: true,
+			topology: map[string]string{v1.LabelHostname: "node3", v1.LabelTopologyZone: "zone-b"}},
+	}
+	local := v1.ServiceInternalTrafficPolicyLocal
+	cluster := v1.ServiceInternalTrafficPolicyCluster
+
+	for _, tc := range []struct {
+		name     string
+		spec     v1.ServiceSpec
+		external bool
+		// weights contains the expected backends weights, indexed by address
+		weights map[string]int32
+	}{
+		{
+			name: "internal traffic with the default policy",
+			weights: map[string]int32{
+				"10.10.1.5": localBackendWeight, "10.10.2.5": zoneBackendWeight, "10.10.3.5": remoteBackendWeight,
+			},
+		},
+		{
+			name: "internal traffic with the Cluster policy",
+			spec: v1.ServiceSpec{InternalTrafficPolicy: &cluster},
+			weights: map[string]int32{
+				"10.10.1.5": localBackendWeight, "10.10.2.5": zoneBackendWeight, "10.10.3.5": remoteBackendWeight,
+			},
+		},
+		{
+			name:    "internal traffic with the Local policy",
+			spec:    v1.ServiceSpec{InternalTrafficPolicy: &local},
+			weights: map[string]int32{"10.10.1.5": localBackendWeight},
+		},
+		{
+			name:     "external traffic with the Local internal policy",
+			spec:     v1.ServiceSpec{InternalTrafficPolicy: &local},
+			external: true,
+			weights: map[string]int32{
+				"10.10.1.5": localBackendWeight, "10.10.2.5": zoneBackendWeight, "10.10.3.5": remoteBackendWeight,
+			},
+		},
+		{
+			name:     "external traffic with the Local external policy",
+			spec:     v1.ServiceSpec{ExternalTrafficPolicy: v1.ServiceExternalTrafficPolicyTypeLocal},
+			external: true,
+			weights:  map[string]int32{"10.10.1.5": localBackendWeight},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			backends := SelectBackends(&v1.Service{Spec: tc.spec}, eps, node, tc.external)
+			if len(backends) != len(tc.weights) {
+				t.Fatalf("wrong backends number - required: %d, found: %+v", len(tc.weights), backends)
+			}
+			for _, backend := range backends {
+				if weight, ok := tc.weights[backend.Ip]; !ok || backend.Weight != weight {
+					t.Errorf("unexpected backend %+v", backend)
+				}
+			}
+		})
+	}
+}
+
+func TestSelectBackendsZoneHints(t *testing.T) {
+	node := &nodeTopology{
+		name:   "node1",
+		labels: map[string]string{v1.LabelTopologyZone: "zone-a"},
+	}
+	hinted := func(ip string, zones ...string) serviceEndpoint {
+		ep := serviceEndpoint{ip: ip, port: 80, ready: true, topology: map[string]string{}}
+		if len(zones) > 0 {
+			ep.zoneHints = make(map[string]bool)
+			for _, zone := range zones {
+				ep.zoneHints[zone] = true
+			}
+		}
+		return ep
+	}
+	local := v1.ServiceInternalTrafficPolicyLocal
+
+	for _, tc := range []struct {
+		name string
+		spec v1.ServiceSpec
+		node *nodeTopology
+		eps  []serviceEndpoint
+		// ips contains the expected backends addresses
+		ips []string
+	}{
+		{
+			name: "endpoints hinted for the node zone",
+			node: node,
+			eps:  []serviceEndpoint{hinted("10.10.1.5", "zone-a"), hinted("10.10.2.5", "zone-b", "zone-a"), hinted("10.10.3.5", "zone-b")},
+			ips:  []string{"10.10.1.5", "10.10.2.5"},
+		},
+		{
+			name: "an endpoint without hints",
+			node: node,
+			eps:  []serviceEndpoint{hinted("10.10.1.5", "zone-a"), hinted("10.10.2.5")},
+			ips:  []string{"10.10.1.5", "10.10.2.5"},
+		},
+		{
+			name: "no endpoint hinted for the node zone",
+			node: node,
+			eps:  []serviceEndpoint{hinted("10.10.1.5", "zone-b"), hinted("10.10.2.5", "zone-c")},
+			ips:  []string{"10.10.1.5", "10.10.2.5"},
+		},
+		{
+			name: "node without a zone",
+			node: &nodeTopology{name: "node1"},
+			eps:  []serviceEndpoint{hinted("10.10.1.5", "zone-a"), hinted("10.10.2.5", "zone-b")},
+			ips:  []string{"10.10.1.5", "10.10.2.5"},
+		},
+		{
+			name: "hints ignored by the Local policy",
+			spec: v1.ServiceSpec{InternalTrafficPolicy: &local},
+			node: node,
+			eps: []serviceEndpoint{
+				hinted("10.10.1.5", "zone-b"), hinted("10.10.2.5", "zone-a"),
+			},
+			ips: []string{"10.10.1.5"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// the first endpoint is always the node-local one
+			tc.eps[0].topology[v1.LabelHostname] = "node1"
+			backends := SelectBackends(&v1.Service{Spec: tc.spec}, tc.eps, tc.node, false)
+			if len(backends) != len(tc.ips) {
+				t.Fatalf("wrong backends number - required: %d, found: %+v", len(tc.ips), backends)
+			}
+			for i, backend := range backends {
+				if backend.Ip != tc.ips[i] {
+					t.Errorf("unexpected backend %+v - required address: %s", backend, tc.ips[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,714 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/ekoops/polykube-cni-plugin/utils/affinity"
+	"github.com/ekoops/polykube-cni-plugin/utils/attachment"
+	k8sdispatcher "github.com/ekoops/polykube-cni-plugin/utils/k8sdispatcher"
+	lbrp "github.com/ekoops/polykube-cni-plugin/utils/lbrp"
+	"github.com/ekoops/polykube-cni-plugin/utils/polycube"
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// reasonSessionAffinityNotApplied is the reason of the events emitted for the ClientIP session affinity services
+	// reachable by clients whose traffic doesn't cross a per-pod lbrp
+	reasonSessionAffinityNotApplied = "SessionAffinityNotApplied"
+	// podLbrpKeyPrefix is the prefix of the keys identifying a per-pod lbrp to configure with the replicated services.
+	// A namespace can't contain a colon, so these keys can't be confused with the services ones
+	podLbrpKeyPrefix = "lbrp:"
+)
+
+// lbrpServiceKey identifies a lbrp service entry
+type lbrpServiceKey struct {
+	vip   string
+	vport int32
+	proto string
+}
+
+// serviceController keeps the lbrp services aligned with the cluster ClusterIP services and their endpoints. The edge
+// services (e.g.: kube-dns) are also replicated into every per-pod lbrp, so that their traffic is load-balanced at the
+// pod edge. The same happens for the services with ClientIP session affinity, whose per-pod lbrp entries contain only
+// the backend the pod is pinned to
+type serviceController struct {
+	*controller
+	conf        *EnvConf
+	lbrps       polycube.LbrpManager
+	dispatchers polycube.DispatcherManager
+	recorder    record.EventRecorder
+	// nodeIP is the address on which the NodePort services are exposed
+	nodeIP        string
+	serviceLister corelisters.ServiceLister
+	sliceLister   discoverylisters.EndpointSliceLister
+	nodeLister    corelisters.NodeLister
+	// services contains the lbrp service entries currently configured for each cluster service, indexed by
+	// namespace/name
+	services map[string][]lbrpServiceKey
+	// podServices contains the per-pod lbrps service entries currently configured for each service replicated into
+	// them, indexed by namespace/name
+	podServices map[string][]lbrpServiceKey
+	// pins keeps the pods pinned to the backends of the services with ClientIP session affinity
+	pins *affinity.Table
+	// announcer announces the services external addresses elected on the current node. It is nil if the L2
+	// announcement is disabled
+	announcer *l2Announcer
+	// nodePorts contains the k8sdispatcher NodePort rules currently configured for each cluster service, indexed by
+	// namespace/name
+	nodePorts map[string][]nodePortKey
+}
+
+func newServiceController(
+	conf *EnvConf, nodeInfo *NodeInfo, cubes *polycube.Cubes, factory informers.SharedInformerFactory,
+	announcer *l2Announcer, recorder record.EventRecorder,
+) *serviceController {
+	serviceInformer := factory.Core().V1().Services()
+	sliceInformer := factory.Discovery().V1().EndpointSlices()
+	nodeInformer := factory.Core().V1().Nodes()
+	c := &serviceController{
+		conf:          conf,
+		lbrps:         cubes.Lbrps,
+		dispatchers:   cubes.Dispatchers,
+		recorder:      recorder,
+		nodeIP:        nodeInfo.extIface.IPNet.IP.String(),
+		serviceLister: serviceInformer.Lister(),
+		sliceLister:   sliceInformer.Lister(),
+		nodeLister:    nodeInformer.Lister(),
+		services:      make(map[string][]lbrpServiceKey),
+		podServices:   make(map[string][]lbrpServiceKey),
+		pins:          affinity.NewTable(nil),
+		announcer:     announcer,
+		nodePorts:     make(map[string][]nodePortKey),
+	}
+	c.controller = newController("services", c.syncService)
+	// the EndpointSlices are keyed by the namespace/name of their service, so both of them trigger the sync of the same
+	// cluster service
+	c.watch(serviceInformer.Informer(), nil)
+	c.watch(sliceInformer.Informer(), endpointSliceServiceKey)
+	// the node topology is only read during the services sync
+	c.synced = append(c.synced, nodeInformer.Informer().HasSynced)
+	return c
+}
+
+// endpointSliceServiceKey returns the namespace/name key of the service owning the provided EndpointSlice
+func endpointSliceServiceKey(obj interface{}) (string, error) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	slice, ok := obj.(*discovery.EndpointSlice)
+	if !ok {
+		return "", fmt.Errorf("unexpected object type %T", obj)
+	}
+	name, ok := slice.Labels[discovery.LabelServiceName]
+	if !ok {
+		return "", fmt.Errorf("%s/%s endpointslice has no %s label", slice.Namespace, slice.Name, discovery.LabelServiceName)
+	}
+	return slice.Namespace + "/" + name, nil
+}
+
+// run removes the stale k8sdispatcher NodePort rules once the informers caches are synced, and then runs the
+// controller
+func (c *serviceController) run(ctx context.Context) error {
+	if cache.WaitForCacheSync(ctx.Done(), c.synced...) {
+		services, err := c.serviceLister.List(labels.Everything())
+		if err == nil {
+			err = CleanupNodeportRules(c.dispatchers, c.conf, services)
+		}
+		if err != nil {
+			log.WithField("detail", err).Error("failed to cleanup stale nodeport rules")
+		}
+	}
+	return c.controller.run(ctx)
+}
+
+// nodeTopology returns the topology of the current node. If the node is not found, only its name is used
+func (c *serviceController) nodeTopology() *nodeTopology {
+	topology := &nodeTopology{name: c.conf.nodeName}
+	if node, err := c.nodeLister.Get(c.conf.nodeName); err == nil {
+		topology.labels = node.Labels
+	}
+	return topology
+}
+
+// BuildLbrpServices returns the lbrp service entries implementing the provided cluster service, whose backends are
+// weighted by their locality with respect to the provided node. Only ClusterIP services (including the ones of type
+// NodePort and LoadBalancer) are considered
+func BuildLbrpServices(svc *v1.Service, slices []*discovery.EndpointSlice, node *nodeTopology) []lbrp.Service {
+	return buildLbrpServices(svc, slices, node, lbrpBackends)
+}
+
+// buildLbrpServices returns the lbrp service entries implementing the provided cluster service, whose backends are
+// chosen by pick among the selected ones
+func buildLbrpServices(
+	svc *v1.Service, slices []*discovery.EndpointSlice, node *nodeTopology,
+	pick func(backends []serviceBackend) []lbrp.ServiceBackend,
+) []lbrp.Service {
+	if svc.Spec.ClusterIP == "" || svc.Spec.ClusterIP == v1.ClusterIPNone {
+		return nil
+	}
+	var services []lbrp.Service
+	for _, port := range svc.Spec.Ports {
+		services = append(services, lbrp.Service{
+			Name:    fmt.Sprintf("%s/%s:%s", svc.Namespace, svc.Name, port.Name),
+			Vip:     svc.Spec.ClusterIP,
+			Vport:   port.Port,
+			Proto:   strings.ToUpper(string(port.Protocol)),
+			Backend: pick(SelectBackends(svc, collectEndpoints(slices, port, node), node, false)),
+		})
+	}
+	return services
+}
+
+// ExternalIPs returns the IPv4 external addresses of the provided service: its externalIPs and its LoadBalancer
+// ingress IPs
+func ExternalIPs(svc *v1.Service) []string {
+	var ips []string
+	seen := make(map[string]bool)
+	raw := append([]string(nil), svc.Spec.ExternalIPs...)
+	for _, ingress := range svc.Status.LoadBalancer.Ingress {
+		raw = append(raw, ingress.IP)
+	}
+	for _, r := range raw {
+		ip := net.ParseIP(r)
+		if ip == nil || ip.To4() == nil || seen[ip.String()] || ip.String() == svc.Spec.ClusterIP {
+			continue
+		}
+		seen[ip.String()] = true
+		ips = append(ips, ip.String())
+	}
+	return ips
+}
+
+// BuildExternalLbrpServices returns the lbrp service entries load-balancing the traffic received by the k8sdispatcher
+// for the external addresses of the provided service. The backends are selected as for the external traffic, so that
+// the Local external traffic policy is honoured
+func BuildExternalLbrpServices(svc *v1.Service, slices []*discovery.EndpointSlice, node *nodeTopology) []lbrp.Service {
+	if svc.Spec.ClusterIP == "" || svc.Spec.ClusterIP == v1.ClusterIPNone {
+		return nil
+	}
+	var services []lbrp.Service
+	for _, ip := range ExternalIPs(svc) {
+		for _, port := range svc.Spec.Ports {
+			services = append(services, lbrp.Service{
+				Name:    fmt.Sprintf("%s/%s:%s@%s", svc.Namespace, svc.Name, port.Name, ip),
+				Vip:     ip,
+				Vport:   port.Port,
+				Proto:   strings.ToUpper(string(port.Protocol)),
+				Backend: lbrpBackends(SelectBackends(svc, collectEndpoints(slices, port, node), node, true)),
+			})
+		}
+	}
+	return services
+}
+
+// buildNodePorts returns the lbrp service entries and the k8sdispatcher rules implementing the NodePorts of the provided
+// service. The NodePorts outside the configured range, or already used by a node process, are rejected: an event is
+// emitted on the service and they are not configured
+func (c *serviceController) buildNodePorts(svc *v1.Service, slices []*discovery.EndpointSlice, node *nodeTopology) (
+	[]lbrp.Service, []k8sdispatcher.NodeportRule, error,
+) {
+	var services []lbrp.Service
+	var rules []k8sdispatcher.NodeportRule
+	var listeners map[nodePortKey]bool
+	for _, port := range svc.Spec.Ports {
+		if port.NodePort == 0 {
+			continue
+		}
+		if listeners == nil {
+			var err error
+			if listeners, err = HostListeners(); err != nil {
+				return nil, nil, err
+			}
+		}
+		proto := strings.ToUpper(string(port.Protocol))
+		var conflict string
+		switch {
+		case !c.conf.nodePortRange.Contains(port.NodePort):
+			conflict = fmt.Sprintf("NodePort %d/%s is outside the %s range", port.NodePort, proto, c.conf.nodePortRange)
+		case listeners[nodePortKey{port: port.NodePort, proto: proto}]:
+			conflict = fmt.Sprintf("NodePort %d/%s is already in use by a node process", port.NodePort, proto)
+		}
+		if conflict != "" {
+			log.WithFields(log.Fields{
+				"service": svc.Namespace + "/" + svc.Name,
+				"detail":  conflict,
+			}).Warning("nodeport rejected")
+			c.recorder.Event(svc, v1.EventTypeWarning, reasonNodePortConflict, conflict)
+			continue
+		}
+		services = append(services, lbrp.Service{
+			Name:    fmt.Sprintf("%s/%s:%s@nodeport", svc.Namespace, svc.Name, port.Name),
+			Vip:     c.nodeIP,
+			Vport:   port.NodePort,
+			Proto:   proto,
+			Backend: lbrpBackends(SelectBackends(svc, collectEndpoints(slices, port, node), node, true)),
+		})
+		rules = append(rules, nodePortRule(svc, port))
+	}
+	return services, rules, nil
+}
+
+// syncNodePortRules configures the provided k8sdispatcher NodePort rules for the provided service, removing the ones
+// that are not needed anymore
+func (c *serviceController) syncNodePortRules(key string, rules []k8sdispatcher.NodeportRule) error {
+	kName := c.conf.k8sDispName
+	l := log.WithFields(log.Fields{
+		"k8sdispatcher": kName,
+		"service":       key,
+	})
+	var keys []nodePortKey
+	desiredKeys := make(map[nodePortKey]bool)
+	for _, rule := range rules {
+		k := nodePortKey{port: rule.NodeportPort, proto: rule.Proto}
+		if err := c.dispatchers.ReplaceNodeportRule(kName, rule); err != nil {
+			l.WithFields(log.Fields{
+				"rule":   fmt.Sprintf("%+v", rule),
+				"detail": err,
+			}).Error("failed to configure nodeport rule")
+			return fmt.Errorf("failed to configure %q k8sdispatcher nodeport rule %d/%s - %v", kName, k.port, k.proto, err)
+		}
+		keys = append(keys, k)
+		desiredKeys[k] = true
+	}
+	for _, k := range c.nodePorts[key] {
+		if desiredKeys[k] {
+			continue
+		}
+		if err := c.dispatchers.DeleteNodeportRule(kName, k.port, k.proto); err != nil && !polycube.IsNotFound(err) {
+			l.WithFields(log.Fields{
+				"rule":   fmt.Sprintf("%+v", k),
+				"detail": err,
+			}).Error("failed to delete nodeport rule")
+			return fmt.Errorf("failed to delete %q k8sdispatcher nodeport rule %d/%s - %v", kName, k.port, k.proto, err)
+		}
+	}
+	if len(keys) == 0 {
+		delete(c.nodePorts, key)
+	} else {
+		c.nodePorts[key] = keys
+	}
+	return nil
+}
+
+// announceCandidates returns the nodes that can announce the external addresses of the provided service: the nodes
+// hosting a ready endpoint if the service has the Local external traffic policy, the ready nodes otherwise
+func (c *serviceController) announceCandidates(svc *v1.Service, slices []*discovery.EndpointSlice) ([]string, error) {
+	seen := make(map[string]bool)
+	var candidates []string
+	if svc.Spec.ExternalTrafficPolicy == v1.ServiceExternalTrafficPolicyTypeLocal {
+		for _, slice := range slices {
+			for _, endpoint := range slice.Endpoints {
+				nodeName := ""
+				if endpoint.NodeName != nil {
+					nodeName = *endpoint.NodeName
+				}
+				ready := endpoint.Conditions.Ready == nil || *endpoint.Conditions.Ready
+				if nodeName != "" && ready && !seen[nodeName] {
+					seen[nodeName] = true
+					candidates = append(candidates, nodeName)
+				}
+			}
+		}
+		return candidates, nil
+	}
+	nodes, err := c.nodeLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range nodes {
+		for _, cond := range node.Status.Conditions {
+			if cond.Type == v1.NodeReady && cond.Status == v1.ConditionTrue {
+				candidates = append(candidates, node.Name)
+			}
+		}
+	}
+	return candidates, nil
+}
+
+// syncAnnouncements makes the current node announce the external addresses of the provided service it is elected
+// for. If svc is nil, the service addresses are withdrawn
+func (c *serviceController) syncAnnouncements(key string, svc *v1.Service, slices []*discovery.EndpointSlice) error {
+	var elected []string
+	if svc != nil {
+		candidates, err := c.announceCandidates(svc, slices)
+		if err != nil {
+			return err
+		}
+		for _, ip := range ExternalIPs(svc) {
+			if nodeName, ok := ElectAnnouncer(ip, candidates); ok && nodeName == c.conf.nodeName {
+				elected = append(elected, ip)
+			}
+		}
+	}
+	return c.announcer.sync(key, elected)
+}
+
+// BuildEdgeLbrpServices returns the per-pod lbrp service entries implementing the provided edge service. For each
+// service port, the endpoints on the provided node are preferred: the other ones are used only if no local endpoint
+// exists
+func BuildEdgeLbrpServices(svc *v1.Service, slices []*discovery.EndpointSlice, node *nodeTopology) []lbrp.Service {
+	return buildLbrpServices(svc, slices, node, func(backends []serviceBackend) []lbrp.ServiceBackend {
+		var localBackends []serviceBackend
+		for _, backend := range backends {
+			if backend.Local {
+				localBackends = append(localBackends, backend)
+			}
+		}
+		if len(localBackends) > 0 {
+			backends = localBackends
+		}
+		return lbrpBackends(backends)
+	})
+}
+
+// podLbrps returns the addresses of the pods attached to the per-pod lbrps, indexed by lbrp name. The address is
+// empty if it is not known
+func (c *serviceController) podLbrps() (map[string]string, error) {
+	lbs, err := c.lbrps.ListLbrps()
+	if err != nil && !polycube.IsNotFound(err) {
+		return nil, fmt.Errorf("failed to list lbrps - %v", err)
+	}
+	atts, err := attachment.List(c.conf.stateDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list attachments state: %v", err)
+	}
+	podIPs := make(map[string]string)
+	for _, a := range atts {
+		podIPs[attachment.LbrpName(a.Name)] = a.IP
+	}
+	names := make(map[string]string)
+	for _, lb := range lbs {
+		if strings.HasPrefix(lb.Name, attachment.LbrpPrefix) {
+			names[lb.Name] = podIPs[lb.Name]
+		}
+	}
+	return names, nil
+}
+
+// affinityTimeout returns the ClientIP session affinity timeout of the provided service, or 0 if the service has no
+// session affinity. The pod traffic is not observed, so the timeout doesn't measure the pod inactivity: the pod pins
+// are refreshed by each sync of the service, and the timeout only drops the pins that stop being synced for its
+// duration (see affinity.Table). The affinity is emulated only for the pods of the node reaching the cluster IP (see
+// warnAffinityBypass)
+func affinityTimeout(svc *v1.Service) time.Duration {
+	if svc == nil || svc.Spec.SessionAffinity != v1.ServiceAffinityClientIP {
+		return 0
+	}
+	seconds := int32(v1.DefaultClientIPServiceAffinitySeconds)
+	if cfg := svc.Spec.SessionAffinityConfig; cfg != nil && cfg.ClientIP != nil && cfg.ClientIP.TimeoutSeconds != nil {
+		seconds = *cfg.ClientIP.TimeoutSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// warnAffinityBypass emits a warning event if the provided ClientIP session affinity service is reachable through its
+// NodePorts or external addresses: the affinity is emulated in the per-pod lbrps, so the traffic of those clients, as
+// the one of the host network clients, is load-balanced without affinity
+func (c *serviceController) warnAffinityBypass(svc *v1.Service) {
+	var paths []string
+	for _, port := range svc.Spec.Ports {
+		if port.NodePort != 0 {
+			paths = append(paths, "NodePort")
+			break
+		}
+	}
+	if len(ExternalIPs(svc)) > 0 {
+		paths = append(paths, "external IP")
+	}
+	if len(paths) == 0 {
+		return
+	}
+	msg := fmt.Sprintf("ClientIP session affinity only applies to the pods reaching the cluster IP: the %s clients "+
+		"are load-balanced without affinity", strings.Join(paths, " and "))
+	log.WithFields(log.Fields{
+		"service": svc.Namespace + "/" + svc.Name,
+		"detail":  msg,
+	}).Warning("session affinity not applied")
+	c.recorder.Event(svc, v1.EventTypeWarning, reasonSessionAffinityNotApplied, msg)
+}
+
+// pinnedServices returns the provided lbrp service entries, with each backends pool restricted to the backend the
+// provided pod address is pinned to. If the pod address is not known, the entries are returned unchanged
+func (c *serviceController) pinnedServices(key string, services []lbrp.Service, podIP string,
+	timeout time.Duration, used map[string]bool) []lbrp.Service {
+	if podIP == "" {
+		return services
+	}
+	pinned := make([]lbrp.Service, 0, len(services))
+	for _, service := range services {
+		pinKey := affinity.Key(key, fmt.Sprintf("%s:%d/%s", service.Vip, service.Vport, service.Proto), podIP)
+		if backend, ok := c.pins.Pick(pinKey, podIP, service.Backend, timeout); ok {
+			backend.Weight = 1
+			service.Backend = []lbrp.ServiceBackend{backend}
+			used[pinKey] = true
+		}
+		pinned = append(pinned, service)
+	}
+	return pinned
+}
+
+// syncPodServices replicates the provided lbrp service entries into every per-pod lbrp, removing the ones that are
+// not needed anymore. If timeout is not 0, each pod is pinned to a single backend for the ClientIP session affinity.
+// The per-pod lbrps removed in the meanwhile are ignored
+func (c *serviceController) syncPodServices(key string, desired []lbrp.Service, timeout time.Duration) error {
+	lbs, err := c.podLbrps()
+	if err != nil {
+		return err
+	}
+	l := log.WithField("service", key)
+
+	var keys []lbrpServiceKey
+	desiredKeys := make(map[lbrpServiceKey]bool)
+	for _, service := range desired {
+		k := lbrpServiceKey{vip: service.Vip, vport: service.Vport, proto: service.Proto}
+		keys = append(keys, k)
+		desiredKeys[k] = true
+	}
+	usedPins := make(map[string]bool)
+	for lbName, podIP := range lbs {
+		services := desired
+		if timeout > 0 {
+			services = c.pinnedServices(key, desired, podIP, timeout, usedPins)
+		}
+		for _, service := range services {
+			err := c.lbrps.ReplaceLbrpService(lbName, service)
+			if err != nil && !polycube.IsNotFound(err) {
+				l.WithFields(log.Fields{
+					"lbrp":   lbName,
+					"entry":  fmt.Sprintf("%+v", service),
+					"detail": err,
+				}).Error("failed to configure per-pod lbrp service")
+				return fmt.Errorf("failed to configure %q lbrp service %s:%d - %v", lbName, service.Vip, service.Vport, err)
+			}
+		}
+		for _, k := range c.podServices[key] {
+			if desiredKeys[k] {
+				continue
+			}
+			if err := c.lbrps.DeleteLbrpService(lbName, k.vip, k.vport, k.proto); err != nil && !polycube.IsNotFound(err) {
+				l.WithFields(log.Fields{
+					"lbrp":   lbName,
+					"entry":  fmt.Sprintf("%+v", k),
+					"detail": err,
+				}).Error("failed to delete per-pod lbrp service")
+				return fmt.Errorf("failed to delete %q lbrp service %+v - %v", lbName, k, err)
+			}
+		}
+	}
+	c.pins.Prune(key, usedPins)
+
+	if len(keys) == 0 {
+		delete(c.podServices, key)
+	} else {
+		c.podServices[key] = keys
+	}
+	l.WithFields(log.Fields{
+		"entries": len(keys),
+		"lbrps":   len(lbs),
+		"pinned":  len(usedPins),
+	}).Info("per-pod lbrps services synced")
+	return nil
+}
+
+// buildPodServices returns the lbrp service entries of the provided service to replicate into every per-pod lbrp: the
+// ones of the edge services and of the services with ClientIP session affinity
+func (c *serviceController) buildPodServices(
+	key string, svc *v1.Service, slices []*discovery.EndpointSlice, node *nodeTopology,
+) []lbrp.Service {
+	switch {
+	case c.conf.edgeServices[key]:
+		return BuildEdgeLbrpServices(svc, slices, node)
+	case affinityTimeout(svc) > 0:
+		return BuildLbrpServices(svc, slices, node)
+	}
+	return nil
+}
+
+// syncPodLbrp configures the services replicated into the per-pod lbrps in the provided one, which was created or
+// recreated after their last sync. The services removed in the meanwhile are left to their own sync, as the per-pod
+// lbrp removed in the meanwhile is ignored
+func (c *serviceController) syncPodLbrp(lbName string) error {
+	lbs, err := c.podLbrps()
+	if err != nil {
+		return err
+	}
+	podIP, ok := lbs[lbName]
+	if !ok {
+		return nil
+	}
+	l := log.WithField("lbrp", lbName)
+	node := c.nodeTopology()
+	entries := 0
+	for key := range c.podServices {
+		namespace, name, err := cache.SplitMetaNamespaceKey(key)
+		if err != nil {
+			return err
+		}
+		svc, err := c.serviceLister.Services(namespace).Get(name)
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		selector := labels.SelectorFromSet(labels.Set{discovery.LabelServiceName: name})
+		slices, err := c.sliceLister.EndpointSlices(namespace).List(selector)
+		if err != nil {
+			return err
+		}
+		services := c.buildPodServices(key, svc, slices, node)
+		if timeout := affinityTimeout(svc); timeout > 0 {
+			services = c.pinnedServices(key, services, podIP, timeout, make(map[string]bool))
+		}
+		for _, service := range services {
+			err := c.lbrps.ReplaceLbrpService(lbName, service)
+			if polycube.IsNotFound(err) {
+				return nil
+			}
+			if err != nil {
+				l.WithFields(log.Fields{
+					"service": key,
+					"entry":   fmt.Sprintf("%+v", service),
+					"detail":  err,
+				}).Error("failed to configure per-pod lbrp service")
+				return fmt.Errorf("failed to configure %q lbrp service %s:%d - %v", lbName, service.Vip, service.Vport, err)
+			}
+			entries++
+		}
+	}
+	l.WithField("entries", entries).Info("per-pod lbrp services synced")
+	return nil
+}
+
+func (c *serviceController) syncService(key string) error {
+	if strings.HasPrefix(key, podLbrpKeyPrefix) {
+		return c.syncPodLbrp(strings.TrimPrefix(key, podLbrpKeyPrefix))
+	}
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+	var desired, desiredPod []lbrp.Service
+	var slices []*discovery.EndpointSlice
+	var rules []k8sdispatcher.NodeportRule
+	svc, err := c.serviceLister.Services(namespace).Get(name)
+	switch {
+	case errors.IsNotFound(err):
+		svc = nil
+	case err != nil:
+		return err
+	default:
+		selector := labels.SelectorFromSet(labels.Set{discovery.LabelServiceName: name})
+		if slices, err = c.sliceLister.EndpointSlices(namespace).List(selector); err != nil {
+			return err
+		}
+		node := c.nodeTopology()
+		desired = BuildLbrpServices(svc, slices, node)
+		desiredPod = c.buildPodServices(key, svc, slices, node)
+		if !c.conf.edgeServices[key] && affinityTimeout(svc) > 0 {
+			c.warnAffinityBypass(svc)
+		}
+		desired = append(desired, BuildExternalLbrpServices(svc, slices, node)...)
+		var nodePortServices []lbrp.Service
+		if nodePortServices, rules, err = c.buildNodePorts(svc, slices, node); err != nil {
+			return err
+		}
+		desired = append(desired, nodePortServices...)
+	}
+	// the session affinity is emulated at the pod edge, where the traffic of each pod can be pinned to a backend
+	if len(desiredPod) > 0 || len(c.podServices[key]) > 0 {
+		if err := c.syncPodServices(key, desiredPod, affinityTimeout(svc)); err != nil {
+			return err
+		}
+	}
+
+	lbName := c.conf.lbrpName
+	l := log.WithFields(log.Fields{
+		"lbrp":    lbName,
+		"service": key,
+	})
+
+	// configuring the desired lbrp services (the whole service entry is replaced, including its backends)
+	var keys []lbrpServiceKey
+	desiredKeys := make(map[lbrpServiceKey]bool)
+	for _, service := range desired {
+		k := lbrpServiceKey{vip: service.Vip, vport: service.Vport, proto: service.Proto}
+		if err := c.lbrps.ReplaceLbrpService(lbName, service); err != nil {
+			l.WithFields(log.Fields{
+				"entry":  fmt.Sprintf("%+v", service),
+				"detail": err,
+			}).Error("failed to configure lbrp service")
+			return fmt.Errorf("failed to configure %q lbrp service %+v - %v", lbName, k, err)
+		}
+		keys = append(keys, k)
+		desiredKeys[k] = true
+	}
+
+	// removing the lbrp services that are not needed anymore
+	for _, k := range c.services[key] {
+		if desiredKeys[k] {
+			continue
+		}
+		if err := c.lbrps.DeleteLbrpService(lbName, k.vip, k.vport, k.proto); err != nil && !polycube.IsNotFound(err) {
+			l.WithFields(log.Fields{
+				"entry":  fmt.Sprintf("%+v", k),
+				"detail": err,
+			}).Error("failed to delete lbrp service")
+			return fmt.Errorf("failed to delete %q lbrp service %+v - %v", lbName, k, err)
+		}
+	}
+
+	if len(keys) == 0 {
+		delete(c.services, key)
+	} else {
+		c.services[key] = keys
+	}
+	l.WithField("entries", len(keys)).Info("lbrp services synced")
+
+	// the NodePort rules are configured once their lbrp services exist
+	if len(rules) > 0 || len(c.nodePorts[key]) > 0 {
+		if err := c.syncNodePortRules(key, rules); err != nil {
+			return err
+		}
+	}
+
+	if c.announcer != nil {
+		return c.syncAnnouncements(key, svc, slices)
+	}
+	return nil
+}
+
+// resyncPodLbrp enqueues the provided per-pod lbrp, so that the services replicated into the per-pod lbrps are
+// configured in it (see syncPodLbrp). It is used when the per-pod lbrp is created or recreated
+func (c *serviceController) resyncPodLbrp(lbName string) {
+	c.queue.Add(podLbrpKeyPrefix + lbName)
+}
+
+// resync enqueues all the cluster services, so that their lbrp services are configured again. It is used when the
+// lbrp is recreated, losing its services
+func (c *serviceController) resync() error {
+	services, err := c.serviceLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	for _, svc := range services {
+		key, err := cache.MetaNamespaceKeyFunc(svc)
+		if err != nil {
+			return err
+		}
+		c.queue.Add(key)
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"github.com/ekoops/polykube-cni-plugin/test/fakepolycubed"
+	"github.com/ekoops/polykube-cni-plugin/utils/affinity"
+	"github.com/ekoops/polykube-cni-plugin/utils/attachment"
+	lbrp "github.com/ekoops/polykube-cni-plugin/utils/lbrp"
+	"github.com/ekoops/polykube-cni-plugin/utils/polycube"
+	"io/ioutil"
+	v1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"os"
+	"strings"
+	"testing"
+)
+
+// newTestSlice returns an EndpointSlice containing an endpoint for each of the provided nodes, indexed by address
+func newTestSlice(nodes map[string]string) *discovery.EndpointSlice {
+	portName, port, proto := "http", int32(8080), v1.ProtocolTCP
+	slice := &discovery.EndpointSlice{
+		ObjectMeta:  metav1.ObjectMeta{Namespace: "default", Name: "web-abc"},
+		AddressType: discovery.AddressTypeIPv4,
+		Ports:       []discovery.EndpointPort{{Name: &portName, Port: &port, Protocol: &proto}},
+	}
+	for ip, node := range nodes {
+		node := node
+		slice.Endpoints = append(slice.Endpoints, discovery.Endpoint{Addresses: []string{ip}, NodeName: &node})
+	}
+	return slice
+}
+
+func TestBuildEdgeLbrpServices(t *testing.T) {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+		Spec: v1.ServiceSpec{
+			ClusterIP: "11.11.11.10",
+			Ports:     []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}},
+		},
+	}
+	node := &nodeTopology{name: "node1"}
+
+	for _, tc := range []struct {
+		name  string
+		nodes map[string]string
+		// backends contains the addresses of the expected backends
+		backends map[string]bool
+	}{
+		{
+			name:     "local endpoints are preferred",
+			nodes:    map[string]string{"10.10.1.5": "node1", "10.10.2.5": "node2"},
+			backends: map[string]bool{"10.10.1.5": true},
+		},
+		{
+			name:     "remote endpoints are used without local ones",
+			nodes:    map[string]string{"10.10.2.5": "node2", "10.10.3.5": "node3"},
+			backends: map[string]bool{"10.10.2.5": true, "10.10.3.5": true},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			slices := []*discovery.EndpointSlice{newTestSlice(tc.nodes)}
+			services := BuildEdgeLbrpServices(svc, slices, node)
+			if len(services) != 1 {
+				t.Fatalf("wrong services number - required: 1, found: %d", len(services))
+			}
+			backends := services[0].Backend
+			if len(backends) != len(tc.backends) {
+				t.Fatalf("wrong backends number - required: %d, found: %+v", len(tc.backends), backends)
+			}
+			for _, backend := range backends {
+				if !tc.backends[backend.Ip] || backend.Port != 8080 {
+					t.Errorf("unexpected backend %+v", backend)
+				}
+			}
+		})
+	}
+}
+
+func TestWarnAffinityBypass(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	c := &serviceController{recorder: recorder}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+		Spec: v1.ServiceSpec{
+			ClusterIP:       "11.11.11.10",
+			SessionAffinity: v1.ServiceAffinityClientIP,
+			Ports:           []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}},
+		},
+	}
+	c.warnAffinityBypass(svc)
+	if len(recorder.Events) != 0 {
+		t.Fatalf("unexpected event for a cluster IP only service: %s", <-recorder.Events)
+	}
+
+	svc.Spec.Ports[0].NodePort = 30080
+	svc.Spec.ExternalIPs = []string{"192.168.1.200"}
+	c.warnAffinityBypass(svc)
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, reasonSessionAffinityNotApplied) || !strings.Contains(event, "NodePort and external IP") {
+			t.Fatalf("unexpected event: %s", event)
+		}
+	default:
+		t.Fatal("no event emitted for the NodePort and external IP clients")
+	}
+}
+
+// TestSyncPodLbrp verifies that the services replicated into the per-pod lbrps are configured only in the provided
+// per-pod lbrp, pinning its pod to a single backend of the ClientIP session affinity services
+func TestSyncPodLbrp(t *testing.T) {
+	srv := fakepolycubed.NewServer()
+	ts, url := srv.Start()
+	defer ts.Close()
+	cubes := polycube.NewCubes(url)
+	stateDir, err := ioutil.TempDir("", "polykube-attachments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(stateDir)
+
+	conf := newTestConf()
+	conf.stateDir = stateDir
+	conf.edgeServices = map[string]bool{"default/dns": true}
+	atts := map[string]string{"eth0_0123456789": "10.10.1.5", "eth0_fedcba9876": "10.10.1.6"}
+	for name, ip := range atts {
+		if err := attachment.Save(stateDir, &attachment.Attachment{Name: name, Bridge: conf.bridgeName, IP: ip}); err != nil {
+			t.Fatal(err)
+		}
+		if err := cubes.Lbrps.CreateLbrp(lbrp.Lbrp{Name: attachment.LbrpName(name)}); err != nil {
+			t.Fatalf("failed to create lbrp: %v", err)
+		}
+	}
+
+	indexers := cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}
+	services := cache.NewIndexer(cache.MetaNamespaceKeyFunc, indexers)
+	slices := cache.NewIndexer(cache.MetaNamespaceKeyFunc, indexers)
+	for i, name := range []string{"dns", "sticky"} {
+		svc := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+			Spec: v1.ServiceSpec{
+				ClusterIP: fmt.Sprintf("11.11.11.%d", 10+i),
+				Ports:     []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}},
+			},
+		}
+		if name == "sticky" {
+			svc.Spec.SessionAffinity = v1.ServiceAffinityClientIP
+		}
+		slice := newTestSlice(map[string]string{"10.10.2.5": "node2", "10.10.3.5": "node3"})
+		slice.Name = name + "-abc"
+		slice.Labels = map[string]string{discovery.LabelServiceName: name}
+		if err := services.Add(svc); err != nil {
+			t.Fatal(err)
+		}
+		if err := slices.Add(slice); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := &serviceController{
+		conf:          conf,
+		lbrps:         cubes.Lbrps,
+		serviceLister: corelisters.NewServiceLister(services),
+		sliceLister:   discoverylisters.NewEndpointSliceLister(slices),
+		nodeLister:    corelisters.NewNodeLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})),
+		// the removed default/gone service is left to its own sync
+		podServices: map[string][]lbrpServiceKey{
+			"default/dns":    {{vip: "11.11.11.10", vport: 80, proto: "TCP"}},
+			"default/sticky": {{vip: "11.11.11.11", vport: 80, proto: "TCP"}},
+			"default/gone":   {{vip: "11.11.11.12", vport: 80, proto: "TCP"}},
+		},
+		pins: affinity.NewTable(nil),
+	}
+
+	lbName := attachment.LbrpName("eth0_fedcba9876")
+	if err := c.syncPodLbrp(lbName); err != nil {
+		t.Fatalf("syncPodLbrp failed: %v", err)
+	}
+	lb, err := cubes.Lbrps.ReadLbrp(lbName)
+	if err != nil {
+		t.Fatalf("failed to read lbrp: %v", err)
+	}
+	if len(lb.Service) != 2 {
+		t.Fatalf("wrong %q lbrp services number - required: 2, found: %+v", lbName, lb.Service)
+	}
+	for _, service := range lb.Service {
+		switch service.Vip {
+		case "11.11.11.10":
+			if len(service.Backend) != 2 {
+				t.Errorf("edge service backends - required: 2, found: %+v", service.Backend)
+			}
+		case "11.11.11.11":
+			if len(service.Backend) != 1 || service.Backend[0].Weight != 1 {
+				t.Errorf("affinity service backends - required: a single pinned backend, found: %+v", service.Backend)
+			}
+		default:
+			t.Errorf("unexpected service %+v", service)
+		}
+	}
+
+	// the other per-pod lbrps are not touched
+	other := attachment.LbrpName("eth0_0123456789")
+	if lb, err := cubes.Lbrps.ReadLbrp(other); err != nil || len(lb.Service) != 0 {
+		t.Fatalf("%q lbrp - required: no services, found: %+v, error: %v", other, lb, err)
+	}
+	// a per-pod lbrp removed in the meanwhile is ignored
+	if err := c.syncPodLbrp(attachment.LbrpName("eth0_0011223344")); err != nil {
+		t.Fatalf("syncPodLbrp failed for a removed lbrp: %v", err)
+	}
+}
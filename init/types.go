@@ -1,22 +1,37 @@
 package main
 
 import (
+	"github.com/ekoops/polykube-cni-plugin/utils"
+	"github.com/ekoops/polykube-cni-plugin/utils/metrics"
 	"github.com/vishvananda/netlink"
 	v1 "k8s.io/api/core/v1"
 	"net"
 )
 
 type EnvConf struct {
-	nodeName        string
-	vxlanIfName		string
-	vtepCIDR        *net.IPNet
-	CNIConfFilePath string
-	vClusterCIDR    *net.IPNet
-	MTU             int
-	bridgeName      string
-	routerName      string
-	lbrpName        string
-	k8sDispName     string
+	nodeName          string
+	polycubeURL       string
+	vxlanIfName       string
+	overlay           Overlay
+	vtepCIDR          *net.IPNet
+	CNIConfFilePath   string
+	CNIKubeconfigPath string
+	CNITokenPath      string
+	stateDir          string
+	ipamDataDir       string
+	vClusterCIDR      *net.IPNet
+	serviceCIDR       *net.IPNet
+	edgeServices      map[string]bool
+	l2Announce        bool
+	nodePortRange     NodePortRange
+	egress            *EgressConf
+	MTU               int
+	bridgeName        string
+	routerName        string
+	lbrpName          string
+	k8sDispName       string
+	cniLogConf        *utils.LogConf
+	metricsConf       *metrics.PushConf
 }
 
 type NodeInfo struct {
@@ -27,6 +42,8 @@ type NodeInfo struct {
 	extIface      *Iface
 	nodeVtepIPNet *net.IPNet
 	nodeGwInfo    *GwInfo
+	// MTU is the pod and overlay interfaces MTU
+	MTU int
 }
 
 type GwInfo struct {
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ekoops/polykube-cni-plugin/utils/attachment"
+	"github.com/ekoops/polykube-cni-plugin/utils/polycube"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// UninstallAction describes the outcome of the removal of a single polykube resource
+type UninstallAction struct {
+	Kind   string
+	Name   string
+	Status string
+	Detail string
+}
+
+const (
+	uninstallRemoved     = "removed"
+	uninstallWouldRemove = "would remove"
+	uninstallAbsent      = "absent"
+	uninstallFailed      = "failed"
+)
+
+// UninstallReport collects the outcomes of the removal of all the polykube resources
+type UninstallReport struct {
+	dryRun  bool
+	Actions []UninstallAction
+}
+
+// record stores the outcome of the removal of a resource. The remove function is not called in dry-run mode
+func (r *UninstallReport) record(kind, name string, remove func() error) {
+	action := UninstallAction{Kind: kind, Name: name, Status: uninstallRemoved}
+	if r.dryRun {
+		action.Status = uninstallWouldRemove
+	} else if err := remove(); err != nil {
+		action.Status = uninstallFailed
+		action.Detail = err.Error()
+	}
+	l := log.WithFields(log.Fields{
+		"kind":   action.Kind,
+		"name":   action.Name,
+		"status": action.Status,
+	})
+	if action.Detail != "" {
+		l.WithField("detail", action.Detail).Error("failed to remove resource")
+	} else {
+		l.Info("resource processed")
+	}
+	r.Actions = append(r.Actions, action)
+}
+
+// absent stores the fact that a resource was not found
+func (r *UninstallReport) absent(kind, name string) {
+	r.Actions = append(r.Actions, UninstallAction{Kind: kind, Name: name, Status: uninstallAbsent})
+}
+
+// Failed returns true if the removal of at least one resource failed
+func (r *UninstallReport) Failed() bool {
+	for _, action := range r.Actions {
+		if action.Status == uninstallFailed {
+			return true
+		}
+	}
+	return false
+}
+
+// Print writes the report in a tabular format on the provided writer
+func (r *UninstallReport) Print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "KIND\tNAME\tSTATUS\tDETAIL")
+	for _, action := range r.Actions {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", action.Kind, action.Name, action.Status, action.Detail)
+	}
+	tw.Flush()
+}
+
+// uninstallCubes removes the per-pod lbrps and the node cubes
+func uninstallCubes(cubes *polycube.Cubes, conf *EnvConf, report *UninstallReport) {
+	// the per-pod lbrps are removed first, since they are connected to the bridge
+	lbs, err := cubes.Lbrps.ListLbrps()
+	if err != nil && !polycube.IsNotFound(err) {
+		report.Actions = append(report.Actions, UninstallAction{
+			Kind: "lbrp", Name: "lbrp_*", Status: uninstallFailed, Detail: err.Error(),
+		})
+	}
+	for _, lb := range lbs {
+		name := lb.Name
+		if !strings.HasPrefix(name, attachment.LbrpPrefix) {
+			continue
+		}
+		report.record("lbrp", name, func() error {
+			return cubes.Lbrps.DeleteLbrp(name)
+		})
+	}
+
+	// removing the node cubes starting from the one connected to the node external interface. The nat cube is
+	// attached to the k8sdispatcher, so it is removed first. It is removed even if the masquerade is currently
+	// disabled, since it could have been enabled before
+	natName := conf.egress.NatName
+	if _, err := cubes.Nats.ReadNat(natName); polycube.IsNotFound(err) {
+		report.absent("nat", natName)
+	} else {
+		report.record("nat", natName, func() error {
+			if err := cubes.Nats.DeleteNat(natName); err != nil && !polycube.IsNotFound(err) {
+				return err
+			}
+			return nil
+		})
+	}
+	if _, err := cubes.Dispatchers.ReadDispatcher(conf.k8sDispName); polycube.IsNotFound(err) {
+		report.absent("k8sdispatcher", conf.k8sDispName)
+	} else {
+		report.record("k8sdispatcher", conf.k8sDispName, func() error {
+			return cubes.Dispatchers.DeleteDispatcher(conf.k8sDispName)
+		})
+	}
+	if _, err := cubes.Lbrps.ReadLbrp(conf.lbrpName); polycube.IsNotFound(err) {
+		report.absent("lbrp", conf.lbrpName)
+	} else {
+		report.record("lbrp", conf.lbrpName, func() error {
+			return cubes.Lbrps.DeleteLbrp(conf.lbrpName)
+		})
+	}
+	if _, err := cubes.Routers.ReadRouter(conf.routerName); polycube.IsNotFound(err) {
+		report.absent("router", conf.routerName)
+	} else {
+		report.record("router", conf.routerName, func() error {
+			return cubes.Routers.DeleteRouter(conf.routerName)
+		})
+	}
+	if _, err := cubes.Bridges.ReadBridge(conf.bridgeName); polycube.IsNotFound(err) {
+		report.absent("bridge", conf.bridgeName)
+	} else {
+		report.record("bridge", conf.bridgeName, func() error {
+			return cubes.Bridges.DeleteBridge(conf.bridgeName)
+		})
+	}
+}
+
+// uninstallVxlanIface removes the vxlan interface fdb entries and the interface itself
+func uninstallVxlanIface(name string, report *UninstallReport) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		if _, notFound := err.(netlink.LinkNotFoundError); notFound {
+			report.absent("interface", name)
+			return
+		}
+		report.Actions = append(report.Actions, UninstallAction{
+			Kind: "interface", Name: name, Status: uninstallFailed, Detail: err.Error(),
+		})
+		return
+	}
+
+	neighs, err := netlink.NeighList(link.Attrs().Index, netlink.FAMILY_V4)
+	if err != nil {
+		report.Actions = append(report.Actions, UninstallAction{
+			Kind: "fdb", Name: name, Status: uninstallFailed, Detail: err.Error(),
+		})
+	}
+	for i := range neighs {
+		neigh := neighs[i]
+		report.record("fdb", fmt.Sprintf("%s %s", name, neigh.IP), func() error {
+			return netlink.NeighDel(&neigh)
+		})
+	}
+	report.record("interface", name, func() error {
+		return netlink.LinkDel(link)
+	})
+}
+
+// uninstallTunnelIfaces removes the per-peer interfaces of the provided link type whose names have the provided prefix
+func uninstallTunnelIfaces(kind, prefix string, report *UninstallReport) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		report.Actions = append(report.Actions, UninstallAction{
+			Kind: "interface", Name: "tunnels", Status: uninstallFailed, Detail: err.Error(),
+		})
+		return
+	}
+	for _, link := range links {
+		link := link
+		if link.Type() != kind || !strings.HasPrefix(link.Attrs().Name, prefix) {
+			continue
+		}
+		report.record("interface", link.Attrs().Name, func() error {
+			return netlink.LinkDel(link)
+		})
+	}
+}
+
+// uninstallLink removes the interface with the provided name. Removing one side of a veth pair removes the other one,
+// and the routes through the interface are removed with it
+func uninstallLink(name string, report *UninstallReport) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		if _, notFound := err.(netlink.LinkNotFoundError); notFound {
+			report.absent("interface", name)
+			return
+		}
+		report.Actions = append(report.Actions, UninstallAction{
+			Kind: "interface", Name: name, Status: uninstallFailed, Detail: err.Error(),
+		})
+		return
+	}
+	report.record("interface", name, func() error {
+		return netlink.LinkDel(link)
+	})
+}
+
+// uninstallSteering removes the routing rules and the veth pairs steering the attachments traffic towards an egress
+// gateway, including the ones left by the pods deleted without the agent. It must be called before removing the
+// attachments state
+func uninstallSteering(conf *EnvConf, report *UninstallReport) {
+	atts, err := attachment.List(conf.stateDir)
+	if err != nil {
+		report.Actions = append(report.Actions, UninstallAction{
+			Kind: "steering", Name: conf.stateDir, Status: uninstallFailed, Detail: err.Error(),
+		})
+	}
+	// restored contains the host sides of the veth pairs of the attachments, which are removed with their rules
+	restored := make(map[string]bool)
+	for _, att := range atts {
+		att := att
+		if !isSteered(att.Name) {
+			continue
+		}
+		host, _ := attachment.SteeringIfaceNames(att.Name)
+		restored[host] = true
+		report.record("steering", att.Name, func() error {
+			return unsteerPod(att)
+		})
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		report.Actions = append(report.Actions, UninstallAction{
+			Kind: "interface", Name: "steering", Status: uninstallFailed, Detail: err.Error(),
+		})
+	}
+	for _, link := range links {
+		link := link
+		name := link.Attrs().Name
+		// removing the host side of a veth pair removes the lbrp side too
+		if link.Type() != "veth" || !strings.HasPrefix(name, attachment.SteeringIfacePrefix) ||
+			strings.HasSuffix(name, "l") || restored[name] {
+			continue
+		}
+		report.record("interface", name, func() error {
+			return netlink.LinkDel(link)
+		})
+	}
+	rules, err := egressGwRules()
+	if err != nil {
+		report.Actions = append(report.Actions, UninstallAction{
+			Kind: "rule", Name: "steering", Status: uninstallFailed, Detail: err.Error(),
+		})
+	}
+	for _, rule := range rules {
+		if restored[rule.IifName] {
+			continue
+		}
+		rule := egressGwRule(rule.IifName, rule.Table)
+		report.record("rule", fmt.Sprintf("iif %s table %d", rule.IifName, rule.Table), func() error {
+			return netlink.RuleDel(rule)
+		})
+	}
+}
+
+// uninstallPath removes the file or the directory at the provided path
+func uninstallPath(kind, path string, report *UninstallReport) {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		report.absent(kind, path)
+		return
+	}
+	report.record(kind, path, func() error {
+		return os.RemoveAll(path)
+	})
+}
+
+// Uninstall removes from the node every resource created by polykube: the polycube cubes (including the per-pod
+// lbrps), the overlay interfaces, the egress gateway steering of the pods, the CNI configuration files and data and the
+// attachments state. If dryRun is true, the resources that would be removed are only listed
+func Uninstall(cubes *polycube.Cubes, conf *EnvConf, dryRun bool) *UninstallReport {
+	report := &UninstallReport{dryRun: dryRun}
+	// the CNI configuration file is removed first, so that no new pods are created in the meanwhile
+	uninstallPath("file", conf.CNIConfFilePath, report)
+	uninstallCubes(cubes, conf, report)
+	conf.overlay.Uninstall(report)
+	uninstallSteering(conf, report)
+	// the veth pair connecting the router to the node, the node-wide vxlan interface and the veth pair connecting the
+	// node to the bridge used by the egress gateway, and the dummy interface holding the announced services external
+	// addresses
+	for _, name := range []string{egressHostIfaceName, egressGwIfaceName, egressGwBridgeIfaceName, announceIfaceName} {
+		uninstallLink(name, report)
+	}
+	uninstallPath("file", conf.CNIKubeconfigPath, report)
+	uninstallPath("file", conf.CNITokenPath, report)
+	uninstallPath("directory", conf.ipamDataDir, report)
+	uninstallPath("directory", conf.stateDir, report)
+	return report
+}
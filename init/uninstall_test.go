@@ -0,0 +1,38 @@
+package main
+
+import (
+	"github.com/ekoops/polykube-cni-plugin/test/fakepolycubed"
+	"github.com/ekoops/polykube-cni-plugin/utils/polycube"
+	"testing"
+)
+
+// TestUninstallCubes verifies that the nat cube left by a previous configuration is removed even if the masquerade is
+// currently disabled, and that a second run finds every cube absent
+func TestUninstallCubes(t *testing.T) {
+	srv := fakepolycubed.NewServer()
+	ts, url := srv.Start()
+	defer ts.Close()
+	cubes := polycube.NewCubes(url)
+	conf := newTestConf()
+	if err := CreateCubes(cubes, newTestNodeInfo(), conf); err != nil {
+		t.Fatalf("CreateCubes failed: %v", err)
+	}
+	conf.egress.Masquerade = false
+
+	report := &UninstallReport{}
+	uninstallCubes(cubes, conf, report)
+	if report.Failed() {
+		t.Fatalf("uninstall failed: %+v", report.Actions)
+	}
+	if _, err := cubes.Nats.ReadNat(conf.egress.NatName); !polycube.IsNotFound(err) {
+		t.Fatalf("nat %q not removed: %v", conf.egress.NatName, err)
+	}
+
+	report = &UninstallReport{}
+	uninstallCubes(cubes, conf, report)
+	for _, action := range report.Actions {
+		if action.Status != uninstallAbsent {
+			t.Errorf("%s %q - required: %s, found: %s", action.Kind, action.Name, uninstallAbsent, action.Status)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ekoops/polykube-cni-plugin/utils/polycube"
+	router "github.com/ekoops/polykube-cni-plugin/utils/router"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// vxlanOverhead is the number of bytes added by the vxlan encapsulation over IPv4: outer ethernet (14), IPv4 (20),
+	// UDP (8) and vxlan (8) headers
+	vxlanOverhead = 50
+	maxVNI        = 1<<24 - 1
+)
+
+// VxlanConf contains the parameters of the node vxlan interface. A zero source port range or TTL selects the kernel
+// defaults
+type VxlanConf struct {
+	VNI         int
+	Port        int
+	SrcPortLow  int
+	SrcPortHigh int
+	Learning    bool
+	TTL         int
+}
+
+// parseIntEnv parses the provided env variable as an integer in the range [min, max]
+func parseIntEnv(envVar, defaultVal string, min, max int) (int, error) {
+	val, err := strconv.Atoi(getEnv(envVar, defaultVal))
+	if err != nil || val < min || val > max {
+		return 0, fmt.Errorf("failed to parse env variable: %s must be an integer in the range [%d, %d]", envVar, min, max)
+	}
+	return val, nil
+}
+
+// getVxlanConf returns the vxlan interface parameters taken from the NODE_VXLAN_* environment variables
+func getVxlanConf() (*VxlanConf, error) {
+	conf := &VxlanConf{}
+	var err error
+	if conf.VNI, err = parseIntEnv("NODE_VXLAN_VNI", "42", 1, maxVNI); err != nil {
+		return nil, err
+	}
+	if conf.Port, err = parseIntEnv("NODE_VXLAN_PORT", "4789", 1, 65535); err != nil {
+		return nil, err
+	}
+	if conf.TTL, err = parseIntEnv("NODE_VXLAN_TTL", "0", 0, 255); err != nil {
+		return nil, err
+	}
+	if conf.Learning, err = strconv.ParseBool(getEnv("NODE_VXLAN_LEARNING", "false")); err != nil {
+		return nil, fmt.Errorf("failed to parse env variable: NODE_VXLAN_LEARNING must be a boolean")
+	}
+
+	// the source port range is in the format low-high
+	if srcPortRange := getEnv("NODE_VXLAN_SRC_PORT_RANGE", ""); srcPortRange != "" {
+		rangeErr := fmt.Errorf(
+			"failed to parse env variable: NODE_VXLAN_SRC_PORT_RANGE must be in the format low-high, with 1 <= low <= high <= 65535",
+		)
+		bounds := strings.SplitN(srcPortRange, "-", 2)
+		if len(bounds) != 2 {
+			return nil, rangeErr
+		}
+		low, lowErr := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		high, highErr := strconv.Atoi(strings.TrimSpace(bounds[1]))
+		if lowErr != nil || highErr != nil || low < 1 || low > high || high > 65535 {
+			return nil, rangeErr
+		}
+		conf.SrcPortLow, conf.SrcPortHigh = low, high
+	}
+	return conf, nil
+}
+
+// newVxlanLink returns the description of the vxlan interface to be created
+func newVxlanLink(name string, conf *VxlanConf, mtu int, extIface *Iface) *netlink.Vxlan {
+	return &netlink.Vxlan{
+		LinkAttrs:    netlink.LinkAttrs{Name: name, MTU: mtu},
+		VxlanId:      conf.VNI,
+		VtepDevIndex: extIface.Link.Attrs().Index,
+		Port:         conf.Port,
+		PortLow:      conf.SrcPortLow,
+		PortHigh:     conf.SrcPortHigh,
+		Learning:     conf.Learning,
+		TTL:          conf.TTL,
+	}
+}
+
+// vxlanMismatch returns a description of the first difference between the existing link and the desired vxlan
+// interface, or an empty string if the link matches it. The MTU is not compared, since it can be changed in place
+func vxlanMismatch(link netlink.Link, desired *netlink.Vxlan) string {
+	vxlan, ok := link.(*netlink.Vxlan)
+	if !ok {
+		return fmt.Sprintf("type - required: vxlan, found: %s", link.Type())
+	}
+	switch {
+	case vxlan.VxlanId != desired.VxlanId:
+		return fmt.Sprintf("VNI - required: %d, found: %d", desired.VxlanId, vxlan.VxlanId)
+	case vxlan.Port != desired.Port:
+		return fmt.Sprintf("port - required: %d, found: %d", desired.Port, vxlan.Port)
+	case vxlan.VtepDevIndex != desired.VtepDevIndex:
+		return fmt.Sprintf("device index - required: %d, found: %d", desired.VtepDevIndex, vxlan.VtepDevIndex)
+	case desired.PortLow != 0 && (vxlan.PortLow != desired.PortLow || vxlan.PortHigh != desired.PortHigh):
+		return fmt.Sprintf("source port range - required: %d-%d, found: %d-%d",
+			desired.PortLow, desired.PortHigh, vxlan.PortLow, vxlan.PortHigh)
+	case vxlan.Learning != desired.Learning:
+		return fmt.Sprintf("learning - required: %t, found: %t", desired.Learning, vxlan.Learning)
+	case vxlan.TTL != desired.TTL:
+		return fmt.Sprintf("TTL - required: %d, found: %d", desired.TTL, vxlan.TTL)
+	}
+	return ""
+}
+
+// CalcPodMTU returns the MTU of the pods interfaces and of the overlay interfaces. If it is not configured, it is
+// derived from the external interface MTU, subtracting the overlay encapsulation overhead
+func CalcPodMTU(conf *EnvConf, extIface *Iface) (int, error) {
+	extMTU := extIface.Link.Attrs().MTU
+	overhead := conf.overlay.Overhead()
+	maxMTU := extMTU - overhead
+	l := log.WithFields(log.Fields{
+		"extIfaceMTU": extMTU,
+		"overlay":     conf.overlay.Name(),
+		"overhead":    overhead,
+	})
+	if conf.MTU == 0 {
+		if maxMTU <= 0 {
+			l.Error("external interface MTU too small for the overlay encapsulation")
+			return 0, fmt.Errorf("external interface MTU %d too small for the %s encapsulation", extMTU, conf.overlay.Name())
+		}
+		l.WithField("MTU", maxMTU).Info("pod MTU derived from the external interface MTU")
+		return maxMTU, nil
+	}
+	if conf.MTU > maxMTU {
+		l.WithField("MTU", conf.MTU).Warning("configured pod MTU exceeds the external interface MTU minus the overlay overhead")
+	}
+	return conf.MTU, nil
+}
+
+// vxlanOverlay implements the vxlan backend: a single node vxlan interface, connected to the router, reaches every
+// peer node through an all-zeros fdb entry
+type vxlanOverlay struct {
+	name string
+	conf *VxlanConf
+}
+
+func (o *vxlanOverlay) Name() string {
+	return overlayVxlan
+}
+
+func (o *vxlanOverlay) Overhead() int {
+	return vxlanOverhead
+}
+
+func (o *vxlanOverlay) RouterPorts() ([]router.Ports, []router.ArpTable) {
+	return []router.Ports{{Name: "to_vxlan0", Peer: o.name}}, nil
+}
+
+func (o *vxlanOverlay) Setup(nodeInfo *NodeInfo) error {
+	_, err := CreateNodeVxlanIface(o.name, o.conf, nodeInfo.MTU, nodeInfo.extIface, nodeInfo.nodeVtepIPNet)
+	return err
+}
+
+func (o *vxlanOverlay) Check(nodeInfo *NodeInfo) error {
+	return checkVxlanIface(o.name, o.conf, nodeInfo)
+}
+
+func (o *vxlanOverlay) Uninstall(report *UninstallReport) {
+	uninstallVxlanIface(o.name, report)
+}
+
+func (o *vxlanOverlay) fdbEntry(peer *PeerNode) (*netlink.Neigh, error) {
+	link, err := netlink.LinkByName(o.name)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"name":   o.name,
+			"detail": err,
+		}).Error("failed to retrieve the cluster node vxlan interface")
+		return nil, fmt.Errorf("failed to retrieve the cluster node %q vxlan interface: %v", o.name, err)
+	}
+	return &netlink.Neigh{
+		LinkIndex:    link.Attrs().Index, // vxlan index
+		State:        netlink.NUD_PERMANENT,
+		IP:           peer.IP,
+		HardwareAddr: net.HardwareAddr{0, 0, 0, 0, 0, 0},
+	}, nil
+}
+
+func (o *vxlanOverlay) AddPeer(_ polycube.RouterManager, _ string, _ *NodeInfo, peer *PeerNode) error {
+	// appending to bridge fdb a rule for the new node
+	neigh, err := o.fdbEntry(peer)
+	if err != nil {
+		return err
+	}
+	l := log.WithFields(log.Fields{
+		"name":   o.name,
+		"entry":  fmt.Sprintf("%+v", *neigh),
+		"nodeIP": peer.IP,
+	})
+	if err := netlink.NeighAppend(neigh); err != nil && !errors.Is(err, syscall.EEXIST) {
+		l.WithField(
+			"detail", err,
+		).Error("failed to configure the node fdb for allowing communication with the new node IP through the vxlan interface")
+		return fmt.Errorf(
+			"failed to configure the node fdb for allowing communication with the new node %q IP through the %q vxlan interface: %v",
+			peer.IP, o.name, err,
+		)
+	}
+	l.Info("node fdb configured in order to allow communication with the new node through vxlan interface")
+	return nil
+}
+
+func (o *vxlanOverlay) DelPeer(_ polycube.RouterManager, _ string, peer *PeerNode) error {
+	// removing the node fdb entry
+	neigh, err := o.fdbEntry(peer)
+	if err != nil {
+		return err
+	}
+	l := log.WithFields(log.Fields{
+		"name":   o.name,
+		"entry":  fmt.Sprintf("%+v", *neigh),
+		"nodeIP": peer.IP,
+	})
+	if err := netlink.NeighDel(neigh); err != nil && !errors.Is(err, syscall.ENOENT) {
+		l.WithField("detail", err).Error("failed to remove the removed node entry from the node fdb")
+		return fmt.Errorf("failed to remove the %q node entry from the %q vxlan interface fdb: %v", peer.IP, o.name, err)
+	}
+	l.Info("removed node entry deleted from the node fdb")
+	return nil
+}
+
+func (o *vxlanOverlay) CheckPeer(_ *router.Router, peer *PeerNode) error {
+	neigh, err := o.fdbEntry(peer)
+	if err != nil {
+		return err
+	}
+	neighs, err := netlink.NeighList(neigh.LinkIndex, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve %q interface neighbors: %v", o.name, err)
+	}
+	for _, n := range neighs {
+		if n.IP.Equal(peer.IP) {
+			return nil
+		}
+	}
+	return fmt.Errorf("fdb entry towards %s is missing", peer.IP)
+}
+
+func (o *vxlanOverlay) PeerRoute(peer *PeerNode) router.Route {
+	return router.Route{
+		Network:    peer.podCIDR.String(),
+		Nexthop:    peer.vtepIP.String(),
+		Interface_: "to_vxlan0",
+	}
+}
+
+func (o *vxlanOverlay) IsPeerRoute(route router.Route) bool {
+	return route.Interface_ == "to_vxlan0"
+}
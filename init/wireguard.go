@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ekoops/polykube-cni-plugin/utils/polycube"
+	router "github.com/ekoops/polykube-cni-plugin/utils/router"
+	"github.com/ekoops/polykube-cni-plugin/utils/wireguard"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"net"
+	"syscall"
+)
+
+const (
+	overlayWireguard = "wireguard"
+
+	// wireguardOverhead is the number of bytes added by the WireGuard encapsulation over IPv4: outer IPv4 (20), UDP (8)
+	// and WireGuard (32) headers
+	wireguardOverhead = 60
+	// wireguardPublicKeyAnnotation is the node annotation through which each node publishes its WireGuard public key
+	wireguardPublicKeyAnnotation = "polykube.io/wireguard-public-key"
+	// wireguardRouterPort is the name of the router port connected to the WireGuard interface through the veth pair
+	wireguardRouterPort      = "to_wg0"
+	wireguardHostIfaceName   = "pkwg0"
+	wireguardRouterIfaceName = "pkwg0r"
+)
+
+// wireguardVeth is the veth pair connecting the router to the node
+var wireguardVeth = &overlayVeth{
+	kind:        overlayWireguard,
+	hostName:    wireguardHostIfaceName,
+	routerName:  wireguardRouterIfaceName,
+	port:        wireguardRouterPort,
+	hostIPNet:   wireguardHostIPNet,
+	routerIPNet: wireguardRouterIPNet,
+}
+
+// wireguardOverlay implements the encrypted backend: a single node WireGuard interface has a WireGuard peer for each
+// peer node. The nodes public keys are exchanged through the wireguardPublicKeyAnnotation node annotation, so a key
+// rotation on a node is propagated to the other nodes by their node controllers.
+// A WireGuard interface has no link layer header, while the router datapath only parses ethernet frames, so the
+// router is not attached to it: the router is connected to the node through a veth pair and the node forwards the
+// packets between the veth pair and the WireGuard interface, which has a route towards each peer node pods
+type wireguardOverlay struct {
+	name    string
+	port    int
+	keyFile string
+}
+
+// getWireguardOverlay returns the WireGuard backend configured through the NODE_WIREGUARD_* environment variables
+func getWireguardOverlay() (*wireguardOverlay, error) {
+	o := &wireguardOverlay{
+		name:    getEnv("NODE_WIREGUARD_IFACE_NAME", "wg0"),
+		keyFile: getEnv("NODE_WIREGUARD_KEY_FILE", "/var/lib/polykube/wireguard/private.key"),
+	}
+	var err error
+	if o.port, err = parseIntEnv("NODE_WIREGUARD_PORT", "51820", 1, 65535); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *wireguardOverlay) Name() string {
+	return overlayWireguard
+}
+
+func (o *wireguardOverlay) Overhead() int {
+	return wireguardOverhead
+}
+
+// RouterPorts returns the router port connected to the veth pair and the static arp entry of the node side, since the
+// WireGuard interface is reached through the veth pair
+func (o *wireguardOverlay) RouterPorts() ([]router.Ports, []router.ArpTable) {
+	return wireguardVeth.routerPorts()
+}
+
+// Uninstall removes the WireGuard interface, the veth pair connecting it to the router and the private key
+func (o *wireguardOverlay) Uninstall(report *UninstallReport) {
+	uninstallLink(o.name, report)
+	uninstallLink(wireguardHostIfaceName, report)
+	uninstallPath("file", o.keyFile, report)
+}
+
+// Setup creates the WireGuard interface and configures it with the private key stored in the key file, generating it
+// if the file doesn't exist. A key rotation is performed replacing (or removing) the key file: the new public key is
+// published on the node as soon as the reconciler detects the change
+func (o *wireguardOverlay) Setup(nodeInfo *NodeInfo) error {
+	l := log.WithField("interface", o.name)
+	privateKey, generated, err := wireguard.LoadOrCreatePrivateKey(o.keyFile)
+	if err != nil {
+		l.WithFields(log.Fields{
+			"path":   o.keyFile,
+			"detail": err,
+		}).Error("failed to load the cluster node WireGuard private key")
+		return fmt.Errorf("failed to load the cluster node WireGuard private key from %q: %v", o.keyFile, err)
+	}
+	if generated {
+		l.WithField("path", o.keyFile).Info("cluster node WireGuard private key generated")
+	}
+
+	// creating the WireGuard interface (it could be already present if the program was restarted)
+	link_ := &netlink.Wireguard{LinkAttrs: netlink.LinkAttrs{Name: o.name, MTU: nodeInfo.MTU}}
+	if err := netlink.LinkAdd(link_); err != nil && !errors.Is(err, syscall.EEXIST) {
+		l.WithField("detail", err).Error("failed to create the cluster node WireGuard interface")
+		return fmt.Errorf("failed to create the cluster node %q WireGuard interface: %v", o.name, err)
+	}
+	link, err := netlink.LinkByName(o.name)
+	if err != nil {
+		l.WithField("detail", err).Error("failed to retrieve the cluster node WireGuard interface")
+		return fmt.Errorf("failed to retrieve the cluster node %q WireGuard interface: %v", o.name, err)
+	}
+	if link.Type() != overlayWireguard {
+		l.WithField("type", link.Type()).Warning("cluster node WireGuard interface misconfigured, recreating it")
+		if err := netlink.LinkDel(link); err != nil {
+			return fmt.Errorf("failed to delete the misconfigured cluster node %q WireGuard interface: %v", o.name, err)
+		}
+		if err := netlink.LinkAdd(link_); err != nil {
+			return fmt.Errorf("failed to create the cluster node %q WireGuard interface: %v", o.name, err)
+		}
+		if link, err = netlink.LinkByName(o.name); err != nil {
+			return fmt.Errorf("failed to retrieve the cluster node %q WireGuard interface: %v", o.name, err)
+		}
+	}
+	if link.Attrs().MTU != nodeInfo.MTU {
+		if err := netlink.LinkSetMTU(link, nodeInfo.MTU); err != nil {
+			l.WithField("detail", err).Error("failed to set the cluster node WireGuard interface MTU")
+			return fmt.Errorf("failed to set the cluster node %q WireGuard interface MTU to %d: %v", o.name, nodeInfo.MTU, err)
+		}
+	}
+	if err := wireguard.ConfigureDevice(o.name, privateKey, o.port); err != nil {
+		l.WithField("detail", err).Error("failed to configure the cluster node WireGuard interface")
+		return err
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		l.WithField("detail", err).Error("failed to set the cluster node WireGuard interface up")
+		return fmt.Errorf("failed to set the cluster node %q WireGuard interface up: %v", o.name, err)
+	}
+	addr := &netlink.Addr{IPNet: nodeInfo.nodeVtepIPNet}
+	if err := netlink.AddrAdd(link, addr); err != nil && !errors.Is(err, syscall.EEXIST) {
+		l.WithField("detail", err).Error("failed to add IPv4 address to the cluster node WireGuard interface")
+		return fmt.Errorf("failed to add IPv4 address to the cluster node %q WireGuard interface: %v", o.name, err)
+	}
+	l.Info("cluster node WireGuard interface configured")
+
+	if err := wireguardVeth.create(nodeInfo); err != nil {
+		return err
+	}
+	return publishWireguardPublicKey(nodeInfo.name, privateKey.PublicKey())
+}
+
+// publishWireguardPublicKey sets the WireGuard public key annotation on the provided node
+func publishWireguardPublicKey(nodeName string, publicKey wireguard.Key) error {
+	l := log.WithFields(log.Fields{
+		"node":      nodeName,
+		"publicKey": publicKey.String(),
+	})
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{wireguardPublicKeyAnnotation: publicKey.String()},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode node annotation patch: %v", err)
+	}
+	if _, err := clientset.CoreV1().Nodes().Patch(
+		context.TODO(), nodeName, types.MergePatchType, patch, metav1.PatchOptions{},
+	); err != nil {
+		l.WithField("detail", err).Error("failed to publish the cluster node WireGuard public key")
+		return fmt.Errorf("failed to publish the %q cluster node WireGuard public key: %v", nodeName, err)
+	}
+	l.Info("cluster node WireGuard public key published")
+	return nil
+}
+
+// Check verifies that the WireGuard interface is up, has the VTEP address and uses the private key stored in the key
+// file and the configured listen port, and that the veth pair connecting the router is configured
+func (o *wireguardOverlay) Check(nodeInfo *NodeInfo) error {
+	link, err := netlink.LinkByName(o.name)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve %q interface: %v", o.name, err)
+	}
+	if link.Type() != overlayWireguard {
+		return fmt.Errorf("%q interface misconfigured: wrong type - required: %s, found: %s",
+			o.name, overlayWireguard, link.Type())
+	}
+	if mtu := link.Attrs().MTU; mtu != nodeInfo.MTU {
+		return fmt.Errorf("%q interface MTU - required: %d, found: %d", o.name, nodeInfo.MTU, mtu)
+	}
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		return fmt.Errorf("%q interface is down", o.name)
+	}
+	privateKey, err := wireguard.LoadPrivateKey(o.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load private key from %q: %v", o.keyFile, err)
+	}
+	device, err := wireguard.GetDevice(o.name)
+	if err != nil {
+		return err
+	}
+	if device.PrivateKey != privateKey {
+		return fmt.Errorf("%q interface private key differs from the %q one", o.name, o.keyFile)
+	}
+	if device.ListenPort != o.port {
+		return fmt.Errorf("%q interface listen port - required: %d, found: %d", o.name, o.port, device.ListenPort)
+	}
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve %q interface addresses: %v", o.name, err)
+	}
+	found := false
+	for _, addr := range addrs {
+		if addr.IPNet.String() == nodeInfo.nodeVtepIPNet.String() {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("VTEP address %s is not assigned to %q interface", nodeInfo.nodeVtepIPNet, o.name)
+	}
+	return wireguardVeth.check(nodeInfo)
+}
+
+// wireguardPeer returns the WireGuard peer of the provided peer node: the peer node pods and VTEP are reachable
+// through the peer node IP
+func (o *wireguardOverlay) wireguardPeer(peer *PeerNode) (wireguard.Peer, error) {
+	if peer.publicKey == "" {
+		return wireguard.Peer{}, fmt.Errorf("%q cluster node has not published its WireGuard public key yet", peer.name)
+	}
+	publicKey, err := wireguard.ParseKey(peer.publicKey)
+	if err != nil {
+		return wireguard.Peer{}, fmt.Errorf("invalid %q cluster node WireGuard public key: %v", peer.name, err)
+	}
+	return wireguard.Peer{
+		PublicKey: publicKey,
+		Endpoint:  &net.UDPAddr{IP: peer.IP, Port: o.port},
+		AllowedIPs: []net.IPNet{
+			*peer.podCIDR,
+			{IP: peer.vtepIP, Mask: net.CIDRMask(32, 32)},
+		},
+	}, nil
+}
+
+func (o *wireguardOverlay) AddPeer(routers polycube.RouterManager, rName string, _ *NodeInfo, peer *PeerNode) error {
+	l := log.WithFields(log.Fields{
+		"interface": o.name,
+		"nodeIP":    peer.IP,
+		"publicKey": peer.publicKey,
+	})
+	wgPeer, err := o.wireguardPeer(peer)
+	if err != nil {
+		l.WithField("detail", err).Error("failed to configure the WireGuard peer for the new node")
+		return err
+	}
+	if err := wireguard.SetPeer(o.name, wgPeer); err != nil {
+		l.WithField("detail", err).Error("failed to configure the WireGuard peer for the new node")
+		return err
+	}
+
+	// the peer node pods are reached by the node through the WireGuard interface
+	route, err := o.peerKernelRoute(peer)
+	if err != nil {
+		l.WithField("detail", err).Error("failed to retrieve the cluster node WireGuard interface")
+		return err
+	}
+	if err := netlink.RouteReplace(route); err != nil {
+		l.WithField("detail", err).Error("failed to set the route towards the new node pods")
+		return fmt.Errorf("failed to set route to %s via %q interface - %v", peer.podCIDR, o.name, err)
+	}
+
+	if err := wireguardVeth.setArpEntries(routers, rName); err != nil {
+		return err
+	}
+	l.Info("WireGuard peer for the new node configured")
+	return nil
+}
+
+func (o *wireguardOverlay) DelPeer(routers polycube.RouterManager, rName string, peer *PeerNode) error {
+	l := log.WithFields(log.Fields{
+		"interface": o.name,
+		"nodeIP":    peer.IP,
+		"publicKey": peer.publicKey,
+	})
+	if route, err := o.peerKernelRoute(peer); err == nil {
+		if err := netlink.RouteDel(route); err != nil && !errors.Is(err, syscall.ESRCH) {
+			l.WithField("detail", err).Error("failed to delete the route towards the removed node pods")
+			return fmt.Errorf("failed to delete route to %s via %q interface - %v", peer.podCIDR, o.name, err)
+		}
+	}
+	// a peer without a valid public key was never configured
+	wgPeer, err := o.wireguardPeer(peer)
+	if err != nil {
+		return nil
+	}
+	if err := wireguard.RemovePeer(o.name, wgPeer.PublicKey); err != nil {
+		l.WithField("detail", err).Error("failed to remove the WireGuard peer of the removed node")
+		return err
+	}
+	l.Info("WireGuard peer of the removed node removed")
+	return nil
+}
+
+func (o *wireguardOverlay) CheckPeer(r *router.Router, peer *PeerNode) error {
+	wgPeer, err := o.wireguardPeer(peer)
+	if err != nil {
+		return err
+	}
+	device, err := wireguard.GetDevice(o.name)
+	if err != nil {
+		return err
+	}
+	current := device.Peer(wgPeer.PublicKey)
+	if current == nil {
+		return fmt.Errorf("WireGuard peer %s is missing", wgPeer.PublicKey)
+	}
+	if current.Endpoint == nil || current.Endpoint.String() != wgPeer.Endpoint.String() {
+		return fmt.Errorf("WireGuard peer %s endpoint - required: %s, found: %v",
+			wgPeer.PublicKey, wgPeer.Endpoint, current.Endpoint)
+	}
+	for _, required := range wgPeer.AllowedIPs {
+		found := false
+		for _, allowed := range current.AllowedIPs {
+			if allowed.String() == required.String() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("WireGuard peer %s allowed IP %s is missing", wgPeer.PublicKey, required.String())
+		}
+	}
+	link, err := netlink.LinkByName(o.name)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve %q interface: %v", o.name, err)
+	}
+	if !hasKernelRoute(link, peer.podCIDR, nil) {
+		return fmt.Errorf("route to %s via %q interface is missing", peer.podCIDR, o.name)
+	}
+	_, entries := o.RouterPorts()
+	return checkArpEntries(r, entries)
+}
+
+// peerKernelRoute returns the node route towards the provided peer node pods through the WireGuard interface
+func (o *wireguardOverlay) peerKernelRoute(peer *PeerNode) (*netlink.Route, error) {
+	link, err := netlink.LinkByName(o.name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve the cluster node %q WireGuard interface: %v", o.name, err)
+	}
+	return &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       peer.podCIDR,
+		Scope:     netlink.SCOPE_LINK,
+	}, nil
+}
+
+func (o *wireguardOverlay) PeerRoute(peer *PeerNode) router.Route {
+	return wireguardVeth.peerRoute(peer)
+}
+
+func (o *wireguardOverlay) IsPeerRoute(route router.Route) bool {
+	return route.Interface_ == wireguardRouterPort
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/ekoops/polykube-cni-plugin/test/fakepolycubed"
+	"github.com/ekoops/polykube-cni-plugin/utils/polycube"
+	"github.com/ekoops/polykube-cni-plugin/utils/wireguard"
+	"github.com/vishvananda/netlink"
+	"io/ioutil"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// errWireguardUnsupported is returned when the kernel can't create WireGuard interfaces
+var errWireguardUnsupported = errors.New("WireGuard interfaces are not supported by the kernel")
+
+// newTestPeer returns the worker2 node, publishing the provided WireGuard public key
+func newTestPeer(publicKey wireguard.Key) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "worker2",
+			Annotations: map[string]string{wireguardPublicKeyAnnotation: publicKey.String()},
+		},
+		Spec: v1.NodeSpec{PodCIDR: "10.10.2.0/24"},
+		Status: v1.NodeStatus{
+			Addresses: []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "192.168.1.11"}},
+		},
+	}
+}
+
+// publishedKey returns the WireGuard public key annotation of the provided node
+func publishedKey(name string) string {
+	node, err := clientset.CoreV1().Nodes().Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return ""
+	}
+	return node.Annotations[wireguardPublicKeyAnnotation]
+}
+
+// TestWireguardOverlay verifies the WireGuard overlay through the agent code path: the node setup, the addition of a
+// peer node through the node controller and the key rotations, both of the current node (published through the node
+// annotation) and of the peer node (picked up through its node annotation)
+func TestWireguardOverlay(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating network namespaces and WireGuard interfaces requires root privileges")
+	}
+	netns, err := testutils.NewNS()
+	if err != nil {
+		t.Fatalf("failed to create netns: %v", err)
+	}
+	defer func() {
+		netns.Close()
+		_ = testutils.UnmountNS(netns)
+	}()
+	if err := netns.Do(func(ns.NetNS) error {
+		link := &netlink.Wireguard{LinkAttrs: netlink.LinkAttrs{Name: "wgprobe"}}
+		if err := netlink.LinkAdd(link); err != nil {
+			return errWireguardUnsupported
+		}
+		return netlink.LinkDel(link)
+	}); err != nil {
+		t.Skip(err)
+	}
+
+	srv := fakepolycubed.NewServer()
+	ts, url := srv.Start()
+	defer ts.Close()
+	cubes := polycube.NewCubes(url)
+
+	keyFile := filepath.Join(t.TempDir(), "private.key")
+	overlay := &wireguardOverlay{name: "wg0", port: 51820, keyFile: keyFile}
+	conf := newTestConf()
+	conf.nodeName = "worker1"
+	conf.overlay = overlay
+	conf.egress = &EgressConf{NatName: "nat0"}
+	_, conf.vtepCIDR, _ = net.ParseCIDR("10.18.0.0/16")
+	nodeInfo := newTestNodeInfo()
+	nodeInfo.name = "worker1"
+	nodeInfo.nodeVtepIPNet = &net.IPNet{IP: net.IPv4(10, 18, 0, 1).To4(), Mask: net.CIDRMask(16, 32)}
+
+	peerKey, err := wireguard.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerNode := newTestPeer(peerKey.PublicKey())
+	clientset = fake.NewSimpleClientset(&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "worker1"}}, peerNode)
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	if err := indexer.Add(peerNode); err != nil {
+		t.Fatal(err)
+	}
+	c := &nodeController{
+		conf:     conf,
+		nodeInfo: nodeInfo,
+		routers:  cubes.Routers,
+		lister:   corelisters.NewNodeLister(indexer),
+		peers:    make(map[string]*PeerNode),
+	}
+
+	err = netns.Do(func(ns.NetNS) error {
+		if err := overlay.Setup(nodeInfo); err != nil {
+			return fmt.Errorf("setup failed: %v", err)
+		}
+		if err := CreateCubes(cubes, nodeInfo, conf); err != nil {
+			return fmt.Errorf("CreateCubes failed: %v", err)
+		}
+		if err := overlay.Check(nodeInfo); err != nil {
+			return fmt.Errorf("check failed after Setup: %v", err)
+		}
+		privateKey, err := wireguard.LoadPrivateKey(keyFile)
+		if err != nil {
+			return err
+		}
+		if key := publishedKey("worker1"); key != privateKey.PublicKey().String() {
+			return fmt.Errorf("published public key - required: %s, found: %s", privateKey.PublicKey(), key)
+		}
+
+		r, err := cubes.Routers.ReadRouter(conf.routerName)
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, port := range r.Ports {
+			if port.Name == wireguardRouterPort {
+				found = true
+				if port.Peer != wireguardRouterIfaceName || port.Ip != wireguardRouterIPNet.String() {
+					return fmt.Errorf("unexpected %q router port: %+v", wireguardRouterPort, port)
+				}
+			}
+		}
+		if !found {
+			return fmt.Errorf("router port %q is missing", wireguardRouterPort)
+		}
+
+		// adding the peer node
+		if err := c.syncNode("worker2"); err != nil {
+			return fmt.Errorf("failed to add peer node: %v", err)
+		}
+		peer := c.peers["worker2"]
+		if peer == nil {
+			return errors.New("peer node not configured")
+		}
+		if r, err = cubes.Routers.ReadRouter(conf.routerName); err != nil {
+			return err
+		}
+		if err := overlay.CheckPeer(r, peer); err != nil {
+			return fmt.Errorf("CheckPeer failed: %v", err)
+		}
+		if route := overlay.PeerRoute(peer); !hasRoute(r, route) {
+			return fmt.Errorf("router route %+v is missing", route)
+		}
+
+		// rotating the peer node key: the new key is picked up through the node annotation
+		newPeerKey, err := wireguard.GeneratePrivateKey()
+		if err != nil {
+			return err
+		}
+		if err := indexer.Update(newTestPeer(newPeerKey.PublicKey())); err != nil {
+			return err
+		}
+		if err := c.syncNode("worker2"); err != nil {
+			return fmt.Errorf("failed to update peer node: %v", err)
+		}
+		device, err := wireguard.GetDevice(overlay.name)
+		if err != nil {
+			return err
+		}
+		if device.Peer(peerKey.PublicKey()) != nil {
+			return errors.New("the WireGuard peer with the old key still configured")
+		}
+		if r, err = cubes.Routers.ReadRouter(conf.routerName); err != nil {
+			return err
+		}
+		if err := overlay.CheckPeer(r, c.peers["worker2"]); err != nil {
+			return fmt.Errorf("CheckPeer failed after the peer key rotation: %v", err)
+		}
+
+		// rotating the current node key: the new key is published through the node annotation
+		if err := os.Remove(keyFile); err != nil {
+			return err
+		}
+		if err := overlay.Check(nodeInfo); err == nil {
+			return errors.New("check succeeded with a rotated key")
+		}
+		if err := overlay.Setup(nodeInfo); err != nil {
+			return fmt.Errorf("setup failed after the key rotation: %v", err)
+		}
+		if err := overlay.Check(nodeInfo); err != nil {
+			return fmt.Errorf("check failed after the key rotation: %v", err)
+		}
+		newKey, err := wireguard.LoadPrivateKey(keyFile)
+		if err != nil {
+			return err
+		}
+		if key := publishedKey("worker1"); key != newKey.PublicKey().String() {
+			return fmt.Errorf("published public key after rotation - required: %s, found: %s", newKey.PublicKey(), key)
+		}
+
+		// removing the peer node
+		if err := indexer.Delete(peerNode); err != nil {
+			return err
+		}
+		if err := c.syncNode("worker2"); err != nil {
+			return fmt.Errorf("failed to remove peer node: %v", err)
+		}
+		if device, err = wireguard.GetDevice(overlay.name); err != nil {
+			return err
+		}
+		if len(device.Peers) != 0 {
+			return fmt.Errorf("the WireGuard peers are still configured: %+v", device.Peers)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestWireguardVeth verifies the veth pair connecting the router to the node, which doesn't require WireGuard support
+func TestWireguardVeth(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating network namespaces and veth pairs requires root privileges")
+	}
+	netns, err := testutils.NewNS()
+	if err != nil {
+		t.Fatalf("failed to create netns: %v", err)
+	}
+	defer func() {
+		netns.Close()
+		_ = testutils.UnmountNS(netns)
+	}()
+	nodeInfo := newTestNodeInfo()
+	err = netns.Do(func(ns.NetNS) error {
+		if err := wireguardVeth.check(nodeInfo); err == nil {
+			return errors.New("check succeeded without the veth pair")
+		}
+		// the setup is performed again after a restart, so it must succeed on an existing veth pair
+		for i := 0; i < 2; i++ {
+			if err := wireguardVeth.create(nodeInfo); err != nil {
+				return fmt.Errorf("create (run %d) failed: %v", i+1, err)
+			}
+		}
+		if err := wireguardVeth.check(nodeInfo); err != nil {
+			return fmt.Errorf("check failed: %v", err)
+		}
+		rpFilter, err := ioutil.ReadFile(fmt.Sprintf(rpFilterPathFormat, wireguardHostIfaceName))
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(string(rpFilter)) != "2" {
+			return fmt.Errorf("%q reverse path filter - required: 2, found: %s", wireguardHostIfaceName, rpFilter)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
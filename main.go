@@ -1,7 +1,6 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,49 +12,97 @@ import (
 	"github.com/containernetworking/plugins/pkg/ipam"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/ekoops/polykube-cni-plugin/utils"
-	lbrp "github.com/ekoops/polykube-cni-plugin/utils/lbrp"
-	simplebridge "github.com/ekoops/polykube-cni-plugin/utils/simplebridge"
+	"github.com/ekoops/polykube-cni-plugin/utils/attachment"
+	"github.com/ekoops/polykube-cni-plugin/utils/metrics"
+	"github.com/ekoops/polykube-cni-plugin/utils/polycube"
 	log "github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
 	"io/ioutil"
 	"net"
-	"os"
 	"runtime"
 )
 
 const (
-	basePath = "http://127.0.0.1:9000/polycube/v1"
+	defaultLogFile  = "/var/log/polykube/polykube-cni-plugin.log"
+	defaultLogLevel = "info"
 )
 
-var (
-	simplebridgeAPI *simplebridge.SimplebridgeApiService
-	lbrpAPI         *lbrp.LbrpApiService
-)
+// Plugin implements the CNI commands
+type Plugin struct {
+	// NewManagers returns the managers used for configuring the polycube instance exposing its REST API at the
+	// provided URL. The performed requests are notified to the provided observer
+	NewManagers func(polycubeURL string, observer metrics.RequestObserver) (attachment.PodLBManager, polycube.BridgeManager)
+}
+
+// newPolycubeManagers returns the managers backed by the polycubed REST API
+func newPolycubeManagers(polycubeURL string, observer metrics.RequestObserver) (attachment.PodLBManager, polycube.BridgeManager) {
+	cubes := polycube.NewCubesWithConf(&polycube.Conf{
+		BasePath:   polycubeURL,
+		Retry:      polycube.DefaultRetryConf,
+		HTTPClient: metrics.NewInstrumentedClient(observer),
+	})
+	return attachment.NewPodLBManager(cubes.Lbrps, cubes.Bridges), cubes.Bridges
+}
 
 func init() {
-	log.SetLevel(log.DebugLevel)
-	file, err := os.OpenFile("polykube-cni-plugin.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-	if err == nil {
-		log.SetOutput(file)
-	} else {
-		// I have not to log anything since stderr and stdout are reserved for CNI specification purposes.
-		log.SetOutput(ioutil.Discard)
-	}
+	// nothing has to be logged until the logger is configured, since stderr and stdout are reserved for CNI
+	// specification purposes
+	log.SetOutput(ioutil.Discard)
 
 	// this ensures that main runs only on main thread (thread group leader).
 	// since namespace ops (unshare, setns) are done for a single thread, we
 	// must ensure that the goroutine does not jump from OS thread to thread
 	runtime.LockOSThread()
+}
 
-	// init simplebrige API
-	cfgSimplebridge := simplebridge.Configuration{BasePath: basePath}
-	srSimplebridge := simplebridge.NewAPIClient(&cfgSimplebridge)
-	simplebridgeAPI = srSimplebridge.SimplebridgeApi
+// setupLogger configures the logger as requested by the log section of the network configuration, falling back on
+// defaults if it is missing or invalid. It returns a logger carrying the fields identifying the current invocation
+// so that its records can be correlated with the container runtime ones
+func setupLogger(verb string, args *skel.CmdArgs) *log.Entry {
+	conf := struct {
+		Log utils.LogConf `json:"log"`
+	}{
+		Log: utils.LogConf{
+			File:  defaultLogFile,
+			Level: defaultLogLevel,
+		},
+	}
+	// errors are ignored here: the network configuration is parsed and validated again later
+	_ = json.Unmarshal(args.StdinData, &conf)
+	if err := utils.SetupLogger(&conf.Log); err != nil {
+		// the logger could have been partially configured, so it must be reset: a failure while opening the log
+		// file must not prevent the plugin from working
+		log.SetOutput(ioutil.Discard)
+	}
+	return log.WithFields(log.Fields{
+		"verb":        verb,
+		"containerID": args.ContainerID,
+		"netns":       args.Netns,
+		"iface":       args.IfName,
+	})
+}
 
-	// init lbrp API
-	cfgLbrp := lbrp.Configuration{BasePath: basePath}
-	srLbrp := lbrp.NewAPIClient(&cfgLbrp)
-	lbrpAPI = srLbrp.LbrpApi
+// startReport starts the report of the current invocation. The returned function must be called with the operation
+// outcome: it pushes the report to the agent as requested by the metrics section of the network configuration
+func startReport(op string, args *skel.CmdArgs, l *log.Entry) (*metrics.Report, func(err error)) {
+	conf := struct {
+		Metrics metrics.PushConf `json:"metrics"`
+	}{
+		Metrics: metrics.PushConf{
+			Socket: metrics.DefaultSocketPath,
+			Spool:  metrics.DefaultSpoolPath,
+		},
+	}
+	// errors are ignored here: the network configuration is parsed and validated again later
+	_ = json.Unmarshal(args.StdinData, &conf)
+	report := metrics.NewReport(op)
+	return report, func(err error) {
+		report.Finish(err)
+		// a failure while pushing the report must not affect the operation outcome
+		if pushErr := report.Push(&conf.Metrics); pushErr != nil {
+			l.WithField("detail", pushErr).Warning("failed to push metrics report")
+		}
+	}
 }
 
 func setupVeth(netns ns.NetNS, contIfName string, hostIfName string, mtu int) (*current.Interface, *current.Interface, error) {
@@ -120,6 +167,11 @@ func loadNetConf(stdin []byte) (*NetConf, error) {
 	if conf.VClusterCIDR == "" {
 		return nil, errors.New("VClusterCIDR must be specified")
 	}
+	_, vClusterIPNet, err := net.ParseCIDR(conf.VClusterCIDR)
+	if err != nil || vClusterIPNet.IP.To4() == nil {
+		return nil, fmt.Errorf("VClusterCIDR must be an ipv4 CIDR: %q", conf.VClusterCIDR)
+	}
+	conf.VClusterIPNet = vClusterIPNet
 
 	if conf.Gw.IP == nil || conf.Gw.IP.To4() == nil {
 		return nil, errors.New("the gateway IP must be an ipv4 address")
@@ -133,10 +185,27 @@ func loadNetConf(stdin []byte) (*NetConf, error) {
 	}
 	conf.Gw.MAC = hwAddr
 
+	if conf.PolycubeURL == "" {
+		conf.PolycubeURL = polycube.DefaultURL
+	}
+
+	if conf.StateDir == "" {
+		conf.StateDir = attachment.DefaultStateDir
+	}
+
 	return conf, nil
 }
 
-func configureNetns(netns ns.NetNS, ifName string, address *net.IPNet, gwInfo *GwInfo) error {
+// vClusterRoute returns the route towards the VClusterCIDR installed in the pod netns, so that the intra-cluster
+// traffic doesn't depend on the default route
+func vClusterRoute(conf *NetConf) *types.Route {
+	return &types.Route{
+		Dst: *conf.VClusterIPNet,
+		GW:  conf.Gw.IP,
+	}
+}
+
+func configureNetns(netns ns.NetNS, ifName string, address *net.IPNet, gwInfo *GwInfo, vClusterIPNet *net.IPNet) error {
 	if err := netns.Do(func(_ ns.NetNS) error {
 		// setting up the veth interface
 		link, err := netlink.LinkByName(ifName)
@@ -161,6 +230,14 @@ func configureNetns(netns ns.NetNS, ifName string, address *net.IPNet, gwInfo *G
 		if err := netlink.RouteAdd(route); err != nil {
 			return fmt.Errorf("failed to add default route: %v", err)
 		}
+		// adding VClusterCIDR route
+		route = &netlink.Route{
+			Dst: vClusterIPNet,
+			Gw:  gwInfo.IP,
+		}
+		if err := netlink.RouteAdd(route); err != nil {
+			return fmt.Errorf("failed to add VClusterCIDR route: %v", err)
+		}
 		// adding arp entry for default gateway
 		arpentry := &netlink.Neigh{
 			LinkIndex:    link.Attrs().Index,
@@ -179,10 +256,12 @@ func configureNetns(netns ns.NetNS, ifName string, address *net.IPNet, gwInfo *G
 	return nil
 }
 
-func cmdAdd(args *skel.CmdArgs) error {
+func (p *Plugin) cmdAdd(args *skel.CmdArgs) (err error) {
 	// defining the attachment identifier and the base logger
-	att := utils.Truncate(fmt.Sprintf("%s_%s", args.IfName, args.ContainerID[0:10]), 15)
-	l := log.WithField("id", fmt.Sprintf("ADD_%s", att))
+	att := attachment.Name(args.IfName, args.ContainerID)
+	l := setupLogger("ADD", args).WithField("attachment", att)
+	report, finish := startReport("ADD", args, l)
+	defer func() { finish(err) }()
 
 	// parsing configuration
 	conf, err := loadNetConf(args.StdinData)
@@ -190,15 +269,16 @@ func cmdAdd(args *skel.CmdArgs) error {
 		l.WithFields(log.Fields{
 			"subject": "netconf",
 			"detail":  err,
-		}).Fatal("parsing failed")
+		}).Error("parsing failed")
 		return fmt.Errorf("failed to parse netconf: %v", err)
 	}
+	podLBs, _ := p.NewManagers(conf.PolycubeURL, report)
 
 	// parsing prevResult, if present
 	var prevResult *current.Result
 	if conf.PrevResult != nil {
 		if prevResult, err = current.NewResultFromResult(conf.PrevResult); err != nil {
-			l.WithField("detail", err).Fatal("failed to convert prevResult to current version")
+			l.WithField("detail", err).Error("failed to convert prevResult to current version")
 			return fmt.Errorf("failed to convert prevResult into current version: %v", err)
 		}
 	}
@@ -209,7 +289,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 		l.WithFields(log.Fields{
 			"netns":  args.Netns,
 			"detail": err,
-		}).Fatal("failed to retrieve netns")
+		}).Error("failed to retrieve netns")
 		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
 	}
 	defer netns.Close() // TODO why?
@@ -229,17 +309,19 @@ func cmdAdd(args *skel.CmdArgs) error {
 			"netns":  args.Netns,
 			"iface":  args.IfName,
 			"detail": err,
-		}).Fatal("error during iface existence checking")
+		}).Error("error during iface existence checking")
 		return fmt.Errorf("error during checking iface %q existence into netns %q: %v", args.IfName, args.Netns, err)
 	}
 
 	// getting ip from ipam plugin
+	done := report.StartStep("ipam")
 	addr, err := allocIP(conf.IPAM.Type, args.StdinData)
+	done(err)
 	if err != nil {
 		l.WithFields(log.Fields{
 			"scope":  "ipam",
 			"detail": err,
-		}).Fatal("failed to get ip")
+		}).Error("failed to get ip")
 		return fmt.Errorf("failed to get ip through ipam plugin: %v", err)
 	}
 	l.WithFields(log.Fields{
@@ -247,22 +329,35 @@ func cmdAdd(args *skel.CmdArgs) error {
 		"netmask": addr.Mask,
 	}).Info("ip allocated")
 
-	// setting up the veth pair
-	// using a truncation of ifName_containerId[0:10] up to 15 characters since it is the max possibile
-	// link name dimensione
+	// the pod address must belong to the VClusterCIDR, otherwise the other pods can't reach it
+	if !conf.VClusterIPNet.Contains(addr.IP) {
+		err = fmt.Errorf("allocated ip %s is outside the VClusterCIDR %s", addr.IP, conf.VClusterCIDR)
+		l.WithFields(log.Fields{
+			"ip":           addr.IP,
+			"vClusterCIDR": conf.VClusterCIDR,
+		}).Error("invalid allocated ip")
+		if delErr := ipam.ExecDel(conf.IPAM.Type, args.StdinData); delErr != nil {
+			l.WithField("detail", delErr).Warning("failed to release ip")
+		}
+		return err
+	}
+
+	// setting up the veth pair, using the attachment identifier as host interface name
+	done = report.StartStep("veth")
 	hostIface, contIface, err := setupVeth(
 		netns,
 		args.IfName,
 		att,
 		conf.MTU,
 	)
+	done(err)
 	if err != nil {
 		l.WithFields(log.Fields{
 			"netns":  args.Netns,
 			"iface":  args.IfName,
 			"mtu":    conf.MTU,
 			"detail": err,
-		}).Fatal("failed to setup veth pair")
+		}).Error("failed to setup veth pair")
 		return fmt.Errorf("failed to setup veth pair: %v", err)
 	}
 	l.WithFields(log.Fields{
@@ -278,8 +373,11 @@ func cmdAdd(args *skel.CmdArgs) error {
 		"address": fmt.Sprintf("%+v", addr),
 		"gateway": fmt.Sprintf("%+v", conf.Gw),
 	})
-	if err := configureNetns(netns, args.IfName, addr, &conf.Gw); err != nil {
-		netnsLgr.WithField("detail", err).Fatal("failed to configure the netns")
+	done = report.StartStep("netns")
+	err = configureNetns(netns, args.IfName, addr, &conf.Gw, conf.VClusterIPNet)
+	done(err)
+	if err != nil {
+		netnsLgr.WithField("detail", err).Error("failed to configure the netns")
 		return fmt.Errorf("failed to configure the netns %q: %v", args.Netns, err)
 	}
 	netnsLgr.Info("netns configured")
@@ -287,14 +385,17 @@ func cmdAdd(args *skel.CmdArgs) error {
 	// creating lbrp (using pod ip as id, so it can be referenced by operator)
 	// and connecting the frontend port to hostInterface
 	//lbrpName := fmt.Sprintf("lbrp-%s", addr.IP.String())
-	lbName := "lbrp_" + hostIface.Name
+	lbName := attachment.LbrpName(hostIface.Name)
 	llog := l.WithField("lbrp", lbName)
-	if err := createLbrp(lbName, hostIface); err != nil {
-		llog.WithField("detail", err).Fatal("failed to create lbrp")
+	done = report.StartStep("lbrp")
+	err = podLBs.Create(lbName, hostIface.Name)
+	done(err)
+	if err != nil {
+		llog.WithField("detail", err).Error("failed to create lbrp")
 		return fmt.Errorf("failed to create lbrp %q: %v", lbName, err)
 	}
 	llog.WithField(
-		"connection", fmt.Sprintf("%s <-> %s", utils.CreatePeer(lbName, "to_pod"), hostIface.Name),
+		"connection", fmt.Sprintf("%s <-> %s", utils.CreatePeer(lbName, attachment.FrontendPort), hostIface.Name),
 	).Info("lbrp created and connected to pod")
 
 	// creating bridge port and connect it to the lbrp
@@ -303,15 +404,41 @@ func cmdAdd(args *skel.CmdArgs) error {
 		"lbrp":   lbName,
 		"bridge": brName,
 	})
-	lbPort, brPort, err := connectLbrpToBridge(lbName, brName)
+	done = report.StartStep("bridge")
+	lbPeer, brPeer, err := podLBs.ConnectToBridge(lbName, brName)
+	done(err)
 	if err != nil {
-		conlog.WithField("detail", err).Fatal("failed to connect lbrp to bridge")
+		conlog.WithField("detail", err).Error("failed to connect lbrp to bridge")
 		return fmt.Errorf("failed to connect %q lbrp to %q bridge: %v", lbName, brName, err)
 	}
 	conlog.WithField(
-		"connection", fmt.Sprintf("%s <-> %s", brPort.Peer, lbPort.Peer),
+		"connection", fmt.Sprintf("%s <-> %s", brPeer, lbPeer),
 	).Info("lbrp connected to bridge")
 
+	// persisting the attachment state, so that the agent can rebuild the lbrp if polycubed loses it. A failure is
+	// not fatal, since the agent falls back on scanning the host interfaces
+	state := &attachment.Attachment{
+		Name:        att,
+		ContainerID: args.ContainerID,
+		IfName:      args.IfName,
+		Netns:       args.Netns,
+		Bridge:      brName,
+		IP:          addr.IP.String(),
+	}
+	k8sArgs := &K8sArgs{}
+	if err := types.LoadArgs(args.Args, k8sArgs); err != nil {
+		l.WithField("detail", err).Warning("failed to parse CNI_ARGS")
+	} else {
+		state.PodNamespace = string(k8sArgs.K8S_POD_NAMESPACE)
+		state.PodName = string(k8sArgs.K8S_POD_NAME)
+	}
+	slog := l.WithField("stateDir", conf.StateDir)
+	if err := attachment.Save(conf.StateDir, state); err != nil {
+		slog.WithField("detail", err).Warning("failed to persist attachment state")
+	} else {
+		slog.Info("attachment state persisted")
+	}
+
 	// setting up the plugin result
 	result := &current.Result{}
 	if prevResult != nil {
@@ -331,7 +458,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 	result.Interfaces = append(result.Interfaces, contIface, hostIface) // the order is important!
 	result.IPs = append(result.IPs, contIp)
-	result.Routes = append(result.Routes, contRoute)
+	result.Routes = append(result.Routes, contRoute, vClusterRoute(conf))
 
 	return types.PrintResult(result, conf.CNIVersion)
 }
@@ -342,10 +469,10 @@ func checkIface(l *log.Entry, netns string, iface *IFaceConf) error {
 	link, err := netlink.LinkByName(name)
 	if err != nil {
 		if _, notFound := err.(netlink.LinkNotFoundError); notFound {
-			l.WithField("detail", err).Fatal("iface doesn't exist")
+			l.WithField("detail", err).Error("iface doesn't exist")
 			return fmt.Errorf("%q iface doesn't exist into %q netns: %v", name, netns, err)
 		}
-		l.WithField("detail", err).Fatal("failed iface lookup")
+		l.WithField("detail", err).Error("failed iface lookup")
 		return fmt.Errorf("failed %q iface lookup into %q netns: %v", name, netns, err)
 	}
 
@@ -357,7 +484,7 @@ func checkIface(l *log.Entry, netns string, iface *IFaceConf) error {
 	// obtaining addresses configured on link
 	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
 	if err != nil {
-		l.WithField("detail", err).Fatal("failed iface addresses lookup")
+		l.WithField("detail", err).Error("failed iface addresses lookup")
 		return fmt.Errorf("failed %q iface addresses lookup into %q netns: %v", name, netns, err)
 	}
 
@@ -367,7 +494,7 @@ func checkIface(l *log.Entry, netns string, iface *IFaceConf) error {
 			return nil
 		}
 	}
-	l.WithField("detail", err).Fatal("iface ip misconfiguration")
+	l.WithField("detail", err).Error("iface ip misconfiguration")
 	return fmt.Errorf("%q iface ip misconfiguration into %q netns: %v", name, netns, err)
 }
 
@@ -414,10 +541,12 @@ func getIfaceConfs(contIfName, hostIfName, netns string, prevResult *current.Res
 }
 
 // cmdCheck is called for CHECK requests
-func cmdCheck(args *skel.CmdArgs) error {
+func (p *Plugin) cmdCheck(args *skel.CmdArgs) (err error) {
 	// defining the attachment identifier and the base logger
-	att := utils.Truncate(fmt.Sprintf("%s_%s", args.IfName, args.ContainerID[0:10]), 15)
-	l := log.WithField("id", fmt.Sprintf("CHK_%s", att))
+	att := attachment.Name(args.IfName, args.ContainerID)
+	l := setupLogger("CHECK", args).WithField("attachment", att)
+	report, finish := startReport("CHECK", args, l)
+	defer func() { finish(err) }()
 
 	// parsing configuration
 	conf, err := loadNetConf(args.StdinData)
@@ -425,31 +554,34 @@ func cmdCheck(args *skel.CmdArgs) error {
 		l.WithFields(log.Fields{
 			"subject": "netconf",
 			"detail":  err,
-		}).Fatal("parsing failed")
+		}).Error("parsing failed")
 		return err
 	}
+	podLBs, bridges := p.NewManagers(conf.PolycubeURL, report)
 
 	// checking the presence of prevResult (its presence is made mandatory by the CNI specification
 	// in order to check the container networking)
 	if conf.PrevResult == nil {
 		l.WithField(
 			"detail", "prevResult must be specified",
-		).Fatal("missing configuration")
+		).Error("missing configuration")
 		return errors.New("missing configuration: prevResult must be specified")
 	}
 	prevResult, err := current.NewResultFromResult(conf.PrevResult)
 	if err != nil {
-		l.WithField("detail", err).Fatal("failed to convert prevResult into current version")
+		l.WithField("detail", err).Error("failed to convert prevResult into current version")
 		return fmt.Errorf("failed to convert prevResult into current version: %v", err)
 	}
 
 	// CHECK on ipam plugin
+	done := report.StartStep("ipam")
 	err = ipam.ExecCheck(conf.IPAM.Type, args.StdinData)
+	done(err)
 	if err != nil {
 		l.WithFields(log.Fields{
 			"scope":  "ipam",
 			"detail": err,
-		}).Fatal("CHECK operation failed")
+		}).Error("CHECK operation failed")
 		return fmt.Errorf("CHECK operation failed on ipam plugin: %v", err)
 	}
 	l.Info("ip checked")
@@ -460,7 +592,7 @@ func cmdCheck(args *skel.CmdArgs) error {
 		l.WithFields(log.Fields{
 			"netns":  args.Netns,
 			"detail": err,
-		}).Fatal("failed to retrieve netns")
+		}).Error("failed to retrieve netns")
 		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
 	}
 	defer netns.Close()
@@ -472,7 +604,7 @@ func cmdCheck(args *skel.CmdArgs) error {
 		l.WithFields(log.Fields{
 			"prevResult": fmt.Sprintf("%+v", *prevResult),
 			"detail":     err,
-		}).Fatal("unexpected prevResult")
+		}).Error("unexpected prevResult")
 		return fmt.Errorf("unexpected prevResult: %v", err)
 	}
 
@@ -487,7 +619,7 @@ func cmdCheck(args *skel.CmdArgs) error {
 
 		// checking that routes are correctly configured
 		if err := ip.ValidateExpectedRoute(prevResult.Routes); err != nil {
-			nlog.WithField("detail", err).Fatal("failed netns routes checking")
+			nlog.WithField("detail", err).Error("failed netns routes checking")
 			return fmt.Errorf("failed %q netns routes checking: %v", args.Netns, err)
 		}
 		nlog.Info("netns routes checked")
@@ -507,45 +639,61 @@ func cmdCheck(args *skel.CmdArgs) error {
 	nlog.Info("netns checked")
 
 	// checking lbrp
-	lbName := "lbrp_" + att
-	lbFPeer := att                                             // lbrp frontend port peer
-	lbBPeer := utils.CreatePeer(conf.BridgeName, "to_"+lbName) // lbrp backend port peer
-	llog := l.WithField("lbrp", lbName)                        // load balancer logger
-	if err := checkLbrp(
+	lbName := attachment.LbrpName(att)
+	lbFPeer := att                                                                  // lbrp frontend port peer
+	lbBPeer := utils.CreatePeer(conf.BridgeName, attachment.BridgePortName(lbName)) // lbrp backend port peer
+	llog := l.WithField("lbrp", lbName)                                             // load balancer logger
+	done = report.StartStep("lbrp")
+	err = podLBs.Check(
 		lbName,
 		lbFPeer,
 		lbBPeer,
-	); err != nil {
-		llog.WithField("detail", err).Fatal("failed lbrp checking")
+	)
+	steered := false
+	if err != nil {
+		// the agent connects the lbrp of a pod steered towards an egress gateway to the pod steering interface,
+		// removing the bridge port
+		if _, lbSPeer := attachment.SteeringIfaceNames(att); podLBs.Check(lbName, lbFPeer, lbSPeer) == nil {
+			err, steered = nil, true
+		}
+	}
+	done(err)
+	if err != nil {
+		llog.WithField("detail", err).Error("failed lbrp checking")
 		return fmt.Errorf("failed %q lbrp checking: %v", lbName, err)
 	}
 	llog.Info("lbrp checked")
+	if steered {
+		return nil
+	}
 
 	// checking bridge port
 	brName := conf.BridgeName
-	brPortName := "to_" + lbName
-	brPeer := utils.CreatePeer(lbName, "to_bridge")
+	brPortName := attachment.BridgePortName(lbName)
+	brPeer := utils.CreatePeer(lbName, attachment.BackendPort)
 	brlog := l.WithFields(log.Fields{
 		"bridge": brName,
 		"port":   brPortName,
 	})
-	port, resp, err := simplebridgeAPI.ReadSimplebridgePortsByID(context.TODO(), brName, brPortName)
+	done = report.StartStep("bridge")
+	port, err := bridges.ReadBridgePort(brName, brPortName)
+	done(err)
 	if err != nil {
 		brlog.WithField("detail", fmt.Sprintf(
-			"failed to retrieve %q bridge - error: %s, response: %+v", brName, err, resp,
-		)).Fatal("failed bridge port checking")
-		return fmt.Errorf("failed to retrieve %q bridge %q port - error: %s, response: %+v", brName, brPortName, err, resp)
+			"failed to retrieve %q bridge - %v", brName, err,
+		)).Error("failed bridge port checking")
+		return fmt.Errorf("failed to retrieve %q bridge %q port - %v", brName, brPortName, err)
 	}
 	if port.Peer != brPeer {
 		brlog.WithField("detail", fmt.Sprintf(
 			"wrong %q bridge %q port peer - required: %q, found: %q", brName, brPortName, brPeer, port.Peer,
-		)).Fatal("failed bridge port checking")
+		)).Error("failed bridge port checking")
 		return fmt.Errorf("wrong %q bridge %q port peer - required: %q, found: %q", brName, brPortName, brPeer, port.Peer)
 	}
 	if port.Status != "UP" {
 		brlog.WithField("detail", fmt.Sprintf(
 			"wrong %q bridge %q port status - required: UP, found: DOWN", brName, brPortName,
-		)).Fatal("failed bridge port checking")
+		)).Error("failed bridge port checking")
 		return fmt.Errorf("wrong %q bridge %q port status - required: UP, found: DOWN", brName, brPortName)
 	}
 	brlog.Info("bridge port checked")
@@ -554,10 +702,12 @@ func cmdCheck(args *skel.CmdArgs) error {
 }
 
 // cmdDel is called for DELETE requests
-func cmdDel(args *skel.CmdArgs) error {
+func (p *Plugin) cmdDel(args *skel.CmdArgs) (err error) {
 	// defining the attachment identifier and the base logger
-	att := utils.Truncate(fmt.Sprintf("%s_%s", args.IfName, args.ContainerID[0:10]), 15)
-	l := log.WithField("id", fmt.Sprintf("DEL_%s", att))
+	att := attachment.Name(args.IfName, args.ContainerID)
+	l := setupLogger("DEL", args).WithField("attachment", att)
+	report, finish := startReport("DEL", args, l)
+	defer func() { finish(err) }()
 
 	// parsing configuration
 	conf, err := loadNetConf(args.StdinData)
@@ -565,19 +715,23 @@ func cmdDel(args *skel.CmdArgs) error {
 		l.WithFields(log.Fields{
 			"subject": "netconf",
 			"detail":  err,
-		}).Fatal("parsing failed")
+		}).Error("parsing failed")
 		return err
 	}
+	podLBs, bridges := p.NewManagers(conf.PolycubeURL, report)
 
 	// actually, this implementation of the DELETE operation doesn't need to access the
 	// information about prevResult, so it will not be checked
 
 	// releasing IP address
-	if err := ipam.ExecDel(conf.IPAM.Type, args.StdinData); err != nil {
+	done := report.StartStep("ipam")
+	err = ipam.ExecDel(conf.IPAM.Type, args.StdinData)
+	done(err)
+	if err != nil {
 		l.WithFields(log.Fields{
 			"scope":  "ipam",
 			"detail": err,
-		}).Fatal("DEL operation failed")
+		}).Error("DEL operation failed")
 		return fmt.Errorf("DEL operation failed on ipam plugin: %v", err)
 	}
 	l.Info("ip released")
@@ -599,7 +753,7 @@ func cmdDel(args *skel.CmdArgs) error {
 		}); err != nil {
 			// if netns is not found, continue anyway.
 			if _, notFound := err.(ns.NSPathNotExistErr); !notFound {
-				nlog.Fatal("failed to delete iface")
+				nlog.Error("failed to delete iface")
 				return fmt.Errorf("failed to delete iface %q into netns %q: %v", args.IfName, args.Netns, err)
 			}
 		}
@@ -607,32 +761,50 @@ func cmdDel(args *skel.CmdArgs) error {
 	}
 
 	// deleting load balancer
-	lbName := "lbrp_" + att
+	lbName := attachment.LbrpName(att)
 	llog := l.WithField("lbrp", lbName)
-	if resp, err := lbrpAPI.DeleteLbrpByID(context.TODO(), lbName); err != nil && resp.StatusCode != 409 {
-		llog.WithField("detail", err).Fatal("failed to delete lbrp")
-		return fmt.Errorf("failed to delete lbrp %q - error: %s, response: %+v", lbName, err, resp)
+	done = report.StartStep("lbrp")
+	if err = podLBs.Delete(lbName); polycube.IsConflict(err) || polycube.IsNotFound(err) {
+		err = nil
+	}
+	done(err)
+	if err != nil {
+		llog.WithField("detail", err).Error("failed to delete lbrp")
+		return fmt.Errorf("failed to delete lbrp %q - %v", lbName, err)
 	}
 	llog.Info("lbrp deleted")
 
 	// deleting bridge port
 	brName := conf.BridgeName
-	brPortName := "to_" + lbName
+	brPortName := attachment.BridgePortName(lbName)
 	brlog := l.WithFields(log.Fields{
 		"bridge": brName,
 		"port":   brPortName,
 	})
-	if resp, err := simplebridgeAPI.DeleteSimplebridgePortsByID(context.TODO(), brName, brPortName); err != nil && resp.StatusCode != 409 {
-		brlog.WithField("detail", err).Fatal("failed to delete bridge port")
-		return fmt.Errorf(
-			"failed to delete port %q on bridge %q: - error: %s, response: %+v", brPortName, brName, err, resp,
-		)
+	done = report.StartStep("bridge")
+	if err = bridges.DeleteBridgePort(brName, brPortName); polycube.IsConflict(err) || polycube.IsNotFound(err) {
+		err = nil
+	}
+	done(err)
+	if err != nil {
+		brlog.WithField("detail", err).Error("failed to delete bridge port")
+		return fmt.Errorf("failed to delete port %q on bridge %q: - %v", brPortName, brName, err)
 	}
 	brlog.Info("bridge port deleted")
 
+	// removing the attachment state. A failure is not fatal, since the agent discards the states of the attachments
+	// whose host interface doesn't exist anymore
+	slog := l.WithField("stateDir", conf.StateDir)
+	if err := attachment.Remove(conf.StateDir, att); err != nil {
+		slog.WithField("detail", err).Warning("failed to remove attachment state")
+	} else {
+		slog.Info("attachment state removed")
+	}
+
 	return nil
 }
 
 func main() {
-	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, "polykube-cni-plugin")
+	p := &Plugin{NewManagers: newPolycubeManagers}
+	skel.PluginMain(p.cmdAdd, p.cmdCheck, p.cmdDel, version.All, "polykube-cni-plugin")
 }
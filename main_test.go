@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/ekoops/polykube-cni-plugin/test/fakepolycubed"
+	"github.com/ekoops/polykube-cni-plugin/utils/attachment"
+	"github.com/ekoops/polykube-cni-plugin/utils/polycube"
+	simplebridge "github.com/ekoops/polykube-cni-plugin/utils/simplebridge"
+	"github.com/vishvananda/netlink"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testIPAMType is the name under which the test binary is run as IPAM plugin
+const testIPAMType = "polykube-test-ipam"
+
+const testConfFormat = `
+{
+	"cniVersion": "1.0.0",
+	"name": "testnet",
+	"type": "polykube-cni-plugin",
+	"mtu": 1450,
+	"vclustercidr": "10.10.0.0/16",
+	"bridge": "br0",
+	"gateway": {
+		"ip": "10.10.1.254",
+		"mac": "aa:bb:cc:dd:ee:ff"
+	},
+	"log": {"file": %q},
+	"polycubeURL": %q,
+	"metrics": {"socket": %q, "spool": %q},
+	"stateDir": %q,
+	"ipam": {
+		"type": %q,
+		"address": "10.10.1.5/24",
+		"gateway": "10.10.1.254"
+	}
+}
+`
+
+// testIPAMConf is the configuration of the IPAM plugin implemented by the test binary, which always allocates the
+// configured address
+type testIPAMConf struct {
+	types.NetConf
+	IPAM struct {
+		Address string `json:"address"`
+		Gateway string `json:"gateway"`
+	} `json:"ipam"`
+}
+
+func testIPAMAdd(args *skel.CmdArgs) error {
+	conf := &testIPAMConf{}
+	if err := json.Unmarshal(args.StdinData, conf); err != nil {
+		return err
+	}
+	address, err := types.ParseCIDR(conf.IPAM.Address)
+	if err != nil {
+		return err
+	}
+	result := &current.Result{
+		IPs: []*current.IPConfig{{Address: *address, Gateway: net.ParseIP(conf.IPAM.Gateway)}},
+	}
+	return types.PrintResult(result, conf.CNIVersion)
+}
+
+func testIPAMNop(*skel.CmdArgs) error {
+	return nil
+}
+
+func TestMain(m *testing.M) {
+	if filepath.Base(os.Args[0]) == testIPAMType {
+		skel.PluginMain(testIPAMAdd, testIPAMNop, testIPAMNop, version.All, testIPAMType)
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// setupTestIPAM makes the test binary available as IPAM plugin, through a link in a directory prepended to PATH (the
+// testutils commands use PATH as CNI_PATH)
+func setupTestIPAM(t *testing.T) {
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatalf("failed to locate test binary: %v", err)
+	}
+	dir := t.TempDir()
+	if err := os.Symlink(self, filepath.Join(dir, testIPAMType)); err != nil {
+		t.Fatalf("failed to link test IPAM plugin: %v", err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestCmdAddCheckDel(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating network namespaces and veth pairs requires root privileges")
+	}
+	setupTestIPAM(t)
+
+	srv := fakepolycubed.NewServer()
+	ts, url := srv.Start()
+	defer ts.Close()
+	cubes := polycube.NewCubes(url)
+	if err := cubes.Bridges.CreateBridge(simplebridge.Simplebridge{Name: "br0"}); err != nil {
+		t.Fatalf("failed to create bridge: %v", err)
+	}
+
+	netns, err := testutils.NewNS()
+	if err != nil {
+		t.Fatalf("failed to create netns: %v", err)
+	}
+	defer func() {
+		netns.Close()
+		_ = testutils.UnmountNS(netns)
+	}()
+
+	dir := t.TempDir()
+	stateDir := filepath.Join(dir, "state")
+	conf := fmt.Sprintf(testConfFormat, filepath.Join(dir, "plugin.log"), url, filepath.Join(dir, "metrics.sock"),
+		filepath.Join(dir, "metrics.spool"), stateDir, testIPAMType)
+	args := &skel.CmdArgs{
+		ContainerID: "0123456789ab",
+		Netns:       netns.Path(),
+		IfName:      "eth0",
+		Args:        "K8S_POD_NAMESPACE=default;K8S_POD_NAME=test",
+		StdinData:   []byte(conf),
+	}
+	p := &Plugin{NewManagers: newPolycubeManagers}
+	att := attachment.Name(args.IfName, args.ContainerID)
+	lbName := attachment.LbrpName(att)
+
+	// ADD
+	r, _, err := testutils.CmdAddWithArgs(args, func() error { return p.cmdAdd(args) })
+	if err != nil {
+		t.Fatalf("ADD failed: %v", err)
+	}
+	result, err := current.GetResult(r)
+	if err != nil {
+		t.Fatalf("failed to convert ADD result: %v", err)
+	}
+	if len(result.IPs) != 1 || result.IPs[0].Address.String() != "10.10.1.5/24" {
+		t.Fatalf("unexpected ADD result IPs: %+v", result.IPs)
+	}
+	if len(result.Interfaces) != 2 || result.Interfaces[1].Name != att {
+		t.Fatalf("unexpected ADD result interfaces: %+v", result.Interfaces)
+	}
+	if _, err := netlink.LinkByName(att); err != nil {
+		t.Fatalf("host interface %q not found: %v", att, err)
+	}
+	if err := netns.Do(func(ns.NetNS) error {
+		_, err := netlink.LinkByName(args.IfName)
+		return err
+	}); err != nil {
+		t.Fatalf("container interface %q not found: %v", args.IfName, err)
+	}
+	if srv.Cube("lbrp", lbName) == nil {
+		t.Fatalf("lbrp %q not created", lbName)
+	}
+	port, err := cubes.Bridges.ReadBridgePort("br0", attachment.BridgePortName(lbName))
+	if err != nil {
+		t.Fatalf("bridge port not created: %v", err)
+	}
+	if port.Status != "UP" {
+		t.Fatalf("bridge port status - required: UP, found: %s", port.Status)
+	}
+	states, err := attachment.List(stateDir)
+	if err != nil || len(states) != 1 {
+		t.Fatalf("attachment state not persisted: %v", err)
+	}
+	if s := states[0]; s.Name != att || s.IP != "10.10.1.5" || s.PodName != "test" || s.PodNamespace != "default" {
+		t.Fatalf("unexpected attachment state: %+v", s)
+	}
+
+	// CHECK
+	checkConf := make(map[string]interface{})
+	if err := json.Unmarshal(args.StdinData, &checkConf); err != nil {
+		t.Fatal(err)
+	}
+	checkConf["prevResult"] = json.RawMessage(mustMarshal(t, result))
+	checkArgs := *args
+	checkArgs.StdinData = mustMarshal(t, checkConf)
+	if err := testutils.CmdCheckWithArgs(&checkArgs, func() error { return p.cmdCheck(&checkArgs) }); err != nil {
+		t.Fatalf("CHECK failed: %v", err)
+	}
+
+	// CHECK must detect a missing lbrp
+	if err := cubes.Lbrps.DeleteLbrp(lbName); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutils.CmdCheckWithArgs(&checkArgs, func() error { return p.cmdCheck(&checkArgs) }); err == nil {
+		t.Fatal("CHECK succeeded with a missing lbrp")
+	}
+
+	// DEL (the lbrp is already missing, so this also verifies that DEL is idempotent)
+	if err := testutils.CmdDelWithArgs(args, func() error { return p.cmdDel(args) }); err != nil {
+		t.Fatalf("DEL failed: %v", err)
+	}
+	if _, err := netlink.LinkByName(att); err == nil {
+		t.Fatalf("host interface %q still exists", att)
+	}
+	if _, err := cubes.Bridges.ReadBridgePort("br0", attachment.BridgePortName(lbName)); !polycube.IsNotFound(err) {
+		t.Fatalf("bridge port not deleted: %v", err)
+	}
+	if states, err := attachment.List(stateDir); err != nil || len(states) != 0 {
+		t.Fatalf("attachment state not removed: %v", err)
+	}
+	if err := testutils.CmdDelWithArgs(args, func() error { return p.cmdDel(args) }); err != nil {
+		t.Fatalf("repeated DEL failed: %v", err)
+	}
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
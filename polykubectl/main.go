@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/ekoops/polykube-cni-plugin/utils/polycube"
+	"os"
+)
+
+const (
+	defaultIPAMDataDir = "/var/lib/cni/networks/mynet"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `polykubectl dumps the polycube topology deployed by polykube on the current node
+
+Usage:
+  polykubectl [flags] [topology|issues]
+
+Commands:
+  topology  show all the cubes, following the ports peers (default)
+  issues    show only the ports that are DOWN or that have dangling peers
+
+Flags:
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	basePath := flag.String("polycube-url", polycube.DefaultURL, "polycube REST API base path")
+	output := flag.String("o", "text", "output format: text, json or dot")
+	ipamDataDir := flag.String("ipam-data-dir", defaultIPAMDataDir,
+		"host-local IPAM data directory, used for mapping the per-pod lbrps to the pods")
+	kubeconfig := flag.String("kubeconfig", os.Getenv("KUBECONFIG"),
+		"kubeconfig used for resolving the pods names; if empty, pods are only identified by container ID")
+	nodeName := flag.String("node", os.Getenv("NODE_K8S_NAME"), "name of the current cluster node")
+	flag.Usage = usage
+	flag.Parse()
+
+	command := "topology"
+	if flag.NArg() > 0 {
+		command = flag.Arg(0)
+	}
+	if command != "topology" && command != "issues" {
+		usage()
+		os.Exit(2)
+	}
+
+	t, err := ReadTopology(*basePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := t.AttachPods(*ipamDataDir, *kubeconfig, *nodeName); err != nil {
+		// the topology can be shown anyway, without the pods info
+		fmt.Fprintf(os.Stderr, "warning: failed to map lbrps to pods: %v\n", err)
+	}
+
+	if command == "issues" {
+		for _, issue := range t.Issues {
+			fmt.Printf("%s:%s\t%s\n", issue.Cube, issue.Port, issue.Reason)
+		}
+		if len(t.Issues) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	switch *output {
+	case "text":
+		RenderText(os.Stdout, t)
+	case "json":
+		if err := RenderJSON(os.Stdout, t); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+	case "dot":
+		RenderDOT(os.Stdout, t)
+	default:
+		fmt.Fprintf(os.Stderr, "error: unsupported output format %q\n", *output)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/ekoops/polykube-cni-plugin/utils/attachment"
+	"io/ioutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"net"
+	"path/filepath"
+	"strings"
+)
+
+// PodInfo describes the pod attached to a per-pod lbrp
+type PodInfo struct {
+	ContainerID string `json:"containerID"`
+	IfName      string `json:"ifName"`
+	IP          string `json:"ip"`
+	Namespace   string `json:"namespace,omitempty"`
+	Name        string `json:"name,omitempty"`
+}
+
+// readIPAMAttachments scans the host-local IPAM data directory in order to build a map associating each attachment
+// identifier with the info of the related pod. Each file of the directory is named after an allocated IP and contains
+// the container ID and the interface name the IP was allocated to
+func readIPAMAttachments(dataDir string) (map[string]*PodInfo, error) {
+	files, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ipam data directory %q: %v", dataDir, err)
+	}
+	attachments := make(map[string]*PodInfo)
+	for _, f := range files {
+		if f.IsDir() || net.ParseIP(f.Name()) == nil {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(dataDir, f.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ipam data file %q: %v", f.Name(), err)
+		}
+		lines := strings.Fields(string(content))
+		if len(lines) != 2 || len(lines[0]) < 10 {
+			continue
+		}
+		info := &PodInfo{ContainerID: lines[0], IfName: lines[1], IP: f.Name()}
+		att := attachment.Name(info.IfName, info.ContainerID)
+		attachments[att] = info
+	}
+	return attachments, nil
+}
+
+// resolvePodNames fills the name and the namespace of the provided pods, looking for the node pods having their IPs
+func resolvePodNames(kubeconfig, nodeName string, pods map[string]*PodInfo) error {
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return fmt.Errorf("failed to build client config: %v", err)
+	}
+	cs, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return fmt.Errorf("failed to create clientset: %v", err)
+	}
+	opts := metav1.ListOptions{}
+	if nodeName != "" {
+		opts.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", nodeName).String()
+	}
+	list, err := cs.CoreV1().Pods("").List(context.TODO(), opts)
+	if err != nil {
+		return fmt.Errorf("failed to list pods: %v", err)
+	}
+	byIP := make(map[string]*PodInfo)
+	for _, info := range pods {
+		byIP[info.IP] = info
+	}
+	for _, pod := range list.Items {
+		if pod.Spec.HostNetwork {
+			continue
+		}
+		if info, ok := byIP[pod.Status.PodIP]; ok {
+			info.Namespace = pod.Namespace
+			info.Name = pod.Name
+		}
+	}
+	return nil
+}
+
+// AttachPods associates each per-pod lbrp of the topology with the info of the related pod
+func (t *Topology) AttachPods(ipamDataDir, kubeconfig, nodeName string) error {
+	attachments, err := readIPAMAttachments(ipamDataDir)
+	if err != nil {
+		return err
+	}
+	if kubeconfig != "" {
+		if err := resolvePodNames(kubeconfig, nodeName, attachments); err != nil {
+			return err
+		}
+	}
+	for _, c := range t.Cubes {
+		if c.Kind != "lbrp" || !strings.HasPrefix(c.Name, attachment.LbrpPrefix) {
+			continue
+		}
+		c.Pod = attachments[strings.TrimPrefix(c.Name, attachment.LbrpPrefix)]
+	}
+	return nil
+}
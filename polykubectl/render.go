@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// describe returns a short description of the pod attached to a per-pod lbrp
+func (p *PodInfo) describe() string {
+	desc := fmt.Sprintf("container %s, iface %s, ip %s", shortID(p.ContainerID), p.IfName, p.IP)
+	if p.Name != "" {
+		desc = fmt.Sprintf("pod %s/%s, %s", p.Namespace, p.Name, desc)
+	}
+	return desc
+}
+
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// RenderText writes the topology as a set of trees obtained following the ports peers, starting from the cube
+// connected to the node external interface
+func RenderText(w io.Writer, t *Topology) {
+	visited := make(map[string]bool)
+	var visit func(c *Cube, indent string)
+	visit = func(c *Cube, indent string) {
+		visited[c.Name] = true
+		header := fmt.Sprintf("%s %s", c.Kind, c.Name)
+		if c.Pod != nil {
+			header += fmt.Sprintf(" (%s)", c.Pod.describe())
+		}
+		fmt.Fprintln(w, header)
+		for i := range c.Ports {
+			p := &c.Ports[i]
+			branch, next := "├─ ", "│  "
+			if i == len(c.Ports)-1 {
+				branch, next = "└─ ", "   "
+			}
+			line := fmt.Sprintf("%s%s%s [%s]", indent, branch, p.Name, p.Status)
+			if p.Type != "" {
+				line += " " + strings.ToLower(p.Type)
+			}
+			if p.Peer != "" {
+				line += " -> " + p.Peer
+			}
+			for _, issue := range t.PortIssues(c, p) {
+				line += " !! " + issue.Reason
+			}
+			fmt.Fprintln(w, line)
+			if peerCube, _ := t.port(p.Peer); peerCube != nil && !visited[peerCube.Name] {
+				fmt.Fprint(w, indent+next+"└─ ")
+				visit(peerCube, indent+next+"   ")
+			}
+		}
+	}
+	for _, c := range t.Cubes {
+		if !visited[c.Name] {
+			visit(c, "")
+			fmt.Fprintln(w)
+		}
+	}
+	if len(t.Issues) == 0 {
+		fmt.Fprintln(w, "no issues found")
+		return
+	}
+	fmt.Fprintf(w, "%d issues found\n", len(t.Issues))
+}
+
+// RenderJSON writes the topology as a JSON document
+func RenderJSON(w io.Writer, t *Topology) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(t)
+}
+
+// dotID returns a valid Graphviz identifier for the provided name
+func dotID(name string) string {
+	return strings.NewReplacer(":", "__", "-", "_", ".", "_").Replace(name)
+}
+
+// RenderDOT writes the topology as a Graphviz DOT graph: each cube is a record node having a field for each port,
+// each network interface is an ellipse node and each peer relationship is an edge. Ports having issues are red
+func RenderDOT(w io.Writer, t *Topology) {
+	fmt.Fprintln(w, "graph polykube {")
+	fmt.Fprintln(w, "\trankdir=LR;")
+	fmt.Fprintln(w, "\tnode [shape=record];")
+	ifaces := make(map[string]bool)
+	for _, c := range t.Cubes {
+		var fields []string
+		for i := range c.Ports {
+			fields = append(fields, fmt.Sprintf("<%s> %s", dotID(c.Ports[i].Name), c.Ports[i].Name))
+		}
+		label := fmt.Sprintf("%s %s", c.Kind, c.Name)
+		if c.Pod != nil && c.Pod.Name != "" {
+			label += fmt.Sprintf("\\n%s/%s", c.Pod.Namespace, c.Pod.Name)
+		}
+		fmt.Fprintf(w, "\t%s [label=\"{%s|{%s}}\"];\n", dotID(c.Name), label, strings.Join(fields, "|"))
+	}
+	// each edge is written only once, from the cube listed first
+	drawn := make(map[string]bool)
+	for _, c := range t.Cubes {
+		for i := range c.Ports {
+			p := &c.Ports[i]
+			if p.Peer == "" {
+				continue
+			}
+			from := fmt.Sprintf("%s:%s", dotID(c.Name), dotID(p.Name))
+			self := c.Name + ":" + p.Name
+			var to string
+			if isCubePeer(p.Peer) {
+				if drawn[p.Peer+"|"+self] {
+					continue
+				}
+				parts := strings.SplitN(p.Peer, ":", 2)
+				to = fmt.Sprintf("%s:%s", dotID(parts[0]), dotID(parts[1]))
+			} else {
+				to = dotID(p.Peer)
+				ifaces[p.Peer] = true
+			}
+			drawn[self+"|"+p.Peer] = true
+			attrs := ""
+			if len(t.PortIssues(c, p)) > 0 {
+				attrs = " [color=red]"
+			}
+			fmt.Fprintf(w, "\t%s -- %s%s;\n", from, to, attrs)
+		}
+	}
+	for iface := range ifaces {
+		fmt.Fprintf(w, "\t%s [shape=ellipse, label=\"%s\"];\n", dotID(iface), iface)
+	}
+	fmt.Fprintln(w, "}")
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"github.com/ekoops/polykube-cni-plugin/utils/polycube"
+	"github.com/vishvananda/netlink"
+	"sort"
+	"strings"
+)
+
+// Port is a cube port, described independently of the cube kind
+type Port struct {
+	Name   string `json:"name"`
+	Type   string `json:"type,omitempty"`
+	Status string `json:"status"`
+	Peer   string `json:"peer,omitempty"`
+}
+
+// Cube is a polycube cube, described independently of its kind
+type Cube struct {
+	Kind  string `json:"kind"`
+	Name  string `json:"name"`
+	Ports []Port `json:"ports"`
+	// Pod is set only for the per-pod lbrps whose attachment was resolved
+	Pod *PodInfo `json:"pod,omitempty"`
+}
+
+// Issue describes a problem found on a cube port
+type Issue struct {
+	Cube   string `json:"cube"`
+	Port   string `json:"port"`
+	Reason string `json:"reason"`
+}
+
+// Topology is the set of cubes deployed on the node and the problems found on their ports
+type Topology struct {
+	Cubes  []*Cube `json:"cubes"`
+	Issues []Issue `json:"issues"`
+	cubes  map[string]*Cube
+	issues map[string][]Issue
+}
+
+// kindOrder defines the order in which the cubes are listed, starting from the node external interface
+var kindOrder = map[string]int{
+	"k8sdispatcher": 0,
+	"lbrp":          1,
+	"router":        2,
+	"simplebridge":  3,
+}
+
+// listError builds an error from the outcome of a cubes list request. A 404 on a list means that no cube of that
+// kind was ever created, so it is not considered an error
+func listError(kind string, err error) error {
+	if err == nil || polycube.IsNotFound(err) {
+		return nil
+	}
+	return fmt.Errorf("failed to list %s cubes - %v", kind, err)
+}
+
+// ReadTopology retrieves all the simplebridge, router, lbrp and k8sdispatcher cubes from polycube
+func ReadTopology(basePath string) (*Topology, error) {
+	t := &Topology{cubes: make(map[string]*Cube), issues: make(map[string][]Issue)}
+	cubes := polycube.NewCubes(basePath)
+
+	brs, err := cubes.Bridges.ListBridges()
+	if err := listError("simplebridge", err); err != nil {
+		return nil, err
+	}
+	for _, br := range brs {
+		c := &Cube{Kind: "simplebridge", Name: br.Name}
+		for _, p := range br.Ports {
+			c.Ports = append(c.Ports, Port{Name: p.Name, Status: p.Status, Peer: p.Peer})
+		}
+		t.add(c)
+	}
+
+	rs, err := cubes.Routers.ListRouters()
+	if err := listError("router", err); err != nil {
+		return nil, err
+	}
+	for _, r := range rs {
+		c := &Cube{Kind: "router", Name: r.Name}
+		for _, p := range r.Ports {
+			c.Ports = append(c.Ports, Port{Name: p.Name, Status: p.Status, Peer: p.Peer})
+		}
+		t.add(c)
+	}
+
+	lbs, err := cubes.Lbrps.ListLbrps()
+	if err := listError("lbrp", err); err != nil {
+		return nil, err
+	}
+	for _, lb := range lbs {
+		c := &Cube{Kind: "lbrp", Name: lb.Name}
+		for _, p := range lb.Ports {
+			c.Ports = append(c.Ports, Port{Name: p.Name, Type: p.Type_, Status: p.Status, Peer: p.Peer})
+		}
+		t.add(c)
+	}
+
+	ks, err := cubes.Dispatchers.ListDispatchers()
+	if err := listError("k8sdispatcher", err); err != nil {
+		return nil, err
+	}
+	for _, k := range ks {
+		c := &Cube{Kind: "k8sdispatcher", Name: k.Name}
+		for _, p := range k.Ports {
+			c.Ports = append(c.Ports, Port{Name: p.Name, Type: p.Type_, Status: p.Status, Peer: p.Peer})
+		}
+		t.add(c)
+	}
+
+	sort.SliceStable(t.Cubes, func(i, j int) bool {
+		ci, cj := t.Cubes[i], t.Cubes[j]
+		if ci.Kind != cj.Kind {
+			return kindOrder[ci.Kind] < kindOrder[cj.Kind]
+		}
+		return ci.Name < cj.Name
+	})
+	t.findIssues()
+	return t, nil
+}
+
+func (t *Topology) add(c *Cube) {
+	t.Cubes = append(t.Cubes, c)
+	t.cubes[c.Name] = c
+}
+
+// port returns the port identified by a peer string in the cube:port format
+func (t *Topology) port(peer string) (*Cube, *Port) {
+	parts := strings.SplitN(peer, ":", 2)
+	if len(parts) != 2 {
+		return nil, nil
+	}
+	c, ok := t.cubes[parts[0]]
+	if !ok {
+		return nil, nil
+	}
+	for i := range c.Ports {
+		if c.Ports[i].Name == parts[1] {
+			return c, &c.Ports[i]
+		}
+	}
+	return c, nil
+}
+
+// isCubePeer returns true if the provided peer refers to a cube port instead of a network interface
+func isCubePeer(peer string) bool {
+	return strings.Contains(peer, ":")
+}
+
+func (t *Topology) addIssue(c *Cube, p *Port, format string, a ...interface{}) {
+	issue := Issue{Cube: c.Name, Port: p.Name, Reason: fmt.Sprintf(format, a...)}
+	t.Issues = append(t.Issues, issue)
+	key := c.Name + ":" + p.Name
+	t.issues[key] = append(t.issues[key], issue)
+}
+
+// findIssues flags the ports that are DOWN, that are not connected or whose peer doesn't exist or doesn't point back
+// to them
+func (t *Topology) findIssues() {
+	for _, c := range t.Cubes {
+		for i := range c.Ports {
+			p := &c.Ports[i]
+			if p.Status != "UP" {
+				t.addIssue(c, p, "port is %s", strings.ToUpper(p.Status))
+			}
+			switch {
+			case p.Peer == "":
+				t.addIssue(c, p, "port has no peer")
+			case isCubePeer(p.Peer):
+				peerCube, peerPort := t.port(p.Peer)
+				if peerCube == nil {
+					t.addIssue(c, p, "dangling peer %q: cube doesn't exist", p.Peer)
+				} else if peerPort == nil {
+					t.addIssue(c, p, "dangling peer %q: port doesn't exist", p.Peer)
+				} else if peerPort.Peer != c.Name+":"+p.Name {
+					t.addIssue(c, p, "asymmetric peer %q: its peer is %q", p.Peer, peerPort.Peer)
+				}
+			default:
+				if _, err := netlink.LinkByName(p.Peer); err != nil {
+					t.addIssue(c, p, "dangling peer %q: interface doesn't exist", p.Peer)
+				}
+			}
+		}
+	}
+}
+
+// PortIssues returns the issues found on the provided cube port
+func (t *Topology) PortIssues(c *Cube, p *Port) []Issue {
+	return t.issues[c.Name+":"+p.Name]
+}
@@ -0,0 +1,20 @@
+// fakepolycubed serves the fake polycubed REST API, so that the plugin and the init program can be run against it
+// without a real polycubed instance
+package main
+
+import (
+	"flag"
+	"github.com/ekoops/polykube-cni-plugin/test/fakepolycubed"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+)
+
+func main() {
+	addr := flag.String("listen", "127.0.0.1:9000", "address the fake polycubed API is served on")
+	flag.Parse()
+
+	log.WithField("url", "http://"+*addr+fakepolycubed.BasePath).Info("serving fake polycubed API")
+	if err := http.ListenAndServe(*addr, fakepolycubed.NewServer()); err != nil {
+		log.WithField("detail", err).Fatal("fake polycubed API server failed")
+	}
+}
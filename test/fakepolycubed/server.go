@@ -0,0 +1,541 @@
+// Package fakepolycubed implements an in-memory fake of the polycubed REST API, supporting the simplebridge, router,
+// lbrp, k8sdispatcher and nat services used by polykube. It is meant to be used in place of a real polycubed instance
+// when testing the plugin and the init agent.
+//
+// Resources are stored as generic JSON trees. As in polycubed, GET, PATCH and DELETE on missing resources fail with
+// 404, POST on existing resources fails with 409 and PUT creates or replaces a resource (creating the missing
+// intermediate resources). The status of a port is UP only if its peer is a network interface or an existing cube
+// port. Transparent cubes (e.g. nat) are attached to a port through the /attach endpoint, which sets their parent.
+package fakepolycubed
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// BasePath is the path prefix of the polycubed REST API
+const BasePath = "/polycube/v1"
+
+// lists contains, for each supported service, the key fields of each YANG list, indexed by list name. The cube list
+// itself is keyed by "name"
+var lists = map[string]map[string][]string{
+	"simplebridge": {
+		"ports": {"name"},
+		"entry": {"address"},
+	},
+	"router": {
+		"ports":       {"name"},
+		"secondaryip": {"ip"},
+		"route":       {"network", "nexthop"},
+		"arp-table":   {"address"},
+	},
+	"lbrp": {
+		"ports":   {"name"},
+		"service": {"vip", "vport", "proto"},
+		"backend": {"ip"},
+	},
+	"k8sdispatcher": {
+		"ports":         {"name"},
+		"natting-rule":  {"internal-src", "internal-dst", "internal-sport", "internal-dport", "proto"},
+		"nodeport-rule": {"nodeport-port", "proto"},
+	},
+	"nat": {
+		"entry": {"id"},
+	},
+}
+
+// attachPath is the endpoint attaching a transparent cube to a port
+const attachPath = "attach"
+
+type object = map[string]interface{}
+
+// Server is a fake polycubed instance
+type Server struct {
+	mu sync.Mutex
+	// cubes contains the cubes of each service, indexed by service and cube name
+	cubes map[string]map[string]object
+	uuid  int
+}
+
+// NewServer returns an empty fake polycubed instance
+func NewServer() *Server {
+	s := &Server{cubes: make(map[string]map[string]object)}
+	for service := range lists {
+		s.cubes[service] = make(map[string]object)
+	}
+	return s
+}
+
+// Start starts serving the fake polycubed API on a local random port. It returns the started server and the base
+// path to be used for configuring the polycube API clients
+func (s *Server) Start() (*httptest.Server, string) {
+	ts := httptest.NewServer(s)
+	return ts, ts.URL + BasePath
+}
+
+// Cube returns a copy of the JSON representation of the requested cube, or nil if it doesn't exist
+func (s *Server) Cube(service, name string) map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cube, ok := s.cubes[service][name]
+	if !ok {
+		return nil
+	}
+	return s.render(service, cube).(object)
+}
+
+type httpError struct {
+	code int
+	msg  string
+}
+
+func (e *httpError) Error() string {
+	return e.msg
+}
+
+func errorf(code int, format string, a ...interface{}) *httpError {
+	return &httpError{code: code, msg: fmt.Sprintf(format, a...)}
+}
+
+// ServeHTTP implements the http.Handler interface
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var body interface{}
+	if r.Body != nil && (r.Method == http.MethodPost || r.Method == http.MethodPut || r.Method == http.MethodPatch) {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, errorf(http.StatusBadRequest, "invalid body: %v", err))
+			return
+		}
+	}
+	result, herr := s.handle(r.Method, r.URL.EscapedPath(), body)
+	if herr != nil {
+		writeError(w, herr)
+		return
+	}
+	switch {
+	case r.Method == http.MethodPost:
+		w.WriteHeader(http.StatusCreated)
+	case result == nil:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(result)
+	}
+}
+
+func writeError(w http.ResponseWriter, err *httpError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(err.code)
+	_ = json.NewEncoder(w).Encode(object{"message": err.msg})
+}
+
+// splitPath returns the unescaped segments of the provided path, relative to BasePath
+func splitPath(path string) ([]string, *httpError) {
+	if !strings.HasPrefix(path, BasePath+"/") {
+		return nil, errorf(http.StatusNotFound, "unknown path %q", path)
+	}
+	var segments []string
+	for _, seg := range strings.Split(strings.Trim(strings.TrimPrefix(path, BasePath), "/"), "/") {
+		unescaped, err := url.PathUnescape(seg)
+		if err != nil {
+			return nil, errorf(http.StatusBadRequest, "invalid path segment %q", seg)
+		}
+		segments = append(segments, unescaped)
+	}
+	return segments, nil
+}
+
+func (s *Server) handle(method, path string, body interface{}) (interface{}, *httpError) {
+	segments, herr := splitPath(path)
+	if herr != nil {
+		return nil, herr
+	}
+	service := segments[0]
+	if service == attachPath && len(segments) == 1 {
+		if method != http.MethodPost {
+			return nil, errorf(http.StatusMethodNotAllowed, "unsupported method %s on %q", method, path)
+		}
+		return nil, s.attach(body)
+	}
+	cubes, ok := s.cubes[service]
+	if !ok {
+		return nil, errorf(http.StatusNotFound, "unknown service %q", service)
+	}
+
+	// operations on the whole service cubes list
+	if len(segments) == 1 {
+		if method != http.MethodGet {
+			return nil, errorf(http.StatusMethodNotAllowed, "unsupported method %s on %q", method, path)
+		}
+		list := make([]interface{}, 0, len(cubes))
+		for _, cube := range cubes {
+			list = append(list, s.render(service, cube))
+		}
+		return list, nil
+	}
+
+	// operations on a whole cube
+	name := segments[1]
+	cube, exists := cubes[name]
+	if len(segments) == 2 {
+		switch method {
+		case http.MethodGet:
+			if !exists {
+				return nil, errorf(http.StatusNotFound, "cube %q doesn't exist", name)
+			}
+			return s.render(service, cube), nil
+		case http.MethodPost, http.MethodPut:
+			if exists && method == http.MethodPost {
+				return nil, errorf(http.StatusConflict, "cube %q already exists", name)
+			}
+			obj, ok := body.(object)
+			if !ok {
+				return nil, errorf(http.StatusBadRequest, "cube body must be an object")
+			}
+			cubes[name] = s.newCube(service, name, obj)
+			return nil, nil
+		case http.MethodPatch:
+			if !exists {
+				return nil, errorf(http.StatusNotFound, "cube %q doesn't exist", name)
+			}
+			obj, ok := body.(object)
+			if !ok {
+				return nil, errorf(http.StatusBadRequest, "cube body must be an object")
+			}
+			merge(service, cube, obj)
+			return nil, nil
+		case http.MethodDelete:
+			if !exists {
+				return nil, errorf(http.StatusNotFound, "cube %q doesn't exist", name)
+			}
+			delete(cubes, name)
+			return nil, nil
+		}
+		return nil, errorf(http.StatusMethodNotAllowed, "unsupported method %s on %q", method, path)
+	}
+	if !exists {
+		return nil, errorf(http.StatusNotFound, "cube %q doesn't exist", name)
+	}
+	return s.handleNested(service, cube, segments[2:], method, body)
+}
+
+// attach sets the parent of the transparent cube described by the provided body
+func (s *Server) attach(body interface{}) *httpError {
+	obj, ok := body.(object)
+	if !ok {
+		return errorf(http.StatusBadRequest, "attach body must be an object")
+	}
+	name, _ := obj["cube"].(string)
+	port, _ := obj["port"].(string)
+	if name == "" || port == "" {
+		return errorf(http.StatusBadRequest, "attach body must contain cube and port")
+	}
+	for _, cubes := range s.cubes {
+		if cube, ok := cubes[name]; ok {
+			cube["parent"] = port
+			return nil
+		}
+	}
+	return errorf(http.StatusNotFound, "cube %q doesn't exist", name)
+}
+
+// ref identifies a value inside its parent: a field of an object or an element of a list
+type ref struct {
+	parent object
+	field  string
+	// keys is set if the value is a list element
+	keys     []string
+	keyVals  []string
+	listName string
+}
+
+func (r *ref) get() (interface{}, bool) {
+	if r.keys == nil {
+		v, ok := r.parent[r.field]
+		return v, ok
+	}
+	list, _ := r.parent[r.listName].([]interface{})
+	i := findElem(list, r.keys, r.keyVals)
+	if i < 0 {
+		return nil, false
+	}
+	return list[i], true
+}
+
+func (r *ref) set(v interface{}) {
+	if r.keys == nil {
+		r.parent[r.field] = v
+		return
+	}
+	obj, _ := v.(object)
+	if obj == nil {
+		obj = object{}
+	}
+	setKeys(obj, r.keys, r.keyVals)
+	list, _ := r.parent[r.listName].([]interface{})
+	if i := findElem(list, r.keys, r.keyVals); i >= 0 {
+		list[i] = obj
+	} else {
+		list = append(list, obj)
+	}
+	r.parent[r.listName] = list
+}
+
+func (r *ref) del() {
+	if r.keys == nil {
+		delete(r.parent, r.field)
+		return
+	}
+	list, _ := r.parent[r.listName].([]interface{})
+	if i := findElem(list, r.keys, r.keyVals); i >= 0 {
+		r.parent[r.listName] = append(list[:i], list[i+1:]...)
+	}
+}
+
+// handleNested handles an operation on a resource nested inside a cube
+func (s *Server) handleNested(service string, cube object, segments []string, method string, body interface{}) (interface{}, *httpError) {
+	var r *ref
+	parent := cube
+	for len(segments) > 0 {
+		if r != nil {
+			v, ok := r.get()
+			if !ok && (method == http.MethodPost || method == http.MethodPut) {
+				v, ok = object{}, true
+				r.set(v)
+			}
+			if !ok {
+				return nil, errorf(http.StatusNotFound, "resource doesn't exist")
+			}
+			if parent, ok = v.(object); !ok {
+				return nil, errorf(http.StatusNotFound, "resource doesn't exist")
+			}
+		}
+		seg := segments[0]
+		segments = segments[1:]
+		keys, isList := lists[service][seg]
+		if isList && len(segments) >= len(keys) {
+			r = &ref{parent: parent, listName: seg, keys: keys, keyVals: segments[:len(keys)]}
+			segments = segments[len(keys):]
+		} else {
+			r = &ref{parent: parent, field: seg}
+		}
+	}
+
+	current, exists := r.get()
+	switch method {
+	case http.MethodGet:
+		if !exists {
+			return nil, errorf(http.StatusNotFound, "resource doesn't exist")
+		}
+		if r.field == "ports" || r.listName == "ports" {
+			return s.renderPorts(current), nil
+		}
+		return current, nil
+	case http.MethodPost, http.MethodPut:
+		if exists && method == http.MethodPost && r.keys != nil {
+			return nil, errorf(http.StatusConflict, "resource already exists")
+		}
+		if list, ok := body.([]interface{}); ok && r.keys == nil {
+			// creating or replacing a whole list
+			if _, isList := lists[service][r.field]; isList && method == http.MethodPost {
+				existing, _ := current.([]interface{})
+				body = append(existing, list...)
+			}
+		}
+		r.set(body)
+		return nil, nil
+	case http.MethodPatch:
+		if !exists {
+			return nil, errorf(http.StatusNotFound, "resource doesn't exist")
+		}
+		if obj, ok := current.(object); ok {
+			if patch, ok := body.(object); ok {
+				merge(service, obj, patch)
+				return nil, nil
+			}
+		}
+		r.set(body)
+		return nil, nil
+	case http.MethodDelete:
+		if !exists {
+			return nil, errorf(http.StatusNotFound, "resource doesn't exist")
+		}
+		r.del()
+		return nil, nil
+	}
+	return nil, errorf(http.StatusMethodNotAllowed, "unsupported method %s", method)
+}
+
+// newCube builds a cube from the provided body, filling the fields that polycubed computes
+func (s *Server) newCube(service, name string, body object) object {
+	cube := object{}
+	merge(service, cube, body)
+	cube["name"] = name
+	s.uuid++
+	cube["uuid"] = fmt.Sprintf("00000000-0000-0000-0000-%012d", s.uuid)
+	cube["service-name"] = service
+	if _, ok := cube["type"]; !ok {
+		cube["type"] = "TC"
+	}
+	if _, ok := cube["loglevel"]; !ok {
+		cube["loglevel"] = "INFO"
+	}
+	return cube
+}
+
+// merge merges patch into dst. Lists elements are merged by key
+func merge(service string, dst object, patch object) {
+	for k, v := range patch {
+		keys, isList := lists[service][k]
+		patchList, patchIsList := v.([]interface{})
+		dstList, dstIsList := dst[k].([]interface{})
+		switch {
+		case isList && patchIsList && dstIsList:
+			for _, elem := range patchList {
+				elemObj, ok := elem.(object)
+				if !ok {
+					continue
+				}
+				vals := make([]string, len(keys))
+				for i, key := range keys {
+					vals[i] = keyString(elemObj[key])
+				}
+				if i := findElem(dstList, keys, vals); i >= 0 {
+					if dstObj, ok := dstList[i].(object); ok {
+						merge(service, dstObj, elemObj)
+						continue
+					}
+				}
+				dstList = append(dstList, elemObj)
+			}
+			dst[k] = dstList
+		default:
+			patchObj, patchIsObj := v.(object)
+			dstObj, dstIsObj := dst[k].(object)
+			if patchIsObj && dstIsObj {
+				merge(service, dstObj, patchObj)
+			} else {
+				dst[k] = v
+			}
+		}
+	}
+}
+
+// keyString returns the string representation of a list key value, as it appears in a path
+func keyString(v interface{}) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+func findElem(list []interface{}, keys []string, vals []string) int {
+	for i, elem := range list {
+		obj, ok := elem.(object)
+		if !ok {
+			continue
+		}
+		match := true
+		for j, key := range keys {
+			if keyString(obj[key]) != vals[j] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return i
+		}
+	}
+	return -1
+}
+
+func setKeys(obj object, keys []string, vals []string) {
+	for i, key := range keys {
+		if _, ok := obj[key]; ok {
+			continue
+		}
+		// numeric keys are stored as numbers, as they are in the original body
+		if n, err := strconv.ParseFloat(vals[i], 64); err == nil && !strings.Contains(vals[i], ".") {
+			obj[key] = n
+		} else {
+			obj[key] = vals[i]
+		}
+	}
+}
+
+// portStatus returns the status polycubed would report for a port having the provided peer
+func (s *Server) portStatus(peer string) string {
+	if peer == "" {
+		return "DOWN"
+	}
+	parts := strings.SplitN(peer, ":", 2)
+	if len(parts) == 1 {
+		// network interfaces are assumed to exist
+		return "UP"
+	}
+	for _, cubes := range s.cubes {
+		cube, ok := cubes[parts[0]]
+		if !ok {
+			continue
+		}
+		ports, _ := cube["ports"].([]interface{})
+		if findElem(ports, []string{"name"}, []string{parts[1]}) >= 0 {
+			return "UP"
+		}
+	}
+	return "DOWN"
+}
+
+// renderPorts returns a copy of the provided port or ports list, including the port computed fields
+func (s *Server) renderPorts(v interface{}) interface{} {
+	switch val := v.(type) {
+	case []interface{}:
+		ports := make([]interface{}, 0, len(val))
+		for _, p := range val {
+			ports = append(ports, s.renderPorts(p))
+		}
+		return ports
+	case object:
+		port := object{}
+		for k, f := range val {
+			port[k] = f
+		}
+		// as polycubed does, port types are reported in upper case
+		if t, ok := port["type"].(string); ok {
+			port["type"] = strings.ToUpper(t)
+		}
+		peer, _ := port["peer"].(string)
+		port["status"] = s.portStatus(peer)
+		if _, ok := port["uuid"]; !ok {
+			port["uuid"] = fmt.Sprintf("port-%s", port["name"])
+		}
+		return port
+	}
+	return v
+}
+
+// render returns a copy of the provided cube, including the ports computed fields
+func (s *Server) render(service string, cube object) interface{} {
+	rendered := object{}
+	for k, v := range cube {
+		rendered[k] = v
+	}
+	if ports, ok := cube["ports"]; ok {
+		rendered["ports"] = s.renderPorts(ports)
+	}
+	return rendered
+}
@@ -0,0 +1,67 @@
+#!/bin/bash
+
+# Tests that the packets received on a tunnel interface reach the router as done by the overlays. A network namespace
+# simulates a peer node, connected to the host by a veth pair: for each tunnel kind, a tunnel interface is created on
+# both sides and the host one is connected to a port of a test router, then the router port address is pinged from
+# the peer namespace through the tunnel. It requires a running polycubed instance.
+# A geneve interface carries ethernet frames, so it is attached to the router port. An IP-in-IP interface has no link
+# layer header, so the router can't parse the packets received on it: as done by the ipip overlay, the router port is
+# attached to a veth pair and the host routes the packets between the veth pair and the IP-in-IP interface
+
+ROUTER="rovltest"
+PEER_NS="ovlns"
+
+cleanup() {
+	polycubectl $ROUTER del
+	sudo ip netns del $PEER_NS
+	sudo ip link del dev veth-ovl1
+	sudo ip link del dev gnvtest
+	sudo ip link del dev ipiptest
+	sudo ip link del dev pkiptest
+}
+
+set -x
+cleanup
+
+set -e
+sudo ip netns add $PEER_NS
+sudo ip link add veth-ovl1 type veth peer name veth-ovl2 netns $PEER_NS
+sudo ip addr add 192.168.251.1/24 dev veth-ovl1
+sudo ip -n $PEER_NS addr add 192.168.251.2/24 dev veth-ovl2
+sudo ip link set veth-ovl1 up
+sudo ip -n $PEER_NS link set veth-ovl2 up
+sudo ip -n $PEER_NS link set lo up
+polycubectl router add $ROUTER
+
+# geneve: same parameters used by the geneve overlay (VNI 42, port 6081)
+sudo ip link add gnvtest type geneve id 42 remote 192.168.251.2 dstport 6081
+sudo ip link set gnvtest up
+sudo ip -n $PEER_NS link add gnvtest type geneve id 42 remote 192.168.251.1 dstport 6081
+sudo ip -n $PEER_NS addr add 10.19.0.2/24 dev gnvtest
+sudo ip -n $PEER_NS link set gnvtest up
+polycubectl $ROUTER ports add to_gnvtest ip=10.19.0.1/24
+polycubectl $ROUTER ports to_gnvtest set peer=gnvtest
+sudo ip netns exec $PEER_NS ping -c 3 -W 1 10.19.0.1
+
+# ipip: same topology used by the ipip overlay (a single IP-in-IP interface without remote endpoint and a veth pair
+# between the router and the host)
+sudo ip link add ipiptest type ipip local 192.168.251.1
+sudo ip link set ipiptest up
+sudo ip link add pkiptest type veth peer name pkiptestr
+sudo ip addr add 169.254.45.1/30 dev pkiptest
+sudo ip link set pkiptest up
+sudo ip link set pkiptestr up
+sudo sysctl -w net.ipv4.ip_forward=1
+sudo ip route add 10.20.0.0/24 via 192.168.251.2 dev ipiptest onlink
+sudo ip -n $PEER_NS link add ipiptest type ipip local 192.168.251.2
+sudo ip -n $PEER_NS addr add 10.20.0.2/24 dev ipiptest
+sudo ip -n $PEER_NS link set ipiptest up
+sudo ip -n $PEER_NS route add 169.254.45.0/30 via 192.168.251.1 dev ipiptest onlink
+polycubectl $ROUTER ports add to_ipiptest ip=169.254.45.2/30
+polycubectl $ROUTER ports to_ipiptest set peer=pkiptestr
+polycubectl $ROUTER route add 10.20.0.0/24 169.254.45.1
+sudo ip netns exec $PEER_NS ping -c 3 -W 1 169.254.45.2
+
+set +x
+cleanup
+echo "overlay test passed"
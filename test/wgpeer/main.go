@@ -0,0 +1,118 @@
+// wgpeer configures a WireGuard interface in the current network namespace through the same code used by the init
+// agent, so that the WireGuard support can be tested between two network namespaces on a single host
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/ekoops/polykube-cni-plugin/utils/wireguard"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+func up(args []string) error {
+	fs := flag.NewFlagSet("up", flag.ExitOnError)
+	iface := fs.String("iface", "wg0", "WireGuard interface name")
+	keyFile := fs.String("key-file", "", "private key file (generated if missing)")
+	port := fs.Int("port", 51820, "listen port")
+	addr := fs.String("addr", "", "interface address in the format w.x.y.z/n")
+	fs.Parse(args)
+
+	ipNet, err := netlink.ParseIPNet(*addr)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %v", *addr, err)
+	}
+	key, _, err := wireguard.LoadOrCreatePrivateKey(*keyFile)
+	if err != nil {
+		return err
+	}
+	if err := netlink.LinkAdd(&netlink.Wireguard{LinkAttrs: netlink.LinkAttrs{Name: *iface}}); err != nil &&
+		!errors.Is(err, syscall.EEXIST) {
+		return fmt.Errorf("failed to create %q: %v", *iface, err)
+	}
+	link, err := netlink.LinkByName(*iface)
+	if err != nil {
+		return err
+	}
+	if err := wireguard.ConfigureDevice(*iface, key, *port); err != nil {
+		return err
+	}
+	if err := netlink.AddrAdd(link, &netlink.Addr{IPNet: ipNet}); err != nil && !errors.Is(err, syscall.EEXIST) {
+		return fmt.Errorf("failed to add %s to %q: %v", ipNet, *iface, err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return err
+	}
+	fmt.Println(key.PublicKey())
+	return nil
+}
+
+func peer(args []string) error {
+	fs := flag.NewFlagSet("peer", flag.ExitOnError)
+	iface := fs.String("iface", "wg0", "WireGuard interface name")
+	publicKey := fs.String("public-key", "", "peer public key")
+	endpoint := fs.String("endpoint", "", "peer endpoint in the format ip:port")
+	allowedIPs := fs.String("allowed-ips", "", "comma separated peer allowed IPs")
+	remove := fs.Bool("remove", false, "remove the peer")
+	fs.Parse(args)
+
+	key, err := wireguard.ParseKey(*publicKey)
+	if err != nil {
+		return err
+	}
+	if *remove {
+		return wireguard.RemovePeer(*iface, key)
+	}
+	p := wireguard.Peer{PublicKey: key}
+	if p.Endpoint, err = net.ResolveUDPAddr("udp4", *endpoint); err != nil {
+		return fmt.Errorf("invalid endpoint %q: %v", *endpoint, err)
+	}
+	for _, cidr := range strings.Split(*allowedIPs, ",") {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return fmt.Errorf("invalid allowed IP %q: %v", cidr, err)
+		}
+		p.AllowedIPs = append(p.AllowedIPs, *ipNet)
+	}
+	return wireguard.SetPeer(*iface, p)
+}
+
+func show(args []string) error {
+	fs := flag.NewFlagSet("show", flag.ExitOnError)
+	iface := fs.String("iface", "wg0", "WireGuard interface name")
+	fs.Parse(args)
+
+	d, err := wireguard.GetDevice(*iface)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("interface %s public-key %s listen-port %d\n", d.Name, d.PublicKey, d.ListenPort)
+	for _, p := range d.Peers {
+		var ips []string
+		for _, ipNet := range p.AllowedIPs {
+			ips = append(ips, ipNet.String())
+		}
+		fmt.Printf("peer %s endpoint %v allowed-ips %s\n", p.PublicKey, p.Endpoint, strings.Join(ips, ","))
+	}
+	return nil
+}
+
+func main() {
+	commands := map[string]func([]string) error{
+		"up":   up,
+		"peer": peer,
+		"show": show,
+	}
+	if len(os.Args) < 2 || commands[os.Args[1]] == nil {
+		fmt.Fprintln(os.Stderr, "usage: wgpeer up|peer|show [flags]")
+		os.Exit(2)
+	}
+	if err := commands[os.Args[1]](os.Args[2:]); err != nil {
+		log.WithField("detail", err).Fatalf("%s failed", os.Args[1])
+	}
+}
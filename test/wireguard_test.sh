@@ -0,0 +1,47 @@
+#!/bin/bash
+
+# Tests the WireGuard configuration performed by the init agent between two network namespaces connected by a veth
+# pair: each namespace gets a WireGuard interface with a VTEP address and the other namespace as peer, then the VTEP
+# addresses are pinged through the tunnel. Finally, a key rotation is simulated on ns2
+
+ROOT_DIR="../"
+BIN_DIR="$ROOT_DIR/bin"
+WGPEER="$BIN_DIR/wgpeer"
+KEY_DIR=$(mktemp -d)
+
+set -x
+sudo ip netns del wgns1
+sudo ip netns del wgns2
+
+set -e
+go build -o $WGPEER ./wgpeer
+
+sudo ip netns add wgns1
+sudo ip netns add wgns2
+sudo ip link add veth-wg1 netns wgns1 type veth peer name veth-wg2 netns wgns2
+sudo ip -n wgns1 addr add 192.168.250.1/24 dev veth-wg1
+sudo ip -n wgns2 addr add 192.168.250.2/24 dev veth-wg2
+sudo ip -n wgns1 link set veth-wg1 up
+sudo ip -n wgns2 link set veth-wg2 up
+
+PUB1=$(sudo ip netns exec wgns1 $WGPEER up -key-file $KEY_DIR/ns1.key -addr 10.18.0.1/16)
+PUB2=$(sudo ip netns exec wgns2 $WGPEER up -key-file $KEY_DIR/ns2.key -addr 10.18.0.2/16)
+sudo ip netns exec wgns1 $WGPEER peer -public-key $PUB2 -endpoint 192.168.250.2:51820 -allowed-ips 10.18.0.2/32
+sudo ip netns exec wgns2 $WGPEER peer -public-key $PUB1 -endpoint 192.168.250.1:51820 -allowed-ips 10.18.0.1/32
+sudo ip netns exec wgns1 $WGPEER show
+sudo ip netns exec wgns1 ping -c 3 -W 1 10.18.0.2
+
+# rotating the ns2 key: the old peer is removed and the new one added, as done by the node controller when the node
+# annotation changes
+sudo rm $KEY_DIR/ns2.key
+NEW_PUB2=$(sudo ip netns exec wgns2 $WGPEER up -key-file $KEY_DIR/ns2.key -addr 10.18.0.2/16)
+sudo ip netns exec wgns1 $WGPEER peer -public-key $PUB2 -remove
+sudo ip netns exec wgns1 $WGPEER peer -public-key $NEW_PUB2 -endpoint 192.168.250.2:51820 -allowed-ips 10.18.0.2/32
+sudo ip netns exec wgns1 $WGPEER show
+sudo ip netns exec wgns1 ping -c 3 -W 1 10.18.0.2
+
+set +x
+sudo ip netns del wgns1
+sudo ip netns del wgns2
+sudo rm -r $KEY_DIR
+echo "wireguard test passed"
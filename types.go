@@ -3,15 +3,22 @@ package main
 import (
 	"github.com/containernetworking/cni/pkg/types"
 	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/ekoops/polykube-cni-plugin/utils"
+	"github.com/ekoops/polykube-cni-plugin/utils/metrics"
 	"net"
 )
 
 type NetConf struct {
 	types.NetConf
-	MTU          int    `json:"mtu"`
-	VClusterCIDR string `json:"vclustercidr"`
-	BridgeName   string `json:"bridge"`
-	Gw           GwInfo `json:"gateway"`
+	MTU           int              `json:"mtu"`
+	VClusterCIDR  string           `json:"vclustercidr"`
+	VClusterIPNet *net.IPNet       `json:"-"`
+	BridgeName    string           `json:"bridge"`
+	Gw            GwInfo           `json:"gateway"`
+	Log           utils.LogConf    `json:"log"`
+	PolycubeURL   string           `json:"polycubeURL,omitempty"`
+	Metrics       metrics.PushConf `json:"metrics"`
+	StateDir      string           `json:"stateDir,omitempty"`
 }
 
 type GwInfo struct {
@@ -20,8 +27,15 @@ type GwInfo struct {
 	MAC    net.HardwareAddr `json:"-"`
 }
 
+// K8sArgs contains the CNI_ARGS set by the kubelet
+type K8sArgs struct {
+	types.CommonArgs
+	K8S_POD_NAMESPACE types.UnmarshallableString
+	K8S_POD_NAME      types.UnmarshallableString
+}
+
 type IFaceConf struct {
 	ResultIndex int
-	Interface *current.Interface
-	IPConf   *current.IPConfig
+	Interface   *current.Interface
+	IPConf      *current.IPConfig
 }
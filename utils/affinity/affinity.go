@@ -0,0 +1,125 @@
+// Package affinity emulates the ClientIP session affinity of the services, which the polycube lbrp doesn't support
+// natively. Each client is pinned to a backend chosen through a weighted rendezvous (highest random weight) hashing of
+// the client IP: the choice is consistent across syncs and nodes, and only the clients of a removed backend, or the
+// ones won by a new backend, are moved. The same hashing is used to elect the node announcing a service external
+// address.
+// The emulation pins the clients in the per-pod lbrps, so it only applies to the pods of the node reaching the service
+// cluster IP: the NodePort, external IP and host network clients are load-balanced without affinity
+package affinity
+
+import (
+	lbrp "github.com/ekoops/polykube-cni-plugin/utils/lbrp"
+	"hash/fnv"
+	"math"
+	"strings"
+	"time"
+)
+
+// score returns the rendezvous score of the provided candidate for the provided client
+func score(client, candidate string, weight int32) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(client))
+	h.Write([]byte{0})
+	h.Write([]byte(candidate))
+	// FNV poorly mixes the last bytes into the high bits, so the hash is finalized as in splitmix64 before mapping it
+	// into (0, 1)
+	x := h.Sum64()
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	x ^= x >> 31
+	u := (float64(x>>11) + 0.5) / (1 << 53)
+	if weight <= 0 {
+		weight = 1
+	}
+	return -float64(weight) / math.Log(u)
+}
+
+// Rendezvous returns the candidate the provided client is hashed to, giving the same weight to all the candidates. It
+// returns false if no candidate is provided
+func Rendezvous(client string, candidates []string) (string, bool) {
+	var best string
+	bestScore := -1.0
+	for _, candidate := range candidates {
+		if s := score(client, candidate, 1); s > bestScore {
+			best, bestScore = candidate, s
+		}
+	}
+	return best, bestScore >= 0
+}
+
+// Pick returns the backend the provided client is hashed to. It returns false if no backend is provided
+func Pick(client string, backends []lbrp.ServiceBackend) (lbrp.ServiceBackend, bool) {
+	var best lbrp.ServiceBackend
+	bestScore := -1.0
+	for _, backend := range backends {
+		if s := score(client, backend.Ip, backend.Weight); s > bestScore {
+			best, bestScore = backend, s
+		}
+	}
+	return best, bestScore >= 0
+}
+
+// pin is the backend a client is pinned to
+type pin struct {
+	backend string
+	// lastPicked is the last time the pin was picked
+	lastPicked time.Time
+}
+
+// Table keeps the clients pinned to their backends, even if the hashing would choose another backend in the meanwhile
+// (e.g.: because a new backend was added). The table doesn't see the client traffic, so it can't emulate the ClientIP
+// affinity timeout, which is measured from the last client connection: a pin is refreshed each time it is picked and
+// expires only if it is not picked for the timeout duration. Since the pins of a service are picked by each of its
+// syncs, a pin expires only if it stops being synced (e.g.: because its service was not synced for the timeout
+// duration). A client is moved before its pin expires only if its backend is removed
+type Table struct {
+	pins map[string]pin
+	now  func() time.Time
+}
+
+// NewTable returns an empty table. If now is nil, time.Now is used
+func NewTable(now func() time.Time) *Table {
+	if now == nil {
+		now = time.Now
+	}
+	return &Table{
+		pins: make(map[string]pin),
+		now:  now,
+	}
+}
+
+// Key returns the table key of the provided client for the provided service entry
+func Key(service, entry, client string) string {
+	return service + "|" + entry + "|" + client
+}
+
+// Pick returns the backend the client identified by the provided key (see Key) is pinned to, refreshing the pin. The
+// pin is replaced if it was not picked for the timeout duration
+func (t *Table) Pick(key, client string, backends []lbrp.ServiceBackend, timeout time.Duration) (lbrp.ServiceBackend, bool) {
+	now := t.now()
+	if p, ok := t.pins[key]; ok && now.Sub(p.lastPicked) < timeout {
+		for _, backend := range backends {
+			if backend.Ip == p.backend {
+				t.pins[key] = pin{backend: p.backend, lastPicked: now}
+				return backend, true
+			}
+		}
+	}
+	backend, ok := Pick(client, backends)
+	if !ok {
+		delete(t.pins, key)
+		return backend, false
+	}
+	t.pins[key] = pin{backend: backend.Ip, lastPicked: now}
+	return backend, true
+}
+
+// Prune removes the pins of the provided service, except the ones whose key is in keep
+func (t *Table) Prune(service string, keep map[string]bool) {
+	prefix := service + "|"
+	for key := range t.pins {
+		if strings.HasPrefix(key, prefix) && !keep[key] {
+			delete(t.pins, key)
+		}
+	}
+}
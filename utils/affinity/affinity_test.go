@@ -0,0 +1,168 @@
+package affinity
+
+import (
+	"fmt"
+	lbrp "github.com/ekoops/polykube-cni-plugin/utils/lbrp"
+	"testing"
+	"time"
+)
+
+const testService = "default/affinity"
+
+func backends(ips ...string) []lbrp.ServiceBackend {
+	var b []lbrp.ServiceBackend
+	for _, ip := range ips {
+		b = append(b, lbrp.ServiceBackend{Name: ip, Ip: ip, Port: 8080, Weight: 1})
+	}
+	return b
+}
+
+// testTable is a table whose clock is controlled by the test
+type testTable struct {
+	*Table
+	now     time.Time
+	timeout time.Duration
+}
+
+func newTestTable() *testTable {
+	t := &testTable{now: time.Unix(0, 0), timeout: 10 * time.Minute}
+	t.Table = NewTable(func() time.Time { return t.now })
+	return t
+}
+
+// connect returns the backend the client connects to through the service entry
+func (t *testTable) connect(client string, pool []lbrp.ServiceBackend) string {
+	backend, ok := t.Pick(Key(testService, "10.96.0.10:80/TCP", client), client, pool, t.timeout)
+	if !ok {
+		return ""
+	}
+	return backend.Ip
+}
+
+// clients returns the addresses of n clients
+func clients(n int) []string {
+	c := make([]string, n)
+	for i := range c {
+		c[i] = fmt.Sprintf("10.18.0.%d", i+2)
+	}
+	return c
+}
+
+func TestPickConsistent(t *testing.T) {
+	tt := newTestTable()
+	pool := backends("10.18.1.1", "10.18.1.2", "10.18.2.1")
+	hits := make(map[string]int)
+	for _, client := range clients(200) {
+		first := tt.connect(client, pool)
+		hits[first]++
+		for i := 1; i < 50; i++ {
+			if b := tt.connect(client, pool); b != first {
+				t.Fatalf("client %s connection %d landed on %s instead of %s", client, i, b, first)
+			}
+		}
+	}
+	for _, b := range pool {
+		if hits[b.Ip] == 0 {
+			t.Errorf("no client landed on backend %s", b.Ip)
+		}
+	}
+}
+
+func TestPickPoolChanges(t *testing.T) {
+	tt := newTestTable()
+	pool := backends("10.18.1.1", "10.18.1.2", "10.18.2.1")
+	first := make(map[string]string)
+	for _, client := range clients(200) {
+		first[client] = tt.connect(client, pool)
+	}
+
+	// a new backend doesn't move the pinned clients before the timeout
+	pool = append(pool, backends("10.18.2.2")...)
+	tt.now = tt.now.Add(tt.timeout / 2)
+	for client, b := range first {
+		if got := tt.connect(client, pool); got != b {
+			t.Fatalf("client %s moved from %s to %s before the timeout", client, b, got)
+		}
+	}
+
+	// after the timeout, the pins not picked in the meanwhile are hashed again over the whole pool
+	tt.now = tt.now.Add(tt.timeout)
+	moved := 0
+	for client, b := range first {
+		got := tt.connect(client, pool)
+		if got != b {
+			if got != "10.18.2.2" {
+				t.Fatalf("client %s moved from %s to %s instead of the new backend", client, b, got)
+			}
+			moved++
+			first[client] = got
+		}
+	}
+	if moved == 0 {
+		t.Error("no client moved to the new backend after the timeout")
+	}
+
+	// removing a backend moves only its clients
+	removed := pool[0].Ip
+	pool = pool[1:]
+	for client, b := range first {
+		got := tt.connect(client, pool)
+		if b != removed && got != b {
+			t.Fatalf("client %s moved from %s to %s, but its backend was not removed", client, b, got)
+		}
+		if got == removed {
+			t.Fatalf("client %s still lands on the removed backend %s", client, removed)
+		}
+	}
+}
+
+// TestPickRefresh verifies that picking a pin refreshes it: a pin picked more often than the timeout (e.g.: by the
+// syncs of its service) never expires, while a pin not picked for the timeout duration does
+func TestPickRefresh(t *testing.T) {
+	tt := newTestTable()
+	pool := backends("10.18.1.1", "10.18.1.2", "10.18.2.1")
+	// finding a client that the hashing would move to a new backend
+	var client, pinned string
+	newPool := append(backends("10.18.2.2"), pool...)
+	for _, c := range clients(200) {
+		if b, _ := Pick(c, pool); func() bool { nb, _ := Pick(c, newPool); return nb.Ip != b.Ip }() {
+			client, pinned = c, b.Ip
+			break
+		}
+	}
+	if client == "" {
+		t.Fatal("no client hashed to the new backend")
+	}
+	if got := tt.connect(client, pool); got != pinned {
+		t.Fatalf("client %s landed on %s instead of %s", client, got, pinned)
+	}
+
+	// the pin keeps being picked, so it outlives the timeout
+	for i := 0; i < 5; i++ {
+		tt.now = tt.now.Add(tt.timeout / 2)
+		if got := tt.connect(client, newPool); got != pinned {
+			t.Fatalf("refreshed client %s moved from %s to %s after %s", client, pinned, got, tt.now.Sub(time.Unix(0, 0)))
+		}
+	}
+
+	// the pin is not picked for the timeout duration, so it expires
+	tt.now = tt.now.Add(tt.timeout)
+	if got := tt.connect(client, newPool); got != "10.18.2.2" {
+		t.Fatalf("expired client %s - required: 10.18.2.2, found: %s", client, got)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	tt := newTestTable()
+	pool := backends("10.18.1.1", "10.18.1.2")
+	keep := Key(testService, "10.96.0.10:80/TCP", "10.18.0.2")
+	tt.connect("10.18.0.2", pool)
+	tt.connect("10.18.0.3", pool)
+	tt.Prune(testService, map[string]bool{keep: true})
+	if len(tt.pins) != 1 {
+		t.Fatalf("wrong pins number after prune - required: 1, found: %d", len(tt.pins))
+	}
+	if _, ok := tt.pins[keep]; !ok {
+		t.Fatalf("pin %q removed", keep)
+	}
+}
@@ -0,0 +1,122 @@
+// Package attachment contains the pod attachments handling shared by the plugin and the agent. An attachment is the
+// pod veth pair connected, through a per-pod lbrp, to the node bridge. The plugin persists a state file for each
+// attachment, so that the agent can rebuild the per-pod lbrps if polycubed loses them
+package attachment
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ekoops/polykube-cni-plugin/utils"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// DefaultStateDir is the directory containing the attachments state files
+	DefaultStateDir = "/var/lib/polykube/attachments"
+	// FrontendPort is the name of the per-pod lbrp port connected to the pod host interface
+	FrontendPort = "to_pod"
+	// BackendPort is the name of the per-pod lbrp port connected to the node bridge
+	BackendPort = "to_bridge"
+	// LbrpPrefix is the prefix of the per-pod lbrps names
+	LbrpPrefix = "lbrp_"
+	// SteeringIfacePrefix is the prefix of the names of the veth pairs steering the pods traffic towards an egress
+	// gateway
+	SteeringIfacePrefix = "pkes"
+
+	stateFileExt = ".json"
+)
+
+// Attachment describes a pod attachment
+type Attachment struct {
+	// Name identifies the attachment and is the name of its host interface
+	Name        string `json:"name"`
+	ContainerID string `json:"containerID"`
+	IfName      string `json:"ifName"`
+	Netns       string `json:"netns"`
+	Bridge      string `json:"bridge"`
+	// PodNamespace and PodName identify the pod, if the plugin was invoked by the kubelet
+	PodNamespace string `json:"podNamespace,omitempty"`
+	PodName      string `json:"podName,omitempty"`
+	// IP is the pod address
+	IP string `json:"ip,omitempty"`
+}
+
+// Name returns the attachment identifier of the provided pod interface. It is a truncation of
+// ifName_containerID[0:10] up to 15 characters, since it is used as host interface name
+func Name(ifName, containerID string) string {
+	return utils.Truncate(fmt.Sprintf("%s_%s", ifName, containerID[0:10]), 15)
+}
+
+// LbrpName returns the name of the per-pod lbrp of the provided attachment
+func LbrpName(att string) string {
+	return LbrpPrefix + att
+}
+
+// BridgePortName returns the name of the bridge port connected to the provided per-pod lbrp
+func BridgePortName(lbName string) string {
+	return "to_" + lbName
+}
+
+// SteeringIfaceNames returns the names of the veth pair steering the traffic of the provided attachment towards an
+// egress gateway: the host side, routed by the node, and the side connected to the per-pod lbrp backend port in place
+// of the node bridge. The names are derived from a hash of the attachment name, since they must fit in 15 characters
+func SteeringIfaceNames(att string) (host string, lb string) {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(att))
+	host = fmt.Sprintf("%s%08x", SteeringIfacePrefix, h.Sum32())
+	return host, host + "l"
+}
+
+func statePath(dir, att string) string {
+	return filepath.Join(dir, att+stateFileExt)
+}
+
+// Save persists the attachment state in the provided directory
+func Save(dir string, a *Attachment) error {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return fmt.Errorf("failed to encode attachment state: %v", err)
+	}
+	return utils.WriteFileAtomic(statePath(dir, a.Name), data, 0644)
+}
+
+// Remove deletes the state of the provided attachment. It doesn't fail if the state doesn't exist
+func Remove(dir, att string) error {
+	if err := os.Remove(statePath(dir, att)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// List returns the attachments persisted in the provided directory. A missing directory means that no attachment
+// was persisted yet
+func List(dir string) ([]*Attachment, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var atts []*Attachment
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), stateFileExt) {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		a := &Attachment{}
+		if err := json.Unmarshal(data, a); err != nil {
+			return nil, fmt.Errorf("failed to decode %q attachment state: %v", entry.Name(), err)
+		}
+		atts = append(atts, a)
+	}
+	return atts, nil
+}
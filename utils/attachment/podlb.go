@@ -0,0 +1,154 @@
+package attachment
+
+import (
+	"fmt"
+	"github.com/ekoops/polykube-cni-plugin/utils"
+	lbrp "github.com/ekoops/polykube-cni-plugin/utils/lbrp"
+	"github.com/ekoops/polykube-cni-plugin/utils/polycube"
+	simplebridge "github.com/ekoops/polykube-cni-plugin/utils/simplebridge"
+	"net"
+	"strings"
+)
+
+// PodLBManager manages the per-pod lbrps, each one connecting a pod host interface to the node bridge
+type PodLBManager interface {
+	// Create creates the lbrp, connecting its frontend port to the provided host interface
+	Create(name, hostIfName string) error
+	// ConnectToBridge connects the lbrp backend port to a new port of the provided bridge. It returns the peers of the
+	// two connected ports
+	ConnectToBridge(name, br string) (lbPeer string, brPeer string, err error)
+	// ConnectToIface connects the lbrp backend port to the provided host interface, removing the port of the provided
+	// bridge it was connected to. It doesn't fail if the bridge port doesn't exist
+	ConnectToIface(name, ifName, br string) error
+	// Check verifies that the lbrp ports are connected to the expected peers and that they are UP
+	Check(name, fpeer, bpeer string) error
+	// SetVirtualIP makes the lbrp rewrite the pod address into the provided virtual address, which must belong to
+	// the VClusterCIDR, in the traffic sent by the pod
+	SetVirtualIP(name string, podIP, virtualIP net.IP) error
+	// ClearVirtualIP removes the virtual address of the pod. It doesn't fail if no virtual address is set
+	ClearVirtualIP(name string) error
+	Delete(name string) error
+}
+
+type podLBManager struct {
+	lbrps   polycube.LbrpManager
+	bridges polycube.BridgeManager
+}
+
+// NewPodLBManager returns a PodLBManager configuring the per-pod lbrps through the provided managers
+func NewPodLBManager(lbrps polycube.LbrpManager, bridges polycube.BridgeManager) PodLBManager {
+	return &podLBManager{lbrps: lbrps, bridges: bridges}
+}
+
+func (m *podLBManager) Create(name, hostIfName string) error {
+	lbFPort := lbrp.Ports{
+		Name:  FrontendPort,
+		Type_: "frontend",
+		Peer:  hostIfName,
+	}
+	lbBPort := lbrp.Ports{
+		Name:  BackendPort,
+		Type_: "backend",
+	}
+	lbrpPorts := []lbrp.Ports{lbFPort, lbBPort}
+	lb := lbrp.Lbrp{
+		Name:     name,
+		Ports:    lbrpPorts,
+		Loglevel: "TRACE",
+	}
+	return m.lbrps.CreateLbrp(lb)
+}
+
+func (m *podLBManager) ConnectToBridge(lb string, br string) (string, string, error) {
+	// Creating port on bridge
+	brPortName := BridgePortName(lb)
+	brPort := simplebridge.Ports{
+		Name: brPortName,
+		Peer: utils.CreatePeer(lb, BackendPort),
+	}
+	if err := m.bridges.CreateBridgePort(br, brPort); err != nil {
+		return "", "", fmt.Errorf("failed to create %q port on bridge - %v", brPortName, err)
+	}
+
+	// updating lbrp backend port "to_bridge" in order to set peer=br-name:to_lb-name
+	lbPortName := BackendPort
+	lbPort := lbrp.Ports{
+		Peer: utils.CreatePeer(br, brPortName),
+	}
+	if err := m.lbrps.UpdateLbrpPort(lb, lbPortName, lbPort); err != nil {
+		return "", "", fmt.Errorf("failed to update %q port on lbrp - %v", lbPortName, err)
+	}
+	return lbPort.Peer, brPort.Peer, nil
+}
+
+func (m *podLBManager) ConnectToIface(lb, ifName, br string) error {
+	lbPort := lbrp.Ports{
+		Peer: ifName,
+	}
+	if err := m.lbrps.UpdateLbrpPort(lb, BackendPort, lbPort); err != nil {
+		return fmt.Errorf("failed to update %q port on lbrp - %v", BackendPort, err)
+	}
+	brPortName := BridgePortName(lb)
+	if err := m.bridges.DeleteBridgePort(br, brPortName); err != nil && !polycube.IsNotFound(err) {
+		return fmt.Errorf("failed to delete %q port on bridge - %v", brPortName, err)
+	}
+	return nil
+}
+
+func (m *podLBManager) Check(name, fpeer, bpeer string) error {
+	lb, err := m.lbrps.ReadLbrp(name)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve lbrp - %v", err)
+	}
+
+	if len(lb.Ports) != 2 {
+		return fmt.Errorf("wrong port number - required: 2, found: %d", len(lb.Ports))
+	}
+	for _, port := range lb.Ports {
+		// polycubed reports the port type in upper case, regardless of how it was configured
+		if strings.EqualFold(port.Type_, "frontend") {
+			if port.Name != FrontendPort {
+				return fmt.Errorf("wrong FRONTEND port name - required: %s, found: %q", FrontendPort, port.Name)
+			}
+			if port.Peer != fpeer {
+				return fmt.Errorf("wrong FRONTEND port peer - required: %q, found: %q", fpeer, port.Peer)
+			}
+		} else { // BACKEND port
+			if port.Name != BackendPort {
+				return fmt.Errorf("wrong BACKEND port name - required: %s, found: %q", BackendPort, port.Name)
+			}
+			if port.Peer != bpeer {
+				return fmt.Errorf("wrong BACKEND port peer - required: %q, found: %q", bpeer, port.Peer)
+			}
+		}
+		if port.Status != "UP" {
+			return fmt.Errorf("wrong %q port status - required: UP, found: DOWN", port.Name)
+		}
+	}
+	return nil
+}
+
+func (m *podLBManager) SetVirtualIP(name string, podIP, virtualIP net.IP) error {
+	if podIP.To4() == nil || virtualIP.To4() == nil {
+		return fmt.Errorf("invalid addresses %s -> %s: only IPv4 addresses are supported", podIP, virtualIP)
+	}
+	rewrite := lbrp.SrcIpRewrite{
+		IpRange:    podIP.String() + "/32",
+		NewIpRange: virtualIP.String() + "/32",
+	}
+	if err := m.lbrps.ReplaceLbrpSrcIpRewrite(name, rewrite); err != nil {
+		return fmt.Errorf("failed to set src ip rewrite %s -> %s - %v", rewrite.IpRange, rewrite.NewIpRange, err)
+	}
+	return nil
+}
+
+func (m *podLBManager) ClearVirtualIP(name string) error {
+	if err := m.lbrps.DeleteLbrpSrcIpRewrite(name); err != nil && !polycube.IsNotFound(err) {
+		return fmt.Errorf("failed to delete src ip rewrite - %v", err)
+	}
+	return nil
+}
+
+func (m *podLBManager) Delete(name string) error {
+	return m.lbrps.DeleteLbrp(name)
+}
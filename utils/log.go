@@ -0,0 +1,250 @@
+package utils
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	logFileMode = 0640
+	logDirMode  = 0750
+
+	// DefaultLogMaxSize is the log file size (in megabytes) triggering the rotation if none is configured
+	DefaultLogMaxSize = 10
+	// DefaultLogMaxBackups is the number of rotated copies kept if none is configured
+	DefaultLogMaxBackups = 3
+)
+
+// LogConf describes where the log records are written and how they are formatted. An empty File means that records
+// are written on stderr. MaxSize is expressed in megabytes: when the log file grows beyond it, the file is rotated
+// keeping at most MaxBackups old copies. A MaxSize equal to 0 disables the rotation, while a MaxBackups equal to 0
+// means that the file is truncated instead of being rotated; if they are missing, DefaultLogMaxSize and
+// DefaultLogMaxBackups are applied
+type LogConf struct {
+	File       string `json:"file,omitempty"`
+	Level      string `json:"level,omitempty"`
+	Format     string `json:"format,omitempty"`
+	MaxSize    *int   `json:"maxSize,omitempty"`
+	MaxBackups *int   `json:"maxBackups,omitempty"`
+}
+
+// IntPtr returns a pointer to the provided value. It is useful for filling the optional fields of a LogConf
+func IntPtr(v int) *int {
+	return &v
+}
+
+func intOrDefault(v *int, def int) int {
+	if v == nil {
+		return def
+	}
+	return *v
+}
+
+// SetupLogger configures the standard logger as described by the provided configuration
+func SetupLogger(conf *LogConf) error {
+	level := log.InfoLevel
+	if conf.Level != "" {
+		l, err := log.ParseLevel(conf.Level)
+		if err != nil {
+			return fmt.Errorf("failed to parse log level %q: %v", conf.Level, err)
+		}
+		level = l
+	}
+
+	var formatter log.Formatter
+	switch strings.ToLower(conf.Format) {
+	case "", "text":
+		formatter = &log.TextFormatter{DisableColors: true, FullTimestamp: true}
+	case "json":
+		formatter = &log.JSONFormatter{}
+	default:
+		return fmt.Errorf("unsupported log format %q: it must be text or json", conf.Format)
+	}
+
+	var out io.Writer = os.Stderr
+	if conf.File != "" {
+		maxSize := intOrDefault(conf.MaxSize, DefaultLogMaxSize)
+		maxBackups := intOrDefault(conf.MaxBackups, DefaultLogMaxBackups)
+		f, err := OpenRotatingFile(conf.File, int64(maxSize)<<20, maxBackups)
+		if err != nil {
+			return err
+		}
+		out = f
+	}
+
+	log.SetLevel(level)
+	log.SetFormatter(formatter)
+	log.SetOutput(out)
+	return nil
+}
+
+// RotatingFile is a log file that is rotated as soon as its size exceeds a given threshold. The current file is
+// renamed with the ".1" suffix, the previous ".1" copy becomes ".2" and so on, discarding the copies beyond maxBackups.
+// Since the same file is shared by concurrent processes (e.g. the CNI plugin invocations), writes and rotations are
+// serialized across them through an exclusive flock on a companion ".lock" file
+type RotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	lockFile   *os.File
+	file       *os.File
+	size       int64
+}
+
+// OpenRotatingFile opens (creating it, if necessary) the log file at the provided path. If maxSize is not positive,
+// the file is never rotated
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), logDirMode); err != nil {
+		return nil, fmt.Errorf("failed to create log directory for %q: %v", path, err)
+	}
+	f := &RotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if f.maxSize > 0 {
+		lockFile, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, logFileMode)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open lock file for %q: %v", path, err)
+		}
+		f.lockFile = lockFile
+	}
+	if err := f.open(); err != nil {
+		f.closeLock()
+		return nil, err
+	}
+	if f.maxSize <= 0 {
+		return f, nil
+	}
+
+	// the file could be already too big (e.g. if it was filled by a previous execution)
+	unlock, err := f.lock()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	defer unlock()
+	if err := f.sync(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if f.size >= f.maxSize {
+		if err := f.rotate(); err != nil {
+			f.closeLock()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, logFileMode)
+	if err != nil {
+		return fmt.Errorf("failed to open log file %q: %v", f.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat log file %q: %v", f.path, err)
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// lock acquires the exclusive flock shared with the other processes writing the same file. It returns the function
+// releasing it
+func (f *RotatingFile) lock() (func(), error) {
+	fd := int(f.lockFile.Fd())
+	if err := syscall.Flock(fd, syscall.LOCK_EX); err != nil {
+		return nil, fmt.Errorf("failed to lock log file %q: %v", f.path, err)
+	}
+	return func() { _ = syscall.Flock(fd, syscall.LOCK_UN) }, nil
+}
+
+func (f *RotatingFile) closeLock() {
+	if f.lockFile != nil {
+		f.lockFile.Close()
+		f.lockFile = nil
+	}
+}
+
+// sync refreshes the file state with the changes made by the other processes: if the file was rotated by one of
+// them, the new one is opened, otherwise the size is updated with the records they appended. It must be called with
+// the flock held
+func (f *RotatingFile) sync() error {
+	pathInfo, err := os.Stat(f.path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to stat log file %q: %v", f.path, err)
+	}
+	fileInfo, err := f.file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat log file %q: %v", f.path, err)
+	}
+	if pathInfo == nil || !os.SameFile(pathInfo, fileInfo) {
+		f.file.Close()
+		return f.open()
+	}
+	f.size = fileInfo.Size()
+	return nil
+}
+
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return fmt.Errorf("failed to close log file %q: %v", f.path, err)
+	}
+	if f.maxBackups > 0 {
+		// shifting the old copies, the oldest one is overwritten
+		for i := f.maxBackups - 1; i > 0; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		}
+		if err := os.Rename(f.path, f.path+".1"); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to rotate log file %q: %v", f.path, err)
+		}
+	} else if err := os.Truncate(f.path, 0); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to truncate log file %q: %v", f.path, err)
+	}
+	return f.open()
+}
+
+// Write writes p to the file, rotating it first if p would make it exceed its maximum size
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.maxSize <= 0 {
+		return f.file.Write(p)
+	}
+
+	unlock, err := f.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	if err := f.sync(); err != nil {
+		return 0, err
+	}
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Close closes the underlying file
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closeLock()
+	return f.file.Close()
+}
@@ -0,0 +1,171 @@
+// Package metrics contains the types used for collecting the outcomes and the latencies of the polykube operations.
+// The plugin, being short-lived, collects them into a Report that is pushed to the agent, which exposes them
+package metrics
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// OutcomeSuccess is the outcome of an operation or a step that succeeded
+	OutcomeSuccess = "success"
+	// OutcomeFailure is the outcome of an operation or a step that failed
+	OutcomeFailure = "failure"
+
+	// DefaultSocketPath is the path of the unix socket on which the agent receives the plugin reports
+	DefaultSocketPath = "/run/polykube/metrics.sock"
+	// DefaultSpoolPath is the path of the file the plugin reports are appended to if the agent is not reachable
+	DefaultSpoolPath = "/run/polykube/metrics.spool"
+
+	pushTimeout = 500 * time.Millisecond
+	// maxSpoolSize bounds the spool file size, so that it can't grow indefinitely while the agent is down
+	maxSpoolSize = 1 << 20
+)
+
+// RequestObserver is notified about the outcome of each polycube API request
+type RequestObserver interface {
+	ObserveRequest(r Request)
+}
+
+// Request describes a polycube API request
+type Request struct {
+	Service  string  `json:"service"`
+	Method   string  `json:"method"`
+	Endpoint string  `json:"endpoint"`
+	Code     string  `json:"code"`
+	Duration float64 `json:"duration"`
+}
+
+// Step describes a single step of an operation
+type Step struct {
+	Name     string  `json:"name"`
+	Outcome  string  `json:"outcome"`
+	Duration float64 `json:"duration"`
+}
+
+// Report describes a CNI operation, its steps and the polycube API requests performed during it. Durations are in
+// seconds
+type Report struct {
+	mu        sync.Mutex
+	start     time.Time
+	Op        string    `json:"op"`
+	Outcome   string    `json:"outcome"`
+	Duration  float64   `json:"duration"`
+	Steps     []Step    `json:"steps"`
+	Requests  []Request `json:"requests"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// NewReport starts the report of the provided operation
+func NewReport(op string) *Report {
+	return &Report{Op: op, start: time.Now()}
+}
+
+func outcome(err error) string {
+	if err != nil {
+		return OutcomeFailure
+	}
+	return OutcomeSuccess
+}
+
+// StartStep starts measuring a step of the operation. The returned function must be called with the step outcome
+// once the step is completed
+func (r *Report) StartStep(name string) func(err error) {
+	start := time.Now()
+	return func(err error) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.Steps = append(r.Steps, Step{
+			Name:     name,
+			Outcome:  outcome(err),
+			Duration: time.Since(start).Seconds(),
+		})
+	}
+}
+
+// ObserveRequest implements the RequestObserver interface
+func (r *Report) ObserveRequest(req Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Requests = append(r.Requests, req)
+}
+
+// Finish sets the operation outcome and duration
+func (r *Report) Finish(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Outcome = outcome(err)
+	r.Duration = time.Since(r.start).Seconds()
+	r.Timestamp = time.Now()
+}
+
+// PushConf contains the paths used for pushing the reports to the agent
+type PushConf struct {
+	Socket string `json:"socket,omitempty"`
+	Spool  string `json:"spool,omitempty"`
+}
+
+// Push sends the report to the agent through the unix socket. If the agent is not reachable, the report is appended
+// to the spool file, from which it is read by the agent later
+func (r *Report) Push(conf *PushConf) error {
+	r.mu.Lock()
+	data, err := json.Marshal(r)
+	r.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to encode report: %v", err)
+	}
+
+	socketErr := errors.New("no socket configured")
+	if conf.Socket != "" {
+		if socketErr = pushToSocket(conf.Socket, data); socketErr == nil {
+			return nil
+		}
+	}
+	if conf.Spool == "" {
+		return fmt.Errorf("failed to push report through socket: %v", socketErr)
+	}
+	if err := appendToSpool(conf.Spool, data); err != nil {
+		return fmt.Errorf("failed to push report through socket (%v) and spool: %v", socketErr, err)
+	}
+	return nil
+}
+
+func pushToSocket(path string, data []byte) error {
+	conn, err := net.DialTimeout("unix", path, pushTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetWriteDeadline(time.Now().Add(pushTimeout)); err != nil {
+		return err
+	}
+	_, err = conn.Write(data)
+	return err
+}
+
+// appendToSpool appends the report as a single line to the spool file. A single write on a file opened in append mode
+// is used, so that reports pushed concurrently by different plugin instances are not interleaved
+func appendToSpool(path string, data []byte) error {
+	if info, err := os.Stat(path); err == nil && info.Size() > maxSpoolSize {
+		return errors.New("spool file is full")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiPrefix is the path prefix of the polycubed REST API
+const apiPrefix = "/polycube/v1/"
+
+// resources contains the names of the polycube API path segments that identify a resource type or an action. All the
+// other segments following the cube name are list keys
+var resources = map[string]bool{
+	"ports": true, "peer": true, "status": true, "type": true,
+	"fdb": true, "entry": true, "flush": true, "aging-time": true,
+	"route": true, "arp-table": true, "secondaryip": true,
+	"service": true, "backend": true, "src-ip-rewrite": true,
+	"natting-rule": true, "nodeport-rule": true,
+	"rule": true, "snat": true,
+}
+
+// endpoint returns the service and the templated endpoint of the provided polycube API path, so that the cube names
+// and the list keys don't end up in the metric labels
+func endpoint(path string) (string, string) {
+	path = strings.Trim(strings.TrimPrefix(path, apiPrefix), "/")
+	if path == "" {
+		return "", "/"
+	}
+	segments := strings.Split(path, "/")
+	service := segments[0]
+	for i := 1; i < len(segments); i++ {
+		switch {
+		case i == 1:
+			segments[i] = "{name}"
+		case !resources[segments[i]]:
+			segments[i] = "{key}"
+		}
+	}
+	return service, "/" + strings.Join(segments, "/")
+}
+
+// InstrumentedTransport is an http.RoundTripper notifying an observer about each performed request
+type InstrumentedTransport struct {
+	// Base is the RoundTripper actually performing the requests. If nil, http.DefaultTransport is used
+	Base     http.RoundTripper
+	Observer RequestObserver
+}
+
+// NewInstrumentedClient returns an HTTP client notifying the provided observer about each performed request
+func NewInstrumentedClient(observer RequestObserver) *http.Client {
+	return &http.Client{Transport: &InstrumentedTransport{Observer: observer}}
+}
+
+// RoundTrip implements the http.RoundTripper interface
+func (t *InstrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	start := time.Now()
+	resp, err := base.RoundTrip(req)
+	service, ep := endpoint(req.URL.EscapedPath())
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	t.Observer.ObserveRequest(Request{
+		Service:  service,
+		Method:   req.Method,
+		Endpoint: ep,
+		Code:     code,
+		Duration: time.Since(start).Seconds(),
+	})
+	return resp, err
+}
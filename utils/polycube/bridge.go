@@ -0,0 +1,87 @@
+package polycube
+
+import (
+	"context"
+	simplebridge "github.com/ekoops/polykube-cni-plugin/utils/simplebridge"
+	"net/http"
+)
+
+// BridgeManager manages the simplebridge cubes
+type BridgeManager interface {
+	CreateBridge(br simplebridge.Simplebridge) error
+	ReadBridge(name string) (*simplebridge.Simplebridge, error)
+	ListBridges() ([]simplebridge.Simplebridge, error)
+	DeleteBridge(name string) error
+	CreateBridgePort(br string, port simplebridge.Ports) error
+	ReadBridgePort(br, name string) (*simplebridge.Ports, error)
+	// UpdateBridgePort updates only the fields set in the provided port
+	UpdateBridgePort(br, name string, port simplebridge.Ports) error
+	DeleteBridgePort(br, name string) error
+}
+
+type bridgeManager struct {
+	ctx   context.Context
+	api   *simplebridge.SimplebridgeApiService
+	retry RetryConf
+}
+
+func (m *bridgeManager) CreateBridge(br simplebridge.Simplebridge) error {
+	return m.retry.do(m.ctx, func() (*http.Response, error) {
+		return m.api.CreateSimplebridgeByID(m.ctx, br.Name, br)
+	})
+}
+
+func (m *bridgeManager) ReadBridge(name string) (*simplebridge.Simplebridge, error) {
+	var br simplebridge.Simplebridge
+	if err := m.retry.do(m.ctx, func() (resp *http.Response, err error) {
+		br, resp, err = m.api.ReadSimplebridgeByID(m.ctx, name)
+		return resp, err
+	}); err != nil {
+		return nil, err
+	}
+	return &br, nil
+}
+
+func (m *bridgeManager) ListBridges() ([]simplebridge.Simplebridge, error) {
+	var brs []simplebridge.Simplebridge
+	err := m.retry.do(m.ctx, func() (resp *http.Response, err error) {
+		brs, resp, err = m.api.ReadSimplebridgeListByID(m.ctx)
+		return resp, err
+	})
+	return brs, err
+}
+
+func (m *bridgeManager) DeleteBridge(name string) error {
+	return m.retry.do(m.ctx, func() (*http.Response, error) {
+		return m.api.DeleteSimplebridgeByID(m.ctx, name)
+	})
+}
+
+func (m *bridgeManager) CreateBridgePort(br string, port simplebridge.Ports) error {
+	return m.retry.do(m.ctx, func() (*http.Response, error) {
+		return m.api.CreateSimplebridgePortsByID(m.ctx, br, port.Name, port)
+	})
+}
+
+func (m *bridgeManager) ReadBridgePort(br, name string) (*simplebridge.Ports, error) {
+	var port simplebridge.Ports
+	if err := m.retry.do(m.ctx, func() (resp *http.Response, err error) {
+		port, resp, err = m.api.ReadSimplebridgePortsByID(m.ctx, br, name)
+		return resp, err
+	}); err != nil {
+		return nil, err
+	}
+	return &port, nil
+}
+
+func (m *bridgeManager) UpdateBridgePort(br, name string, port simplebridge.Ports) error {
+	return m.retry.do(m.ctx, func() (*http.Response, error) {
+		return m.api.UpdateSimplebridgePortsByID(m.ctx, br, name, port)
+	})
+}
+
+func (m *bridgeManager) DeleteBridgePort(br, name string) error {
+	return m.retry.do(m.ctx, func() (*http.Response, error) {
+		return m.api.DeleteSimplebridgePortsByID(m.ctx, br, name)
+	})
+}
@@ -0,0 +1,162 @@
+package polycube
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrorKind classifies the failures of the polycube API calls
+type ErrorKind int
+
+const (
+	// Unknown is the kind of the failures not falling in any other kind
+	Unknown ErrorKind = iota
+	// NotFound means that the requested resource doesn't exist
+	NotFound
+	// Conflict means that the resource to be created already exists
+	Conflict
+	// Unavailable means that polycubed could not be reached or that it is temporarily unable to serve the request
+	Unavailable
+	// Invalid means that polycubed rejected the request, that the request could not be built or that the response could
+	// not be decoded
+	Invalid
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case NotFound:
+		return "not found"
+	case Conflict:
+		return "conflict"
+	case Unavailable:
+		return "unavailable"
+	case Invalid:
+		return "invalid"
+	default:
+		return "unknown"
+	}
+}
+
+// Error describes a failed polycube API call
+type Error struct {
+	Kind ErrorKind
+	// StatusCode is the HTTP status code of the response, or 0 if no response was received
+	StatusCode int
+	// Message is the reason of the failure reported by polycubed, if any
+	Message string
+	Err     error
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("polycube API error (%s", e.Kind)
+	if e.StatusCode != 0 {
+		msg += fmt.Sprintf(", status: %d", e.StatusCode)
+	}
+	msg += fmt.Sprintf("): %v", e.Err)
+	if e.Message != "" {
+		msg += fmt.Sprintf(" - %s", e.Message)
+	}
+	return msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Temporary returns true if the call could succeed if performed again
+func (e *Error) Temporary() bool {
+	return e.Kind == Unavailable
+}
+
+// swaggerError is implemented by the errors returned by all the generated API clients
+type swaggerError interface {
+	Body() []byte
+}
+
+// apiError builds an Error from the outcome of a polycube API call, if the call failed. The provided response can be
+// nil
+func apiError(resp *http.Response, err error) error {
+	if err == nil {
+		return nil
+	}
+	e := &Error{Kind: Unknown, Err: err}
+	if resp == nil {
+		// no response means that polycubed could not be reached
+		e.Kind = Unavailable
+		return e
+	}
+	e.StatusCode = resp.StatusCode
+	var se swaggerError
+	if errors.As(err, &se) {
+		e.Message = errorMessage(se.Body())
+	}
+	switch code := resp.StatusCode; {
+	case code < 300:
+		// the call succeeded, but the response could not be decoded
+		e.Kind = Invalid
+	case code == http.StatusNotFound:
+		e.Kind = NotFound
+	case code == http.StatusConflict:
+		e.Kind = Conflict
+	case code == http.StatusBadRequest || code == http.StatusMethodNotAllowed ||
+		code == http.StatusUnprocessableEntity:
+		e.Kind = Invalid
+	case code == http.StatusTooManyRequests || code == http.StatusBadGateway ||
+		code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout:
+		e.Kind = Unavailable
+	}
+	return e
+}
+
+// errorMessage extracts the failure reason from the body of a polycubed error response
+func errorMessage(body []byte) string {
+	var v struct {
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &v); err == nil && v.Message != "" {
+		return v.Message
+	}
+	return strings.TrimSpace(string(body))
+}
+
+// kindOf returns the kind of the provided error, or Unknown if it is not an Error
+func kindOf(err error) ErrorKind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	return Unknown
+}
+
+// StatusCode returns the HTTP status code of the response related to the provided error, or 0 if no response was
+// received
+func StatusCode(err error) int {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.StatusCode
+	}
+	return 0
+}
+
+// IsNotFound returns true if the provided error reports that the resource doesn't exist
+func IsNotFound(err error) bool {
+	return kindOf(err) == NotFound
+}
+
+// IsConflict returns true if the provided error reports that the resource already exists
+func IsConflict(err error) bool {
+	return kindOf(err) == Conflict
+}
+
+// IsUnavailable returns true if the provided error reports that polycubed could not serve the request
+func IsUnavailable(err error) bool {
+	return kindOf(err) == Unavailable
+}
+
+// IsInvalid returns true if the provided error reports that the request or the response were not valid
+func IsInvalid(err error) bool {
+	return kindOf(err) == Invalid
+}
@@ -0,0 +1,103 @@
+package polycube
+
+import (
+	"context"
+	k8sdispatcher "github.com/ekoops/polykube-cni-plugin/utils/k8sdispatcher"
+	"net/http"
+	"strconv"
+)
+
+// DispatcherManager manages the k8sdispatcher cubes
+type DispatcherManager interface {
+	CreateDispatcher(k k8sdispatcher.K8sdispatcher) error
+	ReadDispatcher(name string) (*k8sdispatcher.K8sdispatcher, error)
+	ListDispatchers() ([]k8sdispatcher.K8sdispatcher, error)
+	DeleteDispatcher(name string) error
+	CreateDispatcherPort(k string, port k8sdispatcher.Ports) error
+	// UpdateDispatcherPort updates only the fields set in the provided port
+	UpdateDispatcherPort(k, name string, port k8sdispatcher.Ports) error
+	// UpdateNodeportRange sets the NodePort range, in the format min-max
+	UpdateNodeportRange(k, nodeportRange string) error
+	ListNodeportRules(k string) ([]k8sdispatcher.NodeportRule, error)
+	// ReplaceNodeportRule creates the rule or replaces the one with the same port and protocol
+	ReplaceNodeportRule(k string, rule k8sdispatcher.NodeportRule) error
+	DeleteNodeportRule(k string, port int32, proto string) error
+}
+
+type dispatcherManager struct {
+	ctx   context.Context
+	api   *k8sdispatcher.K8sdispatcherApiService
+	retry RetryConf
+}
+
+func (m *dispatcherManager) CreateDispatcher(k k8sdispatcher.K8sdispatcher) error {
+	return m.retry.do(m.ctx, func() (*http.Response, error) {
+		return m.api.CreateK8sdispatcherByID(m.ctx, k.Name, k)
+	})
+}
+
+func (m *dispatcherManager) ReadDispatcher(name string) (*k8sdispatcher.K8sdispatcher, error) {
+	var k k8sdispatcher.K8sdispatcher
+	if err := m.retry.do(m.ctx, func() (resp *http.Response, err error) {
+		k, resp, err = m.api.ReadK8sdispatcherByID(m.ctx, name)
+		return resp, err
+	}); err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+func (m *dispatcherManager) ListDispatchers() ([]k8sdispatcher.K8sdispatcher, error) {
+	var ks []k8sdispatcher.K8sdispatcher
+	err := m.retry.do(m.ctx, func() (resp *http.Response, err error) {
+		ks, resp, err = m.api.ReadK8sdispatcherListByID(m.ctx)
+		return resp, err
+	})
+	return ks, err
+}
+
+func (m *dispatcherManager) DeleteDispatcher(name string) error {
+	return m.retry.do(m.ctx, func() (*http.Response, error) {
+		return m.api.DeleteK8sdispatcherByID(m.ctx, name)
+	})
+}
+
+func (m *dispatcherManager) CreateDispatcherPort(k string, port k8sdispatcher.Ports) error {
+	return m.retry.do(m.ctx, func() (*http.Response, error) {
+		return m.api.CreateK8sdispatcherPortsByID(m.ctx, k, port.Name, port)
+	})
+}
+
+func (m *dispatcherManager) UpdateDispatcherPort(k, name string, port k8sdispatcher.Ports) error {
+	return m.retry.do(m.ctx, func() (*http.Response, error) {
+		return m.api.UpdateK8sdispatcherPortsByID(m.ctx, k, name, port)
+	})
+}
+
+// UpdateNodeportRange quotes the range, since the generated client writes string bodies as they are
+func (m *dispatcherManager) UpdateNodeportRange(k, nodeportRange string) error {
+	return m.retry.do(m.ctx, func() (*http.Response, error) {
+		return m.api.UpdateK8sdispatcherNodeportRangeByID(m.ctx, k, strconv.Quote(nodeportRange))
+	})
+}
+
+func (m *dispatcherManager) ListNodeportRules(k string) ([]k8sdispatcher.NodeportRule, error) {
+	var rules []k8sdispatcher.NodeportRule
+	err := m.retry.do(m.ctx, func() (resp *http.Response, err error) {
+		rules, resp, err = m.api.ReadK8sdispatcherNodeportRuleListByID(m.ctx, k)
+		return resp, err
+	})
+	return rules, err
+}
+
+func (m *dispatcherManager) ReplaceNodeportRule(k string, rule k8sdispatcher.NodeportRule) error {
+	return m.retry.do(m.ctx, func() (*http.Response, error) {
+		return m.api.ReplaceK8sdispatcherNodeportRuleByID(m.ctx, k, rule.NodeportPort, rule.Proto, rule)
+	})
+}
+
+func (m *dispatcherManager) DeleteNodeportRule(k string, port int32, proto string) error {
+	return m.retry.do(m.ctx, func() (*http.Response, error) {
+		return m.api.DeleteK8sdispatcherNodeportRuleByID(m.ctx, k, port, proto)
+	})
+}
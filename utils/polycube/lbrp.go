@@ -0,0 +1,99 @@
+package polycube
+
+import (
+	"context"
+	lbrp "github.com/ekoops/polykube-cni-plugin/utils/lbrp"
+	"net/http"
+)
+
+// LbrpManager manages the lbrp cubes
+type LbrpManager interface {
+	CreateLbrp(lb lbrp.Lbrp) error
+	ReadLbrp(name string) (*lbrp.Lbrp, error)
+	ListLbrps() ([]lbrp.Lbrp, error)
+	DeleteLbrp(name string) error
+	// UpdateLbrpPort updates only the fields set in the provided port
+	UpdateLbrpPort(lb, name string, port lbrp.Ports) error
+	// ReplaceLbrpService creates or replaces a service, including its backends
+	ReplaceLbrpService(lb string, service lbrp.Service) error
+	DeleteLbrpService(lb, vip string, vport int32, proto string) error
+	// ReplaceLbrpSrcIpRewrite sets the rewrite of the source addresses of the traffic sent by the lbrp backends
+	ReplaceLbrpSrcIpRewrite(lb string, rewrite lbrp.SrcIpRewrite) error
+	DeleteLbrpSrcIpRewrite(lb string) error
+}
+
+type lbrpManager struct {
+	ctx context.Context
+	api *lbrp.LbrpApiService
+	// basePath and client are used for reading the lbrps without the generated client
+	basePath string
+	client   *http.Client
+	retry    RetryConf
+}
+
+func (m *lbrpManager) CreateLbrp(lb lbrp.Lbrp) error {
+	return m.retry.do(m.ctx, func() (*http.Response, error) {
+		return m.api.CreateLbrpByID(m.ctx, lb.Name, lb)
+	})
+}
+
+// ReadLbrp reads the lbrp through the robust read path, since the generated client fails to decode it
+func (m *lbrpManager) ReadLbrp(name string) (*lbrp.Lbrp, error) {
+	var lb *lbrp.Lbrp
+	err := m.read(lbrpPath(name), func(body []byte) (err error) {
+		lb, err = DecodeLbrp(body)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lb, nil
+}
+
+// ListLbrps reads the lbrps through the robust read path, since the generated client fails to decode them
+func (m *lbrpManager) ListLbrps() ([]lbrp.Lbrp, error) {
+	var lbs []lbrp.Lbrp
+	err := m.read("", func(body []byte) (err error) {
+		lbs, err = DecodeLbrpList(body)
+		return err
+	})
+	return lbs, err
+}
+
+func (m *lbrpManager) DeleteLbrp(name string) error {
+	return m.retry.do(m.ctx, func() (*http.Response, error) {
+		return m.api.DeleteLbrpByID(m.ctx, name)
+	})
+}
+
+func (m *lbrpManager) UpdateLbrpPort(lb, name string, port lbrp.Ports) error {
+	return m.retry.do(m.ctx, func() (*http.Response, error) {
+		return m.api.UpdateLbrpPortsByID(m.ctx, lb, name, port)
+	})
+}
+
+func (m *lbrpManager) ReplaceLbrpService(lb string, service lbrp.Service) error {
+	return m.retry.do(m.ctx, func() (*http.Response, error) {
+		return m.api.ReplaceLbrpServiceByID(
+			m.ctx, lb, service.Vip, service.Vport, service.Proto, service,
+		)
+	})
+}
+
+func (m *lbrpManager) DeleteLbrpService(lb, vip string, vport int32, proto string) error {
+	return m.retry.do(m.ctx, func() (*http.Response, error) {
+		return m.api.DeleteLbrpServiceByID(m.ctx, lb, vip, vport, proto)
+	})
+}
+
+func (m *lbrpManager) ReplaceLbrpSrcIpRewrite(lb string, rewrite lbrp.SrcIpRewrite) error {
+	return m.retry.do(m.ctx, func() (*http.Response, error) {
+		return m.api.ReplaceLbrpSrcIpRewriteByID(m.ctx, lb, rewrite)
+	})
+}
+
+func (m *lbrpManager) DeleteLbrpSrcIpRewrite(lb string) error {
+	return m.retry.do(m.ctx, func() (*http.Response, error) {
+		return m.api.DeleteLbrpSrcIpRewriteByID(m.ctx, lb)
+	})
+}
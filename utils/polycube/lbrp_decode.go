@@ -0,0 +1,212 @@
+package polycube
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	lbrp "github.com/ekoops/polykube-cni-plugin/utils/lbrp"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// The generated lbrp client fails to decode the lbrp resources returned by polycubed, since their shape differs from
+// the one described by the API specification:
+//   - the Content-Type header is not always set to application/json;
+//   - numeric leaves (vport, port and weight) can be encoded as strings;
+//   - empty lists can be encoded as null.
+// For this reason, the lbrps are read directly and decoded through the following wire types, that accept all the
+// shapes above and that are then converted in the generated models. Port types are normalized in upper case, as
+// polycubed reports them regardless of how they were configured
+
+// flexInt is an integer that can be encoded both as a JSON number and as a JSON string
+type flexInt int32
+
+func (i *flexInt) UnmarshalJSON(b []byte) error {
+	s := string(bytes.Trim(b, `"`))
+	if s == "" || s == "null" {
+		*i = 0
+		return nil
+	}
+	n, err := strconv.ParseInt(s, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid integer %s: %v", b, err)
+	}
+	*i = flexInt(n)
+	return nil
+}
+
+// flexBool is a boolean that can be encoded both as a JSON boolean and as a JSON string
+type flexBool bool
+
+func (v *flexBool) UnmarshalJSON(b []byte) error {
+	s := string(bytes.Trim(b, `"`))
+	if s == "" || s == "null" {
+		*v = false
+		return nil
+	}
+	parsed, err := strconv.ParseBool(s)
+	if err != nil {
+		return fmt.Errorf("invalid boolean %s: %v", b, err)
+	}
+	*v = flexBool(parsed)
+	return nil
+}
+
+type wireLbrpPort struct {
+	Name   string   `json:"name"`
+	Uuid   string   `json:"uuid"`
+	Status string   `json:"status"`
+	Peer   string   `json:"peer"`
+	Tcubes []string `json:"tcubes"`
+	Type   string   `json:"type"`
+}
+
+type wireLbrpBackend struct {
+	Name   string  `json:"name"`
+	Ip     string  `json:"ip"`
+	Port   flexInt `json:"port"`
+	Weight flexInt `json:"weight"`
+}
+
+type wireLbrpService struct {
+	Name    string            `json:"name"`
+	Vip     string            `json:"vip"`
+	Vport   flexInt           `json:"vport"`
+	Proto   string            `json:"proto"`
+	Backend []wireLbrpBackend `json:"backend"`
+}
+
+// wireSrcIpRewrite uses the same keys of the generated model, which is used for writing the rewrite: as in the lbrp
+// YANG model, the new range leaf is named new_ip_range
+type wireSrcIpRewrite struct {
+	IpRange    string `json:"ip-range"`
+	NewIpRange string `json:"new_ip_range"`
+}
+
+type wireLbrp struct {
+	Name         string            `json:"name"`
+	Uuid         string            `json:"uuid"`
+	Type         string            `json:"type"`
+	ServiceName  string            `json:"service-name"`
+	Loglevel     string            `json:"loglevel"`
+	Ports        []wireLbrpPort    `json:"ports"`
+	Shadow       flexBool          `json:"shadow"`
+	Span         flexBool          `json:"span"`
+	SrcIpRewrite *wireSrcIpRewrite `json:"src-ip-rewrite"`
+	Service      []wireLbrpService `json:"service"`
+}
+
+// model converts the decoded lbrp into the generated model
+func (w *wireLbrp) model() lbrp.Lbrp {
+	lb := lbrp.Lbrp{
+		Name:        w.Name,
+		Uuid:        w.Uuid,
+		Type_:       w.Type,
+		ServiceName: w.ServiceName,
+		Loglevel:    w.Loglevel,
+		Shadow:      bool(w.Shadow),
+		Span:        bool(w.Span),
+	}
+	for _, p := range w.Ports {
+		lb.Ports = append(lb.Ports, lbrp.Ports{
+			Name:   p.Name,
+			Uuid:   p.Uuid,
+			Status: p.Status,
+			Peer:   p.Peer,
+			Tcubes: p.Tcubes,
+			Type_:  strings.ToUpper(p.Type),
+		})
+	}
+	if w.SrcIpRewrite != nil {
+		lb.SrcIpRewrite = &lbrp.SrcIpRewrite{IpRange: w.SrcIpRewrite.IpRange, NewIpRange: w.SrcIpRewrite.NewIpRange}
+	}
+	for _, s := range w.Service {
+		service := lbrp.Service{
+			Name:  s.Name,
+			Vip:   s.Vip,
+			Vport: int32(s.Vport),
+			Proto: s.Proto,
+		}
+		for _, b := range s.Backend {
+			service.Backend = append(service.Backend, lbrp.ServiceBackend{
+				Name:   b.Name,
+				Ip:     b.Ip,
+				Port:   int32(b.Port),
+				Weight: int32(b.Weight),
+			})
+		}
+		lb.Service = append(lb.Service, service)
+	}
+	return lb
+}
+
+// DecodeLbrp decodes a lbrp resource as returned by polycubed
+func DecodeLbrp(body []byte) (*lbrp.Lbrp, error) {
+	var w wireLbrp
+	if err := json.Unmarshal(body, &w); err != nil {
+		return nil, fmt.Errorf("failed to decode lbrp: %v", err)
+	}
+	lb := w.model()
+	return &lb, nil
+}
+
+// DecodeLbrpList decodes a list of lbrp resources as returned by polycubed
+func DecodeLbrpList(body []byte) ([]lbrp.Lbrp, error) {
+	var ws []wireLbrp
+	if err := json.Unmarshal(body, &ws); err != nil {
+		return nil, fmt.Errorf("failed to decode lbrp list: %v", err)
+	}
+	lbs := make([]lbrp.Lbrp, 0, len(ws))
+	for i := range ws {
+		lbs = append(lbs, ws[i].model())
+	}
+	return lbs, nil
+}
+
+// responseError is the error returned for a polycubed error response. As the errors of the generated clients, it
+// provides the response body
+type responseError struct {
+	status string
+	body   []byte
+}
+
+func (e *responseError) Error() string {
+	return e.status
+}
+
+func (e *responseError) Body() []byte {
+	return e.body
+}
+
+// read performs a GET request for the lbrp resource at the provided path, relative to the lbrp service path, and
+// decodes the response body through the provided function
+func (m *lbrpManager) read(path string, decode func(body []byte) error) error {
+	return m.retry.do(m.ctx, func() (*http.Response, error) {
+		req, err := http.NewRequestWithContext(m.ctx, http.MethodGet, m.basePath+"/lbrp/"+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/json")
+		resp, err := m.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode >= 300 {
+			return resp, &responseError{status: resp.Status, body: body}
+		}
+		return resp, decode(body)
+	})
+}
+
+// lbrpPath returns the path of the lbrp having the provided name, relative to the lbrp service path
+func lbrpPath(name string) string {
+	return url.PathEscape(name) + "/"
+}
@@ -0,0 +1,260 @@
+package polycube
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ekoops/polykube-cni-plugin/test/fakepolycubed"
+	lbrp "github.com/ekoops/polykube-cni-plugin/utils/lbrp"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sigs.k8s.io/yaml"
+	"strings"
+	"testing"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	body, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("failed to read fixture %q: %v", name, err)
+	}
+	return body
+}
+
+func TestDecodeLbrp(t *testing.T) {
+	lb, err := DecodeLbrp(readFixture(t, "lbrp.json"))
+	if err != nil {
+		t.Fatalf("failed to decode lbrp: %v", err)
+	}
+	expected := &lbrp.Lbrp{
+		Name:        "lbrp_eth0_0123456789ab",
+		Uuid:        "6c4a3b6e-0f4e-4f5c-9d1a-2f6f4a1b7c01",
+		Type_:       "TC",
+		ServiceName: "lbrp",
+		Loglevel:    "TRACE",
+		Ports: []lbrp.Ports{
+			{
+				Name:   "to_pod",
+				Uuid:   "0b1f6b9e-4d5a-4c1e-8a4e-9f2b3c4d5e01",
+				Status: "UP",
+				Peer:   "eth0_0123456789ab",
+				Tcubes: []string{},
+				Type_:  "FRONTEND",
+			},
+			{
+				Name:   "to_bridge",
+				Uuid:   "0b1f6b9e-4d5a-4c1e-8a4e-9f2b3c4d5e02",
+				Status: "DOWN",
+				Peer:   "br0:to_lbrp_eth0_0123456789ab",
+				Tcubes: []string{},
+				Type_:  "BACKEND",
+			},
+		},
+		SrcIpRewrite: &lbrp.SrcIpRewrite{IpRange: "10.10.1.5/32", NewIpRange: "10.10.200.5/32"},
+		Service: []lbrp.Service{
+			{
+				Name:  "default/kubernetes",
+				Vip:   "11.11.11.1",
+				Vport: 443,
+				Proto: "TCP",
+				Backend: []lbrp.ServiceBackend{
+					{Name: "node1", Ip: "192.168.1.10", Port: 6443, Weight: 1},
+				},
+			},
+			{
+				Name:  "default/empty",
+				Vip:   "11.11.11.2",
+				Vport: 80,
+				Proto: "TCP",
+			},
+		},
+	}
+	if !reflect.DeepEqual(lb, expected) {
+		t.Fatalf("unexpected decoded lbrp\nrequired: %+v\nfound:    %+v", expected, lb)
+	}
+}
+
+func TestDecodeLbrpList(t *testing.T) {
+	lbs, err := DecodeLbrpList(readFixture(t, "lbrp_list.json"))
+	if err != nil {
+		t.Fatalf("failed to decode lbrp list: %v", err)
+	}
+	if len(lbs) != 2 {
+		t.Fatalf("wrong lbrp number - required: 2, found: %d", len(lbs))
+	}
+	if lbs[0].Name != "lbrp0" || len(lbs[0].Ports) != 2 || lbs[0].Service != nil {
+		t.Fatalf("unexpected first lbrp: %+v", lbs[0])
+	}
+	if lbs[0].Ports[0].Type_ != "BACKEND" || lbs[0].Ports[1].Type_ != "FRONTEND" {
+		t.Fatalf("unexpected port types: %+v", lbs[0].Ports)
+	}
+	if lbs[1].Name != "lbrp_eth0_0123456789ab" || lbs[1].Ports != nil {
+		t.Fatalf("unexpected second lbrp: %+v", lbs[1])
+	}
+}
+
+// TestDecodeLbrpDeviations verifies that the decoder accepts the shapes deviating from the API specification
+func TestDecodeLbrpDeviations(t *testing.T) {
+	lb, err := DecodeLbrp(readFixture(t, "lbrp_deviations.json"))
+	if err != nil {
+		t.Fatalf("failed to decode lbrp: %v", err)
+	}
+	if lb.Shadow || !lb.Span {
+		t.Errorf("booleans encoded as strings - required: shadow false, span true, found: %t, %t", lb.Shadow, lb.Span)
+	}
+	// port types are normalized in upper case
+	if len(lb.Ports) != 2 || lb.Ports[0].Type_ != "FRONTEND" || lb.Ports[1].Type_ != "BACKEND" {
+		t.Errorf("port types not normalized: %+v", lb.Ports)
+	}
+	if lb.Ports[0].Tcubes != nil {
+		t.Errorf("null tcubes decoded as %v", lb.Ports[0].Tcubes)
+	}
+	expected := []lbrp.Service{
+		{
+			Name:  "default/kubernetes",
+			Vip:   "11.11.11.1",
+			Vport: 443,
+			Proto: "TCP",
+			Backend: []lbrp.ServiceBackend{
+				{Name: "node1", Ip: "192.168.1.10", Port: 6443, Weight: 1},
+			},
+		},
+		{Name: "default/empty", Vip: "11.11.11.2", Vport: 80, Proto: "TCP"},
+	}
+	if !reflect.DeepEqual(lb.Service, expected) {
+		t.Errorf("unexpected services\nrequired: %+v\nfound:    %+v", expected, lb.Service)
+	}
+}
+
+// specDefinition is a definition of the lbrp API specification
+type specDefinition struct {
+	Properties map[string]struct {
+		Type string        `json:"type"`
+		Ref  string        `json:"$ref"`
+		Enum []interface{} `json:"enum"`
+		// Items is the definition of the array elements
+		Items struct {
+			Type string `json:"type"`
+			Ref  string `json:"$ref"`
+		} `json:"items"`
+	} `json:"properties"`
+}
+
+// checkSpec verifies that the provided JSON value has the shape of the provided specification definition
+func checkSpec(t *testing.T, defs map[string]specDefinition, def, path string, value interface{}) {
+	t.Helper()
+	obj, ok := value.(map[string]interface{})
+	if !ok {
+		t.Errorf("%s: required an object, found: %v", path, value)
+		return
+	}
+	for key, v := range obj {
+		prop, ok := defs[def].Properties[key]
+		if !ok {
+			t.Errorf("%s: %q is not a %s property", path, key, def)
+			continue
+		}
+		keyPath := path + "." + key
+		switch {
+		case prop.Ref != "":
+			checkSpec(t, defs, strings.TrimPrefix(prop.Ref, "#/definitions/"), keyPath, v)
+		case prop.Type == "array":
+			items, ok := v.([]interface{})
+			if !ok {
+				t.Errorf("%s: required an array, found: %v", keyPath, v)
+				continue
+			}
+			for i, item := range items {
+				itemPath := fmt.Sprintf("%s[%d]", keyPath, i)
+				if prop.Items.Ref != "" {
+					checkSpec(t, defs, strings.TrimPrefix(prop.Items.Ref, "#/definitions/"), itemPath, item)
+				} else if _, ok := item.(string); !ok {
+					t.Errorf("%s: required a string, found: %v", itemPath, item)
+				}
+			}
+		default:
+			var typeOk bool
+			switch prop.Type {
+			case "string":
+				_, typeOk = v.(string)
+			case "integer":
+				n, isNumber := v.(float64)
+				typeOk = isNumber && n == float64(int64(n))
+			case "boolean":
+				_, typeOk = v.(bool)
+			}
+			if !typeOk {
+				t.Errorf("%s: required type %s, found: %v", keyPath, prop.Type, v)
+			}
+			if len(prop.Enum) > 0 {
+				found := false
+				for _, e := range prop.Enum {
+					found = found || e == v
+				}
+				if !found {
+					t.Errorf("%s: %v is not one of %v", keyPath, v, prop.Enum)
+				}
+			}
+		}
+	}
+}
+
+// TestFixturesMatchSpec verifies that the lbrp fixtures follow the API specification the lbrp client is generated
+// from (see testdata/README.md)
+func TestFixturesMatchSpec(t *testing.T) {
+	raw, err := ioutil.ReadFile(filepath.Join("..", "lbrp", "api", "swagger.yaml"))
+	if err != nil {
+		t.Fatalf("failed to read the lbrp API specification: %v", err)
+	}
+	var spec struct {
+		Definitions map[string]specDefinition `json:"definitions"`
+	}
+	if err := yaml.Unmarshal(raw, &spec); err != nil {
+		t.Fatalf("failed to decode the lbrp API specification: %v", err)
+	}
+
+	var lb interface{}
+	if err := json.Unmarshal(readFixture(t, "lbrp.json"), &lb); err != nil {
+		t.Fatal(err)
+	}
+	checkSpec(t, spec.Definitions, "Lbrp", "lbrp.json", lb)
+
+	var lbs []interface{}
+	if err := json.Unmarshal(readFixture(t, "lbrp_list.json"), &lbs); err != nil {
+		t.Fatal(err)
+	}
+	for i, lb := range lbs {
+		checkSpec(t, spec.Definitions, "Lbrp", fmt.Sprintf("lbrp_list.json[%d]", i), lb)
+	}
+}
+
+func TestDecodeLbrpInvalid(t *testing.T) {
+	if _, err := DecodeLbrp([]byte(`{"service": [{"vport": "http"}]}`)); err == nil {
+		t.Fatal("decoding succeeded with a non numeric vport")
+	}
+}
+
+// TestSrcIpRewriteRoundTrip verifies that the rewrite written through the generated client is read back by the
+// decoder
+func TestSrcIpRewriteRoundTrip(t *testing.T) {
+	srv := fakepolycubed.NewServer()
+	ts, url := srv.Start()
+	defer ts.Close()
+	cubes := NewCubes(url)
+
+	if err := cubes.Lbrps.CreateLbrp(lbrp.Lbrp{Name: "lb1"}); err != nil {
+		t.Fatalf("failed to create lbrp: %v", err)
+	}
+	rewrite := lbrp.SrcIpRewrite{IpRange: "10.10.1.5/32", NewIpRange: "10.10.200.5/32"}
+	if err := cubes.Lbrps.ReplaceLbrpSrcIpRewrite("lb1", rewrite); err != nil {
+		t.Fatalf("failed to set src ip rewrite: %v", err)
+	}
+	lb, err := cubes.Lbrps.ReadLbrp("lb1")
+	if err != nil {
+		t.Fatalf("failed to read lbrp: %v", err)
+	}
+	if lb.SrcIpRewrite == nil || *lb.SrcIpRewrite != rewrite {
+		t.Fatalf("src ip rewrite - required: %+v, found: %+v", rewrite, lb.SrcIpRewrite)
+	}
+}
@@ -0,0 +1,151 @@
+package polycube
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// Nat describes a polycube nat cube. The nat is a transparent cube: it has no ports, but it is attached to the port
+// of another cube (its parent) and it processes the traffic crossing that port
+type Nat struct {
+	Name     string `json:"name,omitempty"`
+	Loglevel string `json:"loglevel,omitempty"`
+	// Parent is the port the nat is attached to, in the format cube:port
+	Parent string `json:"parent,omitempty"`
+}
+
+// SnatRule translates the source address of the traffic leaving the parent port and coming from InternalNet into
+// ExternalIp
+type SnatRule struct {
+	Id          int32  `json:"id"`
+	InternalNet string `json:"internal-net"`
+	ExternalIp  string `json:"external-ip"`
+}
+
+// NatManager manages the nat cubes. No generated client is available for them, so the polycubed REST API is called
+// directly
+type NatManager interface {
+	CreateNat(n Nat) error
+	ReadNat(name string) (*Nat, error)
+	DeleteNat(name string) error
+	// AttachNat attaches the nat to the provided port, in the format cube:port
+	AttachNat(name, port string) error
+	ListSnatRules(name string) ([]SnatRule, error)
+	// ReplaceSnatRule creates the rule or replaces the one with the same id
+	ReplaceSnatRule(name string, rule SnatRule) error
+	DeleteSnatRule(name string, id int32) error
+}
+
+type natManager struct {
+	ctx      context.Context
+	basePath string
+	client   *http.Client
+	retry    RetryConf
+}
+
+// call performs a request for the resource at the provided path, relative to the polycubed API base path, encoding
+// in and decoding into out, if they are not nil. Only the request is retried: the failures in encoding the request
+// body, building the request and decoding the response are local, so they are returned immediately as Invalid errors
+func (m *natManager) call(method, path string, in, out interface{}) error {
+	var reqBody []byte
+	if in != nil {
+		var err error
+		if reqBody, err = json.Marshal(in); err != nil {
+			return &Error{Kind: Invalid, Err: fmt.Errorf("failed to encode request body: %v", err)}
+		}
+	}
+	req, err := http.NewRequestWithContext(m.ctx, method, m.basePath+"/"+path, nil)
+	if err != nil {
+		return &Error{Kind: Invalid, Err: fmt.Errorf("failed to build request: %v", err)}
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	var resp *http.Response
+	var respBody []byte
+	if err := m.retry.do(m.ctx, func() (*http.Response, error) {
+		attempt := req.Clone(m.ctx)
+		if in != nil {
+			attempt.Body = ioutil.NopCloser(bytes.NewReader(reqBody))
+			attempt.ContentLength = int64(len(reqBody))
+		}
+		var err error
+		if resp, err = m.client.Do(attempt); err != nil {
+			return nil, err
+		}
+		respBody, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode >= 300 {
+			return resp, &responseError{status: resp.Status, body: respBody}
+		}
+		return resp, nil
+	}); err != nil {
+		return err
+	}
+	if out == nil || len(bytes.TrimSpace(respBody)) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return &Error{
+			Kind:       Invalid,
+			StatusCode: resp.StatusCode,
+			Err:        fmt.Errorf("failed to decode response body: %v", err),
+		}
+	}
+	return nil
+}
+
+// natPath returns the path of the nat having the provided name, relative to the polycubed API base path
+func natPath(name string) string {
+	return "nat/" + url.PathEscape(name) + "/"
+}
+
+func (m *natManager) CreateNat(n Nat) error {
+	return m.call(http.MethodPost, natPath(n.Name), n, nil)
+}
+
+func (m *natManager) ReadNat(name string) (*Nat, error) {
+	var n Nat
+	if err := m.call(http.MethodGet, natPath(name), nil, &n); err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+func (m *natManager) DeleteNat(name string) error {
+	return m.call(http.MethodDelete, natPath(name), nil, nil)
+}
+
+func (m *natManager) AttachNat(name, port string) error {
+	attach := struct {
+		Cube string `json:"cube"`
+		Port string `json:"port"`
+	}{Cube: name, Port: port}
+	return m.call(http.MethodPost, "attach", attach, nil)
+}
+
+func (m *natManager) ListSnatRules(name string) ([]SnatRule, error) {
+	var rules []SnatRule
+	if err := m.call(http.MethodGet, natPath(name)+"rule/snat/entry/", nil, &rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func (m *natManager) ReplaceSnatRule(name string, rule SnatRule) error {
+	return m.call(http.MethodPut, natPath(name)+fmt.Sprintf("rule/snat/entry/%d/", rule.Id), rule, nil)
+}
+
+func (m *natManager) DeleteSnatRule(name string, id int32) error {
+	return m.call(http.MethodDelete, natPath(name)+fmt.Sprintf("rule/snat/entry/%d/", id), nil, nil)
+}
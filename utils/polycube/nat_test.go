@@ -0,0 +1,63 @@
+package polycube
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestNatManager returns a nat manager calling the provided handler, retrying up to 3 times
+func newTestNatManager(handler http.HandlerFunc) (*natManager, func()) {
+	ts := httptest.NewServer(handler)
+	return &natManager{
+		ctx:      context.Background(),
+		basePath: ts.URL,
+		client:   ts.Client(),
+		retry:    RetryConf{Attempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+	}, ts.Close
+}
+
+func TestNatCallLocalFailures(t *testing.T) {
+	calls := 0
+	m, stop := newTestNatManager(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		_, _ = w.Write([]byte("not json"))
+	})
+	defer stop()
+
+	// a request body that can't be encoded is never sent
+	if err := m.call(http.MethodPost, "nat/nat0/", make(chan int), nil); !IsInvalid(err) || calls != 0 {
+		t.Fatalf("expected an invalid error without calls, found: %d calls, error: %v", calls, err)
+	}
+	// a response that can't be decoded is not requested again
+	if _, err := m.ReadNat("nat0"); !IsInvalid(err) || calls != 1 {
+		t.Fatalf("expected a single invalid failure, found: %d calls, error: %v", calls, err)
+	}
+}
+
+func TestNatCallRetriesWithBody(t *testing.T) {
+	rule := SnatRule{Id: 100, InternalNet: "10.10.1.5/32", ExternalIp: "192.168.1.100"}
+	calls := 0
+	m, stop := newTestNatManager(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		// the body must be sent again by each attempt
+		body, _ := ioutil.ReadAll(r.Body)
+		var received SnatRule
+		if err := json.Unmarshal(body, &received); err != nil || received != rule {
+			t.Errorf("unexpected request body at attempt %d: %q", calls, body)
+		}
+	})
+	defer stop()
+
+	if err := m.ReplaceSnatRule("nat0", rule); err != nil || calls != 2 {
+		t.Fatalf("expected success after 2 calls, found: %d calls, error: %v", calls, err)
+	}
+}
@@ -0,0 +1,86 @@
+// Package polycube exposes the polycube cubes used by polykube through small manager interfaces, so that their users
+// don't depend on the generated REST API clients
+package polycube
+
+import (
+	"context"
+	k8sdispatcher "github.com/ekoops/polykube-cni-plugin/utils/k8sdispatcher"
+	lbrp "github.com/ekoops/polykube-cni-plugin/utils/lbrp"
+	router "github.com/ekoops/polykube-cni-plugin/utils/router"
+	simplebridge "github.com/ekoops/polykube-cni-plugin/utils/simplebridge"
+	"net/http"
+)
+
+// DefaultURL is the base path of the REST API exposed by a local polycubed instance
+const DefaultURL = "http://127.0.0.1:9000/polycube/v1"
+
+// Cubes groups the managers of all the kinds of cube used by polykube
+type Cubes struct {
+	Bridges     BridgeManager
+	Routers     RouterManager
+	Lbrps       LbrpManager
+	Dispatchers DispatcherManager
+	Nats        NatManager
+}
+
+// Conf configures the managers returned by NewCubesWithConf
+type Conf struct {
+	// BasePath is the base path of the polycubed REST API
+	BasePath string
+	Retry    RetryConf
+	// HTTPClient is the client performing the requests. If nil, http.DefaultClient is used
+	HTTPClient *http.Client
+	// Context bounds the requests and the waits between the retries: once it is done, no more calls are attempted.
+	// If nil, context.Background() is used
+	Context context.Context
+}
+
+// NewCubes returns the managers backed by the polycubed REST API available at the provided base path, retrying the
+// calls as specified by DefaultRetryConf
+func NewCubes(basePath string) *Cubes {
+	return NewCubesWithConf(&Conf{BasePath: basePath, Retry: DefaultRetryConf})
+}
+
+// NewCubesWithConf returns the managers backed by the polycubed REST API, configured as requested
+func NewCubesWithConf(conf *Conf) *Cubes {
+	brConf := &simplebridge.Configuration{BasePath: conf.BasePath, HTTPClient: conf.HTTPClient}
+	rConf := &router.Configuration{BasePath: conf.BasePath, HTTPClient: conf.HTTPClient}
+	lbConf := &lbrp.Configuration{BasePath: conf.BasePath, HTTPClient: conf.HTTPClient}
+	kConf := &k8sdispatcher.Configuration{BasePath: conf.BasePath, HTTPClient: conf.HTTPClient}
+	// the HTTP client is set into the configuration by the API client creation, if missing
+	lbClient := lbrp.NewAPIClient(lbConf)
+	ctx := conf.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return &Cubes{
+		Bridges: &bridgeManager{
+			ctx:   ctx,
+			api:   simplebridge.NewAPIClient(brConf).SimplebridgeApi,
+			retry: conf.Retry,
+		},
+		Routers: &routerManager{
+			ctx:   ctx,
+			api:   router.NewAPIClient(rConf).RouterApi,
+			retry: conf.Retry,
+		},
+		Lbrps: &lbrpManager{
+			ctx:      ctx,
+			api:      lbClient.LbrpApi,
+			basePath: conf.BasePath,
+			client:   lbConf.HTTPClient,
+			retry:    conf.Retry,
+		},
+		Dispatchers: &dispatcherManager{
+			ctx:   ctx,
+			api:   k8sdispatcher.NewAPIClient(kConf).K8sdispatcherApi,
+			retry: conf.Retry,
+		},
+		Nats: &natManager{
+			ctx:      ctx,
+			basePath: conf.BasePath,
+			client:   lbConf.HTTPClient,
+			retry:    conf.Retry,
+		},
+	}
+}
@@ -0,0 +1,60 @@
+package polycube
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// RetryConf controls how the failed polycube API calls are retried. Only the calls failed because polycubed was
+// unavailable are retried
+type RetryConf struct {
+	// Attempts is the maximum number of times a call is performed
+	Attempts int
+	// BaseDelay is the delay before the first retry, doubled at each following retry
+	BaseDelay time.Duration
+	// MaxDelay bounds the delay between two attempts
+	MaxDelay time.Duration
+}
+
+// DefaultRetryConf is the retry configuration used by NewCubes
+var DefaultRetryConf = RetryConf{
+	Attempts:  4,
+	BaseDelay: 100 * time.Millisecond,
+	MaxDelay:  2 * time.Second,
+}
+
+// delay returns the time to wait before the provided retry (starting from 1). A random jitter of up to half of the
+// delay is subtracted, so that concurrent callers don't retry all together
+func (c RetryConf) delay(retry int) time.Duration {
+	d := c.BaseDelay
+	for i := 1; i < retry && d < c.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > c.MaxDelay {
+		d = c.MaxDelay
+	}
+	if half := int64(d / 2); half > 0 {
+		d -= time.Duration(rand.Int63n(half))
+	}
+	return d
+}
+
+// do performs the provided call, retrying it if it fails because polycubed is unavailable. It returns the error of
+// the last attempt. The retries are interrupted as soon as the provided context is done
+func (c RetryConf) do(ctx context.Context, call func() (*http.Response, error)) error {
+	for attempt := 1; ; attempt++ {
+		err := apiError(call())
+		if err == nil || !err.(*Error).Temporary() || attempt >= c.Attempts || ctx.Err() != nil {
+			return err
+		}
+		timer := time.NewTimer(c.delay(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
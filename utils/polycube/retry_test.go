@@ -0,0 +1,59 @@
+package polycube
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetryInterruptedByContext(t *testing.T) {
+	c := RetryConf{Attempts: 10, BaseDelay: time.Hour, MaxDelay: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	err := c.do(ctx, func() (*http.Response, error) {
+		calls++
+		return nil, errors.New("connection refused")
+	})
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("retry not interrupted by the context cancellation (elapsed: %s)", elapsed)
+	}
+	if !IsUnavailable(err) {
+		t.Fatalf("expected an unavailable error, found: %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected 1 call, found: %d", calls)
+	}
+}
+
+func TestRetryTemporaryFailures(t *testing.T) {
+	c := RetryConf{Attempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	calls := 0
+	err := c.do(context.Background(), func() (*http.Response, error) {
+		calls++
+		if calls < 3 {
+			return nil, errors.New("connection refused")
+		}
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})
+	if err != nil || calls != 3 {
+		t.Fatalf("expected success after 3 calls, found: %d calls, error: %v", calls, err)
+	}
+
+	// failures that are not temporary are not retried
+	calls = 0
+	err = c.do(context.Background(), func() (*http.Response, error) {
+		calls++
+		return &http.Response{StatusCode: http.StatusNotFound}, errors.New("not found")
+	})
+	if !IsNotFound(err) || calls != 1 {
+		t.Fatalf("expected a single not found failure, found: %d calls, error: %v", calls, err)
+	}
+}
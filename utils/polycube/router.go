@@ -0,0 +1,128 @@
+package polycube
+
+import (
+	"context"
+	router "github.com/ekoops/polykube-cni-plugin/utils/router"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// RouterManager manages the router cubes
+type RouterManager interface {
+	CreateRouter(r router.Router) error
+	ReadRouter(name string) (*router.Router, error)
+	ListRouters() ([]router.Router, error)
+	DeleteRouter(name string) error
+	// UpdateRouterPort updates only the fields set in the provided port
+	UpdateRouterPort(r, name string, port router.Ports) error
+	// SetRouterPortPeer sets the port peer. Unlike UpdateRouterPort, an empty peer detaches the port
+	SetRouterPortPeer(r, name, peer string) error
+	CreateRouterPort(r string, port router.Ports) error
+	DeleteRouterPort(r, name string) error
+	CreateRoute(r string, route router.Route) error
+	ListRoutes(r string) ([]router.Route, error)
+	DeleteRoute(r, network, nexthop string) error
+	// ReplaceArpEntry creates or replaces a static arp table entry
+	ReplaceArpEntry(r string, entry router.ArpTable) error
+	DeleteArpEntry(r, address string) error
+}
+
+type routerManager struct {
+	ctx   context.Context
+	api   *router.RouterApiService
+	retry RetryConf
+}
+
+func (m *routerManager) CreateRouter(r router.Router) error {
+	return m.retry.do(m.ctx, func() (*http.Response, error) {
+		return m.api.CreateRouterByID(m.ctx, r.Name, r)
+	})
+}
+
+func (m *routerManager) ReadRouter(name string) (*router.Router, error) {
+	var r router.Router
+	if err := m.retry.do(m.ctx, func() (resp *http.Response, err error) {
+		r, resp, err = m.api.ReadRouterByID(m.ctx, name)
+		return resp, err
+	}); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (m *routerManager) ListRouters() ([]router.Router, error) {
+	var rs []router.Router
+	err := m.retry.do(m.ctx, func() (resp *http.Response, err error) {
+		rs, resp, err = m.api.ReadRouterListByID(m.ctx)
+		return resp, err
+	})
+	return rs, err
+}
+
+func (m *routerManager) DeleteRouter(name string) error {
+	return m.retry.do(m.ctx, func() (*http.Response, error) {
+		return m.api.DeleteRouterByID(m.ctx, name)
+	})
+}
+
+func (m *routerManager) UpdateRouterPort(r, name string, port router.Ports) error {
+	return m.retry.do(m.ctx, func() (*http.Response, error) {
+		return m.api.UpdateRouterPortsByID(m.ctx, r, name, port)
+	})
+}
+
+func (m *routerManager) CreateRouterPort(r string, port router.Ports) error {
+	return m.retry.do(m.ctx, func() (*http.Response, error) {
+		return m.api.CreateRouterPortsByID(m.ctx, r, port.Name, port)
+	})
+}
+
+func (m *routerManager) DeleteRouterPort(r, name string) error {
+	return m.retry.do(m.ctx, func() (*http.Response, error) {
+		return m.api.DeleteRouterPortsByID(m.ctx, r, name)
+	})
+}
+
+// SetRouterPortPeer quotes the peer, since the generated client writes string bodies as they are
+func (m *routerManager) SetRouterPortPeer(r, name, peer string) error {
+	return m.retry.do(m.ctx, func() (*http.Response, error) {
+		return m.api.UpdateRouterPortsPeerByID(m.ctx, r, name, strconv.Quote(peer))
+	})
+}
+
+// CreateRoute creates a route. The route network is escaped since, being a CIDR, it contains a slash
+func (m *routerManager) CreateRoute(r string, route router.Route) error {
+	return m.retry.do(m.ctx, func() (*http.Response, error) {
+		return m.api.CreateRouterRouteByID(
+			m.ctx, r, url.QueryEscape(route.Network), route.Nexthop, route,
+		)
+	})
+}
+
+func (m *routerManager) ListRoutes(r string) ([]router.Route, error) {
+	var routes []router.Route
+	err := m.retry.do(m.ctx, func() (resp *http.Response, err error) {
+		routes, resp, err = m.api.ReadRouterRouteListByID(m.ctx, r)
+		return resp, err
+	})
+	return routes, err
+}
+
+func (m *routerManager) DeleteRoute(r, network, nexthop string) error {
+	return m.retry.do(m.ctx, func() (*http.Response, error) {
+		return m.api.DeleteRouterRouteByID(m.ctx, r, url.QueryEscape(network), nexthop)
+	})
+}
+
+func (m *routerManager) ReplaceArpEntry(r string, entry router.ArpTable) error {
+	return m.retry.do(m.ctx, func() (*http.Response, error) {
+		return m.api.ReplaceRouterArpTableByID(m.ctx, r, entry.Address, entry)
+	})
+}
+
+func (m *routerManager) DeleteArpEntry(r, address string) error {
+	return m.retry.do(m.ctx, func() (*http.Response, error) {
+		return m.api.DeleteRouterArpTableByID(m.ctx, r, address)
+	})
+}
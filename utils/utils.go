@@ -1,5 +1,11 @@
 package utils
 
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
 func CreatePeer(serviceName, servicePort string) string {
 	return serviceName + ":" + servicePort
 }
@@ -9,4 +15,21 @@ func Truncate(s string, n int) string {
 		return s[:n]
 	}
 	return s
-}
\ No newline at end of file
+}
+
+// WriteFileAtomic writes data to the file at the provided path (creating its directory, if needed) through a
+// temporary file, so that readers never observe a partially written content
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+package wireguard
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"net"
+	"syscall"
+)
+
+// WireGuard generic netlink API, as defined in include/uapi/linux/wireguard.h
+const (
+	genlName    = "wireguard"
+	genlVersion = 1
+
+	cmdGetDevice = 0
+	cmdSetDevice = 1
+
+	deviceAttrIfname     = 2
+	deviceAttrPrivateKey = 3
+	deviceAttrPublicKey  = 4
+	deviceAttrListenPort = 6
+	deviceAttrPeers      = 8
+
+	peerAttrPublicKey  = 1
+	peerAttrFlags      = 3
+	peerAttrEndpoint   = 4
+	peerAttrKeepalive  = 5
+	peerAttrAllowedIPs = 9
+
+	peerFlagRemoveMe          = 1 << 0
+	peerFlagReplaceAllowedIPs = 1 << 1
+
+	allowedIPAttrFamily   = 1
+	allowedIPAttrIPAddr   = 2
+	allowedIPAttrCidrMask = 3
+)
+
+// Peer describes a WireGuard peer
+type Peer struct {
+	PublicKey  Key
+	Endpoint   *net.UDPAddr
+	AllowedIPs []net.IPNet
+	// Keepalive is the persistent keepalive interval in seconds. Zero disables it
+	Keepalive int
+}
+
+// Device describes the configuration of a WireGuard interface
+type Device struct {
+	Name       string
+	PrivateKey Key
+	PublicKey  Key
+	ListenPort int
+	Peers      []Peer
+}
+
+// Peer returns the device peer with the provided public key, or nil if it is not configured
+func (d *Device) Peer(publicKey Key) *Peer {
+	for i := range d.Peers {
+		if d.Peers[i].PublicKey == publicKey {
+			return &d.Peers[i]
+		}
+	}
+	return nil
+}
+
+func newRequest(cmd uint8, flags int) (*nl.NetlinkRequest, error) {
+	family, err := netlink.GenlFamilyGet(genlName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve %q generic netlink family: %v", genlName, err)
+	}
+	req := nl.NewNetlinkRequest(int(family.ID), flags)
+	req.AddData(&nl.Genlmsg{Command: cmd, Version: genlVersion})
+	return req, nil
+}
+
+func nested(attrType int) *nl.RtAttr {
+	return nl.NewRtAttr(attrType|int(nl.NLA_F_NESTED), nil)
+}
+
+// addNested adds a nested attribute to the provided parent and returns it
+func addNested(parent *nl.RtAttr, attrType int) *nl.RtAttr {
+	child := nested(attrType)
+	parent.AddChild(child)
+	return child
+}
+
+// encodeEndpoint returns the sockaddr_in encoding of the provided IPv4 endpoint
+func encodeEndpoint(addr *net.UDPAddr) ([]byte, error) {
+	ip4 := addr.IP.To4()
+	if ip4 == nil {
+		return nil, fmt.Errorf("unsupported endpoint %s: only IPv4 endpoints are supported", addr)
+	}
+	b := make([]byte, 16)
+	nl.NativeEndian().PutUint16(b[0:2], syscall.AF_INET)
+	binary.BigEndian.PutUint16(b[2:4], uint16(addr.Port))
+	copy(b[4:8], ip4)
+	return b, nil
+}
+
+func decodeEndpoint(b []byte) *net.UDPAddr {
+	if len(b) < 8 || nl.NativeEndian().Uint16(b[0:2]) != syscall.AF_INET {
+		return nil
+	}
+	return &net.UDPAddr{
+		IP:   net.IPv4(b[4], b[5], b[6], b[7]),
+		Port: int(binary.BigEndian.Uint16(b[2:4])),
+	}
+}
+
+// ConfigureDevice sets the private key and the listen port of the WireGuard interface with the provided name
+func ConfigureDevice(name string, privateKey Key, listenPort int) error {
+	req, err := newRequest(cmdSetDevice, syscall.NLM_F_ACK)
+	if err != nil {
+		return err
+	}
+	req.AddData(nl.NewRtAttr(deviceAttrIfname, nl.ZeroTerminated(name)))
+	req.AddData(nl.NewRtAttr(deviceAttrPrivateKey, privateKey[:]))
+	req.AddData(nl.NewRtAttr(deviceAttrListenPort, nl.Uint16Attr(uint16(listenPort))))
+	if _, err := req.Execute(syscall.NETLINK_GENERIC, 0); err != nil {
+		return fmt.Errorf("failed to configure %q device: %v", name, err)
+	}
+	return nil
+}
+
+// SetPeer creates or updates a peer of the WireGuard interface with the provided name. The peer allowed IPs replace
+// the configured ones
+func SetPeer(name string, peer Peer) error {
+	req, err := newRequest(cmdSetDevice, syscall.NLM_F_ACK)
+	if err != nil {
+		return err
+	}
+	req.AddData(nl.NewRtAttr(deviceAttrIfname, nl.ZeroTerminated(name)))
+	peers := nested(deviceAttrPeers)
+	p := addNested(peers, 0)
+	p.AddRtAttr(peerAttrPublicKey, peer.PublicKey[:])
+	p.AddRtAttr(peerAttrFlags, nl.Uint32Attr(peerFlagReplaceAllowedIPs))
+	if peer.Endpoint != nil {
+		endpoint, err := encodeEndpoint(peer.Endpoint)
+		if err != nil {
+			return err
+		}
+		p.AddRtAttr(peerAttrEndpoint, endpoint)
+	}
+	p.AddRtAttr(peerAttrKeepalive, nl.Uint16Attr(uint16(peer.Keepalive)))
+	allowedIPs := addNested(p, peerAttrAllowedIPs)
+	for i, ipNet := range peer.AllowedIPs {
+		ip4 := ipNet.IP.To4()
+		if ip4 == nil {
+			return fmt.Errorf("unsupported allowed IP %s: only IPv4 addresses are supported", ipNet.String())
+		}
+		ones, _ := ipNet.Mask.Size()
+		a := addNested(allowedIPs, i)
+		a.AddRtAttr(allowedIPAttrFamily, nl.Uint16Attr(syscall.AF_INET))
+		a.AddRtAttr(allowedIPAttrIPAddr, ip4)
+		a.AddRtAttr(allowedIPAttrCidrMask, nl.Uint8Attr(uint8(ones)))
+	}
+	req.AddData(peers)
+	if _, err := req.Execute(syscall.NETLINK_GENERIC, 0); err != nil {
+		return fmt.Errorf("failed to set %q device peer %s: %v", name, peer.PublicKey, err)
+	}
+	return nil
+}
+
+// RemovePeer removes the peer with the provided public key from the WireGuard interface with the provided name. It
+// doesn't fail if the peer doesn't exist
+func RemovePeer(name string, publicKey Key) error {
+	req, err := newRequest(cmdSetDevice, syscall.NLM_F_ACK)
+	if err != nil {
+		return err
+	}
+	req.AddData(nl.NewRtAttr(deviceAttrIfname, nl.ZeroTerminated(name)))
+	peers := nested(deviceAttrPeers)
+	p := addNested(peers, 0)
+	p.AddRtAttr(peerAttrPublicKey, publicKey[:])
+	p.AddRtAttr(peerAttrFlags, nl.Uint32Attr(peerFlagRemoveMe))
+	req.AddData(peers)
+	if _, err := req.Execute(syscall.NETLINK_GENERIC, 0); err != nil {
+		return fmt.Errorf("failed to remove %q device peer %s: %v", name, publicKey, err)
+	}
+	return nil
+}
+
+// GetDevice returns the configuration of the WireGuard interface with the provided name
+func GetDevice(name string) (*Device, error) {
+	req, err := newRequest(cmdGetDevice, syscall.NLM_F_DUMP)
+	if err != nil {
+		return nil, err
+	}
+	req.AddData(nl.NewRtAttr(deviceAttrIfname, nl.ZeroTerminated(name)))
+	msgs, err := req.Execute(syscall.NETLINK_GENERIC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve %q device: %v", name, err)
+	}
+
+	// the peers of a device can be split across multiple messages
+	d := &Device{Name: name}
+	for _, msg := range msgs {
+		attrs, err := nl.ParseRouteAttr(msg[nl.SizeofGenlmsg:])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %q device: %v", name, err)
+		}
+		for _, attr := range attrs {
+			switch attr.Attr.Type & nl.NLA_TYPE_MASK {
+			case deviceAttrPrivateKey:
+				copy(d.PrivateKey[:], attr.Value)
+			case deviceAttrPublicKey:
+				copy(d.PublicKey[:], attr.Value)
+			case deviceAttrListenPort:
+				d.ListenPort = int(nl.NativeEndian().Uint16(attr.Value))
+			case deviceAttrPeers:
+				peers, err := parsePeers(attr.Value)
+				if err != nil {
+					return nil, fmt.Errorf("failed to parse %q device peers: %v", name, err)
+				}
+				for _, peer := range peers {
+					// a peer split across messages is repeated with the remaining allowed IPs
+					if existing := d.Peer(peer.PublicKey); existing != nil {
+						existing.AllowedIPs = append(existing.AllowedIPs, peer.AllowedIPs...)
+						continue
+					}
+					d.Peers = append(d.Peers, peer)
+				}
+			}
+		}
+	}
+	return d, nil
+}
+
+func parsePeers(b []byte) ([]Peer, error) {
+	entries, err := nl.ParseRouteAttr(b)
+	if err != nil {
+		return nil, err
+	}
+	var peers []Peer
+	for _, entry := range entries {
+		attrs, err := nl.ParseRouteAttr(entry.Value)
+		if err != nil {
+			return nil, err
+		}
+		var p Peer
+		for _, attr := range attrs {
+			switch attr.Attr.Type & nl.NLA_TYPE_MASK {
+			case peerAttrPublicKey:
+				copy(p.PublicKey[:], attr.Value)
+			case peerAttrEndpoint:
+				p.Endpoint = decodeEndpoint(attr.Value)
+			case peerAttrKeepalive:
+				p.Keepalive = int(nl.NativeEndian().Uint16(attr.Value))
+			case peerAttrAllowedIPs:
+				if p.AllowedIPs, err = parseAllowedIPs(attr.Value); err != nil {
+					return nil, err
+				}
+			}
+		}
+		peers = append(peers, p)
+	}
+	return peers, nil
+}
+
+func parseAllowedIPs(b []byte) ([]net.IPNet, error) {
+	entries, err := nl.ParseRouteAttr(b)
+	if err != nil {
+		return nil, err
+	}
+	var ipNets []net.IPNet
+	for _, entry := range entries {
+		attrs, err := nl.ParseRouteAttr(entry.Value)
+		if err != nil {
+			return nil, err
+		}
+		var ip net.IP
+		var ones int
+		for _, attr := range attrs {
+			switch attr.Attr.Type & nl.NLA_TYPE_MASK {
+			case allowedIPAttrIPAddr:
+				ip = net.IP(attr.Value)
+			case allowedIPAttrCidrMask:
+				ones = int(attr.Value[0])
+			}
+		}
+		if ip.To4() == nil {
+			continue
+		}
+		ipNets = append(ipNets, net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(ones, 32)})
+	}
+	return ipNets, nil
+}
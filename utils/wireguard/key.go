@@ -0,0 +1,92 @@
+// Package wireguard configures WireGuard interfaces through the kernel generic netlink API and manages the curve25519
+// keys they use
+package wireguard
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/ekoops/polykube-cni-plugin/utils"
+	"golang.org/x/crypto/curve25519"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// KeyLen is the length of a WireGuard key
+const KeyLen = 32
+
+// Key is a WireGuard private or public key
+type Key [KeyLen]byte
+
+// GeneratePrivateKey returns a new random private key
+func GeneratePrivateKey() (Key, error) {
+	var k Key
+	if _, err := rand.Read(k[:]); err != nil {
+		return Key{}, fmt.Errorf("failed to generate private key: %v", err)
+	}
+	// clamping the key as required by curve25519
+	k[0] &= 248
+	k[31] = (k[31] & 127) | 64
+	return k, nil
+}
+
+// ParseKey parses a base64 encoded key
+func ParseKey(s string) (Key, error) {
+	var k Key
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return Key{}, fmt.Errorf("failed to decode key: %v", err)
+	}
+	if len(b) != KeyLen {
+		return Key{}, fmt.Errorf("invalid key length: required %d bytes, found %d", KeyLen, len(b))
+	}
+	copy(k[:], b)
+	return k, nil
+}
+
+// PublicKey returns the public key corresponding to the private key
+func (k Key) PublicKey() Key {
+	var pub Key
+	curve25519.ScalarBaseMult((*[KeyLen]byte)(&pub), (*[KeyLen]byte)(&k))
+	return pub
+}
+
+// IsZero returns true if the key is not set
+func (k Key) IsZero() bool {
+	return k == Key{}
+}
+
+// String returns the base64 encoding of the key
+func (k Key) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+// LoadPrivateKey reads the base64 encoded private key stored in the file at the provided path
+func LoadPrivateKey(path string) (Key, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Key{}, err
+	}
+	return ParseKey(string(data))
+}
+
+// LoadOrCreatePrivateKey reads the private key stored in the file at the provided path. If the file doesn't exist, a
+// new private key is generated and stored in it. The returned boolean is true if the key was generated
+func LoadOrCreatePrivateKey(path string) (Key, bool, error) {
+	k, err := LoadPrivateKey(path)
+	if err == nil {
+		return k, false, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return Key{}, false, err
+	}
+	if k, err = GeneratePrivateKey(); err != nil {
+		return Key{}, false, err
+	}
+	if err := utils.WriteFileAtomic(path, []byte(k.String()+"\n"), 0600); err != nil {
+		return Key{}, false, fmt.Errorf("failed to store private key: %v", err)
+	}
+	return k, true, nil
+}